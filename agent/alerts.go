@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/weaveworks/launcher/pkg/k8s"
+	"github.com/weaveworks/launcher/pkg/text"
+	"github.com/weaveworks/launcher/pkg/weavecloud"
+)
+
+// Key of the alert rules in the alert rules ConfigMap.
+const alertRulesKey = "rules.yaml"
+
+// alertsConfig holds the configuration of the event alerting rules.
+type alertsConfig struct {
+	// RulesConfigMap is the name of the ConfigMap, in the weave namespace,
+	// holding the alert rules. Alerting is disabled when empty.
+	RulesConfigMap string
+	// Notifiers is the comma-separated list of notifiers alert records are
+	// sent to.
+	Notifiers       string
+	WebhookURL      string
+	NotificationURL string
+}
+
+// weaveCloudAlertNotifier sends alert records to the Weave Cloud notification
+// endpoint.
+type weaveCloudAlertNotifier struct {
+	url   string
+	token string
+}
+
+func (n *weaveCloudAlertNotifier) Name() string {
+	return "weave-cloud"
+}
+
+func (n *weaveCloudAlertNotifier) Notify(ctx context.Context, record *k8s.AlertRecord) error {
+	eventType := fmt.Sprintf("kubernetes_events_alert_%s", record.Status)
+	return weavecloud.SendNotification(ctx, n.url, n.token, eventType, record.Summary())
+}
+
+func newAlertNotifier(name string, alerts *alertsConfig, cfg *agentConfig) (k8s.AlertNotifier, error) {
+	switch name {
+	case "log":
+		return k8s.LogAlertNotifier{}, nil
+	case "webhook":
+		if alerts.WebhookURL == "" {
+			return nil, errors.New("the webhook alert notifier requires -events.alert-webhook-url")
+		}
+		return k8s.NewWebhookAlertNotifier(alerts.WebhookURL), nil
+	case "weave-cloud":
+		url, err := text.ResolveString(alerts.NotificationURL, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL template: %v", err)
+		}
+		return &weaveCloudAlertNotifier{url: url, token: cfg.Token}, nil
+	}
+	return nil, fmt.Errorf("unknown alert notifier '%s'", name)
+}
+
+// newAlerter creates an Alerter sending alert records to the notifiers listed
+// in alerts.Notifiers.
+func newAlerter(alerts *alertsConfig, cfg *agentConfig) (*k8s.Alerter, error) {
+	names := []string{}
+	for _, name := range strings.Split(alerts.Notifiers, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	notifiers := []k8s.AlertNotifier{}
+	for _, name := range deduplicate(names) {
+		notifier, err := newAlertNotifier(name, alerts, cfg)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if len(notifiers) == 0 {
+		return nil, errors.New("at least one alert notifier must be specified with -events.alert-notifiers")
+	}
+	alerter := k8s.NewAlerter(notifiers...)
+	alerter.NotifyTimeout = cfg.APITimeout
+	return alerter, nil
+}
+
+// loadAlertRules sets the rules of alerter from the alert rules ConfigMap.
+func loadAlertRules(alerter *k8s.Alerter, cm *apiv1.ConfigMap) {
+	config, err := k8s.ParseAlertConfig([]byte(cm.Data[alertRulesKey]))
+	if err == nil {
+		err = alerter.SetRules(config)
+	}
+	if err != nil {
+		log.Errorf("Invalid alert rules in ConfigMap %s/%s, keeping the previous rules: %v", cm.Namespace, cm.Name, err)
+	}
+}
+
+// watchAlertRules keeps the rules of alerter in sync with the alert rules
+// ConfigMap until stopCh is closed.
+func watchAlertRules(cfg *agentConfig, name string, alerter *k8s.Alerter, stopCh <-chan struct{}) {
+	source := cache.NewListWatchFromClient(
+		cfg.KubeClient.CoreV1().RESTClient(),
+		"configmaps",
+		"weave",
+		fields.SelectorFromSet(fields.Set{"metadata.name": name}))
+
+	informer := cache.NewSharedIndexInformer(
+		source,
+		&apiv1.ConfigMap{},
+		0,
+		cache.Indexers{},
+	)
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if cm, ok := obj.(*apiv1.ConfigMap); ok {
+				loadAlertRules(alerter, cm)
+			}
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			if cm, ok := cur.(*apiv1.ConfigMap); ok {
+				loadAlertRules(alerter, cm)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			log.Infof("Alert rules ConfigMap %s deleted, no longer evaluating alert rules", name)
+			alerter.SetRules(&k8s.AlertConfig{})
+		},
+	})
+
+	informer.Run(stopCh)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/weaveworks/launcher/pkg/weavecloud"
+)
+
+func TestNewAlerter(t *testing.T) {
+	cfg := &agentConfig{WCHostname: "cloud.weave.works", Token: "token"}
+
+	tests := []struct {
+		alerts alertsConfig
+		valid  bool
+	}{
+		{alertsConfig{Notifiers: "log,weave-cloud", NotificationURL: weavecloud.DefaultNotificationURLTemplate}, true},
+		{alertsConfig{Notifiers: "log, log"}, true},
+		{alertsConfig{Notifiers: "webhook", WebhookURL: "http://alerts.example.com"}, true},
+		{alertsConfig{Notifiers: "webhook"}, false},
+		{alertsConfig{Notifiers: "pager"}, false},
+		{alertsConfig{Notifiers: ""}, false},
+	}
+
+	for _, test := range tests {
+		_, err := newAlerter(&test.alerts, cfg)
+		assert.Equal(t, test.valid, err == nil, test.alerts.Notifiers)
+	}
+}
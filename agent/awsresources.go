@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// awsResourceType describes the CloudWatch metrics exported for a type of AWS
+// resource.
+type awsResourceType struct {
+	// Dimensions the metrics can be filtered on.
+	dimensions []string
+	// Metrics that can be exported.
+	metrics []string
+}
+
+// awsResourceTypes is the catalogue of AWS resource types Cloudwatch can
+// monitor, by name.
+var awsResourceTypes = map[string]awsResourceType{
+	"rds": {
+		dimensions: []string{"DBInstanceIdentifier", "DBClusterIdentifier", "DatabaseClass", "EngineName"},
+		metrics: []string{"CPUUtilization", "DatabaseConnections", "FreeStorageSpace", "FreeableMemory",
+			"ReadIOPS", "WriteIOPS", "ReadLatency", "WriteLatency", "ReplicaLag"},
+	},
+	"classic-elb": {
+		dimensions: []string{"LoadBalancerName", "AvailabilityZone"},
+		metrics: []string{"RequestCount", "Latency", "HealthyHostCount", "UnHealthyHostCount",
+			"HTTPCode_Backend_2XX", "HTTPCode_Backend_4XX", "HTTPCode_Backend_5XX", "HTTPCode_ELB_5XX",
+			"SurgeQueueLength", "SpilloverCount"},
+	},
+	"ec2": {
+		dimensions: []string{"InstanceId", "InstanceType", "AutoScalingGroupName", "ImageId"},
+		metrics: []string{"CPUUtilization", "CPUCreditBalance", "NetworkIn", "NetworkOut",
+			"DiskReadOps", "DiskWriteOps", "StatusCheckFailed"},
+	},
+	"ebs": {
+		dimensions: []string{"VolumeId"},
+		metrics: []string{"VolumeReadOps", "VolumeWriteOps", "VolumeReadBytes", "VolumeWriteBytes",
+			"VolumeQueueLength", "VolumeIdleTime", "BurstBalance"},
+	},
+	"elbv2": {
+		dimensions: []string{"LoadBalancer", "TargetGroup", "AvailabilityZone"},
+		metrics: []string{"RequestCount", "TargetResponseTime", "HealthyHostCount", "UnHealthyHostCount",
+			"HTTPCode_Target_2XX_Count", "HTTPCode_Target_4XX_Count", "HTTPCode_Target_5XX_Count",
+			"HTTPCode_ELB_5XX_Count", "ActiveFlowCount", "NewFlowCount", "ProcessedBytes"},
+	},
+	"sqs": {
+		dimensions: []string{"QueueName"},
+		metrics: []string{"ApproximateNumberOfMessagesVisible", "ApproximateNumberOfMessagesNotVisible",
+			"ApproximateAgeOfOldestMessage", "NumberOfMessagesSent", "NumberOfMessagesReceived",
+			"NumberOfMessagesDeleted", "NumberOfEmptyReceives"},
+	},
+	"lambda": {
+		dimensions: []string{"FunctionName", "Resource", "ExecutedVersion"},
+		metrics: []string{"Invocations", "Errors", "Throttles", "Duration", "ConcurrentExecutions",
+			"IteratorAge", "DeadLetterErrors"},
+	},
+	"dynamodb": {
+		dimensions: []string{"TableName", "GlobalSecondaryIndexName", "Operation"},
+		metrics: []string{"ConsumedReadCapacityUnits", "ConsumedWriteCapacityUnits",
+			"ProvisionedReadCapacityUnits", "ProvisionedWriteCapacityUnits", "ReadThrottleEvents",
+			"WriteThrottleEvents", "ThrottledRequests", "SuccessfulRequestLatency", "SystemErrors", "UserErrors"},
+	},
+	"elasticache": {
+		dimensions: []string{"CacheClusterId", "CacheNodeId"},
+		metrics: []string{"CPUUtilization", "EngineCPUUtilization", "FreeableMemory", "CurrConnections",
+			"Evictions", "CacheHits", "CacheMisses", "NetworkBytesIn", "NetworkBytesOut", "ReplicationLag"},
+	},
+}
+
+// awsResourceTypeNames returns the names of the AWS resource types, sorted.
+func awsResourceTypeNames() []string {
+	names := []string{}
+	for name := range awsResourceTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// cloudwatchResourceOptions narrows down what is exported for a type of AWS
+// resource.
+type cloudwatchResourceOptions struct {
+	// Dimensions restricts the metrics to the given values of each
+	// dimension.
+	Dimensions map[string][]string `json:"dimensions,omitempty"`
+	// Tags selects the resources carrying all of these AWS tags.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Metrics lists the metrics to export, all of them when empty.
+	Metrics []string `json:"metrics,omitempty"`
+}
+
+// validate checks the options of the resource type name, errors are
+// prefixed with field, the path of the options in the configuration.
+func (o *cloudwatchResourceOptions) validate(field, name string) error {
+	resourceType := awsResourceTypes[name]
+
+	// Iterate in order, for the same configuration to always give the same
+	// error.
+	dimensions := []string{}
+	for dimension := range o.Dimensions {
+		dimensions = append(dimensions, dimension)
+	}
+	sort.Strings(dimensions)
+	for _, dimension := range dimensions {
+		if !contains(resourceType.dimensions, dimension) {
+			return fmt.Errorf("%s.dimensions: unknown %s dimension '%s', must be one of %s",
+				field, name, dimension, strings.Join(resourceType.dimensions, ", "))
+		}
+		values := o.Dimensions[dimension]
+		if len(values) == 0 {
+			return fmt.Errorf("%s.dimensions.%s: at least one value must be specified", field, dimension)
+		}
+		for i, value := range values {
+			if value == "" {
+				return fmt.Errorf("%s.dimensions.%s[%d]: empty value", field, dimension, i)
+			}
+		}
+	}
+
+	tags := []string{}
+	for key := range o.Tags {
+		tags = append(tags, key)
+	}
+	sort.Strings(tags)
+	for _, key := range tags {
+		if key == "" {
+			return fmt.Errorf("%s.tags: empty tag key", field)
+		}
+		if strings.HasPrefix(key, "aws:") {
+			return fmt.Errorf("%s.tags.%s: tags prefixed with 'aws:' are reserved", field, key)
+		}
+	}
+
+	for i, metric := range o.Metrics {
+		if !contains(resourceType.metrics, metric) {
+			return fmt.Errorf("%s.metrics[%d]: unknown %s metric '%s', must be one of %s",
+				field, i, name, metric, strings.Join(resourceType.metrics, ", "))
+		}
+	}
+
+	return nil
+}
@@ -3,8 +3,14 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -12,6 +18,7 @@ import (
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/tools/cache"
 
@@ -19,19 +26,63 @@ import (
 	"github.com/weaveworks/launcher/pkg/text"
 )
 
+// Labels set on the objects deployed for a Cloudwatch configuration, so they
+// can be found, and deleted, along with the ConfigMap or the Secret.
+const (
+	cloudwatchConfigUIDLabel = "cloudwatch.weave.works/config-uid"
+	cloudwatchSecretUIDLabel = "cloudwatch.weave.works/secret-uid"
+)
+
+// Types of the objects a Cloudwatch manifest may create, by namespace. An
+// empty namespace lists cluster-scoped types.
+var cloudwatchResourceTypes = []struct {
+	namespace, types string
+}{
+	{"weave", "deployments,services,serviceaccounts,configmaps,secrets,roles,rolebindings"},
+	{"", "clusterroles,clusterrolebindings"},
+}
+
 type cloudwatch struct {
-	Region     string
+	Region string
+	// SecretName is the secret holding the AWS credentials, unless Role
+	// is set.
 	SecretName string
+	Role       *cloudwatchRole `json:",omitempty"`
 	Resources  []string
+	// ResourceOptions holds the options of the resource types listed in
+	// Resources, by type.
+	ResourceOptions map[string]*cloudwatchResourceOptions `json:",omitempty"`
+}
+
+const (
+	// Name of the original, single, Cloudwatch ConfigMap. It is still picked
+	// up when it doesn't match the Cloudwatch selector.
+	legacyCloudwatchConfigMap = "cloudwatch"
+	// Key of the Cloudwatch configuration in its ConfigMap.
+	cloudwatchConfigKey = "cloudwatch.yaml"
+)
+
+// isCloudwatchConfigMap returns whether obj is a ConfigMap holding a
+// Cloudwatch configuration.
+func (cfg *agentConfig) isCloudwatchConfigMap(obj interface{}) bool {
+	cm, ok := deletedObject(obj).(*apiv1.ConfigMap)
+	if !ok {
+		return false
+	}
+	if cm.Name == legacyCloudwatchConfigMap {
+		return true
+	}
+	return cfg.CloudwatchSelector != nil && cfg.CloudwatchSelector.Matches(labels.Set(cm.Labels))
 }
 
-// Watch for CM creation.
+// Watch for the creation of ConfigMaps matching the Cloudwatch selector. Each
+// of them is an independent Cloudwatch configuration.
 func watchConfigMaps(cfg *agentConfig) {
 	source := cache.NewListWatchFromClient(
 		cfg.KubeClient.CoreV1().RESTClient(),
 		"configmaps",
 		"weave",
-		fields.SelectorFromSet(fields.Set{"metadata.name": "cloudwatch"}))
+		fields.Everything())
 
 	cfg.CMInformer = cache.NewSharedIndexInformer(
 		source,
@@ -40,14 +91,18 @@ func watchConfigMaps(cfg *agentConfig) {
 		cache.Indexers{},
 	)
 
-	cfg.CMInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    cfg.handleCMAdd,
-		UpdateFunc: cfg.handleCMUpdate,
-		DeleteFunc: cfg.handleCMDelete,
+	// A ConfigMap no longer matching the selector is handled as deleted.
+	cfg.CMInformer.AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: cfg.isCloudwatchConfigMap,
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc:    cfg.handleCMAdd,
+			UpdateFunc: cfg.handleCMUpdate,
+			DeleteFunc: cfg.handleCMDelete,
+		},
 	})
 }
 
-// Triggered on all ConfigMap creation with name cloudwatch in weave ns
+// Triggered on all Cloudwatch ConfigMap creation in weave ns
 func (cfg *agentConfig) handleCMAdd(obj interface{}) {
 	cm, ok := obj.(*apiv1.ConfigMap)
 	if !ok {
@@ -55,12 +110,12 @@ func (cfg *agentConfig) handleCMAdd(obj interface{}) {
 		return
 	}
 
-	log.Debugf("ConfigMap %v/%v was created", cm.ObjectMeta.Name, cm.ObjectMeta.Name)
+	log.Debugf("ConfigMap %v/%v was created", cm.ObjectMeta.Namespace, cm.ObjectMeta.Name)
 
-	cfg.checkOrInstallCloudWatch(cm)
+	cfg.enqueueCloudwatch(configMapKey(cm))
 }
 
-// Triggered on all ConfigMap update with name cloudwatch in weave ns
+// Triggered on all Cloudwatch ConfigMap update in weave ns
 func (cfg *agentConfig) handleCMUpdate(old, cur interface{}) {
 	cm, ok := cur.(*apiv1.ConfigMap)
 	if !ok {
@@ -68,14 +123,37 @@ func (cfg *agentConfig) handleCMUpdate(old, cur interface{}) {
 		return
 	}
 
+	// Writing the status updates the ConfigMap too.
+	if oldCM, ok := old.(*apiv1.ConfigMap); ok && reflect.DeepEqual(oldCM.Data, cm.Data) {
+		return
+	}
+
 	log.Debugf("ConfigMap %v/%v was updated", cm.ObjectMeta.Namespace, cm.ObjectMeta.Name)
 
-	cfg.checkOrInstallCloudWatch(cm)
+	cfg.enqueueCloudwatch(configMapKey(cm))
+}
+
+// deletedObject returns the object deleted, obj may be a tombstone when the
+// informer missed the deletion.
+func deletedObject(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
 }
 
-// Triggered on only ConfigMap deletion with name cloudwatch in weave ns
+// Triggered on only Cloudwatch ConfigMap deletion in weave ns
 func (cfg *agentConfig) handleCMDelete(obj interface{}) {
-	// TODO: Handle ConfigMap deletion. Delete individual objects that were created as at this point.
+	cm, ok := deletedObject(obj).(*apiv1.ConfigMap)
+	if !ok {
+		log.Error("Failed to type assert ConfigMap: ", obj)
+		return
+	}
+
+	log.Infof("ConfigMap %v/%v was deleted, deleting its Cloudwatch resources", cm.ObjectMeta.Namespace, cm.ObjectMeta.Name)
+
+	cfg.deleteCloudwatch(cfg.handlerContext(), cloudwatchConfigUIDLabel, string(cm.UID))
+	cfg.enqueueCloudwatch(configMapKey(cm))
 }
 
 // Watch for Secret creation/update/deletion.
@@ -111,7 +189,7 @@ func (cfg *agentConfig) handleSecretAdd(obj interface{}) {
 
 	log.Debugf("Secret %v/%v was created", secret.ObjectMeta.Namespace, secret.ObjectMeta.Name)
 
-	cfg.conformSecret()
+	cfg.conformSecret(secret)
 }
 
 // Triggered on all Secret updates in the weave ns
@@ -125,129 +203,396 @@ func (cfg *agentConfig) handleSecretUpdate(old, cur interface{}) {
 
 	log.Debugf("Secret %v/%v was updated", secret.ObjectMeta.Namespace, secret.ObjectMeta.Name)
 
-	cfg.conformSecret()
+	cfg.conformSecret(secret)
 }
 
 // Triggered on all Secret deletions in the weave ns
 func (cfg *agentConfig) handleSecretDelete(obj interface{}) {
-	// TODO: Handle Secret deletion. Delete individual objects that were created.
+	secret, ok := deletedObject(obj).(*apiv1.Secret)
+	if !ok {
+		// If the object is not a secret we should ignore.
+		log.Error("Failed to type assert Secret: ", obj)
+		return
+	}
+
+	log.Debugf("Secret %v/%v was deleted", secret.ObjectMeta.Namespace, secret.ObjectMeta.Name)
+
+	// Only the Cloudwatch resources using this Secret are deleted, if any.
+	cfg.deleteCloudwatch(cfg.handlerContext(), cloudwatchSecretUIDLabel, string(secret.UID))
 }
 
-func (cfg *agentConfig) conformSecret() {
-	// Get ConfigMap
-	cm, err := cfg.getConfigMap("cloudwatch")
-	if err != nil {
-		// If we don't have the cloudwatch CM this is the wrong secret.
-		log.Debug(err)
+// cloudwatchConfigMapsUsing returns the Cloudwatch ConfigMaps whose
+// configuration uses the Secret named secretName.
+func (cfg *agentConfig) cloudwatchConfigMapsUsing(secretName string) []*apiv1.ConfigMap {
+	cms := []*apiv1.ConfigMap{}
+	for _, obj := range cfg.CMInformer.GetStore().List() {
+		cm, ok := obj.(*apiv1.ConfigMap)
+		if !ok || !cfg.isCloudwatchConfigMap(cm) {
+			continue
+		}
+		cw, err := parseCloudwatchConfigMap(cm)
+		if err != nil || cw.SecretName != secretName {
+			continue
+		}
+		cms = append(cms, cm)
+	}
+	return cms
+}
+
+// conformSecret re-deploys the Cloudwatch configurations using secret.
+func (cfg *agentConfig) conformSecret(secret *apiv1.Secret) {
+	if cfg.CloudwatchMonitors {
+		for _, monitor := range cfg.cloudwatchMonitorsUsing(secret.Name) {
+			cfg.enqueueCloudwatch(monitorKey(monitor))
+		}
 		return
 	}
+	for _, cm := range cfg.cloudwatchConfigMapsUsing(secret.Name) {
+		cfg.enqueueCloudwatch(configMapKey(cm))
+	}
+}
 
-	cfg.checkOrInstallCloudWatch(cm)
+// cloudwatchInputs is what the deployment of a Cloudwatch configuration
+// depends on.
+type cloudwatchInputs struct {
+	cw       *cloudwatch
+	parseErr error
+	secret   *apiv1.Secret
+	// secretErr is the error getting the secret, when the configuration
+	// could be parsed.
+	secretErr error
+	// url is the manifest to apply, when the configuration could be parsed
+	// and its secret found.
+	url string
 }
 
-// checkOrInstallCloudWatch by applying the manifest file.
-func (cfg *agentConfig) checkOrInstallCloudWatch(cm *apiv1.ConfigMap) {
-	for name, content := range cm.Data {
-		if name != "cloudwatch.yaml" {
-			return
+// getCloudwatchInputs parses the Cloudwatch configuration of target and gets
+// its secret.
+func (cfg *agentConfig) getCloudwatchInputs(ctx context.Context, target cloudwatchTarget) (*cloudwatchInputs, error) {
+	in := &cloudwatchInputs{}
+	in.cw, in.parseErr = target.parse()
+	if in.parseErr != nil {
+		return in, nil
+	}
+
+	secretUID := ""
+	if in.cw.Role == nil {
+		// Get the Secret UID and with that we make sure the Secret actually exists.
+		in.secret, in.secretErr = cfg.getSecret(ctx, in.cw.SecretName)
+		if in.secretErr != nil {
+			return in, nil
 		}
+		secretUID = string(in.secret.UID)
+	}
 
-		cw, err := parseCloudwatchYaml(content)
-		if err != nil {
-			log.Error(err)
-			return
+	url, err := cfg.cloudwatchURL(in.cw, target.GetName(), string(target.GetUID()), secretUID)
+	if err != nil {
+		return nil, err
+	}
+	in.url = url
+	return in, nil
+}
+
+// hash digests the inputs. The manifest URL covers the configuration and the
+// objects it belongs to, the secret data is hashed to check it again when it
+// changes.
+func (in *cloudwatchInputs) hash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%v\n%v\n", in.url, in.parseErr, in.secretErr)
+	if in.secret != nil {
+		keys := []string{}
+		for key := range in.secret.Data {
+			keys = append(keys, key)
 		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(h, "%s=%x\n", key, in.secret.Data[key])
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-		// Get the Secret UID and with that we make sure the Secret actually exists.
-		secret, err := cfg.getSecret(cw.SecretName)
-		if err != nil {
-			log.Error(err)
-			return
+// installCloudwatch deploys the Cloudwatch configuration of target, and
+// reports how it went on target. It returns the URL of the manifest applied,
+// empty when the configuration or its secret is invalid, or when its objects
+// belong to another configuration. An error is only returned when applying
+// the manifest failed, and is worth retrying.
+func (cfg *agentConfig) installCloudwatch(ctx context.Context, target cloudwatchTarget, in *cloudwatchInputs) (string, error) {
+	status := newCloudwatchStatus()
+	name := fmt.Sprintf("%s/%s", target.GetNamespace(), target.GetName())
+
+	status.set(cloudwatchParsed, in.parseErr)
+	if in.parseErr != nil {
+		log.Errorf("%s: %v", name, in.parseErr)
+		reason := reasonCloudwatchInvalid
+		if errors.Is(in.parseErr, errCloudwatchMonitorNamespace) {
+			reason = reasonCloudwatchWrongNamespace
 		}
+		cfg.reportCloudwatchStatus(ctx, target, status, apiv1.EventTypeWarning, reason, in.parseErr.Error())
+		return "", nil
+	}
 
-		err = cfg.deployCloudwatch(cw, cm.Name, string(cm.UID), string(secret.UID))
+	secretUID := ""
+	if in.cw.Role != nil {
+		// There is no secret when assuming a role.
+		status.remove(cloudwatchSecretFound, cloudwatchSecretValid)
+		status.RoleARN = in.cw.Role.ARN
+	} else {
+		status.set(cloudwatchSecretFound, in.secretErr)
+		if in.secretErr != nil {
+			log.Error(in.secretErr)
+			cfg.reportCloudwatchStatus(ctx, target, status, apiv1.EventTypeWarning, reasonCloudwatchSecretNotFound, in.secretErr.Error())
+			return "", nil
+		}
+
+		// A secret without well-formed credentials would only give us a
+		// crashlooping exporter.
+		err := validateCloudwatchSecret(in.secret)
+		status.set(cloudwatchSecretValid, err)
 		if err != nil {
-			log.Error("Error while deploying cloudwatch manifest: ", err)
-			return
+			countSecretError(err)
+			log.Errorf("%s: %v", name, err)
+			cfg.reportCloudwatchStatus(ctx, target, status, apiv1.EventTypeWarning, reasonCloudwatchInvalidSecret, err.Error())
+			return "", nil
 		}
+		secretUID = string(in.secret.UID)
 	}
-}
 
-func (cfg *agentConfig) getSecret(name string) (*apiv1.Secret, error) {
-	s, err := cfg.KubeClient.CoreV1().Secrets("weave").Get(context.Background(), name, metav1.GetOptions{})
+	err := cfg.applyCloudwatch(ctx, in.url, string(target.GetUID()), migratedFromUID(target), secretUID)
+	status.set(cloudwatchApplied, err)
 	if err != nil {
-		return nil, err
+		log.Errorf("Error while deploying cloudwatch manifest for %s: %v", name, err)
+		reason := reasonCloudwatchApplyFailed
+		var conflict *cloudwatchConflictError
+		if errors.As(err, &conflict) {
+			reason = reasonCloudwatchConflict
+		}
+		cfg.reportCloudwatchStatus(ctx, target, status, apiv1.EventTypeWarning, reason, err.Error())
+		if conflict != nil {
+			// Retrying won't help until the configuration changes.
+			return "", nil
+		}
+		return "", err
+	}
+	message := fmt.Sprintf("Cloudwatch deployed for %s in %s", strings.Join(in.cw.Resources, ", "), in.cw.Region)
+	if in.cw.Role != nil {
+		message += fmt.Sprintf(" assuming role %s", in.cw.Role.ARN)
 	}
+	cfg.reportCloudwatchStatus(ctx, target, status, apiv1.EventTypeNormal, reasonCloudwatchApplied, message)
+	return in.url, nil
+}
 
-	return s, nil
+// parseCloudwatchConfigMap parses the Cloudwatch configuration held by cm.
+func parseCloudwatchConfigMap(cm *apiv1.ConfigMap) (*cloudwatch, error) {
+	content, ok := cm.Data[cloudwatchConfigKey]
+	if !ok {
+		return nil, fmt.Errorf("cloudwatch: no %s key", cloudwatchConfigKey)
+	}
+	return parseCloudwatchYaml(content)
 }
 
-func (cfg *agentConfig) getConfigMap(name string) (*apiv1.ConfigMap, error) {
-	cm, err := cfg.KubeClient.CoreV1().ConfigMaps("weave").Get(context.Background(), name, metav1.GetOptions{})
+func (cfg *agentConfig) getSecret(ctx context.Context, name string) (*apiv1.Secret, error) {
+	s, err := cfg.KubeClient.CoreV1().Secrets("weave").Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	}
 
-	return cm, nil
-}
-
-func isValidResource(name string) bool {
-	for _, resource := range validResources {
-		if name == resource {
-			return true
-		}
-	}
-	return false
+	return s, nil
 }
 
-func (cfg *agentConfig) deployCloudwatch(cw *cloudwatch, CMName, CMUID, secretUID string) error {
+// cloudwatchURL returns the URL of the manifest deploying cw, for the
+// ConfigMap, or CloudWatchMonitor, CMName.
+func (cfg *agentConfig) cloudwatchURL(cw *cloudwatch, CMName, CMUID, secretUID string) (string, error) {
 	k8sVersion, err := getMajorMinorVersion(cfg.KubernetesMajorVersion, cfg.KubernetesMinorVersion, cfg.KubernetesVersion)
 	if err != nil {
 		log.Fatal("invalid Kubernetes version: ", err)
 	}
 
-	cwPollURL, err := text.ResolveString(defaultCloudwatchURL, map[string]string{
+	options, err := encodeResourceOptions(cw)
+	if err != nil {
+		return "", err
+	}
+
+	params := map[string]string{
 		"WCHostname":                  cfg.WCHostname,
 		"KubernetesMajorMinorVersion": k8sVersion,
 		"Region":                      cw.Region,
 		"SecretName":                  cw.SecretName,
 		"Resources":                   strings.Join(cw.Resources, "%2C"),
+		"ResourceOptions":             options,
 		"ConfigName":                  CMName,
 		"ConfigUID":                   CMUID,
 		"SecretUID":                   secretUID,
-	})
+	}
+	if cw.Role != nil {
+		params["RoleARN"] = url.QueryEscape(cw.Role.ARN)
+		params["RoleAnnotation"] = url.QueryEscape(cw.Role.ServiceAccountAnnotation)
+		params["WebIdentityTokenFile"] = url.QueryEscape(cw.Role.WebIdentityTokenFile)
+	}
+
+	cwPollURL, err := text.ResolveString(defaultCloudwatchURL, params)
 	if err != nil {
 		log.Fatal("invalid URL template: ", err)
 	}
+	return cwPollURL, nil
+}
 
-	log.Info("Applying cloudwatch manifest from: ", cwPollURL)
+// cloudwatchConflictError is returned when the objects of a Cloudwatch
+// configuration already exist for another one.
+type cloudwatchConflictError struct {
+	resource  kubectl.Resource
+	configUID string
+}
+
+func (e *cloudwatchConflictError) Error() string {
+	return fmt.Sprintf("%s is deployed for another Cloudwatch configuration (UID %s), refusing to overwrite it", e.resource, e.configUID)
+}
 
-	err = kubectl.Apply(cfg.KubectlClient, cwPollURL)
+// checkCloudwatchConflicts returns a cloudwatchConflictError if applying the
+// Cloudwatch manifest at cwPollURL would overwrite objects deployed for
+// another configuration than CMUID. Objects deployed for ownerUID, the
+// ConfigMap CMUID was migrated from, are not in conflict.
+func (cfg *agentConfig) checkCloudwatchConflicts(ctx context.Context, cwPollURL, CMUID, ownerUID string) error {
+	names, err := kubectl.DryRunNames(ctx, cfg.KubectlClient, cwPollURL)
 	if err != nil {
 		return err
 	}
-
+	existing, err := kubectl.GetLabelledResources(ctx, cfg.KubectlClient, "weave", names)
+	if err != nil {
+		return err
+	}
+	for _, r := range existing {
+		if uid, ok := r.Labels[cloudwatchConfigUIDLabel]; ok && uid != CMUID && (ownerUID == "" || uid != ownerUID) {
+			return &cloudwatchConflictError{resource: r.Resource, configUID: uid}
+		}
+	}
 	return nil
 }
 
+// applyCloudwatch applies the Cloudwatch manifest at cwPollURL, unless its
+// objects belong to another configuration than CMUID, or ownerUID it was
+// migrated from, if any. The objects are then labelled as belonging to CMUID.
+// secretUID is empty when the exporter assumes a role.
+func (cfg *agentConfig) applyCloudwatch(ctx context.Context, cwPollURL, CMUID, ownerUID, secretUID string) error {
+	if err := cfg.checkCloudwatchConflicts(ctx, cwPollURL, CMUID, ownerUID); err != nil {
+		return err
+	}
+
+	log.Info("Applying cloudwatch manifest from: ", cwPollURL)
+	applied, err := kubectl.ApplyNames(ctx, cfg.KubectlClient, cwPollURL)
+	if err != nil {
+		return err
+	}
+
+	// Remember which ConfigMap and Secret the objects were created for.
+	labels := map[string]string{cloudwatchConfigUIDLabel: CMUID}
+	if secretUID != "" {
+		labels[cloudwatchSecretUIDLabel] = secretUID
+	}
+	return kubectl.LabelResources(ctx, cfg.KubectlClient, "weave", applied, labels)
+}
+
+// deleteCloudwatch deletes the Cloudwatch resources labelled with uid.
+func (cfg *agentConfig) deleteCloudwatch(ctx context.Context, label, uid string) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.KubectlTimeout)
+	defer cancel()
+
+	selector := fmt.Sprintf("%s=%s", label, uid)
+	for _, t := range cloudwatchResourceTypes {
+		resources, err := kubectl.ListResources(ctx, cfg.KubectlClient, t.types, t.namespace, selector)
+		if err != nil {
+			log.Errorf("Error while listing cloudwatch resources with %s: %v", selector, err)
+			return
+		}
+		for _, r := range resources {
+			log.Info("Deleting cloudwatch resource ", r)
+			if err := kubectl.DeleteResource(ctx, cfg.KubectlClient, strings.ToLower(r.Kind), r.Namespace, r.Name); err != nil {
+				log.Errorf("Error while deleting cloudwatch resource %s: %v", r, err)
+			}
+		}
+	}
+}
+
 func validateResources(resources []string) error {
 	if len(resources) == 0 {
 		return errors.New("cloudwatch: at least one AWS resource must be specified")
 	}
 	for _, resource := range resources {
-		if !isValidResource(resource) {
-			return fmt.Errorf("cloudwatch: unknown resource '%s'", resource)
+		if _, ok := awsResourceTypes[resource]; !ok {
+			return fmt.Errorf("cloudwatch: unknown resource '%s', must be one of %s", resource, strings.Join(awsResourceTypeNames(), ", "))
+		}
+	}
+	return nil
+}
+
+func validateResourceOptions(cw *cloudwatch) error {
+	names := []string{}
+	for name := range cw.ResourceOptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		options := cw.ResourceOptions[name]
+		field := fmt.Sprintf("resourceOptions.%s", name)
+		if !contains(cw.Resources, name) {
+			return fmt.Errorf("cloudwatch: %s: resource '%s' isn't listed in resources", field, name)
+		}
+		if options == nil {
+			continue
+		}
+		if err := options.validate(field, name); err != nil {
+			return fmt.Errorf("cloudwatch: %v", err)
 		}
 	}
 	return nil
 }
 
+// encodeResourceOptions encodes the resource options as a URL query
+// parameter value, empty when there are none.
+func encodeResourceOptions(cw *cloudwatch) (string, error) {
+	if len(cw.ResourceOptions) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(cw.ResourceOptions)
+	if err != nil {
+		return "", err
+	}
+	return url.QueryEscape(string(data)), nil
+}
+
+// setDefaults fills in the settings left out of cw.
+func (cw *cloudwatch) setDefaults() {
+	if cw.Role != nil {
+		cw.Role.setDefaults()
+	}
+}
+
+// validateCloudwatch checks the Cloudwatch configuration cw.
+func validateCloudwatch(cw *cloudwatch) error {
+	if err := validateAuth(cw); err != nil {
+		return err
+	}
+	if err := validateResources(cw.Resources); err != nil {
+		return err
+	}
+	return validateResourceOptions(cw)
+}
+
+// parseCloudwatchYaml parses and validates a YAML or JSON Cloudwatch
+// configuration. Unknown fields are rejected.
 func parseCloudwatchYaml(cm string) (*cloudwatch, error) {
-	cw := cloudwatch{}
-	if err := yaml.NewYAMLOrJSONDecoder(bytes.NewBufferString(cm), 1000).Decode(&cw); err != nil {
+	data, err := yaml.ToJSON([]byte(cm))
+	if err != nil {
 		return nil, err
 	}
-	if err := validateResources(cw.Resources); err != nil {
+	cw := cloudwatch{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cw); err != nil {
+		return nil, fmt.Errorf("cloudwatch: %v", err)
+	}
+	cw.setDefaults()
+	if err := validateCloudwatch(&cw); err != nil {
 		return nil, err
 	}
 	return &cw, nil
@@ -1,9 +1,20 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 func TestValidateResources(t *testing.T) {
@@ -16,6 +27,8 @@ func TestValidateResources(t *testing.T) {
 		{[]string{"rds", "classic-elb"}, true},
 		{[]string{"foo", "classic-elb"}, false},
 		{[]string{"foo"}, false},
+		{[]string{"ec2", "ebs", "elbv2", "sqs", "lambda", "dynamodb", "elasticache"}, true},
+		{[]string{"alb"}, false},
 	}
 
 	for _, test := range tests {
@@ -36,6 +49,13 @@ region: us-east-1
 secretName: cloudwatch
 `
 
+var testCloudwatchConfigUnknownField = `
+region: us-east-1
+secretName: cloudwatch
+resource:
+  - rds
+`
+
 var testCloudwatchConfigUnknownResource = `
 region: us-east-1
 secretName: cloudwatch
@@ -69,6 +89,11 @@ func TestParseCloudwatchYaml(t *testing.T) {
 			false,
 			cloudwatch{},
 		},
+		{
+			testCloudwatchConfigUnknownField,
+			false,
+			cloudwatch{},
+		},
 	}
 
 	for _, test := range tests {
@@ -84,3 +109,226 @@ func TestParseCloudwatchYaml(t *testing.T) {
 		assert.Equal(t, test.expected, *got)
 	}
 }
+
+// testKubectl answers kubectl commands from responses and records them.
+type testKubectl struct {
+	responses map[string]string
+	commands  []string
+}
+
+func newTestKubectl() *testKubectl {
+	return &testKubectl{responses: map[string]string{}}
+}
+
+func (c *testKubectl) Execute(ctx context.Context, args ...string) (string, error) {
+	cmd := strings.Join(args, " ")
+	c.commands = append(c.commands, cmd)
+	response, ok := c.responses[cmd]
+	if !ok {
+		return "", fmt.Errorf("missing response for %q", cmd)
+	}
+	return response, nil
+}
+
+func (c *testKubectl) ExecuteOutputMatrix(ctx context.Context, args ...string) (string, string, error) {
+	stdout, err := c.Execute(ctx, args...)
+	return stdout, "", err
+}
+
+func TestDeployCloudwatchLabels(t *testing.T) {
+	c := newTestKubectl()
+	cfg := &agentConfig{KubernetesVersion: "v1.9.3", WCHostname: "cloud.weave.works", KubectlClient: c}
+	url := "https://cloud.weave.works/k8s/v1.9/cloudwatch.yaml?aws-region=us-east-1&aws-secret=cloudwatch&aws-resources=rds%2Cclassic-elb&aws-config=cloudwatch&aws-config-uid=cm-uid&aws-secret-uid=secret-uid"
+	c.responses["apply --dry-run=client -f "+url+" -o name"] = "deployment.apps/cloudwatch-exporter\nclusterrole.rbac.authorization.k8s.io/cloudwatch-exporter\n"
+	c.responses["get --namespace=weave --ignore-not-found deployment.apps/cloudwatch-exporter clusterrole.rbac.authorization.k8s.io/cloudwatch-exporter -ojson"] = ""
+	c.responses["apply -f "+url+" -o name"] = "deployment.apps/cloudwatch-exporter\nclusterrole.rbac.authorization.k8s.io/cloudwatch-exporter\n"
+	c.responses["label --overwrite --namespace=weave deployment.apps/cloudwatch-exporter clusterrole.rbac.authorization.k8s.io/cloudwatch-exporter "+
+		"cloudwatch.weave.works/config-uid=cm-uid cloudwatch.weave.works/secret-uid=secret-uid"] = ""
+
+	cw := &cloudwatch{Region: "us-east-1", SecretName: "cloudwatch", Resources: []string{"rds", "classic-elb"}}
+	cwURL, err := cfg.cloudwatchURL(cw, "cloudwatch", "cm-uid", "secret-uid")
+	assert.NoError(t, err)
+	assert.Equal(t, url, cwURL)
+	assert.NoError(t, cfg.applyCloudwatch(context.Background(), cwURL, "cm-uid", "", "secret-uid"))
+	assert.Len(t, c.commands, 4)
+}
+
+func TestDeployTwoCloudwatchConfigs(t *testing.T) {
+	first := cloudwatchConfigMap("cloudwatch", nil, testCloudwatchConfig)
+	first.UID = "first-uid"
+	second := cloudwatchConfigMap("cloudwatch-2", nil, testCloudwatchConfig)
+	second.UID = "second-uid"
+	secret := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "weave", Name: "cloudwatch", UID: "secret-uid"},
+		Data:       testCredentials(),
+	}
+	c := newTestKubectl()
+	recorder := record.NewFakeRecorder(10)
+	cfg := &agentConfig{
+		KubernetesVersion: "v1.9.3",
+		WCHostname:        "cloud.weave.works",
+		KubeClient:        fake.NewSimpleClientset(first, second, secret),
+		KubectlClient:     c,
+		Recorder:          recorder,
+	}
+	ctx := context.Background()
+	install := func(cm *apiv1.ConfigMap) error {
+		in, err := cfg.getCloudwatchInputs(ctx, configMapTarget{cm})
+		assert.NoError(t, err)
+		_, err = cfg.installCloudwatch(ctx, configMapTarget{cm}, in)
+		return err
+	}
+
+	// Both configurations deploy the same objects.
+	urlOf := func(cm *apiv1.ConfigMap) string {
+		return "https://cloud.weave.works/k8s/v1.9/cloudwatch.yaml?aws-region=us-east-1&aws-secret=cloudwatch&aws-resources=rds%2Cclassic-elb" +
+			"&aws-config=" + cm.Name + "&aws-config-uid=" + string(cm.UID) + "&aws-secret-uid=secret-uid"
+	}
+	get := "get --namespace=weave --ignore-not-found deployment.apps/cloudwatch-exporter -ojson"
+	for _, cm := range []*apiv1.ConfigMap{first, second} {
+		c.responses["apply --dry-run=client -f "+urlOf(cm)+" -o name"] = "deployment.apps/cloudwatch-exporter\n"
+		c.responses["apply -f "+urlOf(cm)+" -o name"] = "deployment.apps/cloudwatch-exporter\n"
+		c.responses["label --overwrite --namespace=weave deployment.apps/cloudwatch-exporter "+
+			"cloudwatch.weave.works/config-uid="+string(cm.UID)+" cloudwatch.weave.works/secret-uid=secret-uid"] = ""
+	}
+
+	c.responses[get] = ""
+	assert.NoError(t, install(first))
+	assert.Equal(t, "Normal Applied Cloudwatch deployed for rds, classic-elb in us-east-1", <-recorder.Events)
+
+	// The second one would take the objects of the first one over.
+	c.responses[get] = `{"kind": "Deployment", "metadata": {"name": "cloudwatch-exporter", "namespace": "weave",
+	  "labels": {"cloudwatch.weave.works/config-uid": "first-uid"}}}`
+	c.commands = nil
+	assert.NoError(t, install(second))
+	assert.Equal(t, []string{"apply --dry-run=client -f " + urlOf(second) + " -o name", get}, c.commands)
+	assert.Equal(t, "Warning Conflict deployment/cloudwatch-exporter (namespace weave) is deployed for another Cloudwatch configuration (UID first-uid), refusing to overwrite it", <-recorder.Events)
+
+	// Re-deploying the first one is fine.
+	assert.NoError(t, install(first))
+}
+
+func TestHandleCMDelete(t *testing.T) {
+	c := newTestKubectl()
+	cfg := &agentConfig{KubectlTimeout: time.Minute, KubectlClient: c}
+	selector := "--selector=cloudwatch.weave.works/config-uid=cm-uid -ojson"
+	c.responses["get deployments,services,serviceaccounts,configmaps,secrets,roles,rolebindings --namespace=weave "+selector] =
+		`{"items": [{"kind": "Deployment", "metadata": {"name": "cloudwatch-exporter", "namespace": "weave"}}]}`
+	c.responses["get clusterroles,clusterrolebindings "+selector] =
+		`{"items": [{"kind": "ClusterRole", "metadata": {"name": "cloudwatch-exporter"}}]}`
+	c.responses["delete deployment cloudwatch-exporter --namespace=weave"] = ""
+	c.responses["delete clusterrole cloudwatch-exporter --namespace="] = ""
+
+	cm := &apiv1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "weave", Name: "cloudwatch", UID: "cm-uid"}}
+	cfg.handleCMDelete(cache.DeletedFinalStateUnknown{Key: "weave/cloudwatch", Obj: cm})
+	assert.Equal(t, []string{
+		"get deployments,services,serviceaccounts,configmaps,secrets,roles,rolebindings --namespace=weave " + selector,
+		"delete deployment cloudwatch-exporter --namespace=weave",
+		"get clusterroles,clusterrolebindings " + selector,
+		"delete clusterrole cloudwatch-exporter --namespace=",
+	}, c.commands)
+}
+
+func cloudwatchConfigMap(name string, cmLabels map[string]string, config string) *apiv1.ConfigMap {
+	return &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "weave", Name: name, Labels: cmLabels},
+		Data:       map[string]string{cloudwatchConfigKey: config},
+	}
+}
+
+func TestCloudwatchConfigMapsUsing(t *testing.T) {
+	cfg := &agentConfig{
+		CloudwatchSelector: labels.SelectorFromSet(labels.Set{"cloud.weave.works/cloudwatch": "true"}),
+		CMInformer:         cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.ConfigMap{}, 0, cache.Indexers{}),
+	}
+	selected := map[string]string{"cloud.weave.works/cloudwatch": "true"}
+	euWest := `
+region: eu-west-1
+secretName: cloudwatch-eu
+resources: [rds]
+`
+	store := cfg.CMInformer.GetStore()
+	for _, cm := range []*apiv1.ConfigMap{
+		cloudwatchConfigMap("cloudwatch", nil, testCloudwatchConfig),
+		cloudwatchConfigMap("cloudwatch-prod", selected, testCloudwatchConfig),
+		cloudwatchConfigMap("cloudwatch-eu", selected, euWest),
+		cloudwatchConfigMap("other", nil, testCloudwatchConfig),
+		cloudwatchConfigMap("invalid", selected, testCloudwatchConfigUnknownResource),
+	} {
+		assert.NoError(t, store.Add(cm))
+	}
+
+	names := func(cms []*apiv1.ConfigMap) []string {
+		result := []string{}
+		for _, cm := range cms {
+			result = append(result, cm.Name)
+		}
+		return result
+	}
+	assert.ElementsMatch(t, []string{"cloudwatch", "cloudwatch-prod"}, names(cfg.cloudwatchConfigMapsUsing("cloudwatch")))
+	assert.ElementsMatch(t, []string{"cloudwatch-eu"}, names(cfg.cloudwatchConfigMapsUsing("cloudwatch-eu")))
+	assert.Empty(t, cfg.cloudwatchConfigMapsUsing("weave-cloud"))
+}
+
+var testCloudwatchConfigOptions = `
+region: us-east-1
+secretName: cloudwatch
+resources: [ec2, sqs, lambda]
+resourceOptions:
+  ec2:
+    dimensions:
+      AutoScalingGroupName: [web, api]
+    tags:
+      team: web
+    metrics: [CPUUtilization, NetworkIn]
+  sqs:
+    metrics: [ApproximateAgeOfOldestMessage]
+`
+
+func TestParseCloudwatchYamlResourceOptions(t *testing.T) {
+	cw, err := parseCloudwatchYaml(testCloudwatchConfigOptions)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ec2", "sqs", "lambda"}, cw.Resources)
+	assert.Equal(t, &cloudwatchResourceOptions{
+		Dimensions: map[string][]string{"AutoScalingGroupName": {"web", "api"}},
+		Tags:       map[string]string{"team": "web"},
+		Metrics:    []string{"CPUUtilization", "NetworkIn"},
+	}, cw.ResourceOptions["ec2"])
+
+	tests := []struct {
+		options string
+		err     string
+	}{
+		{"rds: {}", "cloudwatch: resourceOptions.rds: resource 'rds' isn't listed in resources"},
+		{"ec2: {dimensions: {QueueName: [q]}}", "cloudwatch: resourceOptions.ec2.dimensions: unknown ec2 dimension 'QueueName', must be one of InstanceId, InstanceType, AutoScalingGroupName, ImageId"},
+		{"ec2: {dimensions: {QueueName: [q], FunctionName: [f]}}", "cloudwatch: resourceOptions.ec2.dimensions: unknown ec2 dimension 'FunctionName', must be one of InstanceId, InstanceType, AutoScalingGroupName, ImageId"},
+		{"sqs: {metrics: [Invocations]}\n  ec2: {metrics: [Invocations]}", "cloudwatch: resourceOptions.ec2.metrics[0]: unknown ec2 metric 'Invocations', must be one of " + strings.Join(awsResourceTypes["ec2"].metrics, ", ")},
+		{"ec2: {metric: [CPUUtilization]}", `cloudwatch: json: unknown field "metric"`},
+		{"ec2: {dimensions: {InstanceId: []}}", "cloudwatch: resourceOptions.ec2.dimensions.InstanceId: at least one value must be specified"},
+		{"ec2: {dimensions: {InstanceId: ['']}}", "cloudwatch: resourceOptions.ec2.dimensions.InstanceId[0]: empty value"},
+		{"ec2: {tags: {'aws:cloudformation:stack-name': web}}", "cloudwatch: resourceOptions.ec2.tags.aws:cloudformation:stack-name: tags prefixed with 'aws:' are reserved"},
+		{"sqs: {metrics: [NumberOfMessagesSent, Invocations]}", "cloudwatch: resourceOptions.sqs.metrics[1]: unknown sqs metric 'Invocations', must be one of ApproximateNumberOfMessagesVisible, ApproximateNumberOfMessagesNotVisible, ApproximateAgeOfOldestMessage, NumberOfMessagesSent, NumberOfMessagesReceived, NumberOfMessagesDeleted, NumberOfEmptyReceives"},
+	}
+	for _, test := range tests {
+		config := "region: us-east-1\nsecretName: cloudwatch\nresources: [ec2, sqs]\nresourceOptions:\n  " + test.options + "\n"
+		_, err := parseCloudwatchYaml(config)
+		if assert.Error(t, err, test.options) {
+			assert.Equal(t, test.err, err.Error())
+		}
+	}
+}
+
+func TestEncodeResourceOptions(t *testing.T) {
+	options, err := encodeResourceOptions(&cloudwatch{Resources: []string{"rds"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "", options)
+
+	options, err = encodeResourceOptions(&cloudwatch{
+		Resources: []string{"sqs"},
+		ResourceOptions: map[string]*cloudwatchResourceOptions{
+			"sqs": {Metrics: []string{"NumberOfMessagesSent", "NumberOfMessagesDeleted"}},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "%7B%22sqs%22%3A%7B%22metrics%22%3A%5B%22NumberOfMessagesSent%22%2C%22NumberOfMessagesDeleted%22%5D%7D%7D", options)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/weaveworks/launcher/pkg/kubectl"
+)
+
+// argType is how the value of an argument is parsed and encoded.
+type argType int
+
+const (
+	stringArg argType = iota
+	// Multi-valued, or passed as comma-separated values. This accounts for
+	// either form.
+	stringSliceArg
+	durationArg
+	// Given without a value, a boolean argument is true.
+	boolArg
+)
+
+// componentArg is an argument of a component preserved across updates.
+type componentArg struct {
+	flag string
+	// shorthand is the one letter form of the flag, if any.
+	shorthand string
+	typ       argType
+	// param is the query parameter of the Weave Cloud manifest URL the
+	// argument is passed back as.
+	param string
+}
+
+// component is a Weave Cloud agent whose arguments are preserved across
+// updates.
+type component struct {
+	name string
+	// kind and selector find the workload of the component.
+	kind     string
+	selector string
+	// container holding the arguments, the first one when empty.
+	container string
+	args      []componentArg
+}
+
+// arg returns the argument named name, either its flag or its shorthand.
+func (c *component) arg(name string) *componentArg {
+	for i := range c.args {
+		arg := &c.args[i]
+		if arg.flag == name || (arg.shorthand != "" && arg.shorthand == name) {
+			return arg
+		}
+	}
+	return nil
+}
+
+// Arguments are passed back under the same name, unless the Weave Cloud
+// manifest knows them under another.
+func sameName(typ argType, flags ...string) []componentArg {
+	args := []componentArg{}
+	for _, flag := range flags {
+		args = append(args, componentArg{flag: flag, typ: typ, param: flag})
+	}
+	return args
+}
+
+func concat(args ...[]componentArg) []componentArg {
+	all := []componentArg{}
+	for _, a := range args {
+		all = append(all, a...)
+	}
+	return all
+}
+
+var (
+	fluxComponent = &component{
+		name:     "flux",
+		kind:     "deploy",
+		selector: "name=weave-flux-agent",
+		args: concat(
+			sameName(stringArg, "git-label", "git-url", "git-branch", "git-user", "git-email",
+				"git-sync-tag", "git-notes-ref",
+				// This is now hard-wired to empty in launch-generator, to tell
+				// flux _not_ to use service discovery. But: maybe someone needs
+				// to use service discovery.
+				"memcached-service"),
+			sameName(durationArg, "git-timeout", "git-poll-interval", "sync-interval", "registry-poll-interval"),
+			sameName(boolArg, "git-set-author", "git-ci-skip", "git-readonly", "sync-garbage-collection",
+				"registry-disable-scanning"),
+			sameName(stringSliceArg, "git-path",
+				// For specifying ECR region from outside AWS (fluxd detects
+				// it when inside AWS)
+				"registry-ecr-region",
+				// For requiring a particular registry to be accessible, else
+				// crash
+				"registry-require",
+				// Can be used to switch image registry scanning off for some
+				// or all images (with glob patterns)
+				"registry-exclude-image",
+				// Just in case we more explicitly support restricting Weave
+				// Cloud, or just Flux to particular namespaces
+				"k8s-allow-namespace"),
+		),
+	}
+
+	memcachedComponent = &component{
+		name:     "memcached",
+		kind:     "deploy",
+		selector: "name=weave-flux-memcached",
+		args: []componentArg{
+			// MB memory max to use for object storage.
+			{flag: "memory-limit", shorthand: "m", typ: stringArg, param: "memcached-memory"},
+			// The default size of each slab page, default is 1m, minimum
+			// is 1k, max is 128m.
+			{flag: "max-item-size", shorthand: "I", typ: stringArg, param: "memcached-item-size"},
+			{flag: "conn-limit", shorthand: "c", typ: stringArg, param: "memcached-conn-limit"},
+		},
+	}
+
+	scopeComponent = &component{
+		name:      "scope",
+		kind:      "daemonset",
+		selector:  "name=weave-scope-agent",
+		container: "agent",
+		args: []componentArg{
+			{flag: "probe.docker.bridge", typ: stringArg, param: "scope-docker-bridge"},
+			{flag: "probe.kubernetes.role", typ: stringArg, param: "scope-kubernetes-role"},
+			{flag: "probe.spy.interval", typ: durationArg, param: "scope-spy-interval"},
+			{flag: "probe.publish.interval", typ: durationArg, param: "scope-publish-interval"},
+			{flag: "probe.processes", typ: boolArg, param: "scope-processes"},
+			{flag: "probe.conntrack", typ: boolArg, param: "scope-conntrack"},
+			{flag: "probe.ebpf.connections", typ: boolArg, param: "scope-ebpf-connections"},
+		},
+	}
+
+	// Prometheus used to be the agent container of weave-cortex-agent, it's
+	// now the first container of prometheus.
+	prometheusComponent = &component{
+		name:     "prometheus",
+		kind:     "deploy",
+		selector: "name in (prometheus, weave-cortex-agent)",
+		args: []componentArg{
+			// Prometheus durations, eg. 15d, aren't Go ones.
+			{flag: "storage.tsdb.retention", typ: stringArg, param: "prometheus-retention"},
+			{flag: "storage.remote.flush-deadline", typ: stringArg, param: "prometheus-flush-deadline"},
+			{flag: "query.timeout", typ: stringArg, param: "prometheus-query-timeout"},
+			{flag: "log.level", typ: stringArg, param: "prometheus-log-level"},
+		},
+	}
+
+	// components is the registry of the arguments preserved when updating
+	// Weave Cloud agents.
+	components = []*component{fluxComponent, memcachedComponent, scopeComponent, prometheusComponent}
+)
+
+// ComponentArgs holds the arguments of a component to preserve.
+type ComponentArgs struct {
+	component *component
+	// values holds the values of the arguments given, by flag.
+	values map[string][]string
+}
+
+// parseComponentArgs parses a string of args of component c. Arguments not
+// in the registry are ignored, nil is returned when none is.
+func parseComponentArgs(c *component, argString string) *ComponentArgs {
+	args := &ComponentArgs{component: c, values: map[string][]string{}}
+
+	tokens := strings.Fields(argString)
+	for i := 0; i < len(tokens); i++ {
+		if !strings.HasPrefix(tokens[i], "-") {
+			continue
+		}
+		// Flags are given with one or two dashes.
+		name := strings.TrimLeft(tokens[i], "-")
+		value, hasValue := "", false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+		arg := c.arg(name)
+		if arg == nil {
+			continue
+		}
+		if !hasValue {
+			switch {
+			case arg.typ == boolArg:
+				value = "true"
+			case i+1 < len(tokens):
+				i++
+				value = tokens[i]
+			default:
+				continue
+			}
+		}
+
+		if err := args.set(arg, value); err != nil {
+			log.Warnf("Ignoring %s argument %s=%s: %v", c.name, name, value, err)
+		}
+	}
+
+	if len(args.values) == 0 {
+		return nil
+	}
+	return args
+}
+
+func (c *ComponentArgs) set(arg *componentArg, value string) error {
+	switch arg.typ {
+	case stringSliceArg:
+		for _, v := range strings.Split(value, ",") {
+			if v != "" {
+				c.values[arg.flag] = append(c.values[arg.flag], v)
+			}
+		}
+		return nil
+	case durationArg:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		value = d.String()
+	case boolArg:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		value = strconv.FormatBool(b)
+	}
+	c.values[arg.flag] = []string{value}
+	return nil
+}
+
+// Value returns the value of the argument flag, comma-separated values for
+// multi-valued arguments.
+func (c *ComponentArgs) Value(flag string) string {
+	if c == nil {
+		return ""
+	}
+	return strings.Join(c.values[flag], ",")
+}
+
+// AsQueryParams returns the arguments as a fragment of query string, so it
+// can be interpolated into a text template.
+func (c *ComponentArgs) AsQueryParams() string {
+	vals := url.Values{}
+
+	if c == nil {
+		return ""
+	}
+
+	for _, arg := range c.component.args {
+		values, ok := c.values[arg.flag]
+		if !ok {
+			continue
+		}
+		if arg.typ == stringSliceArg {
+			values = deduplicate(values)
+		}
+		for _, value := range values {
+			vals.Add(arg.param, value)
+		}
+	}
+
+	return vals.Encode()
+}
+
+// ParseFluxArgs parses a string of flux args.
+func ParseFluxArgs(argString string) (*ComponentArgs, error) {
+	return parseComponentArgs(fluxComponent, argString), nil
+}
+
+// ParseMemcachedArgs parses a string of flux memcached args.
+func ParseMemcachedArgs(argString string) (*ComponentArgs, error) {
+	return parseComponentArgs(memcachedComponent, argString), nil
+}
+
+// getComponentArgs returns the arguments of component c running in
+// namespace, nil when it isn't running or has none to preserve.
+func getComponentArgs(ctx context.Context, k kubectl.Client, c *component, namespace string) (*ComponentArgs, error) {
+	container := "[0]"
+	if c.container != "" {
+		container = fmt.Sprintf(`[?(@.name=="%s")]`, c.container)
+	}
+	// kubectl isn't run through a shell, quotes would end up in the output.
+	out, err := k.Execute(ctx, "get", c.kind, "-n", namespace, "-l", c.selector, "-o",
+		fmt.Sprintf("jsonpath={.items[*].spec.template.spec.containers%s.args[*]}", container))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseComponentArgs(c, out), nil
+}
+
+// ComponentQueryParams returns the arguments to preserve of all the
+// components, as a fragment of query string.
+func (cfg *agentConfig) ComponentQueryParams() string {
+	params := []string{}
+	for _, c := range components {
+		if p := cfg.ComponentArgs[c.name].AsQueryParams(); p != "" {
+			params = append(params, p)
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func deduplicate(s []string) []string {
+	if len(s) <= 1 {
+		return s
+	}
+
+	res := []string{}
+	seen := make(map[string]bool)
+	for _, val := range s {
+		if _, ok := seen[val]; !ok {
+			res = append(res, val)
+			seen[val] = true
+		}
+	}
+	return res
+}
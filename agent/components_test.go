@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// manifestKubectl answers kubectl get -l ... -o jsonpath=... from the
+// workloads of a Weave Cloud manifest.
+type manifestKubectl struct {
+	items []unstructured.Unstructured
+	// outputs holds what was answered, by selector.
+	outputs map[string]string
+}
+
+func newManifestKubectl(path string) (*manifestKubectl, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	list := struct {
+		Items []map[string]interface{} `json:"items"`
+	}{}
+	if err := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096).Decode(&list); err != nil {
+		return nil, err
+	}
+	items := []unstructured.Unstructured{}
+	for _, item := range list.Items {
+		items = append(items, unstructured.Unstructured{Object: item})
+	}
+	return &manifestKubectl{items: items, outputs: map[string]string{}}, nil
+}
+
+var kindShortNames = map[string]string{"deploy": "Deployment", "daemonset": "DaemonSet"}
+
+func (c *manifestKubectl) Execute(ctx context.Context, args ...string) (string, error) {
+	if len(args) != 8 || args[0] != "get" || args[4] != "-l" || args[6] != "-o" {
+		return "", fmt.Errorf("unexpected command %q", strings.Join(args, " "))
+	}
+	selector, err := labels.Parse(args[5])
+	if err != nil {
+		return "", err
+	}
+	matched := []interface{}{}
+	for _, item := range c.items {
+		if item.GetKind() == kindShortNames[args[1]] && selector.Matches(labels.Set(item.GetLabels())) {
+			matched = append(matched, item.Object)
+		}
+	}
+
+	template := strings.TrimPrefix(args[7], "jsonpath=")
+	j := jsonpath.New("args")
+	if err := j.Parse(template); err != nil {
+		return "", err
+	}
+	out := &bytes.Buffer{}
+	if err := j.Execute(out, map[string]interface{}{"items": matched}); err != nil {
+		return "", err
+	}
+	c.outputs[args[5]] = out.String()
+	return out.String(), nil
+}
+
+func (c *manifestKubectl) ExecuteOutputMatrix(ctx context.Context, args ...string) (string, string, error) {
+	stdout, err := c.Execute(ctx, args...)
+	return stdout, "", err
+}
+
+func TestParseComponentArgs(t *testing.T) {
+	// Go style flags, with a single dash.
+	args := parseComponentArgs(prometheusComponent, "-config.file=/etc/prometheus/prometheus.yml -storage.tsdb.retention=15d -log.level debug")
+	assert.Equal(t, "prometheus-log-level=debug&prometheus-retention=15d", args.AsQueryParams())
+
+	// Invalid values are ignored.
+	args = parseComponentArgs(scopeComponent, "--probe.spy.interval=soon --probe.publish.interval 3s --probe.processes=false")
+	assert.Equal(t, "scope-processes=false&scope-publish-interval=3s", args.AsQueryParams())
+
+	assert.Nil(t, parseComponentArgs(scopeComponent, "--no-app --probe.docker=true"))
+}
+
+func TestGetComponentArgs(t *testing.T) {
+	c := newTestKubectl()
+	c.responses[`get daemonset -n weave -l name=weave-scope-agent -o jsonpath={.items[*].spec.template.spec.containers[?(@.name=="agent")].args[*]}`] =
+		"--no-app --probe.docker.bridge=docker0 --probe.kubernetes.role=host"
+	c.responses[`get deploy -n weave -l name=weave-flux-agent -o jsonpath={.items[*].spec.template.spec.containers[0].args[*]}`] =
+		"--git-url=git@github.com:weaveworks/example --git-readonly"
+
+	ctx := context.Background()
+	cfg := &agentConfig{ComponentArgs: map[string]*ComponentArgs{}}
+	for _, component := range []*component{scopeComponent, fluxComponent} {
+		args, err := getComponentArgs(ctx, c, component, "weave")
+		assert.NoError(t, err)
+		cfg.ComponentArgs[component.name] = args
+	}
+	assert.Equal(t, "git-readonly=true&git-url=git%40github.com%3Aweaveworks%2Fexample"+
+		"&scope-docker-bridge=docker0&scope-kubernetes-role=host", cfg.ComponentQueryParams())
+}
+
+func TestUpdateComponentArgs(t *testing.T) {
+	c := newTestKubectl()
+	scope := `get daemonset -n weave -l name=weave-scope-agent -o jsonpath={.items[*].spec.template.spec.containers[?(@.name=="agent")].args[*]}`
+	c.responses[scope] = "--probe.docker.bridge=docker0"
+	for _, component := range []*component{prometheusComponent, fluxComponent, memcachedComponent} {
+		container := "[0]"
+		if component.container != "" {
+			container = fmt.Sprintf(`[?(@.name=="%s")]`, component.container)
+		}
+		c.responses[fmt.Sprintf("get %s -n weave -l %s -o jsonpath={.items[*].spec.template.spec.containers%s.args[*]}",
+			component.kind, component.selector, container)] = ""
+	}
+
+	ctx := context.Background()
+	cfg := &agentConfig{
+		KubectlClient: c,
+		ComponentArgs: map[string]*ComponentArgs{
+			"flux":  parseComponentArgs(fluxComponent, "--git-readonly"),
+			"scope": parseComponentArgs(scopeComponent, "--probe.kubernetes.role=host"),
+		},
+	}
+	cfg.updateComponentArgs(ctx)
+	assert.Equal(t, "scope-docker-bridge=docker0", cfg.ComponentQueryParams())
+
+	// Arguments are kept when they can't be read.
+	delete(c.responses, scope)
+	cfg.updateComponentArgs(ctx)
+	assert.Equal(t, "scope-docker-bridge=docker0", cfg.ComponentQueryParams())
+}
+
+func TestGetComponentArgsFromManifest(t *testing.T) {
+	c, err := newManifestKubectl("../integration-tests/k8s/k8s-kube-system.yaml.in")
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	cfg := &agentConfig{ComponentArgs: map[string]*ComponentArgs{}}
+	for _, component := range components {
+		args, err := getComponentArgs(ctx, c, component, "kube-system")
+		assert.NoError(t, err)
+		cfg.ComponentArgs[component.name] = args
+	}
+	assert.Equal(t, "git-branch=master&git-label=example&git-path=k8s%2Fexample&git-url=git%40github.com%3Aweaveworks%2Fexample"+
+		"&memcached-memory=64&scope-docker-bridge=docker0", cfg.ComponentQueryParams())
+
+	// Prometheus has none of the arguments preserved, but is found.
+	assert.Contains(t, c.outputs[prometheusComponent.selector], "-config.file=/etc/prometheus/prometheus.yml")
+}
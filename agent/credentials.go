@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var cloudwatchSecretErrorsNum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "launcher",
+		Subsystem: "cloudwatch",
+		Name:      "secret_errors_total",
+		Help:      "The total number of Cloudwatch deployments refused because of an invalid AWS credentials secret.",
+	}, []string{"key", "problem"})
+
+func init() {
+	prometheus.MustRegister(cloudwatchSecretErrorsNum)
+}
+
+// Keys of the AWS credentials in a Cloudwatch secret.
+const (
+	awsAccessKeyIDKey     = "access-key-id"
+	awsSecretAccessKeyKey = "secret-access-key"
+	// The session token is only there for temporary credentials.
+	awsSessionTokenKey = "session-token"
+)
+
+// Problems found in Cloudwatch secrets, as reported in metrics.
+const (
+	secretKeyMissing     = "missing"
+	secretValueEmpty     = "empty"
+	secretValueSpaces    = "whitespace"
+	secretValueMalformed = "malformed"
+)
+
+var (
+	awsAccessKeyIDRegexp     = regexp.MustCompile(`^[A-Z0-9]{16,128}$`)
+	awsSecretAccessKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9/+]{40}$`)
+	awsRoleARNRegexp         = regexp.MustCompile(`^arn:aws[a-z-]*:iam::[0-9]{12}:role/[\w+=,.@/-]{1,512}$`)
+)
+
+// Defaults of the IAM role mode, those of EKS IAM roles for service
+// accounts.
+const (
+	defaultRoleAnnotation       = "eks.amazonaws.com/role-arn"
+	defaultWebIdentityTokenFile = "/var/run/secrets/eks.amazonaws.com/serviceaccount/token"
+)
+
+// secretError is a problem with the value of key in a Cloudwatch secret. It
+// never includes the value itself.
+type secretError struct {
+	secret  string
+	key     string
+	problem string
+	detail  string
+}
+
+func (e *secretError) Error() string {
+	return fmt.Sprintf("secret %s: %s", e.secret, e.detail)
+}
+
+// validateCloudwatchSecret checks secret holds well-formed AWS credentials.
+func validateCloudwatchSecret(secret *apiv1.Secret) error {
+	newError := func(key, problem, format string, args ...interface{}) error {
+		return &secretError{
+			secret:  secret.Name,
+			key:     key,
+			problem: problem,
+			detail:  fmt.Sprintf(format, args...),
+		}
+	}
+
+	for _, key := range []string{awsAccessKeyIDKey, awsSecretAccessKeyKey} {
+		if _, ok := secret.Data[key]; !ok {
+			return newError(key, secretKeyMissing, "missing key '%s', found %s", key, secretKeys(secret))
+		}
+	}
+
+	for _, key := range []string{awsAccessKeyIDKey, awsSecretAccessKeyKey, awsSessionTokenKey} {
+		value, ok := secret.Data[key]
+		if !ok {
+			continue
+		}
+		if len(value) == 0 {
+			return newError(key, secretValueEmpty, "'%s' is empty", key)
+		}
+		if strings.TrimSpace(string(value)) != string(value) {
+			return newError(key, secretValueSpaces, "'%s' has leading or trailing whitespace", key)
+		}
+	}
+
+	if !awsAccessKeyIDRegexp.Match(secret.Data[awsAccessKeyIDKey]) {
+		return newError(awsAccessKeyIDKey, secretValueMalformed,
+			"'%s' isn't an AWS access key ID: expected 16 to 128 uppercase letters or digits", awsAccessKeyIDKey)
+	}
+	if !awsSecretAccessKeyRegexp.Match(secret.Data[awsSecretAccessKeyKey]) {
+		return newError(awsSecretAccessKeyKey, secretValueMalformed,
+			"'%s' isn't an AWS secret access key: expected 40 base64 characters", awsSecretAccessKeyKey)
+	}
+	return nil
+}
+
+// secretKeys describes the keys of secret, to spot misspelled ones.
+func secretKeys(secret *apiv1.Secret) string {
+	if len(secret.Data) == 0 {
+		return "no keys"
+	}
+	keys := []string{}
+	for key := range secret.Data {
+		keys = append(keys, fmt.Sprintf("'%s'", key))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
+
+// countSecretError records err in metrics.
+func countSecretError(err error) {
+	if e, ok := err.(*secretError); ok {
+		cloudwatchSecretErrorsNum.WithLabelValues(e.key, e.problem).Inc()
+	}
+}
+
+// cloudwatchRole has the Cloudwatch exporter assume an IAM role with a web
+// identity token, instead of using long-lived keys from a secret.
+type cloudwatchRole struct {
+	// ARN of the role to assume.
+	ARN string `json:"arn"`
+	// ServiceAccountAnnotation is the annotation of the exporter service
+	// account set to the role ARN.
+	ServiceAccountAnnotation string `json:"serviceAccountAnnotation,omitempty"`
+	// WebIdentityTokenFile is the path of the service account token
+	// projected in the exporter pod.
+	WebIdentityTokenFile string `json:"webIdentityTokenFile,omitempty"`
+}
+
+func (r *cloudwatchRole) setDefaults() {
+	if r.ServiceAccountAnnotation == "" {
+		r.ServiceAccountAnnotation = defaultRoleAnnotation
+	}
+	if r.WebIdentityTokenFile == "" {
+		r.WebIdentityTokenFile = defaultWebIdentityTokenFile
+	}
+}
+
+func (r *cloudwatchRole) validate() error {
+	if !awsRoleARNRegexp.MatchString(r.ARN) {
+		return fmt.Errorf("cloudwatch: role.arn: '%s' isn't an IAM role ARN, expected arn:aws:iam::<account>:role/<name>", r.ARN)
+	}
+	if errs := validation.IsQualifiedName(r.ServiceAccountAnnotation); len(errs) > 0 {
+		return fmt.Errorf("cloudwatch: role.serviceAccountAnnotation: invalid annotation '%s': %s",
+			r.ServiceAccountAnnotation, strings.Join(errs, ", "))
+	}
+	if !path.IsAbs(r.WebIdentityTokenFile) {
+		return fmt.Errorf("cloudwatch: role.webIdentityTokenFile: '%s' isn't an absolute path", r.WebIdentityTokenFile)
+	}
+	return nil
+}
+
+// validateAuth checks cw has exactly one way of authenticating with AWS.
+func validateAuth(cw *cloudwatch) error {
+	switch {
+	case cw.SecretName == "" && cw.Role == nil:
+		return errors.New("cloudwatch: either secretName or role must be specified")
+	case cw.SecretName != "" && cw.Role != nil:
+		return errors.New("cloudwatch: secretName and role are mutually exclusive")
+	case cw.Role != nil:
+		return cw.Role.validate()
+	}
+	return nil
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/weaveworks/launcher/pkg/kubectl"
+)
+
+var customizationsNum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "launcher",
+		Subsystem: "agent",
+		Name:      "customizations_total",
+		Help:      "The total number of customised fields of Weave Cloud workloads found when updating them, by field and result.",
+	}, []string{"field", "result"})
+
+func init() {
+	prometheus.MustRegister(customizationsNum)
+}
+
+// Fields of Weave Cloud workloads users customise.
+const (
+	replicasField     = "replicas"
+	resourcesField    = "resources"
+	nodeSelectorField = "nodeSelector"
+	tolerationsField  = "tolerations"
+	affinityField     = "affinity"
+	envField          = "env"
+)
+
+// customizableFields are the fields which may be preserved across updates.
+var customizableFields = []string{
+	replicasField, resourcesField, nodeSelectorField, tolerationsField, affinityField, envField,
+}
+
+// What happens to a customised field when updating, as reported in metrics.
+const (
+	// The customised value is carried forward.
+	customizationPreserved = "preserved"
+	// The manifest changed the field too, its value wins.
+	customizationConflict = "conflict"
+	// The field isn't in the allow-list.
+	customizationReverted = "reverted"
+)
+
+// upstreamAnnotation holds, on workloads whose customisations were
+// preserved, the replicas and pod template of the Weave Cloud manifest before
+// they were. Customisations are found against it, as the last applied
+// configuration has them.
+const upstreamAnnotation = "cloud.weave.works/upstream"
+
+// parsePreservedFields parses a comma-separated allow-list of fields.
+func parsePreservedFields(s string) (map[string]bool, error) {
+	fields := map[string]bool{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !contains(customizableFields, field) {
+			return nil, fmt.Errorf("unknown field '%s', expected any of %s", field, strings.Join(customizableFields, ", "))
+		}
+		fields[field] = true
+	}
+	return fields, nil
+}
+
+// workload is the customisable part of a Deployment, DaemonSet or
+// StatefulSet.
+type workload struct {
+	// replicas is nil for DaemonSets.
+	replicas **int32
+	template *apiv1.PodTemplateSpec
+}
+
+// upstream is the content of the upstream annotation.
+type upstream struct {
+	Replicas *int32                `json:"replicas,omitempty"`
+	Template apiv1.PodTemplateSpec `json:"template"`
+}
+
+// workloadOf returns the workload of obj, nil if it isn't one.
+func workloadOf(obj runtime.Object) *workload {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		return &workload{replicas: &o.Spec.Replicas, template: &o.Spec.Template}
+	case *appsv1.StatefulSet:
+		return &workload{replicas: &o.Spec.Replicas, template: &o.Spec.Template}
+	case *appsv1.DaemonSet:
+		return &workload{template: &o.Spec.Template}
+	}
+	return nil
+}
+
+// newWorkloadObject returns an empty object of kind, nil if it isn't a
+// workload.
+func newWorkloadObject(kind string) runtime.Object {
+	switch kind {
+	case "Deployment":
+		return &appsv1.Deployment{}
+	case "StatefulSet":
+		return &appsv1.StatefulSet{}
+	case "DaemonSet":
+		return &appsv1.DaemonSet{}
+	}
+	return nil
+}
+
+func (w *workload) container(name string) *apiv1.Container {
+	for i := range w.template.Spec.Containers {
+		if c := &w.template.Spec.Containers[i]; c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// workloadField is a field of a workload users may customise.
+type workloadField struct {
+	// name of the field in the allow-list.
+	name string
+	// path describes the field in reports, eg. the container it belongs to.
+	path string
+	// get returns the value of the field in w, false if w doesn't have it.
+	get func(w *workload) (interface{}, bool)
+	// patch sets the field of obj, a workload as found in a manifest, to a
+	// value returned by get.
+	patch func(obj map[string]interface{}, value interface{}) error
+}
+
+// workloadFields returns the customisable fields of workloads, for all their
+// containers and environment variables.
+func workloadFields(workloads ...*workload) []workloadField {
+	fields := []workloadField{
+		{
+			name: replicasField,
+			path: replicasField,
+			get: func(w *workload) (interface{}, bool) {
+				if w.replicas == nil {
+					return nil, false
+				}
+				// Replicas default to 1.
+				if *w.replicas == nil {
+					return int32(1), true
+				}
+				return **w.replicas, true
+			},
+			patch: func(obj map[string]interface{}, value interface{}) error {
+				return unstructured.SetNestedField(obj, int64(value.(int32)), "spec", "replicas")
+			},
+		},
+		{
+			name: nodeSelectorField,
+			path: nodeSelectorField,
+			get: func(w *workload) (interface{}, bool) {
+				return w.template.Spec.NodeSelector, true
+			},
+			patch: func(obj map[string]interface{}, value interface{}) error {
+				return setNestedValue(obj, value, "spec", "template", "spec", nodeSelectorField)
+			},
+		},
+		{
+			name: tolerationsField,
+			path: tolerationsField,
+			get: func(w *workload) (interface{}, bool) {
+				return w.template.Spec.Tolerations, true
+			},
+			patch: func(obj map[string]interface{}, value interface{}) error {
+				return setNestedValue(obj, value, "spec", "template", "spec", tolerationsField)
+			},
+		},
+		{
+			name: affinityField,
+			path: affinityField,
+			get: func(w *workload) (interface{}, bool) {
+				return w.template.Spec.Affinity, true
+			},
+			patch: func(obj map[string]interface{}, value interface{}) error {
+				return setNestedValue(obj, value, "spec", "template", "spec", affinityField)
+			},
+		},
+	}
+
+	containers := []string{}
+	env := map[string][]string{}
+	for _, w := range workloads {
+		for _, c := range w.template.Spec.Containers {
+			if !contains(containers, c.Name) {
+				containers = append(containers, c.Name)
+			}
+			for _, e := range c.Env {
+				if !contains(env[c.Name], e.Name) {
+					env[c.Name] = append(env[c.Name], e.Name)
+				}
+			}
+		}
+	}
+
+	for _, container := range containers {
+		container := container
+		fields = append(fields, workloadField{
+			name: resourcesField,
+			path: fmt.Sprintf("resources of container %s", container),
+			get: func(w *workload) (interface{}, bool) {
+				c := w.container(container)
+				if c == nil {
+					return nil, false
+				}
+				return c.Resources, true
+			},
+			patch: func(obj map[string]interface{}, value interface{}) error {
+				return patchContainer(obj, container, func(c map[string]interface{}) error {
+					return setNestedValue(c, value, "resources")
+				})
+			},
+		})
+
+		sort.Strings(env[container])
+		for _, name := range env[container] {
+			name := name
+			fields = append(fields, workloadField{
+				name: envField,
+				path: fmt.Sprintf("env %s of container %s", name, container),
+				// A variable missing from a container is nil, so added and
+				// removed variables are customisations too.
+				get: func(w *workload) (interface{}, bool) {
+					c := w.container(container)
+					if c == nil {
+						return nil, false
+					}
+					for _, e := range c.Env {
+						if e.Name == name {
+							return normalizeEnvVar(e), true
+						}
+					}
+					return (*apiv1.EnvVar)(nil), true
+				},
+				patch: func(obj map[string]interface{}, value interface{}) error {
+					e, err := toUnstructured(value)
+					if err != nil {
+						return err
+					}
+					return patchContainer(obj, container, func(c map[string]interface{}) error {
+						env, _, err := unstructured.NestedSlice(c, "env")
+						if err != nil {
+							return err
+						}
+						for i := range env {
+							if v, ok := env[i].(map[string]interface{}); !ok || v["name"] != name {
+								continue
+							}
+							if e == nil {
+								env = append(env[:i], env[i+1:]...)
+							} else {
+								env[i] = e
+							}
+							return unstructured.SetNestedSlice(c, env, "env")
+						}
+						if e == nil {
+							return nil
+						}
+						return unstructured.SetNestedSlice(c, append(env, e), "env")
+					})
+				},
+			})
+		}
+	}
+
+	return fields
+}
+
+// setNestedValue sets the field of obj at path to value, removing it when
+// value is nil.
+func setNestedValue(obj map[string]interface{}, value interface{}, path ...string) error {
+	v, err := toUnstructured(value)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		unstructured.RemoveNestedField(obj, path...)
+		return nil
+	}
+	return unstructured.SetNestedField(obj, v, path...)
+}
+
+// patchContainer calls f with the container named name of obj, a workload
+// as found in a manifest, and keeps the changes f makes to it.
+func patchContainer(obj map[string]interface{}, name string, f func(c map[string]interface{}) error) error {
+	path := []string{"spec", "template", "spec", "containers"}
+	containers, _, err := unstructured.NestedSlice(obj, path...)
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		if c, ok := container.(map[string]interface{}); ok && c["name"] == name {
+			if err := f(c); err != nil {
+				return err
+			}
+			return unstructured.SetNestedSlice(obj, containers, path...)
+		}
+	}
+	return fmt.Errorf("container %s not found", name)
+}
+
+// normalizeEnvVar returns a copy of e with the defaults the API server sets.
+func normalizeEnvVar(e apiv1.EnvVar) *apiv1.EnvVar {
+	e = *e.DeepCopy()
+	if e.ValueFrom != nil && e.ValueFrom.FieldRef != nil && e.ValueFrom.FieldRef.APIVersion == "" {
+		e.ValueFrom.FieldRef.APIVersion = "v1"
+	}
+	return &e
+}
+
+// Semantic equality considers nil and empty slices or maps, and quantities of
+// different formats, equal.
+func fieldValuesEqual(a, b interface{}) bool {
+	return equality.Semantic.DeepEqual(a, b)
+}
+
+// customization is a field of a workload whose live value differs from the
+// one last applied.
+type customization struct {
+	field  workloadField
+	result string
+	// value is the live value of the field, carried forward when preserved.
+	value interface{}
+}
+
+// preserveCustomizations returns the customised fields of live, those in the
+// allow-list are to be carried forward into manifest unless the manifest
+// changed them too. Customisations are found against baseline, the workload
+// last applied before being customised.
+func preserveCustomizations(live, baseline, manifest *workload, allowed map[string]bool) []customization {
+	customizations := []customization{}
+	for _, field := range workloadFields(live, baseline, manifest) {
+		liveValue, ok := field.get(live)
+		if !ok {
+			continue
+		}
+		baselineValue, ok := field.get(baseline)
+		if !ok {
+			continue
+		}
+		manifestValue, ok := field.get(manifest)
+		if !ok {
+			continue
+		}
+		if fieldValuesEqual(liveValue, baselineValue) {
+			continue
+		}
+
+		result := customizationPreserved
+		switch {
+		case !allowed[field.name]:
+			result = customizationReverted
+		case !fieldValuesEqual(manifestValue, baselineValue):
+			result = customizationConflict
+		}
+		customizations = append(customizations, customization{field: field, result: result, value: liveValue})
+	}
+	return customizations
+}
+
+// baselineOf returns the workload live was last applied with, before any
+// customisation was preserved, nil when it wasn't applied with kubectl apply.
+func baselineOf(live metav1.Object, kind string) (*workload, error) {
+	if data, ok := live.GetAnnotations()[upstreamAnnotation]; ok {
+		u := &upstream{}
+		if err := json.Unmarshal([]byte(data), u); err != nil {
+			return nil, fmt.Errorf("annotation %s: %v", upstreamAnnotation, err)
+		}
+		w := &workload{template: &u.Template}
+		if kind != "DaemonSet" {
+			w.replicas = &u.Replicas
+		}
+		return w, nil
+	}
+
+	data, ok := live.GetAnnotations()[apiv1.LastAppliedConfigAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	obj := newWorkloadObject(kind)
+	if err := json.Unmarshal([]byte(data), obj); err != nil {
+		return nil, fmt.Errorf("annotation %s: %v", apiv1.LastAppliedConfigAnnotation, err)
+	}
+	return workloadOf(obj), nil
+}
+
+// getWorkload returns the live workload of kind namespace/name, nil if it
+// doesn't exist.
+func (cfg *agentConfig) getWorkload(ctx context.Context, kind, namespace, name string) (runtime.Object, error) {
+	var obj runtime.Object
+	var err error
+	apps := cfg.KubeClient.AppsV1()
+	switch kind {
+	case "Deployment":
+		obj, err = apps.Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	case "StatefulSet":
+		obj, err = apps.StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	case "DaemonSet":
+		obj, err = apps.DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return obj, err
+}
+
+// preserveObjectCustomizations carries the customisations of the live
+// workload of obj, a manifest object, forward into it.
+func (cfg *agentConfig) preserveObjectCustomizations(ctx context.Context, obj *unstructured.Unstructured) error {
+	manifestObj := newWorkloadObject(obj.GetKind())
+	if manifestObj == nil {
+		return nil
+	}
+	namespace := obj.GetNamespace()
+	if namespace == "" {
+		namespace = "weave"
+	}
+	var live runtime.Object
+	err := withTimeout(ctx, cfg.APITimeout, func(ctx context.Context) error {
+		var err error
+		live, err = cfg.getWorkload(ctx, obj.GetKind(), namespace, obj.GetName())
+		return err
+	})
+	if err != nil || live == nil {
+		return err
+	}
+	liveMeta := live.(metav1.Object)
+	baseline, err := baselineOf(liveMeta, obj.GetKind())
+	if err != nil || baseline == nil {
+		return err
+	}
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, manifestObj); err != nil {
+		return err
+	}
+	manifest := workloadOf(manifestObj)
+	up := upstream{Template: *manifest.template.DeepCopy()}
+	if manifest.replicas != nil && *manifest.replicas != nil {
+		replicas := **manifest.replicas
+		up.Replicas = &replicas
+	}
+
+	// Only the preserved fields are patched into obj, the rest of the
+	// manifest is applied as is.
+	patched := obj.DeepCopy()
+	preserved := false
+	for _, c := range preserveCustomizations(workloadOf(live), baseline, manifest, cfg.PreservedFields) {
+		customizationsNum.WithLabelValues(c.field.name, c.result).Inc()
+		what := fmt.Sprintf("%s %s/%s", obj.GetKind(), namespace, obj.GetName())
+		switch c.result {
+		case customizationPreserved:
+			if err := c.field.patch(patched.Object, c.value); err != nil {
+				return fmt.Errorf("%s: %v", c.field.path, err)
+			}
+			preserved = true
+			log.Infof("Preserving the customised %s of %s", c.field.path, what)
+			cfg.recordEvent(live, apiv1.EventTypeNormal, "CustomizationPreserved",
+				"Preserved the customised %s", c.field.path)
+		case customizationConflict:
+			log.Warnf("The customised %s of %s conflicts with a change of the Weave Cloud manifest, reverting it", c.field.path, what)
+			cfg.recordEvent(live, apiv1.EventTypeWarning, "CustomizationConflict",
+				"Reverted the customised %s, changed by the Weave Cloud manifest", c.field.path)
+		case customizationReverted:
+			log.Warnf("The customised %s of %s isn't preserved, reverting it", c.field.path, what)
+			cfg.recordEvent(live, apiv1.EventTypeWarning, "CustomizationReverted",
+				"Reverted the customised %s, %s isn't preserved", c.field.path, c.field.name)
+		}
+	}
+	if !preserved {
+		return nil
+	}
+
+	data, err := json.Marshal(up)
+	if err != nil {
+		return err
+	}
+	annotations := patched.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[upstreamAnnotation] = string(data)
+	patched.SetAnnotations(annotations)
+	obj.Object = patched.Object
+	return nil
+}
+
+func (cfg *agentConfig) recordEvent(obj runtime.Object, eventType, reason, format string, args ...interface{}) {
+	if cfg.Recorder != nil {
+		cfg.Recorder.Eventf(obj, eventType, reason, format, args...)
+	}
+}
+
+// fetchManifest returns the objects of the manifest at url, Lists flattened.
+func fetchManifest(ctx context.Context, url string) ([]*unstructured.Unstructured, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	objects := []*unstructured.Unstructured{}
+	decoder := yaml.NewYAMLOrJSONDecoder(resp.Body, 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		if err := decoder.Decode(&obj.Object); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+		if !obj.IsList() {
+			objects = append(objects, obj)
+			continue
+		}
+		err := obj.EachListItem(func(item runtime.Object) error {
+			objects = append(objects, item.(*unstructured.Unstructured))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+// applyPreservingCustomizations applies the manifest at url, carrying the
+// customisations of the workloads it updates forward.
+func (cfg *agentConfig) applyPreservingCustomizations(ctx context.Context, url string) error {
+	var objects []*unstructured.Unstructured
+	err := withTimeout(ctx, cfg.APITimeout, func(ctx context.Context) error {
+		var err error
+		objects, err = fetchManifest(ctx, url)
+		return err
+	})
+	if err != nil {
+		logError("Failed to fetch WC manifest, customisations aren't preserved", err, cfg)
+		return cfg.apply(ctx, url)
+	}
+
+	items := []interface{}{}
+	for _, obj := range objects {
+		if err := cfg.preserveObjectCustomizations(ctx, obj); err != nil {
+			log.Errorf("Failed to preserve the customisations of %s %s: %v", obj.GetKind(), obj.GetName(), err)
+		}
+		items = append(items, obj.Object)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"items":      items,
+	})
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "weave-cloud-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return withTimeout(ctx, cfg.KubectlTimeout, func(ctx context.Context) error {
+		return kubectl.Apply(ctx, cfg.KubectlClient, f.Name())
+	})
+}
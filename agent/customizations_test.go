@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestParsePreservedFields(t *testing.T) {
+	fields, err := parsePreservedFields("replicas, env,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"replicas": true, "env": true}, fields)
+
+	fields, err = parsePreservedFields("")
+	assert.NoError(t, err)
+	assert.Empty(t, fields)
+
+	_, err = parsePreservedFields("replicas,image")
+	assert.Error(t, err)
+}
+
+func int32Ptr(i int32) *int32 { return &i }
+
+// testFluxDeployment is a Weave Cloud workload as found in its manifest.
+func testFluxDeployment(debug string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "weave", Name: "weave-flux-agent"},
+		Spec: appsv1.DeploymentSpec{
+			Template: apiv1.PodTemplateSpec{
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{{
+						Name:  "flux",
+						Image: "docker.io/fluxcd/flux:1.4.0",
+						Resources: apiv1.ResourceRequirements{
+							Requests: apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse("50m")},
+						},
+						Env: []apiv1.EnvVar{{Name: "DEBUG", Value: debug}},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// liveDeployment returns the live object of the manifest d was applied from.
+func liveDeployment(t *testing.T, d *appsv1.Deployment) *appsv1.Deployment {
+	data, err := json.Marshal(d)
+	assert.NoError(t, err)
+	live := d.DeepCopy()
+	live.Annotations = map[string]string{apiv1.LastAppliedConfigAnnotation: string(data)}
+	return live
+}
+
+// manifestObject returns obj as decoded from a manifest.
+func manifestObject(t *testing.T, obj runtime.Object) *unstructured.Unstructured {
+	data, err := toUnstructured(obj)
+	assert.NoError(t, err)
+	return &unstructured.Unstructured{Object: data.(map[string]interface{})}
+}
+
+func TestPreserveCustomizations(t *testing.T) {
+	live := liveDeployment(t, testFluxDeployment("false"))
+	live.Spec.Replicas = int32Ptr(2)
+	live.Spec.Template.Spec.Containers[0].Resources.Limits = apiv1.ResourceList{apiv1.ResourceMemory: resource.MustParse("1Gi")}
+	live.Spec.Template.Spec.Containers[0].Env = []apiv1.EnvVar{
+		{Name: "DEBUG", Value: "true"},
+		{Name: "HTTP_PROXY", Value: "http://proxy:3128"},
+	}
+	live.Spec.Template.Spec.NodeSelector = map[string]string{"pool": "infra"}
+
+	recorder := record.NewFakeRecorder(10)
+	cfg := &agentConfig{
+		APITimeout:      time.Minute,
+		KubeClient:      fake.NewSimpleClientset(live),
+		Recorder:        recorder,
+		PreservedFields: map[string]bool{"replicas": true, "resources": true, "env": true},
+	}
+	update := func(manifest *appsv1.Deployment) *appsv1.Deployment {
+		obj := manifestObject(t, manifest)
+		assert.NoError(t, cfg.preserveObjectCustomizations(context.Background(), obj))
+		d := &appsv1.Deployment{}
+		assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, d))
+		return d
+	}
+	events := func() []string {
+		e := []string{}
+		for len(recorder.Events) > 0 {
+			e = append(e, <-recorder.Events)
+		}
+		return e
+	}
+
+	// The manifest changed DEBUG too.
+	d := update(testFluxDeployment("1"))
+	assert.Equal(t, int32(2), *d.Spec.Replicas)
+	assert.Equal(t, "1Gi", d.Spec.Template.Spec.Containers[0].Resources.Limits.Memory().String())
+	assert.Equal(t, []apiv1.EnvVar{
+		{Name: "DEBUG", Value: "1"},
+		{Name: "HTTP_PROXY", Value: "http://proxy:3128"},
+	}, d.Spec.Template.Spec.Containers[0].Env)
+	assert.Empty(t, d.Spec.Template.Spec.NodeSelector)
+	assert.Equal(t, []string{
+		"Normal CustomizationPreserved Preserved the customised replicas",
+		"Warning CustomizationReverted Reverted the customised nodeSelector, nodeSelector isn't preserved",
+		"Normal CustomizationPreserved Preserved the customised resources of container flux",
+		"Warning CustomizationConflict Reverted the customised env DEBUG of container flux, changed by the Weave Cloud manifest",
+		"Normal CustomizationPreserved Preserved the customised env HTTP_PROXY of container flux",
+	}, events())
+
+	// Once applied, customisations are found against the manifest before they
+	// were preserved.
+	upstream := d.Annotations[upstreamAnnotation]
+	assert.NotEmpty(t, upstream)
+	live = liveDeployment(t, d)
+	live.Annotations[upstreamAnnotation] = upstream
+	cfg.KubeClient = fake.NewSimpleClientset(live)
+	d = update(testFluxDeployment("1"))
+	assert.Equal(t, int32(2), *d.Spec.Replicas)
+	assert.Equal(t, upstream, d.Annotations[upstreamAnnotation])
+	assert.Len(t, events(), 3)
+
+	// Until the manifest changes them.
+	manifest := testFluxDeployment("1")
+	manifest.Spec.Replicas = int32Ptr(3)
+	d = update(manifest)
+	assert.Equal(t, int32(3), *d.Spec.Replicas)
+	assert.Len(t, d.Spec.Template.Spec.Containers[0].Env, 2)
+	assert.Contains(t, events(), "Warning CustomizationConflict Reverted the customised replicas, changed by the Weave Cloud manifest")
+
+	// Workloads without customisations are left untouched.
+	cfg.KubeClient = fake.NewSimpleClientset(liveDeployment(t, testFluxDeployment("false")))
+	obj := manifestObject(t, testFluxDeployment("false"))
+	expected := obj.DeepCopy()
+	assert.NoError(t, cfg.preserveObjectCustomizations(context.Background(), obj))
+	assert.Equal(t, expected, obj)
+	assert.Empty(t, events())
+}
+
+func TestPreserveCustomizationsQuantities(t *testing.T) {
+	manifest := testFluxDeployment("false")
+	live := liveDeployment(t, manifest)
+	live.Spec.Template.Spec.Containers[0].Resources.Requests[apiv1.ResourceCPU] = resource.MustParse("0.05")
+
+	m := manifest.DeepCopy()
+	baseline, err := baselineOf(live, "Deployment")
+	assert.NoError(t, err)
+	assert.Empty(t, preserveCustomizations(workloadOf(live), baseline, workloadOf(m), map[string]bool{}))
+}
+
+const testManifest = `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ServiceAccount
+  metadata:
+    name: weave-flux
+    namespace: weave
+- apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: weave-flux-agent
+    namespace: weave
+---
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: weave-scope-agent
+  namespace: weave
+---
+`
+
+func TestFetchManifest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/k8s.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, testManifest)
+	}))
+	defer server.Close()
+
+	objects, err := fetchManifest(context.Background(), server.URL+"/k8s.yaml")
+	assert.NoError(t, err)
+	names := []string{}
+	for _, obj := range objects {
+		names = append(names, obj.GetKind()+" "+obj.GetName())
+	}
+	assert.Equal(t, []string{
+		"ServiceAccount weave-flux",
+		"Deployment weave-flux-agent",
+		"DaemonSet weave-scope-agent",
+	}, names)
+
+	_, err = fetchManifest(context.Background(), server.URL+"/missing.yaml")
+	assert.Error(t, err)
+}
+
+// applyKubectl records the objects of the manifest files applied.
+type applyKubectl struct {
+	applied []map[string]interface{}
+}
+
+func (c *applyKubectl) Execute(ctx context.Context, args ...string) (string, error) {
+	if len(args) != 3 || args[0] != "apply" || args[1] != "-f" {
+		return "", fmt.Errorf("unexpected command %q", strings.Join(args, " "))
+	}
+	data, err := ioutil.ReadFile(args[2])
+	if err != nil {
+		return "", err
+	}
+	list := struct {
+		Items []map[string]interface{} `json:"items"`
+	}{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return "", err
+	}
+	c.applied = list.Items
+	return "", nil
+}
+
+func (c *applyKubectl) ExecuteOutputMatrix(ctx context.Context, args ...string) (string, string, error) {
+	stdout, err := c.Execute(ctx, args...)
+	return stdout, "", err
+}
+
+const testFluxManifest = `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ServiceAccount
+  metadata:
+    name: weave-flux
+    namespace: weave
+- apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: weave-flux-agent
+    namespace: weave
+  spec:
+    template:
+      spec:
+        containers:
+        - name: flux
+          image: docker.io/fluxcd/flux:1.4.0
+          resources:
+            requests:
+              cpu: 50m
+          env:
+          - name: DEBUG
+            value: "false"
+          futureField: kept
+`
+
+func TestApplyPreservingCustomizations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testFluxManifest)
+	}))
+	defer server.Close()
+
+	live := liveDeployment(t, testFluxDeployment("false"))
+	live.Spec.Replicas = int32Ptr(2)
+	live.Spec.Template.Spec.Containers[0].Env = append(live.Spec.Template.Spec.Containers[0].Env,
+		apiv1.EnvVar{Name: "HTTP_PROXY", Value: "http://proxy:3128"})
+	c := &applyKubectl{}
+	cfg := &agentConfig{
+		APITimeout:      time.Minute,
+		KubectlTimeout:  time.Minute,
+		KubeClient:      fake.NewSimpleClientset(live),
+		KubectlClient:   c,
+		PreservedFields: map[string]bool{"replicas": true, "env": true},
+	}
+
+	assert.NoError(t, cfg.applyPreservingCustomizations(context.Background(), server.URL))
+	if !assert.Len(t, c.applied, 2) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ServiceAccount",
+		"metadata":   map[string]interface{}{"name": "weave-flux", "namespace": "weave"},
+	}, c.applied[0])
+
+	// The customisations are patched in, the rest of the manifest is left
+	// as is.
+	d := c.applied[1]
+	assert.NotContains(t, d, "status")
+	assert.NotContains(t, d["metadata"], "creationTimestamp")
+	assert.NotEmpty(t, d["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})[upstreamAnnotation])
+	assert.Equal(t, float64(2), d["spec"].(map[string]interface{})["replicas"])
+	assert.NotContains(t, d["spec"], "strategy")
+	container := d["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})[0]
+	assert.Equal(t, map[string]interface{}{
+		"name":  "flux",
+		"image": "docker.io/fluxcd/flux:1.4.0",
+		"resources": map[string]interface{}{
+			"requests": map[string]interface{}{"cpu": "50m"},
+		},
+		"env": []interface{}{
+			map[string]interface{}{"name": "DEBUG", "value": "false"},
+			map[string]interface{}{"name": "HTTP_PROXY", "value": "http://proxy:3128"},
+		},
+		"futureField": "kept",
+	}, container)
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/weaveworks/launcher/pkg/text"
+	"github.com/weaveworks/launcher/pkg/weavecloud"
+)
+
+var deployKeyOperationsNum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "launcher",
+		Subsystem: "flux",
+		Name:      "deploy_key_operations_total",
+		Help:      "The total number of changes made to the Flux deploy keys, by operation.",
+	}, []string{"operation"})
+
+func init() {
+	prometheus.MustRegister(deployKeyOperationsNum)
+}
+
+// Changes made to the Flux deploy keys, as reported in metrics.
+const (
+	deployKeyCreated   = "created"
+	deployKeyScheduled = "scheduled"
+	deployKeyRotated   = "rotated"
+)
+
+const (
+	// fluxDeploySecret is the secret Flux reads its SSH identity from.
+	fluxDeploySecret = "flux-git-deploy"
+
+	// Keys of the flux deploy secret. Flux only reads identity, the next key
+	// is kept alongside until it's authorised.
+	identityKey        = "identity"
+	identityPubKey     = "identity.pub"
+	nextIdentityKey    = "next-identity"
+	nextIdentityPubKey = "next-identity.pub"
+
+	// deployKeyCreatedAnnotation marks the deploy keys managed by the agent
+	// with the time the identity was activated.
+	deployKeyCreatedAnnotation = "flux.weave.works/deploy-key-created"
+	// nextDeployKeyCreatedAnnotation holds the time the next key was created.
+	nextDeployKeyCreatedAnnotation = "flux.weave.works/next-deploy-key-created"
+	// nextDeployKeyAuthorisedAnnotation is set by users, to the fingerprint
+	// of the next key, once they authorised it on the git host. The next key
+	// replaces the identity then.
+	nextDeployKeyAuthorisedAnnotation = "flux.weave.works/next-deploy-key-authorised"
+
+	defaultDeployKeyBits = 4096
+	// deployKeyCheckInterval is how often the deploy keys are checked for
+	// rotation.
+	deployKeyCheckInterval = 10 * time.Minute
+	// deployKeyMaxBackoff is the longest we wait before syncing the deploy
+	// keys again after failures.
+	deployKeyMaxBackoff = time.Hour
+)
+
+// deployKeyManager creates the SSH key pair Flux accesses its git repository
+// with, and rotates it every rotationInterval. A rotation first publishes the
+// next key while Flux keeps using the current one, so it can be authorised on
+// the git host, then swaps them in a single update of the secret once users
+// confirm it was. Users are warned when the next key is still waiting after
+// gracePeriod.
+type deployKeyManager struct {
+	cfg              *agentConfig
+	namespace        string
+	rotationInterval time.Duration
+	gracePeriod      time.Duration
+	bits             int
+	// reportURLTemplate is the Weave Cloud URL the public keys are reported
+	// to, they aren't when empty.
+	reportURLTemplate string
+	now               func() time.Time
+
+	lock sync.RWMutex
+	// keys are the public keys last published, reported holds whether Weave
+	// Cloud knows about them.
+	keys     []weavecloud.DeployKey
+	reported bool
+	// overdue is the fingerprint of the next key users were last warned
+	// about.
+	overdue string
+}
+
+func newDeployKeyManager(cfg *agentConfig, rotationInterval, gracePeriod time.Duration) *deployKeyManager {
+	return &deployKeyManager{
+		cfg:              cfg,
+		namespace:        "weave",
+		rotationInterval: rotationInterval,
+		gracePeriod:      gracePeriod,
+		bits:             defaultDeployKeyBits,
+		now:              time.Now,
+	}
+}
+
+// Run syncs the deploy keys every interval until ctx is done. Failed syncs
+// are retried, backing off up to deployKeyMaxBackoff.
+func (m *deployKeyManager) Run(ctx context.Context, interval time.Duration) {
+	backoff := interval
+	for {
+		wait := interval
+		if err := m.sync(ctx); err != nil {
+			wait = backoff
+			log.Warnf("Failed to sync the Flux deploy keys, retrying in %s: %v", wait, err)
+			backoff *= 2
+			if backoff > deployKeyMaxBackoff {
+				backoff = deployKeyMaxBackoff
+			}
+		} else {
+			backoff = interval
+		}
+
+		select {
+		case <-time.After(wait):
+			continue
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sync creates or rotates the deploy keys as needed, and publishes them.
+func (m *deployKeyManager) sync(ctx context.Context) error {
+	secrets := m.cfg.KubeClient.CoreV1().Secrets(m.namespace)
+
+	var secret *apiv1.Secret
+	create := false
+	err := withTimeout(ctx, m.cfg.APITimeout, func(ctx context.Context) error {
+		var err error
+		secret, err = secrets.Get(ctx, fluxDeploySecret, metav1.GetOptions{})
+		return err
+	})
+	if apierrors.IsNotFound(err) {
+		create = true
+		secret = &apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: m.namespace, Name: fluxDeploySecret},
+			Type:       apiv1.SecretTypeOpaque,
+		}
+	} else if err != nil {
+		return err
+	}
+
+	updated := secret.DeepCopy()
+	operation, err := m.update(updated)
+	if err != nil {
+		return err
+	}
+	if operation != "" {
+		// The resource version of secret makes the update fail, rather than
+		// overwrite it, if it changed since.
+		err := withTimeout(ctx, m.cfg.APITimeout, func(ctx context.Context) error {
+			var err error
+			if create {
+				updated, err = secrets.Create(ctx, updated, metav1.CreateOptions{})
+			} else {
+				updated, err = secrets.Update(ctx, updated, metav1.UpdateOptions{})
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		m.record(updated, operation)
+	}
+
+	keys, err := publicDeployKeys(updated)
+	if err != nil {
+		return err
+	}
+	m.warnOverdue(updated, keys)
+	return m.publish(ctx, keys)
+}
+
+// update changes secret, returning the operation made, empty when none is.
+// Secrets holding an identity not created by the agent are left alone.
+func (m *deployKeyManager) update(secret *apiv1.Secret) (string, error) {
+	now := m.now().UTC()
+	annotations := secret.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	_, managed := annotations[deployKeyCreatedAnnotation]
+	if !managed && len(secret.Data[identityKey]) > 0 {
+		return "", nil
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	defer secret.SetAnnotations(annotations)
+
+	if !managed {
+		private, public, err := generateDeployKey(m.bits)
+		if err != nil {
+			return "", err
+		}
+		secret.Data[identityKey] = private
+		secret.Data[identityPubKey] = public
+		annotations[deployKeyCreatedAnnotation] = now.Format(time.RFC3339)
+		return deployKeyCreated, nil
+	}
+
+	if _, ok := secret.Data[nextIdentityKey]; ok {
+		authorised, ok := annotations[nextDeployKeyAuthorisedAnnotation]
+		if !ok {
+			return "", nil
+		}
+		next, err := publicDeployKey(secret.Data[nextIdentityKey], weavecloud.DeployKeyPending, now)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %s: %v", secret.Name, nextIdentityKey, err)
+		}
+		if strings.TrimSpace(authorised) != next.Fingerprint {
+			log.Warnf("The Flux deploy key authorised, %s, isn't the next one, %s", authorised, next.Fingerprint)
+			return "", nil
+		}
+		secret.Data[identityKey] = secret.Data[nextIdentityKey]
+		secret.Data[identityPubKey] = secret.Data[nextIdentityPubKey]
+		delete(secret.Data, nextIdentityKey)
+		delete(secret.Data, nextIdentityPubKey)
+		annotations[deployKeyCreatedAnnotation] = now.Format(time.RFC3339)
+		delete(annotations, nextDeployKeyCreatedAnnotation)
+		delete(annotations, nextDeployKeyAuthorisedAnnotation)
+		return deployKeyRotated, nil
+	}
+
+	if m.rotationInterval == 0 {
+		return "", nil
+	}
+	created, err := time.Parse(time.RFC3339, annotations[deployKeyCreatedAnnotation])
+	if err != nil {
+		return "", fmt.Errorf("annotation %s: %v", deployKeyCreatedAnnotation, err)
+	}
+	if now.Sub(created) < m.rotationInterval {
+		return "", nil
+	}
+	private, public, err := generateDeployKey(m.bits)
+	if err != nil {
+		return "", err
+	}
+	secret.Data[nextIdentityKey] = private
+	secret.Data[nextIdentityPubKey] = public
+	annotations[nextDeployKeyCreatedAnnotation] = now.Format(time.RFC3339)
+	return deployKeyScheduled, nil
+}
+
+func (m *deployKeyManager) record(secret *apiv1.Secret, operation string) {
+	deployKeyOperationsNum.WithLabelValues(operation).Inc()
+	switch operation {
+	case deployKeyCreated:
+		log.Info("Created the Flux deploy key")
+		m.cfg.recordEvent(secret, apiv1.EventTypeNormal, "DeployKeyCreated", "Created the Flux deploy key")
+	case deployKeyScheduled:
+		next, err := publicDeployKey(secret.Data[nextIdentityKey], weavecloud.DeployKeyPending, time.Time{})
+		if err != nil {
+			return
+		}
+		log.Infof("Created the next Flux deploy key %s, it replaces the current one once authorised", next.Fingerprint)
+		m.cfg.recordEvent(secret, apiv1.EventTypeNormal, "DeployKeyScheduled",
+			"Created the next Flux deploy key, authorise it on the git host then annotate this secret with %s=%s",
+			nextDeployKeyAuthorisedAnnotation, next.Fingerprint)
+	case deployKeyRotated:
+		log.Info("Rotated the Flux deploy key")
+		m.cfg.recordEvent(secret, apiv1.EventTypeNormal, "DeployKeyRotated", "Rotated the Flux deploy key")
+	}
+}
+
+// warnOverdue warns users, once, when the next key of secret is still to be
+// authorised after the grace period.
+func (m *deployKeyManager) warnOverdue(secret *apiv1.Secret, keys []weavecloud.DeployKey) {
+	if len(keys) < 2 {
+		return
+	}
+	next := keys[1]
+	if m.now().Sub(next.CreatedAt) < m.gracePeriod || m.overdue == next.Fingerprint {
+		return
+	}
+	m.overdue = next.Fingerprint
+	log.Warnf("The next Flux deploy key %s is still to be authorised", next.Fingerprint)
+	m.cfg.recordEvent(secret, apiv1.EventTypeWarning, "DeployKeyNotAuthorised",
+		"The next Flux deploy key is still to be authorised, annotate this secret with %s=%s once it is",
+		nextDeployKeyAuthorisedAnnotation, next.Fingerprint)
+}
+
+// publish serves keys and reports them to Weave Cloud, unless it already knows
+// about them.
+func (m *deployKeyManager) publish(ctx context.Context, keys []weavecloud.DeployKey) error {
+	m.lock.Lock()
+	if !reflect.DeepEqual(m.keys, keys) {
+		m.keys = keys
+		m.reported = false
+	}
+	reported := m.reported
+	m.lock.Unlock()
+
+	if reported || m.reportURLTemplate == "" {
+		return nil
+	}
+	reportURL, err := text.ResolveString(m.reportURLTemplate, m.cfg)
+	if err != nil {
+		return err
+	}
+	err = withTimeout(ctx, m.cfg.APITimeout, func(ctx context.Context) error {
+		return weavecloud.UpdateDeployKeys(ctx, reportURL, m.cfg.Token, keys)
+	})
+	if err != nil {
+		return fmt.Errorf("report to Weave Cloud: %v", err)
+	}
+
+	m.lock.Lock()
+	if reflect.DeepEqual(m.keys, keys) {
+		m.reported = true
+	}
+	m.lock.Unlock()
+	return nil
+}
+
+// ServeHTTP serves the public deploy keys.
+func (m *deployKeyManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lock.RLock()
+	keys := m.keys
+	m.lock.RUnlock()
+	if keys == nil {
+		keys = []weavecloud.DeployKey{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(keys); err != nil {
+		log.Errorf("Failed to serve the Flux deploy keys: %v", err)
+	}
+}
+
+// generateDeployKey returns a new RSA key pair, the private key PEM encoded
+// and the public key in the authorized_keys format.
+func generateDeployKey(bits int) ([]byte, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	public, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	private := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	return private, ssh.MarshalAuthorizedKey(public), nil
+}
+
+// publicDeployKeys returns the public keys of the identities in secret.
+func publicDeployKeys(secret *apiv1.Secret) ([]weavecloud.DeployKey, error) {
+	keys := []weavecloud.DeployKey{}
+	if len(secret.Data[identityKey]) == 0 {
+		return keys, nil
+	}
+
+	// Identities not created by the agent only have their private key.
+	created := secret.CreationTimestamp.UTC()
+	if t, err := time.Parse(time.RFC3339, secret.Annotations[deployKeyCreatedAnnotation]); err == nil {
+		created = t
+	}
+	key, err := publicDeployKey(secret.Data[identityKey], weavecloud.DeployKeyActive, created)
+	if err != nil {
+		return nil, fmt.Errorf("secret %s: %s: %v", secret.Name, identityKey, err)
+	}
+	keys = append(keys, key)
+
+	if len(secret.Data[nextIdentityKey]) == 0 {
+		return keys, nil
+	}
+	created, err = time.Parse(time.RFC3339, secret.Annotations[nextDeployKeyCreatedAnnotation])
+	if err != nil {
+		return nil, fmt.Errorf("annotation %s: %v", nextDeployKeyCreatedAnnotation, err)
+	}
+	key, err = publicDeployKey(secret.Data[nextIdentityKey], weavecloud.DeployKeyPending, created)
+	if err != nil {
+		return nil, fmt.Errorf("secret %s: %s: %v", secret.Name, nextIdentityKey, err)
+	}
+	return append(keys, key), nil
+}
+
+func publicDeployKey(private []byte, state string, created time.Time) (weavecloud.DeployKey, error) {
+	signer, err := ssh.ParsePrivateKey(private)
+	if err != nil {
+		return weavecloud.DeployKey{}, err
+	}
+	return weavecloud.DeployKey{
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		Fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+		State:       state,
+		CreatedAt:   created,
+	}, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/weaveworks/launcher/pkg/weavecloud"
+)
+
+func TestGenerateDeployKey(t *testing.T) {
+	private, public, err := generateDeployKey(1024)
+	assert.NoError(t, err)
+
+	signer, err := ssh.ParsePrivateKey(private)
+	assert.NoError(t, err)
+	key, _, _, _, err := ssh.ParseAuthorizedKey(public)
+	assert.NoError(t, err)
+	assert.Equal(t, signer.PublicKey().Marshal(), key.Marshal())
+}
+
+func TestDeployKeyRotation(t *testing.T) {
+	now := time.Date(2018, 1, 11, 0, 0, 0, 0, time.UTC)
+	recorder := record.NewFakeRecorder(10)
+	cfg := &agentConfig{
+		APITimeout: time.Minute,
+		KubeClient: fake.NewSimpleClientset(),
+		Recorder:   recorder,
+	}
+	m := newDeployKeyManager(cfg, 30*24*time.Hour, 24*time.Hour)
+	m.bits = 1024
+	m.now = func() time.Time { return now }
+	ctx := context.Background()
+	getSecret := func() *apiv1.Secret {
+		secret, err := cfg.KubeClient.CoreV1().Secrets("weave").Get(ctx, fluxDeploySecret, metav1.GetOptions{})
+		assert.NoError(t, err)
+		return secret
+	}
+	served := func() []weavecloud.DeployKey {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/flux/deploy-keys", nil))
+		keys := []weavecloud.DeployKey{}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&keys))
+		return keys
+	}
+
+	// Created.
+	assert.NoError(t, m.sync(ctx))
+	secret := getSecret()
+	identity := secret.Data[identityKey]
+	assert.NotEmpty(t, identity)
+	assert.Equal(t, "2018-01-11T00:00:00Z", secret.Annotations[deployKeyCreatedAnnotation])
+	assert.Equal(t, "Normal DeployKeyCreated Created the Flux deploy key", <-recorder.Events)
+	keys := served()
+	if assert.Len(t, keys, 1) {
+		assert.Equal(t, weavecloud.DeployKeyActive, keys[0].State)
+		assert.Equal(t, string(secret.Data[identityPubKey]), keys[0].PublicKey+"\n")
+	}
+
+	// Nothing to do until the key is due for rotation.
+	now = now.Add(29 * 24 * time.Hour)
+	assert.NoError(t, m.sync(ctx))
+	assert.Equal(t, identity, getSecret().Data[identityKey])
+	assert.Empty(t, recorder.Events)
+
+	// Then the next key is published, Flux keeps the current one.
+	now = now.Add(24 * time.Hour)
+	assert.NoError(t, m.sync(ctx))
+	secret = getSecret()
+	assert.Equal(t, identity, secret.Data[identityKey])
+	next := secret.Data[nextIdentityKey]
+	assert.NotEmpty(t, next)
+	keys = served()
+	if assert.Len(t, keys, 2) {
+		assert.Equal(t, weavecloud.DeployKeyPending, keys[1].State)
+		assert.Equal(t, now, keys[1].CreatedAt)
+	}
+	fingerprint := keys[1].Fingerprint
+	assert.Equal(t, "Normal DeployKeyScheduled Created the next Flux deploy key, authorise it on the git host "+
+		"then annotate this secret with flux.weave.works/next-deploy-key-authorised="+fingerprint, <-recorder.Events)
+
+	// It isn't activated when the grace period ends, users are warned once.
+	now = now.Add(24 * time.Hour)
+	assert.NoError(t, m.sync(ctx))
+	assert.NoError(t, m.sync(ctx))
+	assert.Equal(t, identity, getSecret().Data[identityKey])
+	assert.Equal(t, "Warning DeployKeyNotAuthorised The next Flux deploy key is still to be authorised, "+
+		"annotate this secret with flux.weave.works/next-deploy-key-authorised="+fingerprint+" once it is", <-recorder.Events)
+	assert.Empty(t, recorder.Events)
+
+	// Nor when another key is authorised.
+	authorise := func(fingerprint string) {
+		secret := getSecret()
+		secret.Annotations[nextDeployKeyAuthorisedAnnotation] = fingerprint
+		_, err := cfg.KubeClient.CoreV1().Secrets("weave").Update(ctx, secret, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+	}
+	authorise(keys[0].Fingerprint)
+	assert.NoError(t, m.sync(ctx))
+	assert.Equal(t, identity, getSecret().Data[identityKey])
+	assert.Empty(t, recorder.Events)
+
+	// It replaces the current one once authorised.
+	authorise(fingerprint)
+	now = now.Add(time.Hour)
+	assert.NoError(t, m.sync(ctx))
+	secret = getSecret()
+	assert.Equal(t, next, secret.Data[identityKey])
+	assert.NotContains(t, secret.Data, nextIdentityKey)
+	assert.NotContains(t, secret.Annotations, nextDeployKeyCreatedAnnotation)
+	assert.NotContains(t, secret.Annotations, nextDeployKeyAuthorisedAnnotation)
+	assert.Equal(t, "2018-02-11T01:00:00Z", secret.Annotations[deployKeyCreatedAnnotation])
+	assert.Equal(t, "Normal DeployKeyRotated Rotated the Flux deploy key", <-recorder.Events)
+	assert.Len(t, served(), 1)
+}
+
+func TestDeployKeyNotManaged(t *testing.T) {
+	private, _, err := generateDeployKey(1024)
+	assert.NoError(t, err)
+	secret := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "weave", Name: fluxDeploySecret},
+		Data:       map[string][]byte{identityKey: private},
+	}
+	cfg := &agentConfig{
+		APITimeout: time.Minute,
+		KubeClient: fake.NewSimpleClientset(secret),
+	}
+	m := newDeployKeyManager(cfg, time.Nanosecond, 0)
+
+	// Keys set up by users are published, but never rotated.
+	assert.NoError(t, m.sync(context.Background()))
+	assert.Len(t, m.keys, 1)
+	current, err := cfg.KubeClient.CoreV1().Secrets("weave").Get(context.Background(), fluxDeploySecret, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, secret, current)
+}
+
+func TestDeployKeyReport(t *testing.T) {
+	reports := 0
+	fail := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reports++
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	cfg := &agentConfig{
+		APITimeout: time.Minute,
+		KubeClient: fake.NewSimpleClientset(),
+	}
+	m := newDeployKeyManager(cfg, 0, 0)
+	m.bits = 1024
+	m.reportURLTemplate = ts.URL
+
+	// Failed reports are retried.
+	assert.Error(t, m.sync(context.Background()))
+	fail = false
+	assert.NoError(t, m.sync(context.Background()))
+	assert.Equal(t, 2, reports)
+
+	// Keys are only reported when they change.
+	assert.NoError(t, m.sync(context.Background()))
+	assert.Equal(t, 2, reports)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/launcher/pkg/k8s"
+	"github.com/weaveworks/launcher/pkg/text"
+)
+
+// eventsConfig holds the configuration of the Kubernetes events pipeline.
+type eventsConfig struct {
+	// Sinks is the comma-separated list of sinks events are sent to.
+	Sinks           string
+	ForwardURL      string
+	MaxPayloadBytes int
+	MaxRetries      int
+	WebhookURL      string
+	FilePath        string
+	FileMaxBytes    int64
+	FileMaxBackups  int
+	SinkBufferSize  int
+	// FilterConfig is the path of an optional EventFilterConfig file.
+	FilterConfig string
+	// SpoolDir enables spooling events to disk, each sink gets its own
+	// spool in a subdirectory named after the sink.
+	SpoolDir      string
+	SpoolMaxBytes int64
+	SpoolMaxAge   time.Duration
+	// BufferSize and BufferPolicy configure the subscription events are
+	// reported from when they aren't aggregated.
+	BufferSize   int
+	BufferPolicy string
+}
+
+// subscribeEvents subscribes to the events reported by the agent.
+func subscribeEvents(source *k8s.EventSource, events *eventsConfig) (*k8s.Subscription, error) {
+	policy, err := k8s.ParseBufferPolicy(events.BufferPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if events.BufferSize <= 0 {
+		return nil, errors.New("-events.buffer-size must be positive")
+	}
+	subscription := source.Subscribe(k8s.SubscriptionOptions{
+		Name:       "report",
+		BufferSize: events.BufferSize,
+		Policy:     policy,
+	})
+	source.StopPolling()
+	return subscription, nil
+}
+
+// batchEvents collects the events delivered to subscription and sends them
+// every interval, until ctx is done.
+func batchEvents(ctx context.Context, subscription *k8s.Subscription, interval time.Duration, send func([]*k8s.Event)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := []*k8s.Event{}
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				return
+			}
+			batch = append(batch, event)
+		case <-ticker.C:
+			send(batch)
+			batch = []*k8s.Event{}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newEventFilter loads the event filter configuration, if any.
+func newEventFilter(events *eventsConfig, lookup *k8s.ObjectLabelLookup) (*k8s.EventFilter, error) {
+	if events.FilterConfig == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(events.FilterConfig)
+	if err != nil {
+		return nil, err
+	}
+	filterCfg, err := k8s.ParseEventFilterConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", events.FilterConfig, err)
+	}
+	return k8s.NewEventFilter(filterCfg, lookup.Labels)
+}
+
+func newEventSink(name string, events *eventsConfig, cfg *agentConfig) (k8s.EventSink, error) {
+	switch name {
+	case "weave-cloud":
+		url, err := text.ResolveString(events.ForwardURL, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL template: %v", err)
+		}
+		forwarder := k8s.NewEventForwarder(url, cfg.Token)
+		forwarder.MaxPayloadBytes = events.MaxPayloadBytes
+		forwarder.MaxRetries = events.MaxRetries
+		forwarder.RequestTimeout = cfg.APITimeout
+		return forwarder, nil
+	case "webhook":
+		if events.WebhookURL == "" {
+			return nil, errors.New("the webhook sink requires -events.webhook-url")
+		}
+		webhook := k8s.NewWebhookSink(events.WebhookURL)
+		webhook.MaxPayloadBytes = events.MaxPayloadBytes
+		webhook.MaxRetries = events.MaxRetries
+		webhook.RequestTimeout = cfg.APITimeout
+		return webhook, nil
+	case "file":
+		if events.FilePath == "" {
+			return nil, errors.New("the file sink requires -events.file-path")
+		}
+		file := k8s.NewFileSink(events.FilePath)
+		file.MaxBytes = events.FileMaxBytes
+		file.MaxBackups = events.FileMaxBackups
+		return file, nil
+	case "stdout":
+		return k8s.NewStdoutSink(), nil
+	}
+	return nil, fmt.Errorf("unknown event sink '%s'", name)
+}
+
+// newEventFanout creates the sinks listed in events.Sinks.
+func newEventFanout(events *eventsConfig, cfg *agentConfig) (*k8s.EventFanout, error) {
+	names := []string{}
+	for _, name := range strings.Split(events.Sinks, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	sinks := []k8s.EventSink{}
+	for _, name := range deduplicate(names) {
+		sink, err := newEventSink(name, events, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if events.SpoolDir != "" {
+			spool, err := k8s.OpenEventSpool(name, filepath.Join(events.SpoolDir, name))
+			if err != nil {
+				return nil, fmt.Errorf("opening spool for event sink '%s': %v", name, err)
+			}
+			spool.MaxBytes = events.SpoolMaxBytes
+			spool.MaxAge = events.SpoolMaxAge
+			sink = k8s.NewSpoolingSink(sink, spool)
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		return nil, errors.New("at least one event sink must be specified with -events.sinks")
+	}
+	return k8s.NewEventFanout(events.SinkBufferSize, sinks...), nil
+}
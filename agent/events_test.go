@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEventFanout(t *testing.T) {
+	cfg := &agentConfig{WCHostname: "cloud.weave.works", Token: "token"}
+
+	tests := []struct {
+		events eventsConfig
+		valid  bool
+	}{
+		{eventsConfig{Sinks: "weave-cloud", ForwardURL: defaultWCEventsURL}, true},
+		{eventsConfig{Sinks: "stdout, weave-cloud,stdout", ForwardURL: defaultWCEventsURL}, true},
+		{eventsConfig{Sinks: "file", FilePath: "/tmp/events.log"}, true},
+		{eventsConfig{Sinks: "file"}, false},
+		{eventsConfig{Sinks: "webhook"}, false},
+		{eventsConfig{Sinks: "foo"}, false},
+		{eventsConfig{Sinks: ""}, false},
+	}
+
+	for _, test := range tests {
+		_, err := newEventFanout(&test.events, cfg)
+		assert.Equal(t, test.valid, err == nil, test.events.Sinks)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"strings"
 	"syscall"
 	"time"
 
@@ -19,8 +21,13 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	kubeclient "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/weaveworks/launcher/pkg/k8s"
 	"github.com/weaveworks/launcher/pkg/kubectl"
@@ -36,22 +43,31 @@ const (
 		"{{end}}" +
 		"&read-only={{.ReadOnly}}"
 	defaultAgentRecoveryWait = 5 * time.Minute
+	defaultKubectlTimeout    = 5 * time.Minute
+	defaultAPITimeout        = 30 * time.Second
 	defaultWCHostname        = "cloud.weave.works"
 	defaultWCPollURL         = "https://{{.WCHostname}}/k8s.yaml" +
 		"?k8s-version={{.KubernetesVersion}}&t={{.Token}}&omit-support-info=true" +
-		"{{if .FluxConfig.AsQueryParams}}&{{.FluxConfig.AsQueryParams}}{{end}}" +
-		"{{if .MemcachedConfig.AsQueryParams}}&{{.MemcachedConfig.AsQueryParams}}{{end}}" +
+		"{{if .ComponentQueryParams}}&{{.ComponentQueryParams}}{{end}}" +
 		"{{if .CRIEndpoint}}" +
 		"&cri-endpoint={{.CRIEndpoint}}" +
 		"{{end}}" +
 		"&read-only={{.ReadOnly}}"
-	defaultCloudwatchURL = "https://{{.WCHostname}}/k8s/{{.KubernetesMajorMinorVersion}}/cloudwatch.yaml?" +
+	defaultWCEventsURL        = "https://{{.WCHostname}}/api/kubernetes/events"
+	defaultCloudwatchSelector = "cloud.weave.works/cloudwatch=true"
+	defaultCloudwatchURL      = "https://{{.WCHostname}}/k8s/{{.KubernetesMajorMinorVersion}}/cloudwatch.yaml?" +
 		"aws-region={{.Region}}" +
-		"&aws-secret={{.SecretName}}" +
+		"{{if .SecretName}}&aws-secret={{.SecretName}}{{end}}" +
+		"{{if .RoleARN}}" +
+		"&aws-role-arn={{.RoleARN}}" +
+		"&aws-role-annotation={{.RoleAnnotation}}" +
+		"&aws-web-identity-token-file={{.WebIdentityTokenFile}}" +
+		"{{end}}" +
 		"&aws-resources={{.Resources}}" +
+		"{{if .ResourceOptions}}&aws-resource-options={{.ResourceOptions}}{{end}}" +
 		"&aws-config={{.ConfigName}}" +
 		"&aws-config-uid={{.ConfigUID}}" +
-		"&aws-secret-uid={{.SecretUID}}"
+		"{{if .SecretUID}}&aws-secret-uid={{.SecretUID}}{{end}}"
 )
 
 type agentConfig struct {
@@ -63,20 +79,48 @@ type agentConfig struct {
 	InstanceID             string
 	AgentPollURLTemplate   string
 	AgentRecoveryWait      time.Duration
+	KubectlTimeout         time.Duration
+	APITimeout             time.Duration
 	ReportErrors           bool
 	WCPollURLTemplate      string
-	KubeClient             *kubeclient.Clientset
+	KubeClient             kubeclient.Interface
 	KubectlClient          kubectl.Client
-	FluxConfig             *FluxConfig
-	MemcachedConfig        *MemcachedConfig
-	CRIEndpoint            string
-	ReadOnly               bool
-
-	CMInformer     cache.SharedIndexInformer
+	// ComponentArgs holds the arguments of the Weave Cloud agents preserved
+	// across updates, by component.
+	ComponentArgs map[string]*ComponentArgs
+	// PreservedFields is the allow-list of the customisations of the Weave
+	// Cloud workloads preserved across updates.
+	PreservedFields map[string]bool
+	CRIEndpoint     string
+	ReadOnly        bool
+
+	// CloudwatchSelector selects the ConfigMaps holding Cloudwatch
+	// configurations.
+	CloudwatchSelector labels.Selector
+	CMInformer         cache.SharedIndexInformer
+	// CloudwatchMonitors is set once the CloudWatchMonitor CRD is installed.
+	// Cloudwatch ConfigMaps are then migrated to CloudWatchMonitors.
+	CloudwatchMonitors bool
+	DynamicClient      dynamic.Interface
+	MonitorInformer    cache.SharedIndexInformer
+	// CloudwatchReconciler deploys the Cloudwatch configurations.
+	CloudwatchReconciler *cloudwatchReconciler
+	// Recorder records Kubernetes events on the objects the agent manages.
+	Recorder       record.EventRecorder
 	SecretInformer cache.SharedIndexInformer
+
+	// ctx is cancelled when the agent stops. Informer handlers derive the
+	// contexts of their work from it.
+	ctx context.Context
 }
 
-var validResources = []string{"rds", "classic-elb"}
+// handlerContext returns the context informer handlers derive theirs from.
+func (cfg *agentConfig) handlerContext() context.Context {
+	if cfg.ctx == nil {
+		return context.Background()
+	}
+	return cfg.ctx
+}
 
 func init() {
 	// https://sentry.io/weaveworks/launcher-agent/
@@ -132,23 +176,47 @@ func agentManifestURL(cfg *agentConfig) string {
 	return agentPollURL
 }
 
-func updateAgents(cfg *agentConfig, cancel <-chan interface{}) {
+// withTimeout bounds a single operation, kubectl invocation or API call, made
+// on behalf of ctx.
+func withTimeout(ctx context.Context, timeout time.Duration, f func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return f(ctx)
+}
+
+func (cfg *agentConfig) apply(ctx context.Context, url string) error {
+	return withTimeout(ctx, cfg.KubectlTimeout, func(ctx context.Context) error {
+		return kubectl.Apply(ctx, cfg.KubectlClient, url)
+	})
+}
+
+func (cfg *agentConfig) agentRevision(ctx context.Context) (int64, error) {
+	var revision int64
+	err := withTimeout(ctx, cfg.APITimeout, func(ctx context.Context) error {
+		var err error
+		revision, err = k8s.GetLatestDeploymentReplicaSetRevision(ctx, cfg.KubeClient, "weave", "weave-agent")
+		return err
+	})
+	return revision, err
+}
+
+func updateAgents(ctx context.Context, cfg *agentConfig) {
 	// Self-update
 	agentPollURL := agentManifestURL(cfg)
 	log.Info("Updating self from ", agentPollURL)
 
-	initialRevision, err := k8s.GetLatestDeploymentReplicaSetRevision(cfg.KubeClient, "weave", "weave-agent")
+	initialRevision, err := cfg.agentRevision(ctx)
 	if err != nil {
 		logError("Failed to fetch latest deployment replicateset revision", err, cfg)
 		return
 	}
 	log.Info("Revision before self-update: ", initialRevision)
-	err = kubectl.Apply(cfg.KubectlClient, agentPollURL)
+	err = cfg.apply(ctx, agentPollURL)
 	if err != nil {
 		logError("Failed to execute kubectl apply", err, cfg)
 		return
 	}
-	updatedRevision, err := k8s.GetLatestDeploymentReplicaSetRevision(cfg.KubeClient, "weave", "weave-agent")
+	updatedRevision, err := cfg.agentRevision(ctx)
 	if err != nil {
 		logError("Failed to fetch latest deployment replicateset revision", err, cfg)
 		return
@@ -164,12 +232,15 @@ func updateAgents(cfg *agentConfig, cancel <-chan interface{}) {
 
 		select {
 		case <-time.After(cfg.AgentRecoveryWait):
-		case <-cancel:
+		case <-ctx.Done():
 			return
 		}
 
 		logError("Deployment of the new agent failed. Rolling back.", errors.New("Deployment failed"), cfg)
-		_, err := cfg.KubectlClient.Execute("rollout", "undo", "--namespace=weave", "deployment/weave-agent")
+		err := withTimeout(ctx, cfg.KubectlTimeout, func(ctx context.Context) error {
+			_, err := cfg.KubectlClient.Execute(ctx, "rollout", "undo", "--namespace=weave", "deployment/weave-agent")
+			return err
+		})
 		if err != nil {
 			logError("Failed rolling back agent. Will continue to check for updates.", err, cfg)
 			return
@@ -180,23 +251,8 @@ func updateAgents(cfg *agentConfig, cancel <-chan interface{}) {
 		return
 	}
 
-	// Get existing flux config
-	fluxCfg, err := getFluxConfig(cfg.KubectlClient, "weave")
-	if err != nil {
-		logError("Failed getting existing flux config", err, cfg)
-	}
-	if fluxCfg != nil {
-		cfg.FluxConfig = fluxCfg
-	}
-
-	// Get existing flux memcached config
-	memcachedCfg, err := getMemcachedConfig(cfg.KubectlClient, "weave")
-	if err != nil {
-		logError("Failed getting existing flux memcached config", err, cfg)
-	}
-	if memcachedCfg != nil {
-		cfg.MemcachedConfig = memcachedCfg
-	}
+	// Get the existing arguments of the components, to preserve them
+	cfg.updateComponentArgs(ctx)
 
 	// Update Weave Cloud agents
 	wcPollURL, err := text.ResolveString(cfg.WCPollURLTemplate, cfg)
@@ -204,23 +260,49 @@ func updateAgents(cfg *agentConfig, cancel <-chan interface{}) {
 		log.Fatal("invalid URL template: ", err)
 	}
 	log.Info("Updating WC from ", wcPollURL)
-	err = kubectl.Apply(cfg.KubectlClient, wcPollURL)
+	err = cfg.applyPreservingCustomizations(ctx, wcPollURL)
 	if err != nil {
 		logError("Failed to execute kubectl apply", err, cfg)
 		return
 	}
 }
 
-func setupKubeClient() (*kubeclient.Clientset, error) {
+// updateComponentArgs refreshes the arguments of the components to preserve.
+// The previous arguments of a component are kept only when kubectl fails.
+func (cfg *agentConfig) updateComponentArgs(ctx context.Context) {
+	for _, c := range components {
+		var args *ComponentArgs
+		err := withTimeout(ctx, cfg.KubectlTimeout, func(ctx context.Context) error {
+			var err error
+			args, err = getComponentArgs(ctx, cfg.KubectlClient, c, "weave")
+			return err
+		})
+		if err != nil {
+			logError(fmt.Sprintf("Failed getting existing %s args", c.name), err, cfg)
+			continue
+		}
+		cfg.ComponentArgs[c.name] = args
+	}
+}
+
+func setupKubeClient() (*kubeclient.Clientset, dynamic.Interface, error) {
 	kubeConfig, err := k8s.NewClientConfig(&k8s.ClientConfig{
 		// We have seen quite a few clusters in the wild with invalid certificates.
 		// Disable checking certificates as a result.
 		Insecure: true,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("client config: %s", err)
+		return nil, nil, fmt.Errorf("client config: %s", err)
 	}
-	return kubeclient.NewForConfig(kubeConfig)
+	client, err := kubeclient.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, dynamicClient, nil
 }
 
 func main() {
@@ -236,6 +318,9 @@ func mainImpl() {
 	address := flag.String("agent.address", ":8080", "agent HTTP address")
 	criEndpoint := flag.String("agent.cri-endpoint", "", "Container runtime endpoint of the Kubernetes cluster.")
 	readOnly := flag.Bool("agent.read-only", false, "Disable scope controls")
+	preservedFields := flag.String("agent.preserved-fields", strings.Join(customizableFields, ","), "Comma-separated list of the customisations of Weave Cloud workloads preserved across updates - any of "+strings.Join(customizableFields, ", "))
+	kubectlTimeout := flag.Duration("agent.kubectl-timeout", defaultKubectlTimeout, "Maximum duration of a single kubectl invocation")
+	apiTimeout := flag.Duration("agent.api-timeout", defaultAPITimeout, "Maximum duration of a single Kubernetes or Weave Cloud API call")
 
 	wcToken := flag.String("wc.token", "", "Weave Cloud instance token")
 	wcPollInterval := flag.Duration("wc.poll-interval", 1*time.Hour, "Polling interval to check WC manifests")
@@ -243,11 +328,43 @@ func mainImpl() {
 	wcOrgLookupURLTemplate := flag.String("wc.org-lookup-url", weavecloud.DefaultWCOrgLookupURLTemplate, "URL to lookup org external ID by token")
 	wcOrgPlatformVersionURLTemplate := flag.String("wc.org-platform-version-url", weavecloud.DefaultWCOrgPlatformVersionURLTemplate, "URL to update platform version by token")
 	wcHostname := flag.String("wc.hostname", defaultWCHostname, "WC Hostname for WC agents and users API")
+	wcDeployKeysURLTemplate := flag.String("wc.deploy-keys-url", weavecloud.DefaultDeployKeysURLTemplate, "URL the public Flux deploy keys are reported to")
 
 	eventsReportInterval := flag.Duration("events.report-interval", 3*time.Second, "Minimal time interval between two reports")
-
+	eventsCfg := &eventsConfig{}
+	flag.StringVar(&eventsCfg.Sinks, "events.sinks", "weave-cloud", "Comma-separated list of sinks events are sent to - any of 'weave-cloud', 'webhook', 'file', 'stdout'")
+	flag.StringVar(&eventsCfg.ForwardURL, "events.forward-url", defaultWCEventsURL, "URL Kubernetes events are forwarded to by the weave-cloud sink")
+	flag.IntVar(&eventsCfg.MaxPayloadBytes, "events.max-payload-bytes", 1024*1024, "Maximum size of a single events report, larger reports are split")
+	flag.IntVar(&eventsCfg.MaxRetries, "events.max-retries", 3, "Number of times a failed events report is retried before its events are dropped, or kept in the spool")
+	flag.StringVar(&eventsCfg.WebhookURL, "events.webhook-url", "", "URL events are POSTed to by the webhook sink")
+	flag.StringVar(&eventsCfg.FilePath, "events.file-path", "", "File events are appended to by the file sink")
+	flag.Int64Var(&eventsCfg.FileMaxBytes, "events.file-max-bytes", 100*1024*1024, "Size after which the file sink rotates its file")
+	flag.IntVar(&eventsCfg.FileMaxBackups, "events.file-max-backups", 3, "Number of rotated files kept by the file sink")
+	flag.IntVar(&eventsCfg.SinkBufferSize, "events.sink-buffer", 100, "Number of event batches buffered for each sink")
+	eventsAggregationWindow := flag.Duration("events.aggregation-window", 5*time.Minute, "Repeated events seen within this window of each other are reported as a single aggregated event. 0 disables aggregation")
+	flag.IntVar(&eventsCfg.BufferSize, "events.buffer-size", 100000, "Number of events buffered between two reports when events aren't aggregated")
+	flag.StringVar(&eventsCfg.BufferPolicy, "events.buffer-policy", string(k8s.BufferDropNewest), "What to do with new events when the buffer is full - any of 'block', 'drop-oldest', 'drop-newest'")
+	eventsHistorySize := flag.Int("events.history-size", 10000, "Number of recent events kept in memory and served on /events. 0 disables it")
+	flag.StringVar(&eventsCfg.FilterConfig, "events.filter-config", "", "YAML file with the include/exclude rules selecting the events to report")
+	alertsCfg := &alertsConfig{}
+	flag.StringVar(&alertsCfg.RulesConfigMap, "events.alert-rules-configmap", "", "Name of the ConfigMap, in the weave namespace, holding event alerting rules under the rules.yaml key. Alerting is disabled when empty")
+	flag.StringVar(&alertsCfg.Notifiers, "events.alert-notifiers", "log,weave-cloud", "Comma-separated list of notifiers alert records are sent to - any of 'log', 'webhook', 'weave-cloud'")
+	flag.StringVar(&alertsCfg.WebhookURL, "events.alert-webhook-url", "", "URL alert records are POSTed to by the webhook alert notifier")
+	flag.StringVar(&alertsCfg.NotificationURL, "events.alert-notification-url", weavecloud.DefaultNotificationURLTemplate, "Weave Cloud notification URL alert records are sent to by the weave-cloud alert notifier")
+	eventsWorkloadCacheBytes := flag.Int64("events.workload-cache-bytes", 64*1024*1024, "Memory budget of the pod and workload caches used to attach workload information to events. 0 disables it")
+	eventsWorkloadChanges := flag.Bool("events.workload-changes", true, "Whether changes of the pod template of Deployments, DaemonSets and StatefulSets are reported along with the Kubernetes events. They are observed through the workload caches")
+	flag.StringVar(&eventsCfg.SpoolDir, "events.spool-dir", "", "Directory, eg. an emptyDir or persistent volume, where events are spooled until their sinks accept them. Disabled when empty")
+	flag.Int64Var(&eventsCfg.SpoolMaxBytes, "events.spool-max-bytes", 100*1024*1024, "Maximum size of the spool of each sink, the oldest events are dropped beyond that")
+	flag.DurationVar(&eventsCfg.SpoolMaxAge, "events.spool-max-age", 24*time.Hour, "Spooled events older than this are dropped")
+
+	deployKeyRotationInterval := flag.Duration("flux.deploy-key-rotation-interval", 0, "How often the Flux deploy key is rotated. 0 disables rotation")
+	deployKeyGracePeriod := flag.Duration("flux.deploy-key-grace-period", 7*24*time.Hour, "How long the next Flux deploy key may wait to be authorised before a warning is recorded")
+
+	cloudwatchResyncInterval := flag.Duration("cloudwatch.resync-interval", 10*time.Minute, "How often the deployed Cloudwatch objects are checked, and re-applied when they drifted from their manifest. 0 disables it")
+	cloudwatchSelector := flag.String("cloudwatch.selector", defaultCloudwatchSelector, "Label selector of the ConfigMaps, in the weave namespace, holding Cloudwatch configurations. The ConfigMap named cloudwatch is always used")
 	featureInstall := flag.Bool("feature.install-agents", true, "Whether the agent should install anything in the cluster or not")
 	featureEvents := flag.Bool("feature.kubernetes-events", false, "Whether the agent should forward kubernetes events to Weave Cloud or not")
+	featureDeployKeys := flag.Bool("feature.flux-deploy-keys", false, "Whether the agent should create and rotate the SSH deploy key of Flux or not")
 
 	flag.Parse()
 
@@ -259,14 +376,23 @@ func mainImpl() {
 		log.Fatal("missing Weave Cloud instance token, provide one with -wc.token")
 	}
 
+	preserved, err := parsePreservedFields(*preservedFields)
+	if err != nil {
+		log.Fatal("invalid preserved fields: ", err)
+	}
+
 	cfg := &agentConfig{
 		Token:                *wcToken,
 		AgentRecoveryWait:    *agentRecoveryWait,
+		KubectlTimeout:       *kubectlTimeout,
+		APITimeout:           *apiTimeout,
 		ReportErrors:         *reportErrors,
 		KubectlClient:        kubectl.LocalClient{},
 		WCHostname:           *wcHostname,
 		AgentPollURLTemplate: *agentPollURLTemplate,
 		WCPollURLTemplate:    *wcPollURLTemplate,
+		ComponentArgs:        map[string]*ComponentArgs{},
+		PreservedFields:      preserved,
 		CRIEndpoint:          *criEndpoint,
 		ReadOnly:             *readOnly,
 	}
@@ -274,12 +400,23 @@ func mainImpl() {
 		"weave_cloud_hostname": *wcHostname,
 	})
 
-	kubeClient, err := setupKubeClient()
+	selector, err := labels.Parse(*cloudwatchSelector)
+	if err != nil {
+		log.Fatal("invalid Cloudwatch selector: ", err)
+	}
+	cfg.CloudwatchSelector = selector
+
+	kubeClient, dynamicClient, err := setupKubeClient()
 	if err != nil {
 		logError("kubernetes client", err, cfg)
 		os.Exit(1)
 	}
 	cfg.KubeClient = kubeClient
+	cfg.DynamicClient = dynamicClient
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	cfg.Recorder = broadcaster.NewRecorder(scheme.Scheme, apiv1.EventSource{Component: "weave-agent"})
 
 	version, err := kubeClient.Discovery().ServerVersion()
 	if err != nil {
@@ -298,7 +435,12 @@ func mainImpl() {
 	if err != nil {
 		log.Fatal("invalid URL template:", err)
 	}
-	instanceID, _, err := weavecloud.LookupInstanceByToken(wcOrgLookupURL, *wcToken)
+	var instanceID string
+	err = withTimeout(context.Background(), cfg.APITimeout, func(ctx context.Context) error {
+		var err error
+		instanceID, _, err = weavecloud.LookupInstanceByToken(ctx, wcOrgLookupURL, *wcToken)
+		return err
+	})
 	if err != nil {
 		logError("lookup instance by token", err, &agentConfig{})
 	} else {
@@ -313,20 +455,26 @@ func mainImpl() {
 	if err != nil {
 		log.Fatal("invalid URL template:", err)
 	}
-	if err = weavecloud.UpdateInstancePlatformVersionByToken(wcOrgPlatformVersionURL, *wcToken, cfg.KubernetesVersion); err != nil {
+	err = withTimeout(context.Background(), cfg.APITimeout, func(ctx context.Context) error {
+		return weavecloud.UpdateInstancePlatformVersionByToken(ctx, wcOrgPlatformVersionURL, *wcToken, cfg.KubernetesVersion)
+	})
+	if err != nil {
 		logError("update instance platform version by token", err, &agentConfig{})
 	}
 
 	// Migrate kube system and reuse any existing flux config
-	existingFluxCfg := migrateKubeSystem(cfg.KubectlClient)
+	migrateCtx, cancelMigrate := context.WithTimeout(context.Background(), cfg.KubectlTimeout)
+	existingFluxCfg := migrateKubeSystem(migrateCtx, cfg.KubectlClient)
+	cancelMigrate()
 	if existingFluxCfg != nil {
-		log.Infof("Using existing flux config: %+v", existingFluxCfg)
+		log.Infof("Using existing flux config: %s", existingFluxCfg.AsQueryParams())
 	}
-	cfg.FluxConfig = existingFluxCfg
+	cfg.ComponentArgs[fluxComponent.name] = existingFluxCfg
 
 	var g run.Group
 
-	// HTTP server for prometheus metrics
+	// HTTP server for prometheus metrics, the event history and the Flux
+	// deploy keys
 	ln, err := net.Listen("tcp", *address)
 	if err != nil {
 		log.Fatal("HTTP listen: ", err)
@@ -343,48 +491,83 @@ func mainImpl() {
 
 	// Poll for new manifests every wcPollInterval.
 	if *featureInstall {
-		cancel := make(chan interface{})
+		ctx, cancel := context.WithCancel(context.Background())
 
 		g.Add(
 			func() error {
 				for {
 
-					updateAgents(cfg, cancel)
+					updateAgents(ctx, cfg)
 
 					select {
 					case <-time.After(*wcPollInterval):
 						continue
-					case <-cancel:
+					case <-ctx.Done():
 						return nil
 					}
 				}
 			},
 			func(err error) {
-				close(cancel)
+				cancel()
 			},
 		)
 	}
 
 	{
 		stopCh := make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(
 			func() error {
+				cfg.ctx = ctx
+				cfg.CloudwatchReconciler = newCloudwatchReconciler(cfg, *cloudwatchResyncInterval)
+
+				// Cloudwatch configurations are CloudWatchMonitors when we can
+				// install their CRD, ConfigMaps otherwise.
+				err := withTimeout(ctx, cfg.APITimeout+cloudwatchCRDEstablishTimeout, cfg.installCloudwatchCRD)
+				if err != nil {
+					log.Warn("CloudWatchMonitor CRD not available, deploying Cloudwatch from ConfigMaps: ", err)
+				} else {
+					cfg.CloudwatchMonitors = true
+					watchMonitors(cfg)
+					go cfg.MonitorInformer.Run(stopCh)
+				}
+
 				// Watch for ConfigMap and Secret creation/update/deletion
 				// so we can deploy Cloudwatch resources.
 				watchConfigMaps(cfg)
 				watchSecrets(cfg)
 				go cfg.CMInformer.Run(stopCh)
 				go cfg.SecretInformer.Run(stopCh)
+				go cfg.CloudwatchReconciler.Run(ctx)
 
 				<-stopCh
 				return nil
 			},
 			func(err error) {
+				cancel()
 				close(stopCh)
 			},
 		)
 	}
 
+	// Create and rotate the Flux deploy keys, served on /flux/deploy-keys.
+	if *featureDeployKeys {
+		deployKeys := newDeployKeyManager(cfg, *deployKeyRotationInterval, *deployKeyGracePeriod)
+		deployKeys.reportURLTemplate = *wcDeployKeysURLTemplate
+		http.Handle("/flux/deploy-keys", deployKeys)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(
+			func() error {
+				deployKeys.Run(ctx, deployKeyCheckInterval)
+				return nil
+			},
+			func(err error) {
+				cancel()
+			},
+		)
+	}
+
 	// Close gracefully on SIGTERM
 	{
 		term := make(chan os.Signal, 1)
@@ -402,44 +585,165 @@ func mainImpl() {
 		)
 	}
 
-	eventSource := k8s.NewEventSource(kubeClient, apiv1.NamespaceAll)
+	var eventSource *k8s.EventSource
+	var eventsSubscription, historySubscription *k8s.Subscription
+	var eventHistory *k8s.EventHistory
+	var labelLookup *k8s.ObjectLabelLookup
+	if *featureEvents {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.APITimeout)
+		eventSource = k8s.NewEventSource(ctx, kubeClient, apiv1.NamespaceAll)
+		cancel()
+		if *eventsWorkloadCacheBytes > 0 {
+			eventSource.Enricher = k8s.NewEventEnricher(kubeClient, *eventsWorkloadCacheBytes)
+		}
+		labelLookup = k8s.NewObjectLabelLookup(kubeClient, eventSource.Enricher)
+		labelLookup.Timeout = cfg.APITimeout
+		eventSource.Filter, err = newEventFilter(eventsCfg, labelLookup)
+		if err != nil {
+			log.Fatal("events: ", err)
+		}
+		if *eventsAggregationWindow > 0 {
+			eventSource.EnableAggregation(*eventsAggregationWindow)
+		} else {
+			eventsSubscription, err = subscribeEvents(eventSource, eventsCfg)
+			if err != nil {
+				log.Fatal("events: ", err)
+			}
+		}
+		if *eventsHistorySize > 0 {
+			eventHistory = k8s.NewEventHistory(*eventsHistorySize)
+			historySubscription = eventSource.Subscribe(k8s.SubscriptionOptions{
+				Name:       "history",
+				BufferSize: 1000,
+				Policy:     k8s.BufferDropOldest,
+			})
+			http.Handle("/events", eventHistory)
+		}
+		if alertsCfg.RulesConfigMap != "" {
+			eventSource.Alerter, err = newAlerter(alertsCfg, cfg)
+			if err != nil {
+				log.Fatal("events: ", err)
+			}
+		}
+	}
 
 	// Capture Kubernetes events
 	if *featureEvents {
-		cancel := make(chan interface{})
+		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(
 			func() error {
-				eventSource.Start(cancel)
+				eventSource.Start(ctx)
 				return nil
 			},
 			func(err error) {
-				close(cancel)
+				cancel()
 			},
 		)
+		if eventSource.Enricher != nil {
+			g.Add(
+				func() error {
+					eventSource.Enricher.Start(ctx)
+					return nil
+				},
+				func(err error) {
+					cancel()
+				},
+			)
+		}
+		if eventSource.Filter != nil {
+			g.Add(
+				func() error {
+					labelLookup.Run(ctx)
+					return nil
+				},
+				func(err error) {
+					cancel()
+				},
+			)
+		}
+		if *eventsWorkloadChanges && eventSource.Enricher == nil {
+			log.Warn("Workload changes are only reported along with the workload caches, -events.workload-cache-bytes is 0")
+		} else if *eventsWorkloadChanges {
+			changeSource := k8s.NewWorkloadChangeSource(kubeClient, eventSource.Enricher, eventSource)
+			changeSource.Timeout = cfg.APITimeout
+			g.Add(
+				func() error {
+					changeSource.Start(ctx)
+					return nil
+				},
+				func(err error) {
+					cancel()
+				},
+			)
+		}
+		if eventHistory != nil {
+			g.Add(
+				func() error {
+					eventHistory.Run(ctx, historySubscription)
+					return nil
+				},
+				func(err error) {
+					cancel()
+				},
+			)
+		}
+		if eventSource.Alerter != nil {
+			g.Add(
+				func() error {
+					go watchAlertRules(cfg, alertsCfg.RulesConfigMap, eventSource.Alerter, ctx.Done())
+					eventSource.Alerter.Run(ctx)
+					return nil
+				},
+				func(err error) {
+					cancel()
+				},
+			)
+		}
 	}
 
 	// Report Kubernetes events
 	if *featureEvents {
-		cancel := make(chan interface{})
+		fanout, err := newEventFanout(eventsCfg, cfg)
+		if err != nil {
+			log.Fatal("events: ", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(
 			func() error {
+				fanout.Run(ctx)
+				return nil
+			},
+			func(err error) {
+				cancel()
+			},
+		)
+		send := func(events []*k8s.Event) {
+			for _, event := range events {
+				log.WithFields(log.Fields{
+					"name": event.InvolvedObject.Name,
+					"kind": event.InvolvedObject.Kind,
+				}).Debug(event.Message)
+			}
+			fanout.Send(events)
+		}
+		g.Add(
+			func() error {
+				if eventsSubscription != nil {
+					batchEvents(ctx, eventsSubscription, *eventsReportInterval, send)
+					return nil
+				}
 				for {
 					select {
 					case <-time.After(*eventsReportInterval):
-						events := eventSource.GetNewEvents()
-						for _, event := range events {
-							log.WithFields(log.Fields{
-								"name": event.InvolvedObject.Name,
-								"kind": event.InvolvedObject.Kind,
-							}).Debug(event.Message)
-						}
-					case <-cancel:
+						send(eventSource.GetNewEvents())
+					case <-ctx.Done():
 						return nil
 					}
 				}
 			},
 			func(err error) {
-				close(cancel)
+				cancel()
 			},
 		)
 	}
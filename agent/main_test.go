@@ -68,7 +68,7 @@ func TestAgentFluxURL(t *testing.T) {
 
 	cfg := &agentConfig{
 		AgentPollURLTemplate: defaultWCPollURL,
-		FluxConfig:           fluxCfg,
+		ComponentArgs:        map[string]*ComponentArgs{"flux": fluxCfg},
 	}
 
 	manifestURL := agentManifestURL(cfg)
@@ -91,7 +91,7 @@ func TestAgentMemcachedURL(t *testing.T) {
 
 	cfg := &agentConfig{
 		AgentPollURLTemplate: defaultWCPollURL,
-		MemcachedConfig:      memcachedCfg,
+		ComponentArgs:        map[string]*ComponentArgs{"memcached": memcachedCfg},
 	}
 
 	manifestURL := agentManifestURL(cfg)
@@ -115,24 +115,24 @@ func TestParseFluxArgs(t *testing.T) {
 	argString = "--git-ci-skip"
 	fluxCfg, err = ParseFluxArgs(argString)
 	assert.Equal(t, nil, err)
-	assert.Equal(t, true, fluxCfg.GitCISkip)
+	assert.Equal(t, "true", fluxCfg.Value("git-ci-skip"))
 
 	// Test handling boolean flags w `=true|false`
 	argString = "--git-ci-skip=true"
 	fluxCfg, err = ParseFluxArgs(argString)
 	assert.Equal(t, nil, err)
-	assert.Equal(t, true, fluxCfg.GitCISkip)
+	assert.Equal(t, "true", fluxCfg.Value("git-ci-skip"))
 
 	argString = "--git-ci-skip=false"
 	fluxCfg, err = ParseFluxArgs(argString)
 	assert.Equal(t, nil, err)
-	assert.Equal(t, false, fluxCfg.GitCISkip)
+	assert.Equal(t, "false", fluxCfg.Value("git-ci-skip"))
 
 	// Test we only serialize props that we provided
 	argString = "--git-label=foo --git-path=derp"
 	fluxCfg, err = ParseFluxArgs(argString)
 	assert.Equal(t, nil, err)
-	assert.Equal(t, "foo", fluxCfg.GitLabel)
+	assert.Equal(t, "foo", fluxCfg.Value("git-label"))
 	assert.Equal(t, "git-label=foo&git-path=derp", fluxCfg.AsQueryParams())
 
 	// string[]
@@ -177,7 +177,7 @@ func TestParseMemcachedArgs(t *testing.T) {
 	argString = "-m 1024 -I 10m"
 	memcachedCfg, err = ParseMemcachedArgs(argString)
 	assert.Equal(t, nil, err)
-	assert.Equal(t, "1024", memcachedCfg.Memory)
+	assert.Equal(t, "1024", memcachedCfg.Value("memory-limit"))
 	assert.Equal(t, "memcached-item-size=10m&memcached-memory=1024", memcachedCfg.AsQueryParams())
 
 	// unknown
@@ -1,15 +1,16 @@
 package main
 
 import (
+	"context"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/weaveworks/launcher/pkg/kubectl"
 )
 
-func migrateKubeSystem(kubectlClient kubectl.Client) *FluxConfig {
+func migrateKubeSystem(ctx context.Context, kubectlClient kubectl.Client) *ComponentArgs {
 	// Save and return any existing flux config in kube-system
-	fluxCfg, err := getFluxConfig(kubectlClient, "kube-system")
+	fluxCfg, err := getComponentArgs(ctx, kubectlClient, fluxComponent, "kube-system")
 	if err != nil {
 		log.Info("Failed to get existing flux config")
 	}
@@ -20,31 +21,31 @@ func migrateKubeSystem(kubectlClient kubectl.Client) *FluxConfig {
 	// 1. Delete our objects in the kube-system namespace
 	// 2. Let launcher-agent install the new ones in the weave namespace
 	log.Info("Checking for any previous installation...")
-	deleted := deleteKubeSystemObjects(kubectlClient)
+	deleted := deleteKubeSystemObjects(ctx, kubectlClient)
 	if deleted {
-		log.Info("Removed old agents from the kube-system namespace. You will have to reconfigure Deploy.")
+		log.Info("Removed old agents from the kube-system namespace. You will have to reconfigure Deploy, authorising the new Flux deploy key on your git host.")
 	}
 
 	return fluxCfg
 }
 
 // Delete old Weave Cloud objects and return if we have indeed deleted anything.
-func deleteKubeSystemObjects(kubectlClient kubectl.Client) bool {
+func deleteKubeSystemObjects(ctx context.Context, kubectlClient kubectl.Client) bool {
 	deleted := false
 
-	out, _ := kubectlClient.Execute("delete", "--namespace=kube-system",
+	out, _ := kubectlClient.Execute(ctx, "delete", "--namespace=kube-system",
 		"deployments,pods,services,daemonsets,serviceaccounts,configmaps,secrets",
 		"--selector=app in (weave-flux, weave-cortex, weave-scope)")
 	// Used with a selector, kubectl 1.7.5 returns a 0 exit code with the message
 	// "No resources found" when there's no matching resources.
 	deleted = deleted || !strings.Contains(out, "No resources found")
 
-	out, _ = kubectlClient.Execute("delete", "--namespace=kube-system",
+	out, _ = kubectlClient.Execute(ctx, "delete", "--namespace=kube-system",
 		"deployments,pods,services,daemonsets,serviceaccounts,configmaps,secrets",
 		"--selector=name in (weave-flux, weave-cortex, weave-scope)")
 	deleted = deleted || !strings.Contains(out, "No resources found")
 
-	_, err := kubectlClient.Execute("--namespace=kube-system", "delete", "secret", "flux-git-deploy")
+	_, err := kubectlClient.Execute(ctx, "--namespace=kube-system", "delete", "secret", "flux-git-deploy")
 	deleted = deleted || (err == nil)
 
 	return deleted
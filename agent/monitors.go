@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/weaveworks/launcher/pkg/text"
+)
+
+var (
+	crdResource = schema.GroupVersionResource{
+		Group:    "apiextensions.k8s.io",
+		Version:  "v1",
+		Resource: "customresourcedefinitions",
+	}
+	cloudwatchMonitorResource = schema.GroupVersionResource{
+		Group:    "cloud.weave.works",
+		Version:  "v1alpha1",
+		Resource: "cloudwatchmonitors",
+	}
+
+	errCloudwatchMonitorNamespace = errors.New("cloudwatch: CloudWatchMonitors must be created in the weave namespace")
+)
+
+const (
+	cloudwatchMonitorKind    = "CloudWatchMonitor"
+	cloudwatchMonitorCRDName = "cloudwatchmonitors.cloud.weave.works"
+	// How long we wait for the API server to serve CloudWatchMonitors once
+	// the CRD is installed.
+	cloudwatchCRDEstablishTimeout = 30 * time.Second
+)
+
+// Reasons of the Kubernetes events recorded when migrating Cloudwatch
+// ConfigMaps.
+const (
+	reasonCloudwatchMigrated        = "Migrated"
+	reasonCloudwatchMigrationFailed = "MigrationFailed"
+)
+
+// cloudwatchMonitorCRDTemplate is the CloudWatchMonitor CRD, the AWS resource
+// types are filled in from the catalogue.
+const cloudwatchMonitorCRDTemplate = `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: cloudwatchmonitors.cloud.weave.works
+spec:
+  group: cloud.weave.works
+  names:
+    kind: CloudWatchMonitor
+    listKind: CloudWatchMonitorList
+    plural: cloudwatchmonitors
+    singular: cloudwatchmonitor
+    shortNames: [cwm]
+  scope: Namespaced
+  versions:
+  - name: v1alpha1
+    served: true
+    storage: true
+    subresources:
+      status: {}
+    additionalPrinterColumns:
+    - name: Region
+      type: string
+      jsonPath: .spec.region
+    - name: Role
+      type: string
+      jsonPath: .spec.role.arn
+      priority: 1
+    - name: Applied
+      type: string
+      jsonPath: .status.conditions[?(@.type=="Applied")].status
+    - name: Age
+      type: date
+      jsonPath: .metadata.creationTimestamp
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            required: [region, resources]
+            oneOf:
+            - required: [secretRef]
+            - required: [role]
+            properties:
+              region:
+                type: string
+                minLength: 1
+              secretRef:
+                type: object
+                required: [name]
+                properties:
+                  name:
+                    type: string
+                    minLength: 1
+              role:
+                type: object
+                required: [arn]
+                properties:
+                  arn:
+                    type: string
+                    pattern: '^arn:aws[a-z-]*:iam::[0-9]{12}:role/.+$'
+                  serviceAccountAnnotation:
+                    type: string
+                  webIdentityTokenFile:
+                    type: string
+              resources:
+                type: array
+                minItems: 1
+                items:
+                  type: object
+                  required: [type]
+                  properties:
+                    type:
+                      type: string
+                      enum: [{{.ResourceTypes}}]
+                    dimensions:
+                      type: object
+                      additionalProperties:
+                        type: array
+                        minItems: 1
+                        items:
+                          type: string
+                          minLength: 1
+                    tags:
+                      type: object
+                      additionalProperties:
+                        type: string
+                    metrics:
+                      type: array
+                      items:
+                        type: string
+          status:
+            type: object
+            properties:
+              observedGeneration:
+                type: integer
+                format: int64
+              roleARN:
+                type: string
+              conditions:
+                type: array
+                items:
+                  type: object
+                  required: [type, status]
+                  properties:
+                    type:
+                      type: string
+                    status:
+                      type: string
+                    message:
+                      type: string
+                    lastTransitionTime:
+                      type: string
+                      format: date-time
+`
+
+// cloudwatchMonitorCRD returns the CloudWatchMonitor CRD.
+func cloudwatchMonitorCRD() (*unstructured.Unstructured, error) {
+	manifest, err := text.ResolveString(cloudwatchMonitorCRDTemplate, map[string]string{
+		"ResourceTypes": strings.Join(awsResourceTypeNames(), ", "),
+	})
+	if err != nil {
+		return nil, err
+	}
+	crd := &unstructured.Unstructured{}
+	if err := yaml.NewYAMLOrJSONDecoder(bytes.NewBufferString(manifest), 1000).Decode(&crd.Object); err != nil {
+		return nil, err
+	}
+	return crd, nil
+}
+
+// installCloudwatchCRD creates, or updates, the CloudWatchMonitor CRD and
+// waits until CloudWatchMonitors are served.
+func (cfg *agentConfig) installCloudwatchCRD(ctx context.Context) error {
+	crd, err := cloudwatchMonitorCRD()
+	if err != nil {
+		return err
+	}
+
+	client := cfg.DynamicClient.Resource(crdResource)
+	existing, err := client.Get(ctx, cloudwatchMonitorCRDName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		log.Info("Installing the CloudWatchMonitor CRD")
+		_, err = client.Create(ctx, crd, metav1.CreateOptions{})
+	case err == nil:
+		crd.SetResourceVersion(existing.GetResourceVersion())
+		_, err = client.Update(ctx, crd, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cloudwatchCRDEstablishTimeout)
+	defer cancel()
+	for {
+		crd, err := client.Get(ctx, cloudwatchMonitorCRDName, metav1.GetOptions{})
+		if err == nil && isCRDEstablished(crd) {
+			return nil
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for the CloudWatchMonitor CRD to be established: %v", ctx.Err())
+		}
+	}
+}
+
+func isCRDEstablished(crd *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if ok && condition["type"] == "Established" && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+type monitorResourceSpec struct {
+	Type string `json:"type"`
+	cloudwatchResourceOptions
+}
+
+type cloudwatchSecretRef struct {
+	Name string `json:"name"`
+}
+
+type cloudwatchMonitorSpec struct {
+	Region    string                `json:"region"`
+	SecretRef *cloudwatchSecretRef  `json:"secretRef,omitempty"`
+	Role      *cloudwatchRole       `json:"role,omitempty"`
+	Resources []monitorResourceSpec `json:"resources"`
+}
+
+// cloudwatchMonitorSpecOf returns the spec of a CloudWatchMonitor equivalent
+// to cw.
+func cloudwatchMonitorSpecOf(cw *cloudwatch) cloudwatchMonitorSpec {
+	spec := cloudwatchMonitorSpec{
+		Region: cw.Region,
+		Role:   cw.Role,
+	}
+	if cw.SecretName != "" {
+		spec.SecretRef = &cloudwatchSecretRef{Name: cw.SecretName}
+	}
+	for _, name := range cw.Resources {
+		resource := monitorResourceSpec{Type: name}
+		if options := cw.ResourceOptions[name]; options != nil {
+			resource.cloudwatchResourceOptions = *options
+		}
+		spec.Resources = append(spec.Resources, resource)
+	}
+	return spec
+}
+
+// cloudwatch returns the Cloudwatch configuration described by spec.
+func (spec *cloudwatchMonitorSpec) cloudwatch() *cloudwatch {
+	cw := &cloudwatch{
+		Region:    spec.Region,
+		Role:      spec.Role,
+		Resources: []string{},
+	}
+	if spec.SecretRef != nil {
+		cw.SecretName = spec.SecretRef.Name
+	}
+	for i := range spec.Resources {
+		resource := &spec.Resources[i]
+		cw.Resources = append(cw.Resources, resource.Type)
+		options := resource.cloudwatchResourceOptions
+		if len(options.Dimensions) == 0 && len(options.Tags) == 0 && len(options.Metrics) == 0 {
+			continue
+		}
+		if cw.ResourceOptions == nil {
+			cw.ResourceOptions = map[string]*cloudwatchResourceOptions{}
+		}
+		cw.ResourceOptions[resource.Type] = &options
+	}
+	return cw
+}
+
+// fromUnstructured converts the value of field of obj into v.
+func fromUnstructured(obj *unstructured.Unstructured, field string, v interface{}) error {
+	data, err := json.Marshal(obj.Object[field])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// toUnstructured converts v into a value of an unstructured object.
+func toUnstructured(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	err = json.Unmarshal(data, &value)
+	return value, err
+}
+
+// monitorTarget is a CloudWatchMonitor.
+type monitorTarget struct {
+	*unstructured.Unstructured
+}
+
+func (m monitorTarget) object() runtime.Object {
+	return m.Unstructured
+}
+
+func (m monitorTarget) parse() (*cloudwatch, error) {
+	// The exporters and their secrets live in weave, a monitor elsewhere
+	// would deploy them in a namespace it doesn't belong to.
+	if m.GetNamespace() != "weave" {
+		return nil, errCloudwatchMonitorNamespace
+	}
+	spec := cloudwatchMonitorSpec{}
+	if err := fromUnstructured(m.Unstructured, "spec", &spec); err != nil {
+		return nil, fmt.Errorf("cloudwatch: invalid spec: %v", err)
+	}
+	cw := spec.cloudwatch()
+	cw.setDefaults()
+	if err := validateCloudwatch(cw); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (m monitorTarget) cloudwatchStatus() *cloudwatchStatus {
+	if _, ok := m.Object["status"]; !ok {
+		return nil
+	}
+	status := &cloudwatchStatus{}
+	if err := fromUnstructured(m.Unstructured, "status", status); err != nil {
+		return nil
+	}
+	return status
+}
+
+func (m monitorTarget) writeStatus(ctx context.Context, cfg *agentConfig, status *cloudwatchStatus) error {
+	status.ObservedGeneration = m.GetGeneration()
+	value, err := toUnstructured(status)
+	if err != nil {
+		return err
+	}
+
+	monitor := m.DeepCopy()
+	monitor.Object["status"] = value
+	_, err = cfg.DynamicClient.Resource(cloudwatchMonitorResource).Namespace(m.GetNamespace()).UpdateStatus(ctx, monitor, metav1.UpdateOptions{})
+	return err
+}
+
+// Watch for CloudWatchMonitor creation/update/deletion. Monitors are watched
+// in all namespaces so the ones created outside weave are reported instead of
+// being silently ignored.
+func watchMonitors(cfg *agentConfig) {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(cfg.DynamicClient, 0, metav1.NamespaceAll, nil)
+	cfg.MonitorInformer = factory.ForResource(cloudwatchMonitorResource).Informer()
+
+	cfg.MonitorInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    cfg.handleMonitorAdd,
+		UpdateFunc: cfg.handleMonitorUpdate,
+		DeleteFunc: cfg.handleMonitorDelete,
+	})
+}
+
+// Triggered on all CloudWatchMonitor creation
+func (cfg *agentConfig) handleMonitorAdd(obj interface{}) {
+	monitor, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		log.Error("Failed to type assert CloudWatchMonitor: ", obj)
+		return
+	}
+
+	log.Debugf("CloudWatchMonitor %v/%v was created", monitor.GetNamespace(), monitor.GetName())
+
+	cfg.enqueueCloudwatch(monitorKey(monitor))
+}
+
+// Triggered on all CloudWatchMonitor update
+func (cfg *agentConfig) handleMonitorUpdate(old, cur interface{}) {
+	monitor, ok := cur.(*unstructured.Unstructured)
+	if !ok {
+		log.Error("Failed to type assert CloudWatchMonitor: ", cur)
+		return
+	}
+
+	// The generation only changes with the spec, not the status.
+	if oldMonitor, ok := old.(*unstructured.Unstructured); ok && oldMonitor.GetGeneration() == monitor.GetGeneration() {
+		return
+	}
+
+	log.Debugf("CloudWatchMonitor %v/%v was updated", monitor.GetNamespace(), monitor.GetName())
+
+	cfg.enqueueCloudwatch(monitorKey(monitor))
+}
+
+// Triggered on all CloudWatchMonitor deletion
+func (cfg *agentConfig) handleMonitorDelete(obj interface{}) {
+	monitor, ok := deletedObject(obj).(*unstructured.Unstructured)
+	if !ok {
+		log.Error("Failed to type assert CloudWatchMonitor: ", obj)
+		return
+	}
+
+	log.Infof("CloudWatchMonitor %v/%v was deleted, deleting its Cloudwatch resources", monitor.GetNamespace(), monitor.GetName())
+
+	cfg.deleteCloudwatch(cfg.handlerContext(), cloudwatchConfigUIDLabel, string(monitor.GetUID()))
+	cfg.enqueueCloudwatch(monitorKey(monitor))
+}
+
+// cloudwatchMonitorsUsing returns the CloudWatchMonitors using the Secret
+// named secretName.
+func (cfg *agentConfig) cloudwatchMonitorsUsing(secretName string) []*unstructured.Unstructured {
+	monitors := []*unstructured.Unstructured{}
+	for _, obj := range cfg.MonitorInformer.GetStore().List() {
+		monitor, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		cw, err := monitorTarget{monitor}.parse()
+		if err != nil || cw.SecretName != secretName {
+			continue
+		}
+		monitors = append(monitors, monitor)
+	}
+	return monitors
+}
+
+// newCloudwatchMonitor returns the CloudWatchMonitor mirroring the Cloudwatch
+// configuration cw of cm. The monitor is owned by cm, and deleted along with
+// it.
+func newCloudwatchMonitor(cm *apiv1.ConfigMap, cw *cloudwatch) (*unstructured.Unstructured, error) {
+	spec, err := toUnstructured(cloudwatchMonitorSpecOf(cw))
+	if err != nil {
+		return nil, err
+	}
+
+	monitor := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	monitor.SetAPIVersion(cloudwatchMonitorResource.GroupVersion().String())
+	monitor.SetKind(cloudwatchMonitorKind)
+	monitor.SetNamespace(cm.Namespace)
+	monitor.SetName(cm.Name)
+	controller := true
+	monitor.SetOwnerReferences([]metav1.OwnerReference{{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       cm.Name,
+		UID:        cm.UID,
+		Controller: &controller,
+	}})
+	return monitor, nil
+}
+
+// migratedFromUID returns the UID of the ConfigMap target was migrated from,
+// empty if it wasn't.
+func migratedFromUID(target metav1.Object) string {
+	owner := metav1.GetControllerOf(target)
+	if owner == nil || owner.APIVersion != "v1" || owner.Kind != "ConfigMap" {
+		return ""
+	}
+	return string(owner.UID)
+}
+
+// migrateConfigMap creates, or updates, the CloudWatchMonitor mirroring the
+// Cloudwatch ConfigMap cm. Changes to cm keep being carried over to the
+// monitor. It returns the monitor, nil when cm is invalid.
+func (cfg *agentConfig) migrateConfigMap(ctx context.Context, cm *apiv1.ConfigMap) (*unstructured.Unstructured, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.APITimeout)
+	defer cancel()
+
+	cw, err := parseCloudwatchConfigMap(cm)
+	if err != nil {
+		// Retrying won't help, the ConfigMap has to be fixed.
+		status := newCloudwatchStatus()
+		status.set(cloudwatchParsed, err)
+		log.Errorf("ConfigMap %s/%s: %v", cm.Namespace, cm.Name, err)
+		cfg.reportCloudwatchStatus(ctx, configMapTarget{cm}, status, apiv1.EventTypeWarning, reasonCloudwatchInvalid, err.Error())
+		return nil, nil
+	}
+
+	monitor, err := newCloudwatchMonitor(cm, cw)
+	if err != nil {
+		return nil, err
+	}
+	client := cfg.DynamicClient.Resource(cloudwatchMonitorResource).Namespace(cm.Namespace)
+	existing, err := client.Get(ctx, cm.Name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		monitor, err = client.Create(ctx, monitor, metav1.CreateOptions{})
+	case err == nil && !metav1.IsControlledBy(existing, cm):
+		err = fmt.Errorf("CloudWatchMonitor %s/%s already exists", cm.Namespace, cm.Name)
+	case err == nil && reflect.DeepEqual(existing.Object["spec"], monitor.Object["spec"]):
+		// Already migrated.
+		return existing, nil
+	case err == nil:
+		existing = existing.DeepCopy()
+		existing.Object["spec"] = monitor.Object["spec"]
+		monitor, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+
+	if err != nil {
+		if cfg.Recorder != nil {
+			cfg.Recorder.Event(cm, apiv1.EventTypeWarning, reasonCloudwatchMigrationFailed, err.Error())
+		}
+		return nil, fmt.Errorf("migrating ConfigMap %s/%s: %v", cm.Namespace, cm.Name, err)
+	}
+	if cfg.Recorder != nil {
+		cfg.Recorder.Eventf(cm, apiv1.EventTypeNormal, reasonCloudwatchMigrated,
+			"Cloudwatch configuration migrated to CloudWatchMonitor %s/%s", cm.Namespace, cm.Name)
+	}
+	return monitor, nil
+}
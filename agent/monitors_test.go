@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func newTestDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		crdResource:               "CustomResourceDefinitionList",
+		cloudwatchMonitorResource: "CloudWatchMonitorList",
+	}, objects...)
+}
+
+func TestCloudwatchMonitorCRD(t *testing.T) {
+	crd, err := cloudwatchMonitorCRD()
+	assert.NoError(t, err)
+	assert.Equal(t, cloudwatchMonitorCRDName, crd.GetName())
+
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	if assert.Len(t, versions, 1) {
+		enum, _, _ := unstructured.NestedStringSlice(versions[0].(map[string]interface{}),
+			"schema", "openAPIV3Schema", "properties", "spec", "properties", "resources", "items", "properties", "type", "enum")
+		assert.Equal(t, awsResourceTypeNames(), enum)
+	}
+}
+
+func TestCloudwatchMonitorSpec(t *testing.T) {
+	cw, err := parseCloudwatchYaml(testCloudwatchConfigOptions)
+	assert.NoError(t, err)
+
+	spec := cloudwatchMonitorSpecOf(cw)
+	assert.Equal(t, "cloudwatch", spec.SecretRef.Name)
+	assert.Len(t, spec.Resources, 3)
+	assert.Equal(t, "ec2", spec.Resources[0].Type)
+	assert.Equal(t, []string{"CPUUtilization", "NetworkIn"}, spec.Resources[0].Metrics)
+	assert.Equal(t, cw, spec.cloudwatch())
+
+	cw, err = parseCloudwatchYaml(testCloudwatchConfigRole)
+	assert.NoError(t, err)
+	spec = cloudwatchMonitorSpecOf(cw)
+	assert.Nil(t, spec.SecretRef)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/cloudwatch-exporter", spec.Role.ARN)
+	assert.Equal(t, cw, spec.cloudwatch())
+}
+
+func TestMonitorTargetParse(t *testing.T) {
+	monitor := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"namespace": "weave", "name": "cloudwatch"},
+		"spec": map[string]interface{}{
+			"region":    "us-east-1",
+			"secretRef": map[string]interface{}{"name": "cloudwatch"},
+			"resources": []interface{}{
+				map[string]interface{}{"type": "sqs", "metrics": []interface{}{"NumberOfMessagesSent"}},
+			},
+		},
+	}}
+	cw, err := monitorTarget{monitor}.parse()
+	assert.NoError(t, err)
+	assert.Equal(t, &cloudwatch{
+		Region:     "us-east-1",
+		SecretName: "cloudwatch",
+		Resources:  []string{"sqs"},
+		ResourceOptions: map[string]*cloudwatchResourceOptions{
+			"sqs": {Metrics: []string{"NumberOfMessagesSent"}},
+		},
+	}, cw)
+
+	unstructured.SetNestedSlice(monitor.Object, []interface{}{
+		map[string]interface{}{"type": "sqs", "metrics": []interface{}{"Invocations"}},
+	}, "spec", "resources")
+	_, err = monitorTarget{monitor}.parse()
+	assert.Error(t, err)
+}
+
+func TestMonitorOutsideWeave(t *testing.T) {
+	monitor := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"region":    "us-east-1",
+			"secretRef": map[string]interface{}{"name": "cloudwatch"},
+			"resources": []interface{}{map[string]interface{}{"type": "sqs"}},
+		},
+	}}
+	monitor.SetAPIVersion(cloudwatchMonitorResource.GroupVersion().String())
+	monitor.SetKind(cloudwatchMonitorKind)
+	monitor.SetNamespace("default")
+	monitor.SetName("cloudwatch")
+	client := newTestDynamicClient(monitor)
+	recorder := record.NewFakeRecorder(10)
+	cfg := &agentConfig{
+		APITimeout:    time.Minute,
+		KubeClient:    fake.NewSimpleClientset(),
+		DynamicClient: client,
+		Recorder:      recorder,
+	}
+	ctx := context.Background()
+
+	// Monitors outside weave are reported, not deployed.
+	in, err := cfg.getCloudwatchInputs(ctx, monitorTarget{monitor})
+	assert.NoError(t, err)
+	url, err := cfg.installCloudwatch(ctx, monitorTarget{monitor}, in)
+	assert.NoError(t, err)
+	assert.Empty(t, url)
+	assert.Equal(t, "Warning WrongNamespace "+errCloudwatchMonitorNamespace.Error(), <-recorder.Events)
+
+	current, err := client.Resource(cloudwatchMonitorResource).Namespace("default").Get(ctx, "cloudwatch", metav1.GetOptions{})
+	assert.NoError(t, err)
+	status := monitorTarget{current}.cloudwatchStatus()
+	if assert.NotNil(t, status) {
+		assert.Equal(t, apiv1.ConditionFalse, conditionStatuses(status)[cloudwatchParsed])
+	}
+
+	// And they don't hold on to secrets.
+	cfg.MonitorInformer = cache.NewSharedIndexInformer(nil, &unstructured.Unstructured{}, 0, cache.Indexers{})
+	assert.NoError(t, cfg.MonitorInformer.GetStore().Add(monitor))
+	assert.Empty(t, cfg.cloudwatchMonitorsUsing("cloudwatch"))
+}
+
+func TestMigrateConfigMap(t *testing.T) {
+	cm := cloudwatchConfigMap("cloudwatch", nil, testCloudwatchConfig)
+	cm.UID = "cm-uid"
+	invalid := cloudwatchConfigMap("invalid", nil, testCloudwatchConfigNoResources)
+	client := newTestDynamicClient()
+	recorder := record.NewFakeRecorder(10)
+	cfg := &agentConfig{
+		APITimeout:    time.Minute,
+		KubeClient:    fake.NewSimpleClientset(invalid),
+		DynamicClient: client,
+		Recorder:      recorder,
+	}
+	monitors := client.Resource(cloudwatchMonitorResource).Namespace("weave")
+	getSpec := func() *cloudwatchMonitorSpec {
+		monitor, err := monitors.Get(context.Background(), "cloudwatch", metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.True(t, metav1.IsControlledBy(monitor, cm))
+		spec := &cloudwatchMonitorSpec{}
+		assert.NoError(t, fromUnstructured(monitor, "spec", spec))
+		return spec
+	}
+
+	// Created.
+	monitor, err := cfg.migrateConfigMap(context.Background(), cm)
+	assert.NoError(t, err)
+	assert.NotNil(t, monitor)
+	assert.Equal(t, "us-east-1", getSpec().Region)
+	assert.Equal(t, "Normal Migrated Cloudwatch configuration migrated to CloudWatchMonitor weave/cloudwatch", <-recorder.Events)
+
+	// Changes to the ConfigMap are carried over.
+	cm.Data[cloudwatchConfigKey] = testCloudwatchConfigOptions
+	_, err = cfg.migrateConfigMap(context.Background(), cm)
+	assert.NoError(t, err)
+	assert.Len(t, getSpec().Resources, 3)
+	<-recorder.Events
+
+	// Migrating it again changes nothing.
+	_, err = cfg.migrateConfigMap(context.Background(), cm)
+	assert.NoError(t, err)
+	assert.Empty(t, recorder.Events)
+
+	// Monitors not created from the ConfigMap are left alone.
+	other := cloudwatchConfigMap("cloudwatch", nil, testCloudwatchConfig)
+	other.UID = "other-uid"
+	_, err = cfg.migrateConfigMap(context.Background(), other)
+	assert.Error(t, err)
+	assert.Len(t, getSpec().Resources, 3)
+	assert.Equal(t, "Warning MigrationFailed CloudWatchMonitor weave/cloudwatch already exists", <-recorder.Events)
+
+	// Invalid configurations aren't migrated.
+	monitor, err = cfg.migrateConfigMap(context.Background(), invalid)
+	assert.NoError(t, err)
+	assert.Nil(t, monitor)
+	assert.Contains(t, <-recorder.Events, "Warning InvalidConfig")
+	_, err = monitors.Get(context.Background(), "invalid", metav1.GetOptions{})
+	assert.Error(t, err)
+}
+
+func TestMigratedMonitorTakesOverConfigMapObjects(t *testing.T) {
+	cm := cloudwatchConfigMap("cloudwatch", nil, testCloudwatchConfig)
+	cm.UID = "cm-uid"
+	secret := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "weave", Name: "cloudwatch", UID: "secret-uid"},
+		Data:       testCredentials(),
+	}
+	c := newTestKubectl()
+	recorder := record.NewFakeRecorder(10)
+	cfg := &agentConfig{
+		KubernetesVersion: "v1.9.3",
+		WCHostname:        "cloud.weave.works",
+		APITimeout:        time.Minute,
+		KubeClient:        fake.NewSimpleClientset(cm, secret),
+		DynamicClient:     newTestDynamicClient(),
+		KubectlClient:     c,
+		Recorder:          recorder,
+	}
+	ctx := context.Background()
+	get := "get --namespace=weave --ignore-not-found deployment.apps/cloudwatch-exporter -ojson"
+	install := func(target cloudwatchTarget) (string, error) {
+		url := "https://cloud.weave.works/k8s/v1.9/cloudwatch.yaml?aws-region=us-east-1&aws-secret=cloudwatch&aws-resources=rds%2Cclassic-elb" +
+			"&aws-config=cloudwatch&aws-config-uid=" + string(target.GetUID()) + "&aws-secret-uid=secret-uid"
+		c.responses["apply --dry-run=client -f "+url+" -o name"] = "deployment.apps/cloudwatch-exporter\n"
+		c.responses["apply -f "+url+" -o name"] = "deployment.apps/cloudwatch-exporter\n"
+		c.responses["label --overwrite --namespace=weave deployment.apps/cloudwatch-exporter "+
+			"cloudwatch.weave.works/config-uid="+string(target.GetUID())+" cloudwatch.weave.works/secret-uid=secret-uid"] = ""
+		in, err := cfg.getCloudwatchInputs(ctx, target)
+		assert.NoError(t, err)
+		return cfg.installCloudwatch(ctx, target, in)
+	}
+
+	// The ConfigMap was deployed before CloudWatchMonitors were available.
+	c.responses[get] = ""
+	url, err := install(configMapTarget{cm})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, url)
+	assert.Equal(t, "Normal Applied Cloudwatch deployed for rds, classic-elb in us-east-1", <-recorder.Events)
+
+	// Its monitor takes its objects over.
+	monitor, err := cfg.migrateConfigMap(ctx, cm)
+	assert.NoError(t, err)
+	<-recorder.Events
+	monitor.SetUID("monitor-uid")
+	c.responses[get] = `{"kind": "Deployment", "metadata": {"name": "cloudwatch-exporter", "namespace": "weave",
+	  "labels": {"cloudwatch.weave.works/config-uid": "cm-uid"}}}`
+	c.commands = nil
+	url, err = install(monitorTarget{monitor})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, url)
+	assert.Contains(t, c.commands, "label --overwrite --namespace=weave deployment.apps/cloudwatch-exporter "+
+		"cloudwatch.weave.works/config-uid=monitor-uid cloudwatch.weave.works/secret-uid=secret-uid")
+	assert.Equal(t, "Normal Applied Cloudwatch deployed for rds, classic-elb in us-east-1", <-recorder.Events)
+
+	// The objects of other configurations are still left alone.
+	c.responses[get] = `{"kind": "Deployment", "metadata": {"name": "cloudwatch-exporter", "namespace": "weave",
+	  "labels": {"cloudwatch.weave.works/config-uid": "other-uid"}}}`
+	url, err = install(monitorTarget{monitor})
+	assert.NoError(t, err)
+	assert.Empty(t, url)
+	assert.Contains(t, <-recorder.Events, "Warning Conflict")
+}
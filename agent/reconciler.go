@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/weaveworks/launcher/pkg/kubectl"
+)
+
+// Results of a Cloudwatch reconciliation, as reported in metrics.
+const (
+	reconcileApplied   = "applied"
+	reconcileUnchanged = "unchanged"
+	reconcileInvalid   = "invalid"
+	reconcileFailed    = "failed"
+)
+
+var (
+	cloudwatchReconcilesNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "cloudwatch",
+			Name:      "reconciles_total",
+			Help:      "The total number of Cloudwatch configurations reconciled, by result.",
+		}, []string{"result"})
+	cloudwatchDriftRepairsNum = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "cloudwatch",
+			Name:      "drift_repairs_total",
+			Help:      "The total number of Cloudwatch manifests re-applied because the deployed objects had been changed.",
+		})
+	cloudwatchQueueLength = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "launcher",
+			Subsystem: "cloudwatch",
+			Name:      "queue_length",
+			Help:      "The number of Cloudwatch configurations waiting to be reconciled.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(cloudwatchReconcilesNum)
+	prometheus.MustRegister(cloudwatchDriftRepairsNum)
+	prometheus.MustRegister(cloudwatchQueueLength)
+}
+
+const (
+	// Retries of a failed reconciliation back off exponentially between
+	// these delays.
+	reconcileBaseDelay = time.Second
+	reconcileMaxDelay  = 5 * time.Minute
+	// At most reconcileRate kubectl apply or diff, with bursts of
+	// reconcileBurst.
+	reconcileRate  = rate.Limit(1)
+	reconcileBurst = 10
+)
+
+// cloudwatchKey identifies a ConfigMap or a CloudWatchMonitor holding a
+// Cloudwatch configuration.
+type cloudwatchKey struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+func (k cloudwatchKey) String() string {
+	return fmt.Sprintf("%s %s/%s", k.kind, k.namespace, k.name)
+}
+
+func configMapKey(cm *apiv1.ConfigMap) cloudwatchKey {
+	return cloudwatchKey{kind: "ConfigMap", namespace: cm.Namespace, name: cm.Name}
+}
+
+func monitorKey(monitor *unstructured.Unstructured) cloudwatchKey {
+	return cloudwatchKey{kind: cloudwatchMonitorKind, namespace: monitor.GetNamespace(), name: monitor.GetName()}
+}
+
+// cloudwatchDeployment is the outcome of the last reconciliation of a
+// Cloudwatch configuration.
+type cloudwatchDeployment struct {
+	hash string
+	// url is the manifest applied, empty when the configuration couldn't be
+	// deployed.
+	url string
+}
+
+// cloudwatchReconciler deploys the Cloudwatch configurations queued, skipping
+// those whose inputs didn't change since they were last deployed. It
+// periodically checks the deployed objects and re-applies the manifests they
+// drifted from.
+type cloudwatchReconciler struct {
+	cfg            *agentConfig
+	queue          workqueue.RateLimitingInterface
+	limiter        *rate.Limiter
+	resyncInterval time.Duration
+
+	lock     sync.Mutex
+	deployed map[cloudwatchKey]cloudwatchDeployment
+	// checks holds the configurations whose objects are checked for drift
+	// on their next reconciliation.
+	checks map[cloudwatchKey]bool
+}
+
+// newCloudwatchReconciler returns a reconciler checking for drift every
+// resyncInterval, never when 0.
+func newCloudwatchReconciler(cfg *agentConfig, resyncInterval time.Duration) *cloudwatchReconciler {
+	return &cloudwatchReconciler{
+		cfg: cfg,
+		queue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.NewItemExponentialFailureRateLimiter(reconcileBaseDelay, reconcileMaxDelay), "cloudwatch"),
+		limiter:        rate.NewLimiter(reconcileRate, reconcileBurst),
+		resyncInterval: resyncInterval,
+		deployed:       map[cloudwatchKey]cloudwatchDeployment{},
+		checks:         map[cloudwatchKey]bool{},
+	}
+}
+
+// enqueueCloudwatch queues the Cloudwatch configuration key for
+// reconciliation. Nothing is deployed until the reconciler is set up.
+func (cfg *agentConfig) enqueueCloudwatch(key cloudwatchKey) {
+	if cfg.CloudwatchReconciler == nil {
+		return
+	}
+	cfg.CloudwatchReconciler.queue.Add(key)
+	cloudwatchQueueLength.Set(float64(cfg.CloudwatchReconciler.queue.Len()))
+}
+
+// Run reconciles the queued configurations until ctx is done.
+func (r *cloudwatchReconciler) Run(ctx context.Context) {
+	defer r.queue.ShutDown()
+
+	go func() {
+		for r.processNextItem(ctx) {
+		}
+	}()
+
+	if r.resyncInterval == 0 {
+		<-ctx.Done()
+		return
+	}
+	ticker := time.NewTicker(r.resyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.resync()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resync queues all the configurations, checking their objects for drift.
+// ConfigMaps are migrated again when CloudWatchMonitors are available, which
+// restores the monitors changed or deleted since.
+func (r *cloudwatchReconciler) resync() {
+	keys := []cloudwatchKey{}
+	if r.cfg.CMInformer != nil {
+		for _, obj := range r.cfg.CMInformer.GetStore().List() {
+			if cm, ok := obj.(*apiv1.ConfigMap); ok && r.cfg.isCloudwatchConfigMap(cm) {
+				keys = append(keys, configMapKey(cm))
+			}
+		}
+	}
+	if r.cfg.MonitorInformer != nil {
+		for _, obj := range r.cfg.MonitorInformer.GetStore().List() {
+			if monitor, ok := obj.(*unstructured.Unstructured); ok {
+				keys = append(keys, monitorKey(monitor))
+			}
+		}
+	}
+
+	r.lock.Lock()
+	for _, key := range keys {
+		r.checks[key] = true
+	}
+	r.lock.Unlock()
+	for _, key := range keys {
+		r.cfg.enqueueCloudwatch(key)
+	}
+}
+
+func (r *cloudwatchReconciler) processNextItem(ctx context.Context) bool {
+	item, shutdown := r.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.queue.Done(item)
+	cloudwatchQueueLength.Set(float64(r.queue.Len()))
+
+	key := item.(cloudwatchKey)
+	if err := r.reconcile(ctx, key); err != nil {
+		cloudwatchReconcilesNum.WithLabelValues(reconcileFailed).Inc()
+		log.Errorf("Error while reconciling cloudwatch for %s, retrying: %v", key, err)
+		r.queue.AddRateLimited(key)
+		return true
+	}
+	r.queue.Forget(key)
+	return true
+}
+
+// target returns the object holding the configuration key, nil if it's gone.
+func (r *cloudwatchReconciler) target(key cloudwatchKey) cloudwatchTarget {
+	storeKey := key.namespace + "/" + key.name
+	switch {
+	case key.kind == "ConfigMap" && r.cfg.CMInformer != nil:
+		obj, _, _ := r.cfg.CMInformer.GetStore().GetByKey(storeKey)
+		if cm, ok := obj.(*apiv1.ConfigMap); ok && r.cfg.isCloudwatchConfigMap(cm) {
+			return configMapTarget{cm}
+		}
+	case key.kind == cloudwatchMonitorKind && r.cfg.MonitorInformer != nil:
+		obj, _, _ := r.cfg.MonitorInformer.GetStore().GetByKey(storeKey)
+		if monitor, ok := obj.(*unstructured.Unstructured); ok {
+			return monitorTarget{monitor}
+		}
+	}
+	return nil
+}
+
+// reconcile deploys the configuration key if its inputs changed since it was
+// last deployed, or if its objects drifted when they are to be checked.
+func (r *cloudwatchReconciler) reconcile(ctx context.Context, key cloudwatchKey) error {
+	target := r.target(key)
+	if target == nil {
+		// Deleted, along with its objects.
+		r.lock.Lock()
+		delete(r.deployed, key)
+		delete(r.checks, key)
+		r.lock.Unlock()
+		return nil
+	}
+
+	if cm, ok := target.(configMapTarget); ok && r.cfg.CloudwatchMonitors {
+		return r.migrate(ctx, key, cm.ConfigMap)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.KubectlTimeout)
+	defer cancel()
+
+	in, err := r.cfg.getCloudwatchInputs(ctx, target)
+	if err != nil {
+		return err
+	}
+	if in.secretErr != nil && !apierrors.IsNotFound(in.secretErr) {
+		return in.secretErr
+	}
+	hash := in.hash()
+
+	r.lock.Lock()
+	deployed, ok := r.deployed[key]
+	check := r.checks[key]
+	delete(r.checks, key)
+	r.lock.Unlock()
+
+	if ok && deployed.hash == hash {
+		if !check || deployed.url == "" {
+			cloudwatchReconcilesNum.WithLabelValues(reconcileUnchanged).Inc()
+			return nil
+		}
+		drifted, err := r.diff(ctx, deployed.url)
+		if err != nil {
+			r.lock.Lock()
+			r.checks[key] = true
+			r.lock.Unlock()
+			return err
+		}
+		if !drifted {
+			cloudwatchReconcilesNum.WithLabelValues(reconcileUnchanged).Inc()
+			return nil
+		}
+		log.Infof("Cloudwatch objects of %s drifted from their manifest, re-applying it", key)
+		cloudwatchDriftRepairsNum.Inc()
+	}
+
+	if err := r.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	url, err := r.cfg.installCloudwatch(ctx, target, in)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.deployed[key] = cloudwatchDeployment{hash: hash, url: url}
+	r.lock.Unlock()
+	if url == "" {
+		cloudwatchReconcilesNum.WithLabelValues(reconcileInvalid).Inc()
+	} else {
+		cloudwatchReconcilesNum.WithLabelValues(reconcileApplied).Inc()
+	}
+	return nil
+}
+
+// migrate migrates the Cloudwatch ConfigMap cm to a CloudWatchMonitor, the
+// monitor is then reconciled on its own.
+func (r *cloudwatchReconciler) migrate(ctx context.Context, key cloudwatchKey, cm *apiv1.ConfigMap) error {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", cm.UID, cm.Data[cloudwatchConfigKey])
+	hash := fmt.Sprintf("%x", h.Sum(nil))
+
+	r.lock.Lock()
+	deployed, ok := r.deployed[key]
+	check := r.checks[key]
+	delete(r.checks, key)
+	r.lock.Unlock()
+
+	if ok && deployed.hash == hash && !check {
+		cloudwatchReconcilesNum.WithLabelValues(reconcileUnchanged).Inc()
+		return nil
+	}
+
+	monitor, err := r.cfg.migrateConfigMap(ctx, cm)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.deployed[key] = cloudwatchDeployment{hash: hash}
+	r.lock.Unlock()
+	if monitor == nil {
+		cloudwatchReconcilesNum.WithLabelValues(reconcileInvalid).Inc()
+	} else {
+		cloudwatchReconcilesNum.WithLabelValues(reconcileApplied).Inc()
+	}
+	return nil
+}
+
+// diff returns whether the objects deployed differ from the manifest at url.
+func (r *cloudwatchReconciler) diff(ctx context.Context, url string) (bool, error) {
+	if err := r.limiter.Wait(ctx); err != nil {
+		return false, err
+	}
+	return kubectl.Diff(ctx, r.cfg.KubectlClient, url)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e exitError) ExitCode() int { return int(e) }
+
+// driftKubectl answers kubectl diff according to drifted.
+type driftKubectl struct {
+	*testKubectl
+	drifted bool
+}
+
+func (c *driftKubectl) ExecuteOutputMatrix(ctx context.Context, args ...string) (string, string, error) {
+	c.commands = append(c.commands, strings.Join(args, " "))
+	if c.drifted {
+		return "", "", exitError(1)
+	}
+	return "", "", nil
+}
+
+func TestCloudwatchReconciler(t *testing.T) {
+	cm := cloudwatchConfigMap("cloudwatch", nil, testCloudwatchConfig)
+	cm.UID = "cm-uid"
+	secret := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "weave", Name: "cloudwatch", UID: "secret-uid"},
+		Data:       testCredentials(),
+	}
+	c := &driftKubectl{testKubectl: newTestKubectl()}
+	url := "https://cloud.weave.works/k8s/v1.9/cloudwatch.yaml?aws-region=us-east-1&aws-secret=cloudwatch&aws-resources=rds%2Cclassic-elb&aws-config=cloudwatch&aws-config-uid=cm-uid&aws-secret-uid=secret-uid"
+	dryRun := "apply --dry-run=client -f " + url + " -o name"
+	c.responses[dryRun] = "deployment.apps/cloudwatch-exporter\n"
+	get := "get --namespace=weave --ignore-not-found deployment.apps/cloudwatch-exporter -ojson"
+	c.responses[get] = ""
+	apply := "apply -f " + url + " -o name"
+	c.responses[apply] = "deployment.apps/cloudwatch-exporter\n"
+	label := "label --overwrite --namespace=weave deployment.apps/cloudwatch-exporter " +
+		"cloudwatch.weave.works/config-uid=cm-uid cloudwatch.weave.works/secret-uid=secret-uid"
+	c.responses[label] = ""
+
+	cfg := &agentConfig{
+		KubernetesVersion: "v1.9.3",
+		WCHostname:        "cloud.weave.works",
+		KubectlTimeout:    time.Minute,
+		KubeClient:        fake.NewSimpleClientset(cm, secret),
+		KubectlClient:     c,
+		CMInformer:        cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.ConfigMap{}, 0, cache.Indexers{}),
+	}
+	assert.NoError(t, cfg.CMInformer.GetStore().Add(cm))
+	r := newCloudwatchReconciler(cfg, time.Minute)
+	cfg.CloudwatchReconciler = r
+	ctx := context.Background()
+	reconcile := func() []string {
+		c.commands = nil
+		assert.True(t, r.processNextItem(ctx))
+		return c.commands
+	}
+
+	// Deployed.
+	cfg.enqueueCloudwatch(configMapKey(cm))
+	assert.Equal(t, []string{dryRun, get, apply, label}, reconcile())
+
+	// Nothing changed.
+	cfg.conformSecret(secret)
+	assert.Empty(t, reconcile())
+
+	// The deployed objects are checked.
+	r.resync()
+	assert.Equal(t, []string{"diff -f " + url}, reconcile())
+
+	// And re-applied when they drifted.
+	c.drifted = true
+	r.resync()
+	assert.Equal(t, []string{"diff -f " + url, dryRun, get, apply, label}, reconcile())
+
+	// Inputs changed.
+	secret.Data["secret-access-key"] = []byte(strings.ToUpper(testSecretAccessKey))
+	_, err := cfg.KubeClient.CoreV1().Secrets("weave").Update(ctx, secret, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	cfg.conformSecret(secret)
+	assert.Equal(t, []string{dryRun, get, apply, label}, reconcile())
+
+	// Conflicts aren't retried until the inputs change.
+	c.responses[get] = `{"kind": "Deployment", "metadata": {"name": "cloudwatch-exporter", "namespace": "weave",
+	  "labels": {"cloudwatch.weave.works/config-uid": "other-uid"}}}`
+	r.resync()
+	assert.Equal(t, []string{"diff -f " + url, dryRun, get}, reconcile())
+	assert.Equal(t, 0, r.queue.NumRequeues(configMapKey(cm)))
+	assert.Empty(t, r.deployed[configMapKey(cm)].url)
+	r.resync()
+	assert.Empty(t, reconcile())
+	c.responses[get] = ""
+
+	// Failed applies are retried.
+	delete(c.responses, apply)
+	secret.Data["secret-access-key"] = []byte(testSecretAccessKey)
+	_, err = cfg.KubeClient.CoreV1().Secrets("weave").Update(ctx, secret, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	cfg.conformSecret(secret)
+	assert.Equal(t, []string{dryRun, get, apply}, reconcile())
+	assert.Equal(t, 1, r.queue.NumRequeues(configMapKey(cm)))
+
+	// Deleted.
+	assert.NoError(t, cfg.CMInformer.GetStore().Delete(cm))
+	r.queue.Forget(configMapKey(cm))
+	cfg.enqueueCloudwatch(configMapKey(cm))
+	assert.Empty(t, reconcile())
+	assert.Empty(t, r.deployed)
+}
+
+func TestCloudwatchReconcilerMigration(t *testing.T) {
+	cm := cloudwatchConfigMap("cloudwatch", nil, testCloudwatchConfig)
+	cm.UID = "cm-uid"
+	client := newTestDynamicClient()
+	failures := 1
+	client.PrependReactor("create", "cloudwatchmonitors", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if failures == 0 {
+			return false, nil, nil
+		}
+		failures--
+		return true, nil, errors.New("connection refused")
+	})
+	cfg := &agentConfig{
+		APITimeout:         time.Minute,
+		KubeClient:         fake.NewSimpleClientset(cm),
+		DynamicClient:      client,
+		CMInformer:         cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.ConfigMap{}, 0, cache.Indexers{}),
+		CloudwatchMonitors: true,
+	}
+	assert.NoError(t, cfg.CMInformer.GetStore().Add(cm))
+	r := newCloudwatchReconciler(cfg, time.Minute)
+	cfg.CloudwatchReconciler = r
+	ctx := context.Background()
+	monitors := client.Resource(cloudwatchMonitorResource).Namespace("weave")
+
+	// Failed migrations are retried.
+	cfg.enqueueCloudwatch(configMapKey(cm))
+	assert.True(t, r.processNextItem(ctx))
+	assert.Equal(t, 1, r.queue.NumRequeues(configMapKey(cm)))
+	assert.True(t, r.processNextItem(ctx))
+	_, err := monitors.Get(ctx, "cloudwatch", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, r.queue.NumRequeues(configMapKey(cm)))
+
+	// Monitors deleted since are migrated again on resync.
+	assert.NoError(t, monitors.Delete(ctx, "cloudwatch", metav1.DeleteOptions{}))
+	cfg.enqueueCloudwatch(configMapKey(cm))
+	assert.True(t, r.processNextItem(ctx))
+	_, err = monitors.Get(ctx, "cloudwatch", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	r.resync()
+	assert.True(t, r.processNextItem(ctx))
+	_, err = monitors.Get(ctx, "cloudwatch", metav1.GetOptions{})
+	assert.NoError(t, err)
+}
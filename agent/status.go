@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Annotation holding the status of a Cloudwatch configuration on its
+// ConfigMap. CloudWatchMonitors have a status subresource instead.
+const cloudwatchStatusAnnotation = "cloudwatch.weave.works/status"
+
+// Types of the conditions of a Cloudwatch configuration.
+const (
+	cloudwatchParsed      = "Parsed"
+	cloudwatchSecretFound = "SecretFound"
+	cloudwatchSecretValid = "SecretValid"
+	cloudwatchApplied     = "Applied"
+)
+
+// Reasons of the Kubernetes events recorded on Cloudwatch ConfigMaps.
+const (
+	reasonCloudwatchInvalid        = "InvalidConfig"
+	reasonCloudwatchWrongNamespace = "WrongNamespace"
+	reasonCloudwatchSecretNotFound = "SecretNotFound"
+	reasonCloudwatchInvalidSecret  = "InvalidSecret"
+	reasonCloudwatchApplyFailed    = "ApplyFailed"
+	reasonCloudwatchConflict       = "Conflict"
+	reasonCloudwatchApplied        = "Applied"
+)
+
+type cloudwatchCondition struct {
+	Type   string                `json:"type"`
+	Status apiv1.ConditionStatus `json:"status"`
+	// Message is the error, if any.
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+// cloudwatchStatus is the outcome of the last deployment of a Cloudwatch
+// configuration.
+type cloudwatchStatus struct {
+	// ObservedGeneration is the generation of the CloudWatchMonitor the
+	// status is about.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// RoleARN is the IAM role assumed by the exporter, if any.
+	RoleARN    string                `json:"roleARN,omitempty"`
+	Conditions []cloudwatchCondition `json:"conditions"`
+}
+
+// newCloudwatchStatus returns a status with all the conditions unknown.
+func newCloudwatchStatus() *cloudwatchStatus {
+	status := &cloudwatchStatus{}
+	for _, t := range []string{cloudwatchParsed, cloudwatchSecretFound, cloudwatchSecretValid, cloudwatchApplied} {
+		status.Conditions = append(status.Conditions, cloudwatchCondition{
+			Type:   t,
+			Status: apiv1.ConditionUnknown,
+		})
+	}
+	return status
+}
+
+// set sets the condition of type t, err being nil when it holds.
+func (s *cloudwatchStatus) set(t string, err error) {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type != t {
+			continue
+		}
+		s.Conditions[i].Status = apiv1.ConditionTrue
+		s.Conditions[i].Message = ""
+		if err != nil {
+			s.Conditions[i].Status = apiv1.ConditionFalse
+			s.Conditions[i].Message = err.Error()
+		}
+	}
+}
+
+// remove removes the conditions of the given types, those not relevant to
+// the configuration.
+func (s *cloudwatchStatus) remove(types ...string) {
+	conditions := []cloudwatchCondition{}
+	for _, condition := range s.Conditions {
+		if !contains(types, condition.Type) {
+			conditions = append(conditions, condition)
+		}
+	}
+	s.Conditions = conditions
+}
+
+// update sets the transition times of the conditions of s: conditions that
+// didn't change since previous keep their time, others transition at now.
+func (s *cloudwatchStatus) update(previous *cloudwatchStatus, now time.Time) {
+	for i := range s.Conditions {
+		cur := &s.Conditions[i]
+		cur.LastTransitionTime = now.UTC()
+		if previous == nil {
+			continue
+		}
+		for _, old := range previous.Conditions {
+			if old.Type == cur.Type && old.Status == cur.Status && old.Message == cur.Message {
+				cur.LastTransitionTime = old.LastTransitionTime
+			}
+		}
+	}
+}
+
+// cloudwatchTarget is an object holding a Cloudwatch configuration: a
+// ConfigMap or a CloudWatchMonitor. The status of the configuration is
+// written back onto it.
+type cloudwatchTarget interface {
+	metav1.Object
+	// object returns the object events are recorded on.
+	object() runtime.Object
+	// parse returns the Cloudwatch configuration.
+	parse() (*cloudwatch, error)
+	// cloudwatchStatus returns the status last written, nil if there is none.
+	cloudwatchStatus() *cloudwatchStatus
+	writeStatus(ctx context.Context, cfg *agentConfig, status *cloudwatchStatus) error
+}
+
+// configMapTarget holds the Cloudwatch configuration in its cloudwatch.yaml
+// key, and its status in an annotation.
+type configMapTarget struct {
+	*apiv1.ConfigMap
+}
+
+func (cm configMapTarget) object() runtime.Object {
+	return cm.ConfigMap
+}
+
+func (cm configMapTarget) parse() (*cloudwatch, error) {
+	return parseCloudwatchConfigMap(cm.ConfigMap)
+}
+
+func (cm configMapTarget) cloudwatchStatus() *cloudwatchStatus {
+	value, ok := cm.Annotations[cloudwatchStatusAnnotation]
+	if !ok {
+		return nil
+	}
+	status := &cloudwatchStatus{}
+	if err := json.Unmarshal([]byte(value), status); err != nil {
+		return nil
+	}
+	return status
+}
+
+func (cm configMapTarget) writeStatus(ctx context.Context, cfg *agentConfig, status *cloudwatchStatus) error {
+	value, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	if cm.Annotations[cloudwatchStatusAnnotation] == string(value) {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				cloudwatchStatusAnnotation: string(value),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = cfg.KubeClient.CoreV1().ConfigMaps(cm.Namespace).Patch(ctx, cm.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// reportCloudwatchStatus writes status on target, and records a Kubernetes
+// event on it.
+func (cfg *agentConfig) reportCloudwatchStatus(ctx context.Context, target cloudwatchTarget, status *cloudwatchStatus, eventType, reason, message string) {
+	if cfg.Recorder != nil {
+		cfg.Recorder.Event(target.object(), eventType, reason, message)
+	}
+
+	status.update(target.cloudwatchStatus(), time.Now())
+	if err := target.writeStatus(ctx, cfg, status); err != nil {
+		log.Errorf("Error while writing the cloudwatch status of %s/%s: %v", target.GetNamespace(), target.GetName(), err)
+	}
+}
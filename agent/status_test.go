@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func conditionStatuses(status *cloudwatchStatus) map[string]apiv1.ConditionStatus {
+	statuses := map[string]apiv1.ConditionStatus{}
+	for _, condition := range status.Conditions {
+		statuses[condition.Type] = condition.Status
+	}
+	return statuses
+}
+
+func TestCloudwatchStatusUpdate(t *testing.T) {
+	start := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	previous := newCloudwatchStatus()
+	previous.set(cloudwatchParsed, nil)
+	previous.set(cloudwatchSecretFound, errors.New("secret not found"))
+	previous.update(nil, start)
+
+	status := newCloudwatchStatus()
+	status.set(cloudwatchParsed, nil)
+	status.set(cloudwatchSecretFound, nil)
+	status.update(previous, start.Add(time.Minute))
+
+	assert.Equal(t, map[string]apiv1.ConditionStatus{
+		cloudwatchParsed:      apiv1.ConditionTrue,
+		cloudwatchSecretFound: apiv1.ConditionTrue,
+		cloudwatchSecretValid: apiv1.ConditionUnknown,
+		cloudwatchApplied:     apiv1.ConditionUnknown,
+	}, conditionStatuses(status))
+	assert.Equal(t, start, status.Conditions[0].LastTransitionTime)
+	assert.Equal(t, start.Add(time.Minute), status.Conditions[1].LastTransitionTime)
+	assert.Equal(t, start, status.Conditions[2].LastTransitionTime)
+	assert.Equal(t, start, status.Conditions[3].LastTransitionTime)
+}
+
+func TestInstallCloudwatchStatus(t *testing.T) {
+	cm := cloudwatchConfigMap("cloudwatch", nil, testCloudwatchConfig)
+	cm.UID = "cm-uid"
+	client := fake.NewSimpleClientset(cm)
+	recorder := record.NewFakeRecorder(10)
+	c := newTestKubectl()
+	cfg := &agentConfig{
+		KubernetesVersion: "v1.9.3",
+		WCHostname:        "cloud.weave.works",
+		KubectlTimeout:    time.Minute,
+		KubeClient:        client,
+		KubectlClient:     c,
+		Recorder:          recorder,
+	}
+	ctx := context.Background()
+	getStatus := func() *cloudwatchStatus {
+		cm, err := client.CoreV1().ConfigMaps("weave").Get(ctx, "cloudwatch", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return configMapTarget{cm}.cloudwatchStatus()
+	}
+	install := func() {
+		in, err := cfg.getCloudwatchInputs(ctx, configMapTarget{cm})
+		assert.NoError(t, err)
+		cfg.installCloudwatch(ctx, configMapTarget{cm}, in)
+	}
+
+	// No secret.
+	install()
+	status := getStatus()
+	assert.Equal(t, apiv1.ConditionFalse, conditionStatuses(status)[cloudwatchSecretFound])
+	assert.Contains(t, status.Conditions[1].Message, "not found")
+	assert.Contains(t, <-recorder.Events, "Warning SecretNotFound")
+
+	// Invalid secret.
+	secret := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "weave", Name: "cloudwatch", UID: "secret-uid"},
+		Data:       map[string][]byte{"access-key": []byte(testAccessKeyID)},
+	}
+	_, err := client.CoreV1().Secrets("weave").Create(ctx, secret, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	install()
+	status = getStatus()
+	assert.Equal(t, apiv1.ConditionFalse, conditionStatuses(status)[cloudwatchSecretValid])
+	assert.Equal(t, "secret cloudwatch: missing key 'access-key-id', found 'access-key'", status.Conditions[2].Message)
+	assert.Contains(t, <-recorder.Events, "Warning InvalidSecret")
+
+	// Deployed.
+	secret.Data = testCredentials()
+	_, err = client.CoreV1().Secrets("weave").Update(ctx, secret, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	url := "https://cloud.weave.works/k8s/v1.9/cloudwatch.yaml?aws-region=us-east-1&aws-secret=cloudwatch&aws-resources=rds%2Cclassic-elb&aws-config=cloudwatch&aws-config-uid=cm-uid&aws-secret-uid=secret-uid"
+	c.responses["apply --dry-run=client -f "+url+" -o name"] = "deployment.apps/cloudwatch-exporter\n"
+	c.responses["get --namespace=weave --ignore-not-found deployment.apps/cloudwatch-exporter -ojson"] = ""
+	c.responses["apply -f "+url+" -o name"] = "deployment.apps/cloudwatch-exporter\n"
+	c.responses["label --overwrite --namespace=weave deployment.apps/cloudwatch-exporter "+
+		"cloudwatch.weave.works/config-uid=cm-uid cloudwatch.weave.works/secret-uid=secret-uid"] = ""
+
+	install()
+	assert.Equal(t, map[string]apiv1.ConditionStatus{
+		cloudwatchParsed:      apiv1.ConditionTrue,
+		cloudwatchSecretFound: apiv1.ConditionTrue,
+		cloudwatchSecretValid: apiv1.ConditionTrue,
+		cloudwatchApplied:     apiv1.ConditionTrue,
+	}, conditionStatuses(getStatus()))
+	assert.Equal(t, "Normal Applied Cloudwatch deployed for rds, classic-elb in us-east-1", <-recorder.Events)
+
+	// Invalid configuration.
+	cm.Data[cloudwatchConfigKey] = testCloudwatchConfigNoResources
+	install()
+	assert.Equal(t, apiv1.ConditionFalse, conditionStatuses(getStatus())[cloudwatchParsed])
+	assert.Contains(t, <-recorder.Events, "Warning InvalidConfig")
+}
+
+func TestInstallCloudwatchRoleStatus(t *testing.T) {
+	cm := cloudwatchConfigMap("cloudwatch", nil, testCloudwatchConfigRole)
+	cm.UID = "cm-uid"
+	client := fake.NewSimpleClientset(cm)
+	c := newTestKubectl()
+	cfg := &agentConfig{
+		KubernetesVersion: "v1.9.3",
+		WCHostname:        "cloud.weave.works",
+		KubeClient:        client,
+		KubectlClient:     c,
+		Recorder:          record.NewFakeRecorder(10),
+	}
+	ctx := context.Background()
+	url := "https://cloud.weave.works/k8s/v1.9/cloudwatch.yaml?aws-region=us-east-1" +
+		"&aws-role-arn=arn%3Aaws%3Aiam%3A%3A123456789012%3Arole%2Fcloudwatch-exporter" +
+		"&aws-role-annotation=eks.amazonaws.com%2Frole-arn" +
+		"&aws-web-identity-token-file=%2Fvar%2Frun%2Fsecrets%2Feks.amazonaws.com%2Fserviceaccount%2Ftoken" +
+		"&aws-resources=rds&aws-config=cloudwatch&aws-config-uid=cm-uid"
+	c.responses["apply --dry-run=client -f "+url+" -o name"] = "deployment.apps/cloudwatch-exporter\n"
+	c.responses["get --namespace=weave --ignore-not-found deployment.apps/cloudwatch-exporter -ojson"] = ""
+	c.responses["apply -f "+url+" -o name"] = "deployment.apps/cloudwatch-exporter\n"
+	c.responses["label --overwrite --namespace=weave deployment.apps/cloudwatch-exporter cloudwatch.weave.works/config-uid=cm-uid"] = ""
+
+	in, err := cfg.getCloudwatchInputs(ctx, configMapTarget{cm})
+	assert.NoError(t, err)
+	applied, err := cfg.installCloudwatch(ctx, configMapTarget{cm}, in)
+	assert.NoError(t, err)
+	assert.Equal(t, url, applied)
+
+	cm, err = client.CoreV1().ConfigMaps("weave").Get(ctx, "cloudwatch", metav1.GetOptions{})
+	assert.NoError(t, err)
+	status := configMapTarget{cm}.cloudwatchStatus()
+	assert.Equal(t, "arn:aws:iam::123456789012:role/cloudwatch-exporter", status.RoleARN)
+	assert.Equal(t, map[string]apiv1.ConditionStatus{
+		cloudwatchParsed:  apiv1.ConditionTrue,
+		cloudwatchApplied: apiv1.ConditionTrue,
+	}, conditionStatuses(status))
+}
@@ -2,12 +2,10 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"strings"
 	"syscall"
@@ -29,12 +27,12 @@ const (
 )
 
 type options struct {
-	AssumeYes        bool   `short:"y" long:"assume-yes" description:"Install without user confirmation"`
+	AssumeYes        bool   `short:"y" long:"assume-yes" description:"Install or uninstall without user confirmation"`
 	Scheme           string `long:"scheme" description:"Weave Cloud scheme" default:"https"`
 	LauncherHostname string `long:"wc.launcher" description:"Weave Cloud launcher hostname" default:"get.weave.works"`
 	WCHostname       string `long:"wc.hostname" description:"Weave Cloud hostname" default:"cloud.weave.works"`
 	Token            string `long:"token" description:"Weave Cloud token" required:"true"`
-	GKE              bool   `long:"gke" description:"Create clusterrolebinding for GKE instances"`
+	GKE              bool   `long:"gke" description:"Create (or, when uninstalling, delete) clusterrolebinding for GKE instances"`
 	ReportErrors     bool   `long:"report-errors" description:"Should install errors be reported to sentry"`
 	SkipChecks       bool   `long:"skip-checks" description:"Skip pre-flight checks"`
 	ReadOnly         bool   `long:"read-only" description:"Disallow scope controls"`
@@ -58,6 +56,8 @@ func mainImpl() {
 	if err != nil {
 		exitWithCapture(opts, "%s\n", err)
 	}
+	otherArgs, uninstallMode := extractCommand(otherArgs, "uninstall")
+	ctx := context.Background()
 	raven.SetTagsContext(map[string]string{
 		"weave_cloud_scheme":   opts.Scheme,
 		"weave_cloud_launcher": opts.LauncherHostname,
@@ -75,10 +75,15 @@ func mainImpl() {
 		exitWithCapture(opts, "Could not find kubectl in PATH, please install it: https://kubernetes.io/docs/tasks/tools/install-kubectl/\n")
 	}
 
+	if uninstallMode {
+		uninstall(ctx, kubectlClient, opts)
+		return
+	}
+
 	// If the user has not passed the container runtime endpoint
 	// we try our best to guess and log it.
 	if opts.CRIEndpoint == "" {
-		opts.CRIEndpoint, err = matchContainerRuntimeEndpoint(kubectlClient)
+		opts.CRIEndpoint, err = matchContainerRuntimeEndpoint(ctx, kubectlClient)
 		if err != nil {
 			log.Fatal("error detecting container runtime endpoint: ", err)
 		}
@@ -104,9 +109,9 @@ func mainImpl() {
 	fmt.Println("Preparing for Weave Cloud setup")
 
 	// Capture the kubernetes version info to help debug issues
-	checkK8sVersion(kubectlClient, opts) // NB exits on error
+	checkK8sVersion(ctx, kubectlClient, opts) // NB exits on error
 
-	InstanceID, InstanceName, err := weavecloud.LookupInstanceByToken(wcOrgLookupURL, opts.Token)
+	InstanceID, InstanceName, err := weavecloud.LookupInstanceByToken(ctx, wcOrgLookupURL, opts.Token)
 	if err != nil {
 		exitWithCapture(opts, "Error looking up Weave Cloud instance: %s\n", err)
 	}
@@ -119,13 +124,13 @@ func mainImpl() {
 	// user friendly. So, in case of errors (eg. no current-context) we simply
 	// assume kubectl can reach the API server eg. through a previously set up api
 	// server proxy with kubectl proxy.
-	cluster, err := kubectl.GetClusterInfo(kubectlClient)
+	cluster, err := kubectl.GetClusterInfo(ctx, kubectlClient)
 	if err == nil {
 		fmt.Printf("Installing Weave Cloud agents on %s at %s\n", cluster.Name, cluster.ServerAddress)
 	}
 
 	if opts.GKE {
-		err := createGKEClusterRoleBinding(kubectlClient)
+		err := createGKEClusterRoleBinding(ctx, kubectlClient)
 		if err != nil {
 			raven.SetTagsContext(map[string]string{
 				"gke_clusterrolebindingError": err.Error(),
@@ -141,7 +146,7 @@ func mainImpl() {
 	if !opts.SkipChecks {
 		// Perform a check to make sure DNS is working correctly.
 		fmt.Println("Performing a check of the Kubernetes installation setup.")
-		ok, err := kubectl.TestDNS(kubectlClient, "cloud.weave.works")
+		ok, err := kubectl.TestDNS(ctx, kubectlClient, "cloud.weave.works")
 		if err != nil {
 			exitWithCapture(opts, "There was an error while performing a DNS check: %s. Please check that your cluster can download images and run pods.", err)
 		}
@@ -153,17 +158,17 @@ func mainImpl() {
 		}
 	}
 
-	secretCreated, err := kubectl.CreateSecretFromLiteral(kubectlClient, "weave", "weave-cloud", "token", opts.Token, opts.AssumeYes)
+	secretCreated, err := kubectl.CreateSecretFromLiteral(ctx, kubectlClient, "weave", "weave-cloud", "token", opts.Token, opts.AssumeYes)
 	if err != nil {
 		exitWithCapture(opts, "There was an error creating the secret: %s\n", err)
 	}
 	if !secretCreated {
-		currentToken, err := kubectl.GetSecretValue(kubectlClient, "weave", "weave-cloud", "token")
+		currentToken, err := kubectl.GetSecretValue(ctx, kubectlClient, "weave", "weave-cloud", "token")
 		if err != nil {
 			exitWithCapture(opts, "There was an error checking the current secret: %s\n", err)
 		}
 		if currentToken != opts.Token {
-			currentInstanceID, currentInstanceName, errCurrent := weavecloud.LookupInstanceByToken(wcOrgLookupURL, currentToken)
+			currentInstanceID, currentInstanceName, errCurrent := weavecloud.LookupInstanceByToken(ctx, wcOrgLookupURL, currentToken)
 			msg := "This cluster is currently connected to "
 			if errCurrent == nil {
 				msg += fmt.Sprintf("%q (id: %s) on Weave Cloud", currentInstanceName, currentInstanceID)
@@ -177,7 +182,7 @@ func mainImpl() {
 			} else if !confirmed {
 				exitWithCapture(opts, "Installation cancelled")
 			}
-			_, err = kubectl.CreateSecretFromLiteral(kubectlClient, "weave", "weave-cloud", "token", opts.Token, true)
+			_, err = kubectl.CreateSecretFromLiteral(ctx, kubectlClient, "weave", "weave-cloud", "token", opts.Token, true)
 			if err != nil {
 				exitWithCapture(opts, "There was an error creating the secret: %s\n", err)
 			}
@@ -185,14 +190,14 @@ func mainImpl() {
 	}
 
 	// Apply the agent
-	err = kubectl.Apply(kubectlClient, agentK8sURL)
+	err = kubectl.Apply(ctx, kubectlClient, agentK8sURL)
 	if err != nil {
 		captureAndSend(opts, 1, "There was an error applying the agent: %s\n", err)
 
 		// We've failed to apply the agent. kubectl apply isn't an atomic operation
 		// can leave some objects behind when encountering an error. Clean things up.
 		fmt.Println("Rolling back cluster changes")
-		kubectl.Execute(kubectlClient, "delete", "--ignore-not-found=true", "-f", agentK8sURL)
+		kubectl.Execute(ctx, kubectlClient, "delete", "--ignore-not-found=true", "-f", agentK8sURL)
 		// Exit with a specific error which will be checked against in install script,
 		// as a way of deduplicating sending of these errors.
 		os.Exit(111)
@@ -201,6 +206,17 @@ func mainImpl() {
 	fmt.Println("Successfully installed.")
 }
 
+// extractCommand removes the first occurrence of command from args and reports
+// whether it was found. Remaining arguments are forwarded to kubectl.
+func extractCommand(args []string, command string) ([]string, bool) {
+	for i, arg := range args {
+		if arg == command {
+			return append(args[:i:i], args[i+1:]...), true
+		}
+	}
+	return args, false
+}
+
 func captureAndSend(opts options, skipFrames uint, msg string, args ...interface{}) {
 	formatted := fmt.Sprintf(msg, args...)
 	fmt.Fprintf(os.Stderr, formatted)
@@ -220,7 +236,7 @@ func exitWithCapture(opts options, msg string, args ...interface{}) {
 	os.Exit(111)
 }
 
-func createGKEClusterRoleBinding(kubectlClient kubectl.Client) error {
+func createGKEClusterRoleBinding(ctx context.Context, kubectlClient kubectl.Client) error {
 	if !gcloud.IsPresent() {
 		return errors.New("Could not find gcloud in PATH, please install it: https://cloud.google.com/sdk/docs/")
 	}
@@ -229,11 +245,10 @@ func createGKEClusterRoleBinding(kubectlClient kubectl.Client) error {
 	if err != nil || account == "" {
 		return errors.New("Could not find gcloud account. Please run: gcloud auth login `ACCOUNT`")
 	}
-	hostUser := os.Getenv("USER")
-
 	err = kubectl.CreateClusterRoleBinding(
+		ctx,
 		kubectlClient,
-		fmt.Sprintf("cluster-admin-%s", hostUser),
+		gkeClusterRoleBindingName(),
 		"cluster-admin",
 		account,
 	)
@@ -243,6 +258,12 @@ func createGKEClusterRoleBinding(kubectlClient kubectl.Client) error {
 	return nil
 }
 
+// gkeClusterRoleBindingName is the name of the clusterrolebinding giving the
+// GKE user cluster-admin rights.
+func gkeClusterRoleBindingName() string {
+	return fmt.Sprintf("cluster-admin-%s", os.Getenv("USER"))
+}
+
 func askForConfirmation(s string) (bool, error) {
 	reader := bufio.NewReader(os.Stdin)
 	for {
@@ -261,9 +282,9 @@ func askForConfirmation(s string) (bool, error) {
 	}
 }
 
-func checkK8sVersion(kubectlClient kubectl.Client, opts options) {
+func checkK8sVersion(ctx context.Context, kubectlClient kubectl.Client, opts options) {
 	fmt.Println("Checking kubectl & kubernetes versions")
-	clientVersion, serverVersion, err := kubectl.GetVersionInfo(kubectlClient)
+	clientVersion, serverVersion, err := kubectl.GetVersionInfo(ctx, kubectlClient)
 	if clientVersion != "" {
 		raven.SetTagsContext(map[string]string{
 			"kubectl_clientVersion_gitVersion": clientVersion,
@@ -300,58 +321,21 @@ func supportedK8sVersion(clusterVersion string) bool {
 	return true
 }
 
-type errorResponse struct {
-	Type     string   `json:"type"`
-	Messages messages `json:"messages"`
-}
-
-type messages struct {
-	Browser browser `json:"browser"`
-}
-
-type browser struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
-}
-
 // sendError sends the error msg to UI.
 func sendError(errMsg string, opts options) {
-	eventTypeFailed := "onboarding_failed"
-	response := errorResponse{
-		Type: eventTypeFailed,
-		Messages: messages{
-			Browser: browser{
-				Type: eventTypeFailed,
-				Text: errMsg,
-			},
-		},
-	}
-
-	jr, err := json.Marshal(response)
-	if err != nil {
-		return
-	}
+	sendNotification("onboarding_failed", errMsg, opts)
+}
 
+// sendNotification sends an event of the given type to the UI.
+func sendNotification(eventType, text string, opts options) {
 	url := fmt.Sprintf("%s://%s/api/notification/external/events", opts.Scheme, opts.WCHostname)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jr))
-	if err != nil {
-		return
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", opts.Token))
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
+	weavecloud.SendNotification(context.Background(), url, opts.Token, eventType, text)
 }
 
 // matchContainerRuntimeEndpoint tries to best match the container runtime the node
 // is using based on the container runtime name.
-func matchContainerRuntimeEndpoint(c kubectl.Client) (string, error) {
-	name, err := kubectl.GetContainerRuntimeName(c)
+func matchContainerRuntimeEndpoint(ctx context.Context, c kubectl.Client) (string, error) {
+	name, err := kubectl.GetContainerRuntimeName(ctx, c)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/weaveworks/launcher/pkg/kubectl"
+	"github.com/weaveworks/launcher/pkg/text"
+	"github.com/weaveworks/launcher/pkg/weavecloud"
+)
+
+const (
+	weaveNamespace           = "weave"
+	cloudwatchMonitorCRDName = "cloudwatchmonitors.cloud.weave.works"
+)
+
+// Selectors matching the objects installed by the agent and by Weave Cloud
+// manifests, both in the weave namespace and in kube-system for installations
+// predating the weave namespace.
+var weaveCloudSelectors = []string{
+	"name in (weave-agent, weave-flux, weave-cortex, weave-scope)",
+	"app in (weave-flux, weave-cortex, weave-scope)",
+}
+
+// ClusterRoles that must never be deleted, even if one of our bindings refers
+// to them.
+var builtinClusterRoles = []string{"cluster-admin", "admin", "edit", "view"}
+
+// uninstallPlan lists the objects to delete, in deletion order.
+type uninstallPlan []kubectl.Resource
+
+func (p *uninstallPlan) add(resources ...kubectl.Resource) {
+	for _, r := range resources {
+		if !p.contains(r) {
+			*p = append(*p, r)
+		}
+	}
+}
+
+func (p uninstallPlan) contains(r kubectl.Resource) bool {
+	for _, existing := range p {
+		if strings.EqualFold(existing.Kind, r.Kind) && existing.Namespace == r.Namespace && existing.Name == r.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func isBuiltinClusterRole(name string) bool {
+	if strings.HasPrefix(name, "system:") {
+		return true
+	}
+	for _, role := range builtinClusterRoles {
+		if name == role {
+			return true
+		}
+	}
+	return false
+}
+
+// buildUninstallPlan finds every object created by bootstrap, the agent and
+// the Weave Cloud manifests. Objects are ordered so that the agent is stopped
+// first (it would otherwise re-apply the manifests), namespaced objects are
+// removed before the RBAC objects granting access to them.
+func buildUninstallPlan(ctx context.Context, c kubectl.Client, opts options) (uninstallPlan, error) {
+	plan := uninstallPlan{}
+
+	agent, err := kubectl.ResourceExists(ctx, c, "deployment", weaveNamespace, "weave-agent")
+	if err != nil {
+		return nil, err
+	}
+	if agent {
+		plan.add(kubectl.Resource{Kind: "Deployment", Namespace: weaveNamespace, Name: "weave-agent"})
+	}
+
+	namespace, err := kubectl.ResourceExists(ctx, c, "namespace", "", weaveNamespace)
+	if err != nil {
+		return nil, err
+	}
+	if namespace {
+		plan.add(kubectl.Resource{Kind: "Namespace", Name: weaveNamespace})
+	}
+
+	// The agent installs the CloudWatchMonitor CRD, deleting it deletes the
+	// monitors left in other namespaces.
+	crd, err := kubectl.ResourceExists(ctx, c, "customresourcedefinition", "", cloudwatchMonitorCRDName)
+	if err != nil {
+		return nil, err
+	}
+	if crd {
+		plan.add(kubectl.Resource{Kind: "CustomResourceDefinition", Name: cloudwatchMonitorCRDName})
+	}
+
+	// Leftovers from installations in kube-system.
+	for _, selector := range weaveCloudSelectors {
+		resources, err := kubectl.ListResources(ctx, c,
+			"deployments,daemonsets,services,serviceaccounts,configmaps,secrets",
+			"kube-system", selector)
+		if err != nil {
+			return nil, err
+		}
+		plan.add(resources...)
+	}
+	deployKey, err := kubectl.ResourceExists(ctx, c, "secret", "kube-system", "flux-git-deploy")
+	if err != nil {
+		return nil, err
+	}
+	if deployKey {
+		plan.add(kubectl.Resource{Kind: "Secret", Namespace: "kube-system", Name: "flux-git-deploy"})
+	}
+
+	// Cluster-scoped RBAC objects, found by label. Bindings we didn't create
+	// are never deleted, even when they grant roles to the weave namespace.
+	roles := []kubectl.Resource{}
+	for _, selector := range weaveCloudSelectors {
+		resources, err := kubectl.ListResources(ctx, c, "clusterrolebindings", "", selector)
+		if err != nil {
+			return nil, err
+		}
+		plan.add(resources...)
+
+		resources, err = kubectl.ListResources(ctx, c, "clusterroles", "", selector)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resources {
+			if !isBuiltinClusterRole(r.Name) {
+				roles = append(roles, r)
+			}
+		}
+	}
+	plan.add(roles...)
+
+	if opts.GKE {
+		name := gkeClusterRoleBindingName()
+		gke, err := kubectl.ResourceExists(ctx, c, "clusterrolebinding", "", name)
+		if err != nil {
+			return nil, err
+		}
+		if gke {
+			plan.add(kubectl.Resource{Kind: "ClusterRoleBinding", Name: name})
+		}
+	}
+
+	return plan, nil
+}
+
+// sharedBindings returns the ClusterRoleBindings granting roles to the weave
+// namespace service accounts that aren't in plan. They were created by users,
+// or grant roles to other subjects too, so they are left in place.
+func sharedBindings(ctx context.Context, c kubectl.Client, plan uninstallPlan) ([]kubectl.Resource, error) {
+	bindings, err := kubectl.ListClusterRoleBindingsForNamespace(ctx, c, weaveNamespace)
+	if err != nil {
+		return nil, err
+	}
+	shared := []kubectl.Resource{}
+	for _, binding := range bindings {
+		if !plan.contains(binding.Resource) {
+			shared = append(shared, binding.Resource)
+		}
+	}
+	return shared, nil
+}
+
+func deleteResource(ctx context.Context, c kubectl.Client, r kubectl.Resource) error {
+	args := []string{"delete", strings.ToLower(r.Kind), r.Name, "--ignore-not-found=true"}
+	if r.Namespace != "" {
+		args = append(args, fmt.Sprintf("--namespace=%s", r.Namespace))
+	}
+	_, err := kubectl.Execute(ctx, c, args...)
+	return err
+}
+
+// uninstall removes Weave Cloud from the cluster and notifies Weave Cloud the
+// cluster was disconnected.
+func uninstall(ctx context.Context, kubectlClient kubectl.Client, opts options) {
+	// Restore stdin, making fd 0 point at the terminal
+	if err := syscall.Dup2(1, 0); err != nil {
+		exitWithCapture(opts, "Could not restore stdin: %s\n", err)
+	}
+
+	wcOrgLookupURL, err := text.ResolveString(weavecloud.DefaultWCOrgLookupURLTemplate, opts)
+	if err != nil {
+		exitWithCapture(opts, "invalid URL template: %s\n", err)
+	}
+	instanceID, instanceName, err := weavecloud.LookupInstanceByToken(ctx, wcOrgLookupURL, opts.Token)
+	if err != nil {
+		exitWithCapture(opts, "Error looking up Weave Cloud instance: %s\n", err)
+	}
+	raven.SetTagsContext(map[string]string{"instance": instanceID})
+
+	cluster, err := kubectl.GetClusterInfo(ctx, kubectlClient)
+	if err == nil {
+		fmt.Printf("Uninstalling Weave Cloud agents from %s at %s\n", cluster.Name, cluster.ServerAddress)
+	}
+
+	plan, err := buildUninstallPlan(ctx, kubectlClient, opts)
+	if err != nil {
+		exitWithCapture(opts, "There was an error looking for Weave Cloud resources: %s\n", err)
+	}
+	shared, err := sharedBindings(ctx, kubectlClient, plan)
+	if err != nil {
+		exitWithCapture(opts, "There was an error looking for Weave Cloud resources: %s\n", err)
+	}
+	if len(shared) > 0 {
+		fmt.Println("The following bindings grant roles to the weave namespace but weren't created by Weave Cloud, they are left in place:")
+		for _, r := range shared {
+			fmt.Printf("  - %s\n", r)
+		}
+	}
+	if len(plan) == 0 {
+		fmt.Println("No Weave Cloud resources found in this cluster.")
+		return
+	}
+
+	fmt.Println("The following resources will be deleted:")
+	for _, r := range plan {
+		fmt.Printf("  - %s\n", r)
+	}
+
+	if !opts.AssumeYes {
+		confirmed, err := askForConfirmation(fmt.Sprintf(
+			"Would you like to disconnect this cluster from %q (id: %s)?", instanceName, instanceID))
+		if err != nil {
+			exitWithCapture(opts, "Could not ask for confirmation: %s\n", err)
+		} else if !confirmed {
+			exitWithCapture(opts, "Uninstall cancelled")
+		}
+	}
+
+	failed := 0
+	for _, r := range plan {
+		fmt.Printf("Deleting %s\n", r)
+		if err := deleteResource(ctx, kubectlClient, r); err != nil {
+			captureAndSend(opts, 1, "There was an error deleting %s: %s\n", r, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		exitWithCapture(opts, "Failed to delete %d resource(s). Run the uninstall again once the errors above are fixed.\n", failed)
+	}
+
+	sendNotification("cluster_disconnected", "Weave Cloud agents were uninstalled from the cluster.", opts)
+	fmt.Println("Successfully uninstalled.")
+}
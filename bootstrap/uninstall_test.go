@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/weaveworks/launcher/pkg/kubectl"
+)
+
+// testClient answers kubectl commands from responses. Objects it doesn't know
+// about are not found, lists are empty.
+type testClient struct {
+	responses map[string]string
+}
+
+func (c *testClient) Execute(ctx context.Context, args ...string) (string, error) {
+	cmd := strings.Join(args, " ")
+	if response, ok := c.responses[cmd]; ok {
+		return response, nil
+	}
+	if strings.HasSuffix(cmd, "-ojson") {
+		return `{"items": []}`, nil
+	}
+	return "", fmt.Errorf("Error from server (NotFound): %q not found", cmd)
+}
+
+func (c *testClient) ExecuteOutputMatrix(ctx context.Context, args ...string) (string, string, error) {
+	stdout, err := c.Execute(ctx, args...)
+	return stdout, "", err
+}
+
+func TestBuildUninstallPlan(t *testing.T) {
+	c := &testClient{responses: map[string]string{
+		"get deployment weave-agent --namespace=weave": "",
+		"get namespace weave --namespace=":             "",
+		"get clusterrolebindings --selector=name in (weave-agent, weave-flux, weave-cortex, weave-scope) -ojson": `{"items": [
+		  {"kind": "ClusterRoleBinding", "metadata": {"name": "weave-agent"}}
+		]}`,
+		"get clusterroles --selector=name in (weave-agent, weave-flux, weave-cortex, weave-scope) -ojson": `{"items": [
+		  {"kind": "ClusterRole", "metadata": {"name": "weave-agent"}}
+		]}`,
+		// A binding created by the user, and one granting a role to other
+		// subjects too.
+		"get clusterrolebindings -ojson": `{"items": [
+		  {"kind": "ClusterRoleBinding", "metadata": {"name": "weave-agent"},
+		   "roleRef": {"kind": "ClusterRole", "name": "weave-agent"},
+		   "subjects": [{"kind": "ServiceAccount", "name": "weave-agent", "namespace": "weave"}]},
+		  {"kind": "ClusterRoleBinding", "metadata": {"name": "psp-users"},
+		   "roleRef": {"kind": "ClusterRole", "name": "psp-users"},
+		   "subjects": [{"kind": "ServiceAccount", "name": "weave-flux", "namespace": "weave"},
+		                {"kind": "ServiceAccount", "name": "default", "namespace": "apps"}]},
+		  {"kind": "ClusterRoleBinding", "metadata": {"name": "weave-scope-extra"},
+		   "roleRef": {"kind": "ClusterRole", "name": "weave-scope-extra"},
+		   "subjects": [{"kind": "ServiceAccount", "name": "weave-scope", "namespace": "weave"}]}
+		]}`,
+	}}
+	ctx := context.Background()
+
+	plan, err := buildUninstallPlan(ctx, c, options{})
+	assert.NoError(t, err)
+	assert.Equal(t, uninstallPlan{
+		{Kind: "Deployment", Namespace: "weave", Name: "weave-agent"},
+		{Kind: "Namespace", Name: "weave"},
+		{Kind: "ClusterRoleBinding", Name: "weave-agent"},
+		{Kind: "ClusterRole", Name: "weave-agent"},
+	}, plan)
+
+	shared, err := sharedBindings(ctx, c, plan)
+	assert.NoError(t, err)
+	assert.Equal(t, []kubectl.Resource{
+		{Kind: "ClusterRoleBinding", Name: "psp-users"},
+		{Kind: "ClusterRoleBinding", Name: "weave-scope-extra"},
+	}, shared)
+}
+
+func TestBuildUninstallPlanGKE(t *testing.T) {
+	name := gkeClusterRoleBindingName()
+	c := &testClient{responses: map[string]string{
+		"get clusterrolebinding " + name + " --namespace=": "",
+	}}
+
+	plan, err := buildUninstallPlan(context.Background(), c, options{GKE: true})
+	assert.NoError(t, err)
+	assert.Equal(t, uninstallPlan{{Kind: "ClusterRoleBinding", Name: name}}, plan)
+}
+
+func TestBuildUninstallPlanCloudwatchMonitors(t *testing.T) {
+	c := &testClient{responses: map[string]string{
+		"get deployment weave-agent --namespace=weave":                                   "",
+		"get namespace weave --namespace=":                                               "",
+		"get customresourcedefinition cloudwatchmonitors.cloud.weave.works --namespace=": "",
+	}}
+
+	// The CRD is deleted once the agent and the namespace are gone.
+	plan, err := buildUninstallPlan(context.Background(), c, options{})
+	assert.NoError(t, err)
+	assert.Equal(t, uninstallPlan{
+		{Kind: "Deployment", Namespace: "weave", Name: "weave-agent"},
+		{Kind: "Namespace", Name: "weave"},
+		{Kind: "CustomResourceDefinition", Name: "cloudwatchmonitors.cloud.weave.works"},
+	}, plan)
+}
@@ -0,0 +1,188 @@
+package k8s
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	aggregatedEventsNum = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "aggregated_total",
+			Help:      "The total number of events collapsed into an existing aggregation group.",
+		})
+	aggregationGroupsNum = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "aggregation_groups",
+			Help:      "The number of event aggregation groups currently tracked.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(aggregatedEventsNum)
+	prometheus.MustRegister(aggregationGroupsNum)
+}
+
+// Events are considered repeats of each other when they are about the same
+// object and have the same reason and message.
+type aggregationKey struct {
+	namespace string
+	kind      string
+	name      string
+	reason    string
+	message   string
+}
+
+func newAggregationKey(event *Event) aggregationKey {
+	return aggregationKey{
+		namespace: event.InvolvedObject.Namespace,
+		kind:      event.InvolvedObject.Kind,
+		name:      event.InvolvedObject.Name,
+		reason:    event.Reason,
+		message:   event.Message,
+	}
+}
+
+type eventGroup struct {
+	// Latest event of the group.
+	event *Event
+	// Occurrences and time span of the group, as reported by its events.
+	count          int32
+	firstTimestamp time.Time
+	lastTimestamp  time.Time
+	// Count of each event of the group when last seen. Kubernetes updates
+	// repeated events in place, only the difference is new.
+	counts map[string]int32
+	// When the group was last updated, by the agent clock.
+	lastSeen time.Time
+	// Whether the group has seen new events since the last flush.
+	pending bool
+}
+
+func eventKey(event *Event) string {
+	if event.UID != "" {
+		return string(event.UID)
+	}
+	return event.Namespace + "/" + event.Name
+}
+
+// record adds the occurrences of event the group doesn't know about yet. It
+// returns false if there are none.
+func (group *eventGroup) record(event *Event) bool {
+	key := eventKey(event)
+	occurrences := event.Count
+	if previous, ok := group.counts[key]; ok {
+		occurrences -= previous
+	} else if occurrences < 1 {
+		occurrences = 1
+	}
+	if occurrences <= 0 {
+		return false
+	}
+	group.counts[key] = event.Count
+
+	group.event = event
+	group.count += occurrences
+	first := event.FirstTimestamp
+	last := firstNonZero(event.LastTimestamp, first)
+	if group.firstTimestamp.IsZero() || (!first.IsZero() && first.Before(group.firstTimestamp)) {
+		group.firstTimestamp = first
+	}
+	if last.After(group.lastTimestamp) {
+		group.lastTimestamp = last
+	}
+	return true
+}
+
+// eventAggregator collapses repeated events. A group lives for as long as
+// repeats keep arriving within window of each other.
+type eventAggregator struct {
+	window    time.Duration
+	maxGroups int
+
+	sync.Mutex
+	groups map[aggregationKey]*eventGroup
+}
+
+func newEventAggregator(window time.Duration, maxGroups int) *eventAggregator {
+	return &eventAggregator{
+		window:    window,
+		maxGroups: maxGroups,
+		groups:    make(map[aggregationKey]*eventGroup),
+	}
+}
+
+// add records event, seen at now. It returns false if the event had to be
+// dropped because too many groups are tracked.
+func (a *eventAggregator) add(event *Event, now time.Time) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	key := newAggregationKey(event)
+	group, ok := a.groups[key]
+	if ok && now.Sub(group.lastSeen) <= a.window {
+		if group.record(event) {
+			group.lastSeen = now
+			group.pending = true
+			aggregatedEventsNum.Inc()
+		}
+		return true
+	}
+
+	if !ok && len(a.groups) >= a.maxGroups {
+		return false
+	}
+	counts := make(map[string]int32)
+	if ok {
+		// The occurrences reported by the expired group aren't new.
+		counts = group.counts
+	}
+	group = &eventGroup{
+		counts:   counts,
+		lastSeen: now,
+		pending:  true,
+	}
+	if !group.record(event) {
+		return true
+	}
+	a.groups[key] = group
+	aggregationGroupsNum.Set(float64(len(a.groups)))
+	return true
+}
+
+// flush returns one aggregated event per group updated since the previous
+// flush and forgets about the groups that have expired. The aggregated event
+// is a copy of the latest event of the group with Count, FirstTimestamp and
+// LastTimestamp describing the whole group.
+func (a *eventAggregator) flush(now time.Time) []*Event {
+	a.Lock()
+	defer a.Unlock()
+
+	events := []*Event{}
+	for key, group := range a.groups {
+		if group.pending {
+			event := *group.event
+			event.Count = group.count
+			event.FirstTimestamp = group.firstTimestamp
+			event.LastTimestamp = group.lastTimestamp
+			events = append(events, &event)
+			group.pending = false
+		}
+		if now.Sub(group.lastSeen) > a.window {
+			delete(a.groups, key)
+		}
+	}
+	aggregationGroupsNum.Set(float64(len(a.groups)))
+
+	if len(events) > 0 {
+		log.Debugf("Aggregated events into %d records", len(events))
+	}
+	return events
+}
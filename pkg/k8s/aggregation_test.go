@@ -0,0 +1,80 @@
+package k8s
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// occurrence returns the state of a repeated event after count occurrences,
+// one per second from start.
+func occurrence(name string, count int, start time.Time) *Event {
+	event := testEvent(name, "Back-off restarting failed container")
+	event.Count = int32(count)
+	event.FirstTimestamp = start
+	event.LastTimestamp = start.Add(time.Duration(count-1) * time.Second)
+	return event
+}
+
+func TestEventAggregator(t *testing.T) {
+	a := newEventAggregator(time.Minute, 10)
+	start := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+	// The agent sees events some time after they happened.
+	seen := start.Add(time.Hour)
+
+	// A crashlooping pod, its event updated in place, and an unrelated
+	// event.
+	for i := 1; i <= 5; i++ {
+		assert.True(t, a.add(occurrence("backoff", i, start), seen.Add(time.Duration(i)*time.Second)))
+	}
+	other := testEvent("pulled", "Pulled image")
+	other.Reason = "Pulled"
+	other.FirstTimestamp = start
+	other.LastTimestamp = start
+	assert.True(t, a.add(other, seen))
+
+	events := a.flush(seen.Add(5 * time.Second))
+	assert.Len(t, events, 2)
+	for _, event := range events {
+		if event.Reason == "BackOff" {
+			assert.Equal(t, int32(5), event.Count)
+			assert.Equal(t, start, event.FirstTimestamp.UTC())
+			assert.Equal(t, start.Add(4*time.Second), event.LastTimestamp.UTC())
+		} else {
+			assert.Equal(t, int32(1), event.Count)
+		}
+	}
+
+	// Updates without new occurrences, eg. after a relist, aren't counted.
+	assert.True(t, a.add(occurrence("backoff", 5, start), seen.Add(6*time.Second)))
+	assert.Len(t, a.flush(seen.Add(6*time.Second)), 0)
+
+	// A repeat within the window extends the group, whether it's the same
+	// event updated or a new one.
+	a.add(occurrence("backoff", 7, start), seen.Add(30*time.Second))
+	a.add(occurrence("backoff-2", 2, start.Add(10*time.Second)), seen.Add(30*time.Second))
+	events = a.flush(seen.Add(31 * time.Second))
+	assert.Len(t, events, 1)
+	assert.Equal(t, int32(9), events[0].Count)
+	assert.Equal(t, start, events[0].FirstTimestamp.UTC())
+	assert.Equal(t, start.Add(11*time.Second), events[0].LastTimestamp.UTC())
+
+	// Groups expire once the window has elapsed without repeats, the
+	// occurrences already reported aren't counted again.
+	a.add(occurrence("backoff", 8, start), seen.Add(5*time.Minute))
+	events = a.flush(seen.Add(5 * time.Minute))
+	assert.Equal(t, int32(1), events[0].Count)
+	a.flush(seen.Add(10 * time.Minute))
+	assert.Len(t, a.groups, 0)
+}
+
+func TestEventAggregatorMaxGroups(t *testing.T) {
+	a := newEventAggregator(time.Minute, 1)
+	now := time.Now()
+
+	assert.True(t, a.add(testEvent("e1", "m1"), now))
+	assert.False(t, a.add(testEvent("e2", "m2"), now))
+	// Repeats of a tracked group are still accepted.
+	assert.True(t, a.add(testEvent("e1", "m1"), now))
+}
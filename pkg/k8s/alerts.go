@@ -0,0 +1,587 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Alert rule types.
+const (
+	AlertThreshold = "threshold"
+	AlertRate      = "rate"
+)
+
+// Alert record statuses.
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+const (
+	alertEvaluationInterval = 10 * time.Second
+	alertRecordsBufferSize  = 100
+	defaultNotifyTimeout    = 30 * time.Second
+	// Maximum number of groups, eg. workloads, tracked per rule.
+	maxAlertGroups = 10000
+)
+
+var (
+	alertsFiringNum = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "alerts_firing",
+			Help:      "The number of alerts currently firing.",
+		},
+		[]string{"rule"})
+	alertRecordsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "alert_records_total",
+			Help:      "The total number of alert records emitted.",
+		},
+		[]string{"rule", "status"})
+	alertNotificationErrorsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "alert_notification_errors_total",
+			Help:      "The total number of alert records that could not be sent to a notifier.",
+		},
+		[]string{"notifier"})
+)
+
+func init() {
+	prometheus.MustRegister(alertsFiringNum)
+	prometheus.MustRegister(alertRecordsNum)
+	prometheus.MustRegister(alertNotificationErrorsNum)
+}
+
+// AlertRule counts the events it matches over a sliding window and fires
+// when there are too many of them.
+type AlertRule struct {
+	Name string `json:"name"`
+	// Type is threshold or rate.
+	Type string `json:"type"`
+	// Match selects the events counted by the rule. Its label selector is
+	// matched against the labels of the event's workload.
+	Match EventRule `json:"match"`
+	// GroupBy counts events separately per "namespace", "object" or
+	// "workload". Events are counted cluster-wide when empty.
+	GroupBy string `json:"groupBy"`
+	// Window is the duration of the sliding window, eg. 10m.
+	Window string `json:"window"`
+	// Threshold rules fire when more than Threshold events are seen within
+	// the window. 0 fires on any matching event.
+	Threshold int `json:"threshold"`
+	// Rate rules fire when more than Rate events per minute, on average, are
+	// seen within the window.
+	Rate float64 `json:"rate"`
+	// Severity is passed along in alert records.
+	Severity string `json:"severity"`
+
+	window time.Duration
+	// Number of events within the window firing the rule.
+	limit int
+}
+
+// AlertConfig is the declarative configuration of an Alerter.
+//
+//	rules:
+//	- name: deployment-backoff
+//	  type: threshold
+//	  match:
+//	    reasons: [BackOff]
+//	  groupBy: workload
+//	  window: 10m
+//	  threshold: 5
+//	- name: prod-failed-scheduling
+//	  type: threshold
+//	  match:
+//	    namespaces: [prod]
+//	    reasons: [FailedScheduling]
+//	  window: 10m
+type AlertConfig struct {
+	Rules []AlertRule `json:"rules"`
+}
+
+// ParseAlertConfig parses a YAML or JSON AlertConfig. Unknown fields are
+// rejected, a misspelled threshold would otherwise fire on every event.
+func ParseAlertConfig(data []byte) (*AlertConfig, error) {
+	data, err := yaml.ToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	config := AlertConfig{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (rule *AlertRule) compile() error {
+	if rule.Name == "" {
+		return fmt.Errorf("alert rules must have a name")
+	}
+	window, err := time.ParseDuration(rule.Window)
+	if err != nil || window <= 0 {
+		return fmt.Errorf("rule '%s': invalid window '%s'", rule.Name, rule.Window)
+	}
+	rule.window = window
+
+	switch rule.Type {
+	case AlertThreshold:
+		if rule.Threshold < 0 {
+			return fmt.Errorf("rule '%s': threshold must not be negative", rule.Name)
+		}
+		rule.limit = rule.Threshold + 1
+	case AlertRate:
+		if rule.Rate <= 0 {
+			return fmt.Errorf("rule '%s': rate must be greater than 0", rule.Name)
+		}
+		rule.limit = int(math.Floor(rule.Rate*window.Minutes())) + 1
+	default:
+		return fmt.Errorf("rule '%s': unknown type '%s', must be one of %s, %s", rule.Name, rule.Type, AlertThreshold, AlertRate)
+	}
+
+	switch rule.GroupBy {
+	case "", "namespace", "object", "workload":
+	default:
+		return fmt.Errorf("rule '%s': unknown groupBy '%s'", rule.Name, rule.GroupBy)
+	}
+
+	rule.Match.Name = rule.Name
+	return rule.Match.compile()
+}
+
+func (rule *AlertRule) matches(event *Event) bool {
+	if !rule.Match.matchFields(event) {
+		return false
+	}
+	if rule.Match.selector == nil {
+		return true
+	}
+	var workloadLabels map[string]string
+	if event.Workload != nil {
+		workloadLabels = event.Workload.Labels
+	}
+	return rule.Match.selector.Matches(labels.Set(workloadLabels))
+}
+
+func (rule *AlertRule) group(event *Event) string {
+	namespace := event.InvolvedObject.Namespace
+	if namespace == "" {
+		namespace = event.Namespace
+	}
+	switch rule.GroupBy {
+	case "namespace":
+		return namespace
+	case "workload":
+		if event.Workload != nil {
+			return fmt.Sprintf("%s/%s/%s", namespace, event.Workload.Kind, event.Workload.Name)
+		}
+		fallthrough
+	case "object":
+		return fmt.Sprintf("%s/%s/%s", namespace, event.InvolvedObject.Kind, event.InvolvedObject.Name)
+	}
+	return ""
+}
+
+// AlertRecord reports an alert firing or resolving.
+type AlertRecord struct {
+	Rule string `json:"rule"`
+	// Status is firing or resolved.
+	Status   string `json:"status"`
+	Severity string `json:"severity,omitempty"`
+	// Group is the namespace, object or workload the events were counted
+	// for. Empty for cluster-wide rules.
+	Group string `json:"group,omitempty"`
+	// Count is the number of matching events within the window.
+	Count    int        `json:"count"`
+	Window   string     `json:"window"`
+	StartsAt time.Time  `json:"startsAt"`
+	EndsAt   *time.Time `json:"endsAt,omitempty"`
+	// LastMessage is the message of the latest matching event.
+	LastMessage string `json:"lastMessage,omitempty"`
+}
+
+// Summary is a one line, human readable, description of the record.
+func (r *AlertRecord) Summary() string {
+	subject := r.Rule
+	if r.Group != "" {
+		subject = fmt.Sprintf("%s %s", r.Rule, r.Group)
+	}
+	return fmt.Sprintf("[%s] %s: %d events in %s: %s", strings.ToUpper(r.Status), subject, r.Count, r.Window, r.LastMessage)
+}
+
+// AlertNotifier delivers alert records.
+type AlertNotifier interface {
+	// Name identifies the notifier in logs and metrics.
+	Name() string
+	Notify(ctx context.Context, record *AlertRecord) error
+}
+
+type alertGroup struct {
+	// Times of the latest matching occurrences, oldest first, at most
+	// rule.limit of them.
+	times       []time.Time
+	lastMessage string
+	// counts holds the count of the events last observed, by eventKey, so
+	// only their new occurrences are counted. Events are forgotten once
+	// they leave the window.
+	counts map[string]observedCount
+	// Set while the alert is firing.
+	firing *AlertRecord
+}
+
+type observedCount struct {
+	count int32
+	last  time.Time
+}
+
+// occurrences returns the number of occurrences of event, last seen at, the
+// group doesn't know about yet.
+func (g *alertGroup) occurrences(event *Event, at time.Time, window time.Duration) int {
+	key := eventKey(event)
+	n := int(event.Count)
+	if previous, ok := g.counts[key]; ok {
+		n -= int(previous.count)
+	} else if first := event.FirstTimestamp; n < 1 || first.IsZero() || at.Sub(first) > window {
+		// Only the latest occurrence is known to be within the window.
+		n = 1
+	}
+	if n <= 0 {
+		return 0
+	}
+	g.counts[key] = observedCount{count: event.Count, last: at}
+	return n
+}
+
+// add records n occurrences at t, keeping the latest limit of them.
+func (g *alertGroup) add(t time.Time, n, limit int) {
+	if n > limit {
+		n = limit
+	}
+	for ; n > 0; n-- {
+		i := sort.Search(len(g.times), func(i int) bool { return g.times[i].After(t) })
+		g.times = append(g.times, time.Time{})
+		copy(g.times[i+1:], g.times[i:])
+		g.times[i] = t
+	}
+	if len(g.times) > limit {
+		g.times = g.times[len(g.times)-limit:]
+	}
+}
+
+// count returns the number of events within window of now.
+func (g *alertGroup) count(now time.Time, window time.Duration) int {
+	for i, t := range g.times {
+		if now.Sub(t) <= window {
+			return len(g.times) - i
+		}
+	}
+	return 0
+}
+
+// Alerter evaluates alert rules over a stream of events and emits alert
+// records to its notifiers.
+type Alerter struct {
+	// NotifyTimeout is the maximum duration of the delivery of a record to
+	// a notifier. No limit when 0.
+	NotifyTimeout time.Duration
+
+	notifiers []AlertNotifier
+	records   chan *AlertRecord
+
+	sync.Mutex
+	rules  []*AlertRule
+	groups map[string]map[string]*alertGroup
+}
+
+// NewAlerter creates an Alerter, without any rule.
+func NewAlerter(notifiers ...AlertNotifier) *Alerter {
+	return &Alerter{
+		NotifyTimeout: defaultNotifyTimeout,
+		notifiers:     notifiers,
+		records:       make(chan *AlertRecord, alertRecordsBufferSize),
+		groups:        make(map[string]map[string]*alertGroup),
+	}
+}
+
+// definition returns the configuration of the rule, for comparison.
+func (rule *AlertRule) definition() string {
+	data, _ := json.Marshal(rule)
+	return string(data)
+}
+
+// SetRules replaces the rules being evaluated. Rules whose definition is
+// unchanged carry on counting events, alerts firing for the other rules are
+// resolved.
+func (a *Alerter) SetRules(config *AlertConfig) error {
+	rules := []*AlertRule{}
+	for i := range config.Rules {
+		rule := config.Rules[i]
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("alerts: %v", err)
+		}
+		rules = append(rules, &rule)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	previous := make(map[string]*AlertRule)
+	for _, rule := range a.rules {
+		previous[rule.Name] = rule
+	}
+	groups := make(map[string]map[string]*alertGroup)
+	for _, rule := range rules {
+		if old, ok := previous[rule.Name]; ok && old.definition() == rule.definition() {
+			if ruleGroups, ok := a.groups[rule.Name]; ok {
+				groups[rule.Name] = ruleGroups
+			}
+			delete(previous, rule.Name)
+		}
+	}
+	now := time.Now()
+	for _, rule := range previous {
+		for _, group := range a.groups[rule.Name] {
+			if group.firing != nil {
+				a.resolve(rule, group, now)
+			}
+		}
+	}
+	a.rules = rules
+	a.groups = groups
+	log.Infof("Evaluating %d alert rules", len(rules))
+	return nil
+}
+
+func (a *Alerter) emit(record *AlertRecord) {
+	alertRecordsNum.WithLabelValues(record.Rule, record.Status).Inc()
+	select {
+	case a.records <- record:
+	default:
+		log.Errorf("Alert records buffer full, dropping: %s", record.Summary())
+	}
+}
+
+func (a *Alerter) resolve(rule *AlertRule, group *alertGroup, now time.Time) {
+	record := *group.firing
+	record.Status = AlertResolved
+	record.Count = group.count(now, rule.window)
+	record.EndsAt = &now
+	group.firing = nil
+	alertsFiringNum.WithLabelValues(rule.Name).Dec()
+	a.emit(&record)
+}
+
+// Observe counts the new occurrences of event against the rules it matches,
+// at the time the event was last seen.
+func (a *Alerter) Observe(event *Event) {
+	a.observe(event, time.Now())
+}
+
+func (a *Alerter) observe(event *Event, now time.Time) {
+	a.Lock()
+	defer a.Unlock()
+
+	at := firstNonZero(event.LastTimestamp, now)
+	for _, rule := range a.rules {
+		// Events replayed after a relist may be long gone.
+		if now.Sub(at) > rule.window || !rule.matches(event) {
+			continue
+		}
+
+		groups, ok := a.groups[rule.Name]
+		if !ok {
+			groups = make(map[string]*alertGroup)
+			a.groups[rule.Name] = groups
+		}
+		key := rule.group(event)
+		group, ok := groups[key]
+		if !ok {
+			if len(groups) >= maxAlertGroups {
+				log.Errorf("Too many groups for alert rule %s, ignoring event", rule.Name)
+				continue
+			}
+			group = &alertGroup{counts: make(map[string]observedCount)}
+			groups[key] = group
+		}
+
+		n := group.occurrences(event, at, rule.window)
+		if n == 0 {
+			continue
+		}
+		// Only the latest limit occurrences matter to know whether the
+		// rule fires.
+		group.add(at, n, rule.limit)
+		group.lastMessage = event.Message
+
+		latest := group.times[len(group.times)-1]
+		count := group.count(latest, rule.window)
+		if group.firing == nil && count >= rule.limit {
+			group.firing = &AlertRecord{
+				Rule:        rule.Name,
+				Status:      AlertFiring,
+				Severity:    rule.Severity,
+				Group:       key,
+				Count:       count,
+				Window:      rule.window.String(),
+				StartsAt:    latest,
+				LastMessage: group.lastMessage,
+			}
+			alertsFiringNum.WithLabelValues(rule.Name).Inc()
+			a.emit(group.firing)
+		}
+	}
+}
+
+// evaluate resolves the alerts that no longer have enough events within
+// their window and forgets about idle groups.
+func (a *Alerter) evaluate(now time.Time) {
+	a.Lock()
+	defer a.Unlock()
+
+	for _, rule := range a.rules {
+		for key, group := range a.groups[rule.Name] {
+			count := group.count(now, rule.window)
+			if group.firing != nil && count < rule.limit {
+				group.firing.LastMessage = group.lastMessage
+				a.resolve(rule, group, now)
+			}
+			if count == 0 {
+				delete(a.groups[rule.Name], key)
+				continue
+			}
+			for k, c := range group.counts {
+				if now.Sub(c.last) > rule.window {
+					delete(group.counts, k)
+				}
+			}
+		}
+	}
+}
+
+func (a *Alerter) notify(ctx context.Context, record *AlertRecord) {
+	for _, notifier := range a.notifiers {
+		if err := a.notifyOne(ctx, notifier, record); err != nil {
+			log.Errorf("Failed to send alert to %s: %v", notifier.Name(), err)
+			alertNotificationErrorsNum.WithLabelValues(notifier.Name()).Inc()
+		}
+	}
+}
+
+func (a *Alerter) notifyOne(ctx context.Context, notifier AlertNotifier, record *AlertRecord) error {
+	if a.NotifyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.NotifyTimeout)
+		defer cancel()
+	}
+	return notifier.Notify(ctx, record)
+}
+
+// Run periodically evaluates the rules and sends alert records to the
+// notifiers until ctx is done.
+func (a *Alerter) Run(ctx context.Context) {
+	ticker := time.NewTicker(alertEvaluationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			a.evaluate(now)
+		case record := <-a.records:
+			a.notify(ctx, record)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// LogAlertNotifier logs alert records.
+type LogAlertNotifier struct{}
+
+// Name implements AlertNotifier.
+func (LogAlertNotifier) Name() string {
+	return "log"
+}
+
+// Notify implements AlertNotifier.
+func (LogAlertNotifier) Notify(ctx context.Context, record *AlertRecord) error {
+	entry := log.WithFields(log.Fields{
+		"rule":     record.Rule,
+		"status":   record.Status,
+		"severity": record.Severity,
+		"group":    record.Group,
+		"count":    record.Count,
+	})
+	if record.Status == AlertFiring {
+		entry.Warn(record.Summary())
+	} else {
+		entry.Info(record.Summary())
+	}
+	return nil
+}
+
+// WebhookAlertNotifier POSTs alert records, as JSON, to a URL.
+type WebhookAlertNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookAlertNotifier creates a WebhookAlertNotifier.
+func NewWebhookAlertNotifier(url string) *WebhookAlertNotifier {
+	return &WebhookAlertNotifier{
+		URL:    url,
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Name implements AlertNotifier.
+func (n *WebhookAlertNotifier) Name() string {
+	return "webhook"
+}
+
+// Notify implements AlertNotifier.
+func (n *WebhookAlertNotifier) Notify(ctx context.Context, record *AlertRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sending alert: %s", resp.Status)
+	}
+	return nil
+}
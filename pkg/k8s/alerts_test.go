@@ -0,0 +1,312 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testAlertConfig = `
+rules:
+  - name: deployment-backoff
+    type: threshold
+    match:
+      reasons: [BackOff]
+    groupBy: workload
+    window: 10m
+    threshold: 2
+  - name: prod-failed-scheduling
+    type: threshold
+    match:
+      namespaces: [prod]
+      reasons: [FailedScheduling]
+    window: 10m
+  - name: warning-rate
+    type: rate
+    match:
+      types: [Warning]
+      labelSelector: team=web
+    window: 2m
+    rate: 1
+`
+
+func drainRecords(a *Alerter) []*AlertRecord {
+	records := []*AlertRecord{}
+	for {
+		select {
+		case record := <-a.records:
+			records = append(records, record)
+		default:
+			return records
+		}
+	}
+}
+
+// testEventSeq names test events apart, each is a new occurrence.
+var testEventSeq int
+
+func workloadEvent(name, reason string) *Event {
+	testEventSeq++
+	event := testEvent(fmt.Sprintf("%s.%d", name, testEventSeq), "Back-off restarting failed container")
+	event.Reason = reason
+	event.Type = "Normal"
+	event.Workload = &Workload{Kind: "Deployment", Name: name}
+	return event
+}
+
+func newTestAlerter(t *testing.T) *Alerter {
+	config, err := ParseAlertConfig([]byte(testAlertConfig))
+	assert.NoError(t, err)
+	a := NewAlerter()
+	assert.NoError(t, a.SetRules(config))
+	return a
+}
+
+func TestParseAlertConfigStrict(t *testing.T) {
+	_, err := ParseAlertConfig([]byte(`
+rules:
+  - name: backoff
+    type: threshold
+    match:
+      reasons: [BackOff]
+    window: 10m
+    treshold: 5
+`))
+	assert.Error(t, err)
+}
+
+func TestAlertThreshold(t *testing.T) {
+	a := newTestAlerter(t)
+	start := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	// Only the third BackOff of the nginx deployment fires.
+	for i := 0; i < 3; i++ {
+		a.observe(workloadEvent("nginx", "BackOff"), start.Add(time.Duration(i)*time.Minute))
+		a.observe(workloadEvent("redis", "BackOff"), start)
+	}
+	records := drainRecords(a)
+	assert.Len(t, records, 2)
+	groups := []string{records[0].Group, records[1].Group}
+	assert.ElementsMatch(t, []string{"default/Deployment/nginx", "default/Deployment/redis"}, groups)
+	assert.Equal(t, AlertFiring, records[0].Status)
+	assert.Equal(t, 3, records[0].Count)
+
+	// More events don't fire again.
+	a.observe(workloadEvent("nginx", "BackOff"), start.Add(3*time.Minute))
+	assert.Len(t, drainRecords(a), 0)
+
+	// The redis events leave the window first.
+	a.evaluate(start.Add(11 * time.Minute))
+	records = drainRecords(a)
+	assert.Len(t, records, 1)
+	assert.Equal(t, AlertResolved, records[0].Status)
+	assert.Equal(t, "default/Deployment/redis", records[0].Group)
+	assert.NotNil(t, records[0].EndsAt)
+
+	a.evaluate(start.Add(14 * time.Minute))
+	records = drainRecords(a)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "default/Deployment/nginx", records[0].Group)
+	assert.Len(t, a.groups["deployment-backoff"], 0)
+}
+
+func TestAlertCountsNewOccurrences(t *testing.T) {
+	a := newTestAlerter(t)
+	now := time.Now()
+
+	// Updates of an event count the occurrences it gained, at the time it
+	// was last seen.
+	event := workloadEvent("nginx", "BackOff")
+	event.LastTimestamp = now.Add(-2 * time.Minute)
+	a.observe(event, now)
+	updated := *event
+	event = &updated
+	event.Count = 3
+	event.LastTimestamp = now.Add(-time.Minute)
+	a.observe(event, now)
+	records := drainRecords(a)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, 3, records[0].Count)
+		assert.Equal(t, now.Add(-time.Minute), records[0].StartsAt)
+	}
+
+	// Replays don't count again.
+	a.observe(event, now)
+	group := a.groups["deployment-backoff"]["default/Deployment/nginx"]
+	assert.Len(t, group.times, 3)
+
+	// Nor do events replayed after they left the window.
+	old := workloadEvent("redis", "BackOff")
+	old.Count = 10
+	old.LastTimestamp = now.Add(-time.Hour)
+	a.observe(old, now)
+	assert.Empty(t, drainRecords(a))
+	assert.NotContains(t, a.groups["deployment-backoff"], "default/Deployment/redis")
+}
+
+func TestAlertAnyEvent(t *testing.T) {
+	a := newTestAlerter(t)
+	now := time.Now()
+
+	event := workloadEvent("nginx", "FailedScheduling")
+	a.observe(event, now)
+	assert.Len(t, drainRecords(a), 0)
+
+	event.Namespace = "prod"
+	a.observe(event, now)
+	records := drainRecords(a)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "prod-failed-scheduling", records[0].Rule)
+	assert.Equal(t, "", records[0].Group)
+}
+
+func TestAlertAllEvents(t *testing.T) {
+	a := NewAlerter()
+	assert.NoError(t, a.SetRules(&AlertConfig{Rules: []AlertRule{
+		{Name: "all", Type: AlertThreshold, Window: "1m", Threshold: 1},
+	}}))
+	now := time.Now()
+
+	// Alert rules without criteria count every event.
+	a.observe(workloadEvent("nginx", "Pulled"), now)
+	a.observe(workloadEvent("redis", "Started"), now)
+	assert.Len(t, drainRecords(a), 1)
+}
+
+func TestAlertRate(t *testing.T) {
+	a := newTestAlerter(t)
+	start := time.Now()
+
+	warning := func(team string) *Event {
+		testEventSeq++
+		event := testEvent(fmt.Sprintf("e.%d", testEventSeq), "m")
+		event.Reason = "Unhealthy"
+		event.Workload = &Workload{Labels: map[string]string{"team": team}}
+		return event
+	}
+
+	// More than 1 event per minute over 2 minutes.
+	for i := 0; i < 3; i++ {
+		a.observe(warning("db"), start)
+	}
+	assert.Len(t, drainRecords(a), 0)
+	for i := 0; i < 2; i++ {
+		a.observe(warning("web"), start)
+	}
+	assert.Len(t, drainRecords(a), 0)
+	a.observe(warning("web"), start)
+	records := drainRecords(a)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "warning-rate", records[0].Rule)
+}
+
+func TestAlertSetRulesResolves(t *testing.T) {
+	a := newTestAlerter(t)
+	event := workloadEvent("nginx", "FailedScheduling")
+	event.Namespace = "prod"
+	a.observe(event, time.Now())
+	drainRecords(a)
+
+	assert.NoError(t, a.SetRules(&AlertConfig{}))
+	records := drainRecords(a)
+	assert.Len(t, records, 1)
+	assert.Equal(t, AlertResolved, records[0].Status)
+}
+
+func TestAlertSetRulesKeepsUnchangedRules(t *testing.T) {
+	a := newTestAlerter(t)
+	scheduling := workloadEvent("nginx", "FailedScheduling")
+	scheduling.Namespace = "prod"
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		a.observe(workloadEvent("nginx", "BackOff"), now)
+	}
+	a.observe(scheduling, now)
+	assert.Len(t, drainRecords(a), 2)
+
+	// Only the alert of the rule that changed is resolved.
+	config, err := ParseAlertConfig([]byte(testAlertConfig))
+	assert.NoError(t, err)
+	config.Rules[1].Window = "5m"
+	assert.NoError(t, a.SetRules(config))
+	records := drainRecords(a)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "prod-failed-scheduling", records[0].Rule)
+		assert.Equal(t, AlertResolved, records[0].Status)
+	}
+
+	// The other keeps firing without being reported again, and resolves
+	// once its events are out of the window.
+	a.observe(workloadEvent("nginx", "BackOff"), now)
+	assert.Len(t, drainRecords(a), 0)
+	a.evaluate(now.Add(time.Hour))
+	records = drainRecords(a)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "deployment-backoff", records[0].Rule)
+		assert.Equal(t, AlertResolved, records[0].Status)
+	}
+}
+
+type blockingNotifier struct{}
+
+func (blockingNotifier) Name() string {
+	return "blocking"
+}
+
+func (blockingNotifier) Notify(ctx context.Context, record *AlertRecord) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestAlertNotifyTimeout(t *testing.T) {
+	a := NewAlerter(blockingNotifier{})
+	a.NotifyTimeout = 10 * time.Millisecond
+
+	// A notifier not answering doesn't block the alerter.
+	done := make(chan struct{})
+	go func() {
+		a.notify(context.Background(), &AlertRecord{Rule: "r", Status: AlertFiring})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notify did not time out")
+	}
+}
+
+func TestAlertInvalidRules(t *testing.T) {
+	tests := []AlertRule{
+		{Type: AlertThreshold, Window: "1m"},
+		{Name: "r", Type: AlertThreshold, Window: "soon"},
+		{Name: "r", Type: AlertRate, Window: "1m"},
+		{Name: "r", Type: "foo", Window: "1m"},
+		{Name: "r", Type: AlertThreshold, Window: "1m", GroupBy: "node"},
+		{Name: "r", Type: AlertThreshold, Window: "1m", Match: EventRule{Message: "("}},
+		{Name: "r", Type: AlertThreshold, Window: "1m", Threshold: -1},
+	}
+	for _, rule := range tests {
+		err := NewAlerter().SetRules(&AlertConfig{Rules: []AlertRule{rule}})
+		assert.Error(t, err, rule.Name)
+	}
+}
+
+func TestWebhookAlertNotifier(t *testing.T) {
+	received := AlertRecord{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer ts.Close()
+
+	notifier := NewWebhookAlertNotifier(ts.URL)
+	err := notifier.Notify(context.Background(), &AlertRecord{Rule: "r", Status: AlertFiring, Count: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, "r", received.Rule)
+	assert.Equal(t, 3, received.Count)
+}
@@ -0,0 +1,339 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeclient "k8s.io/client-go/kubernetes"
+)
+
+// Reason of the events recording workload changes.
+const WorkloadChangedReason = "TemplateChanged"
+
+// Name of the component reporting workload changes.
+const workloadChangeController = "weave-agent"
+
+// Annotation holding the revision of a Deployment.
+const deploymentRevisionAnnotation = "deployment.kubernetes.io/revision"
+
+const (
+	revisionLookupTimeout = 10 * time.Second
+	// Changes observed beyond this many waiting to be recorded are dropped.
+	maxObservedChanges = 100
+)
+
+var workloadChangesNum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "launcher",
+		Subsystem: "events",
+		Name:      "workload_changes_total",
+		Help:      "The total number of workload pod template changes observed.",
+	},
+	[]string{"kind"})
+
+func init() {
+	prometheus.MustRegister(workloadChangesNum)
+}
+
+// WorkloadChange describes a change to the pod template of a Deployment,
+// DaemonSet or StatefulSet, ie. a rollout.
+type WorkloadChange struct {
+	// Images, by container name, before and after the change.
+	OldImages map[string]string `json:"oldImages"`
+	NewImages map[string]string `json:"newImages"`
+	// Revision of the workload after the change: the revision of the
+	// Deployment, as assigned by its controller, or of the ControllerRevision
+	// of the DaemonSet or StatefulSet. 0 when unknown.
+	Revision int64 `json:"revision"`
+	// ChangedBy is the field manager that last changed the pod template, eg.
+	// kubectl or a CI tool. Empty when unknown.
+	ChangedBy string `json:"changedBy,omitempty"`
+}
+
+// containerImages returns the images of template, by container name.
+func containerImages(template *apiv1.PodTemplateSpec) map[string]string {
+	images := map[string]string{}
+	for _, container := range template.Spec.InitContainers {
+		images[container.Name] = container.Image
+	}
+	for _, container := range template.Spec.Containers {
+		images[container.Name] = container.Image
+	}
+	return images
+}
+
+// templateChangedBy returns the manager which most recently changed the pod
+// template, according to the managed fields of object.
+func templateChangedBy(object metav1.Object) string {
+	var manager string
+	var latest time.Time
+	for _, entry := range object.GetManagedFields() {
+		if entry.FieldsV1 == nil || entry.Time == nil || entry.Time.Time.Before(latest) {
+			continue
+		}
+		fields := map[string]interface{}{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		spec, _ := fields["f:spec"].(map[string]interface{})
+		if _, ok := spec["f:template"]; !ok {
+			continue
+		}
+		manager = entry.Manager
+		latest = entry.Time.Time
+	}
+	return manager
+}
+
+// imageChanges describes how the images of a workload changed.
+func imageChanges(change *WorkloadChange) string {
+	names := []string{}
+	for name := range change.NewImages {
+		names = append(names, name)
+	}
+	for name := range change.OldImages {
+		if _, ok := change.NewImages[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []string{}
+	for _, name := range names {
+		old, cur := change.OldImages[name], change.NewImages[name]
+		switch {
+		case old == cur:
+		case old == "":
+			changes = append(changes, fmt.Sprintf("%s added with image %s", name, cur))
+		case cur == "":
+			changes = append(changes, fmt.Sprintf("%s removed", name))
+		default:
+			changes = append(changes, fmt.Sprintf("%s image %s -> %s", name, old, cur))
+		}
+	}
+	return strings.Join(changes, ", ")
+}
+
+// workloadChangeEvent returns the event recording a change of the pod
+// template of object to revision, or nil if the template didn't change.
+func workloadChangeEvent(kind string, object metav1.Object, old, cur *templateDigest, revision int64, now time.Time) *Event {
+	if old.hash == cur.hash {
+		return nil
+	}
+
+	change := &WorkloadChange{
+		OldImages: old.images,
+		NewImages: cur.images,
+		Revision:  revision,
+		ChangedBy: templateChangedBy(object),
+	}
+	message := fmt.Sprintf("Pod template of %s %s changed", kind, object.GetName())
+	if change.ChangedBy != "" {
+		message += fmt.Sprintf(" by %s", change.ChangedBy)
+	}
+	if images := imageChanges(change); images != "" {
+		message += ": " + images
+	}
+
+	return &Event{
+		Namespace: object.GetNamespace(),
+		Name:      fmt.Sprintf("%s.%d", object.GetName(), object.GetGeneration()),
+		InvolvedObject: apiv1.ObjectReference{
+			Kind:            kind,
+			APIVersion:      appsv1.SchemeGroupVersion.String(),
+			Namespace:       object.GetNamespace(),
+			Name:            object.GetName(),
+			UID:             object.GetUID(),
+			ResourceVersion: object.GetResourceVersion(),
+		},
+		Type:                apiv1.EventTypeNormal,
+		Reason:              WorkloadChangedReason,
+		Action:              "Rollout",
+		Message:             message,
+		Count:               1,
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		ReportingController: workloadChangeController,
+		Change:              change,
+	}
+}
+
+// WorkloadChangeSource records every change of the pod template of the
+// Deployments, DaemonSets and StatefulSets as an event, kept by an EventSource
+// along with the Kubernetes events. Changes are observed through the workload
+// caches of an EventEnricher, those of the workloads that don't fit in them
+// aren't recorded. Changes are recorded once the workload controller has
+// observed them, and given them a revision.
+type WorkloadChangeSource struct {
+	client kubeclient.Interface
+	events *EventSource
+	// Timeout bounds the time spent looking up the revision of a change.
+	Timeout time.Duration
+
+	// Changes observed by their controller, waiting to be recorded.
+	changes chan *observedChange
+
+	sync.Mutex
+	// Pod templates of the workloads before a change not observed by their
+	// controller yet, by kind, namespace and name.
+	pending map[string]*templateDigest
+}
+
+// observedChange is a change of the pod template of a workload observed by
+// its controller.
+type observedChange struct {
+	kind     string
+	object   metav1.Object
+	old, cur *templateDigest
+}
+
+// NewWorkloadChangeSource creates a WorkloadChangeSource observing the
+// workloads cached by workloads, which must not be started yet, and adding
+// its events to events.
+func NewWorkloadChangeSource(client kubeclient.Interface, workloads *EventEnricher, events *EventSource) *WorkloadChangeSource {
+	s := &WorkloadChangeSource{
+		client:  client,
+		events:  events,
+		Timeout: revisionLookupTimeout,
+		changes: make(chan *observedChange, maxObservedChanges),
+		pending: make(map[string]*templateDigest),
+	}
+	workloads.observe(s)
+	return s
+}
+
+// deploymentRevision returns the revision the Deployment controller assigned
+// to the current pod template of deployment.
+func deploymentRevision(deployment *appsv1.Deployment) int64 {
+	revision, _ := strconv.ParseInt(deployment.Annotations[deploymentRevisionAnnotation], 10, 64)
+	return revision
+}
+
+// controllerRevision returns the revision of the ControllerRevision of the
+// current pod template of object: the one named name if not empty, the latest
+// one owned by object among those matching selector otherwise.
+func (s *WorkloadChangeSource) controllerRevision(ctx context.Context, object metav1.Object, selector *metav1.LabelSelector, name string) int64 {
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	revisions := s.client.AppsV1().ControllerRevisions(object.GetNamespace())
+
+	if name != "" {
+		cr, err := revisions.Get(ctx, name, metav1.GetOptions{})
+		if err != nil || !metav1.IsControlledBy(cr, object) {
+			return 0
+		}
+		return cr.Revision
+	}
+
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return 0
+	}
+	list, err := revisions.List(ctx, metav1.ListOptions{LabelSelector: labelSelector.String()})
+	if err != nil {
+		return 0
+	}
+	var revision int64
+	for i := range list.Items {
+		cr := &list.Items[i]
+		if metav1.IsControlledBy(cr, object) && cr.Revision > revision {
+			revision = cr.Revision
+		}
+	}
+	return revision
+}
+
+func (s *WorkloadChangeSource) revision(ctx context.Context, object metav1.Object) int64 {
+	switch o := object.(type) {
+	case *appsv1.Deployment:
+		return deploymentRevision(o)
+	case *appsv1.DaemonSet:
+		return s.controllerRevision(ctx, o, o.Spec.Selector, "")
+	case *appsv1.StatefulSet:
+		return s.controllerRevision(ctx, o, o.Spec.Selector, o.Status.UpdateRevision)
+	}
+	return 0
+}
+
+// workloadUpdated queues a change of the pod template of obj to be recorded
+// once its controller has observed it, ie. observedGeneration has caught up
+// with its generation.
+func (s *WorkloadChangeSource) workloadUpdated(kind string, old, cur *cachedObject, obj interface{}) {
+	var object metav1.Object
+	var observedGeneration int64
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		object, observedGeneration = o, o.Status.ObservedGeneration
+	case *appsv1.DaemonSet:
+		object, observedGeneration = o, o.Status.ObservedGeneration
+	case *appsv1.StatefulSet:
+		object, observedGeneration = o, o.Status.ObservedGeneration
+	default:
+		return
+	}
+	key := fmt.Sprintf("%s/%s/%s", kind, object.GetNamespace(), object.GetName())
+
+	s.Lock()
+	before, ok := s.pending[key]
+	if !ok && old.template.hash != cur.template.hash {
+		before, ok = old.template, true
+		s.pending[key] = before
+	}
+	if !ok || observedGeneration < object.GetGeneration() {
+		s.Unlock()
+		return
+	}
+	delete(s.pending, key)
+	s.Unlock()
+
+	select {
+	case s.changes <- &observedChange{kind: kind, object: object, old: before, cur: cur.template}:
+	default:
+		log.Errorf("Too many workload changes waiting to be recorded, dropping the change of %s %s/%s",
+			kind, object.GetNamespace(), object.GetName())
+	}
+}
+
+func (s *WorkloadChangeSource) workloadDeleted(kind, key string) {
+	s.Lock()
+	delete(s.pending, kind+"/"+key)
+	s.Unlock()
+}
+
+// record records change, looking up its revision.
+func (s *WorkloadChangeSource) record(ctx context.Context, change *observedChange) {
+	revision := s.revision(ctx, change.object)
+	event := workloadChangeEvent(change.kind, change.object, change.old, change.cur, revision, time.Now())
+	if event == nil {
+		return
+	}
+	workloadChangesNum.WithLabelValues(change.kind).Inc()
+	log.Debug(event.Message)
+	s.events.Inject(ctx, event)
+}
+
+// Start records the changes of the workloads until ctx is done. Workloads
+// existing when the workload caches start aren't reported.
+func (s *WorkloadChangeSource) Start(ctx context.Context) {
+	for {
+		select {
+		case change := <-s.changes:
+			s.record(ctx, change)
+		case <-ctx.Done():
+			log.Infof("Workload change watching stopped")
+			return
+		}
+	}
+}
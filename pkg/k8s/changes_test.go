@@ -0,0 +1,208 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func containersTemplate(images ...string) apiv1.PodTemplateSpec {
+	template := apiv1.PodTemplateSpec{}
+	names := []string{"nginx", "sidecar"}
+	for i, image := range images {
+		template.Spec.Containers = append(template.Spec.Containers, apiv1.Container{Name: names[i], Image: image})
+	}
+	return template
+}
+
+func managedFields(manager string, t time.Time, fields string) metav1.ManagedFieldsEntry {
+	updated := metav1.NewTime(t)
+	return metav1.ManagedFieldsEntry{
+		Manager:    manager,
+		Operation:  metav1.ManagedFieldsOperationUpdate,
+		Time:       &updated,
+		FieldsType: "FieldsV1",
+		FieldsV1:   &metav1.FieldsV1{Raw: []byte(fields)},
+	}
+}
+
+func TestTemplateChangedBy(t *testing.T) {
+	object := &metav1.ObjectMeta{
+		ManagedFields: []metav1.ManagedFieldsEntry{
+			managedFields("kubectl-client-side-apply", testEventStart, `{"f:spec":{"f:template":{}}}`),
+			managedFields("kube-controller-manager", testEventLast, `{"f:status":{}}`),
+			managedFields("kubectl-set", testEventStart.Add(time.Minute), `{"f:spec":{"f:template":{}}}`),
+			managedFields("hpa", testEventLast, `{"f:spec":{"f:replicas":{}}}`),
+		},
+	}
+	assert.Equal(t, "kubectl-set", templateChangedBy(object))
+	assert.Equal(t, "", templateChangedBy(&metav1.ObjectMeta{}))
+}
+
+func TestWorkloadChangeEvent(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx", Generation: 4},
+	}
+	old, cur := containersTemplate("nginx:1.13", "envoy:1.5"), containersTemplate("nginx:1.14")
+	now := time.Now()
+
+	assert.Nil(t, workloadChangeEvent("Deployment", deployment, digestTemplate(&old), digestTemplate(&old), 3, now))
+
+	event := workloadChangeEvent("Deployment", deployment, digestTemplate(&old), digestTemplate(&cur), 3, now)
+	assert.Equal(t, WorkloadChangedReason, event.Reason)
+	assert.Equal(t, "Deployment", event.InvolvedObject.Kind)
+	assert.Equal(t, "nginx", event.InvolvedObject.Name)
+	assert.Equal(t, "Pod template of Deployment nginx changed: nginx image nginx:1.13 -> nginx:1.14, sidecar removed", event.Message)
+	assert.Equal(t, int64(3), event.Change.Revision)
+	assert.Equal(t, map[string]string{"nginx": "nginx:1.13", "sidecar": "envoy:1.5"}, event.Change.OldImages)
+	assert.Equal(t, map[string]string{"nginx": "nginx:1.14"}, event.Change.NewImages)
+
+	// Changes not touching images are reported too.
+	cur = containersTemplate("nginx:1.13", "envoy:1.5")
+	cur.Labels = map[string]string{"version": "2"}
+	event = workloadChangeEvent("Deployment", deployment, digestTemplate(&old), digestTemplate(&cur), 3, now)
+	assert.Equal(t, "Pod template of Deployment nginx changed", event.Message)
+}
+
+func waitForEvent(t *testing.T, subscription *Subscription) *Event {
+	select {
+	case event := <-subscription.Events():
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no workload change received")
+	}
+	return nil
+}
+
+// startWorkloadChangeSource starts a WorkloadChangeSource, and the workload
+// caches it observes, once they listed the workloads.
+func startWorkloadChangeSource(ctx context.Context, client *fake.Clientset, events *EventSource) {
+	workloads := NewEventEnricher(client, 1024*1024)
+	source := NewWorkloadChangeSource(client, workloads, events)
+	go workloads.Start(ctx)
+	go source.Start(ctx)
+	for len(client.Actions()) < 2*len(workloads.stores) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func assertNoEvent(t *testing.T, subscription *Subscription) {
+	select {
+	case event := <-subscription.Events():
+		t.Fatalf("unexpected event: %s", event.Message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWorkloadChangeSource(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "nginx",
+			Generation:  1,
+			Annotations: map[string]string{deploymentRevisionAnnotation: "1"},
+		},
+		Spec:   appsv1.DeploymentSpec{Template: containersTemplate("nginx:1.13")},
+		Status: appsv1.DeploymentStatus{ObservedGeneration: 1},
+	}
+	client := fake.NewSimpleClientset(deployment)
+	events := &EventSource{}
+	subscription := events.Subscribe(SubscriptionOptions{Name: "test", BufferSize: 10, Policy: BufferDropNewest})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startWorkloadChangeSource(ctx, client, events)
+	apps := client.AppsV1().Deployments("default")
+
+	// Status updates aren't changes.
+	deployment.Status.Replicas = 1
+	_, err := apps.Update(ctx, deployment, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	// Changes are reported once the controller has given them a revision.
+	deployment.Generation = 2
+	deployment.Spec.Template = containersTemplate("nginx:1.14")
+	deployment.ManagedFields = []metav1.ManagedFieldsEntry{
+		managedFields("kubectl-set", testEventStart, `{"f:spec":{"f:template":{}}}`),
+	}
+	_, err = apps.Update(ctx, deployment, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assertNoEvent(t, subscription)
+
+	deployment.Annotations[deploymentRevisionAnnotation] = "2"
+	deployment.Status.ObservedGeneration = 2
+	_, err = apps.Update(ctx, deployment, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	event := waitForEvent(t, subscription)
+	assert.Equal(t, "Pod template of Deployment nginx changed by kubectl-set: nginx image nginx:1.13 -> nginx:1.14", event.Message)
+	assert.Equal(t, int64(2), event.Change.Revision)
+	assertNoEvent(t, subscription)
+}
+
+func TestWorkloadChangeSourceControllerRevisions(t *testing.T) {
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "redis", UID: "sts", Generation: 1},
+		Spec:       appsv1.StatefulSetSpec{Template: containersTemplate("redis:4.0")},
+		Status:     appsv1.StatefulSetStatus{ObservedGeneration: 1, UpdateRevision: "redis-1"},
+	}
+	daemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "fluentd", UID: "ds", Generation: 1},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "fluentd"}},
+			Template: containersTemplate("fluentd:1.1"),
+		},
+		Status: appsv1.DaemonSetStatus{ObservedGeneration: 1},
+	}
+	controllerRevision := func(name string, owner metav1.Object, kind string, revision int64) *appsv1.ControllerRevision {
+		controller := true
+		return &appsv1.ControllerRevision{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      name,
+				Labels:    map[string]string{"app": owner.GetName()},
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: kind, Name: owner.GetName(), UID: owner.GetUID(), Controller: &controller},
+				},
+			},
+			Revision: revision,
+		}
+	}
+	client := fake.NewSimpleClientset(
+		statefulSet, daemonSet,
+		controllerRevision("redis-1", statefulSet, "StatefulSet", 1),
+		controllerRevision("redis-2", statefulSet, "StatefulSet", 2),
+		controllerRevision("redis-3", statefulSet, "StatefulSet", 3),
+		controllerRevision("fluentd-1", daemonSet, "DaemonSet", 1),
+		controllerRevision("fluentd-5", daemonSet, "DaemonSet", 5),
+	)
+	events := &EventSource{}
+	subscription := events.Subscribe(SubscriptionOptions{Name: "test", BufferSize: 10, Policy: BufferDropNewest})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startWorkloadChangeSource(ctx, client, events)
+
+	// The StatefulSet revision is the one of its update revision.
+	statefulSet.Generation = 2
+	statefulSet.Spec.Template = containersTemplate("redis:4.1")
+	statefulSet.Status = appsv1.StatefulSetStatus{ObservedGeneration: 2, UpdateRevision: "redis-2"}
+	_, err := client.AppsV1().StatefulSets("default").Update(ctx, statefulSet, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), waitForEvent(t, subscription).Change.Revision)
+
+	// The DaemonSet revision is its latest.
+	daemonSet.Generation = 2
+	daemonSet.Spec.Template = containersTemplate("fluentd:1.2")
+	daemonSet.Status.ObservedGeneration = 2
+	_, err = client.AppsV1().DaemonSets("default").Update(ctx, daemonSet, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), waitForEvent(t, subscription).Change.Revision)
+}
@@ -10,11 +10,11 @@ import (
 )
 
 // GetLatestDeploymentReplicaSetRevision gets the latest revision of replica sets of a deployment
-func GetLatestDeploymentReplicaSetRevision(kubeClient *kubeclient.Clientset, namespace, name string) (int64, error) {
+func GetLatestDeploymentReplicaSetRevision(ctx context.Context, kubeClient kubeclient.Interface, namespace, name string) (int64, error) {
 	// Based on https://github.com/kubernetes/kubernetes/blob/release-1.9/pkg/kubectl/history.go
 	versionedClient := kubeClient.AppsV1()
 
-	deployment, err := versionedClient.Deployments(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	deployment, err := versionedClient.Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
 		return 0, fmt.Errorf("failed to retrieve deployment: %s", err)
 	}
@@ -23,7 +23,7 @@ func GetLatestDeploymentReplicaSetRevision(kubeClient *kubeclient.Clientset, nam
 	if err != nil {
 		return 0, fmt.Errorf("failed to turn label selector into selector: %s", err)
 	}
-	allRSs, err := versionedClient.ReplicaSets(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: selector.String()})
+	allRSs, err := versionedClient.ReplicaSets(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
 	if err != nil {
 		return 0, fmt.Errorf("failed to retrieve deployment replicasets: %s", err)
 	}
@@ -0,0 +1,249 @@
+package k8s
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	apiv1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubewatch "k8s.io/apimachinery/pkg/watch"
+	kubeclient "k8s.io/client-go/kubernetes"
+	kubev1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	kubev1events "k8s.io/client-go/kubernetes/typed/events/v1"
+)
+
+// Event is a Kubernetes event normalized from either the core/v1 or the
+// events.k8s.io/v1 API, along with what is known of the workload its
+// involved object belongs to.
+type Event struct {
+	Namespace       string    `json:"namespace"`
+	Name            string    `json:"name"`
+	UID             types.UID `json:"uid"`
+	ResourceVersion string    `json:"resourceVersion,omitempty"`
+	// InvolvedObject is the object the event is about, "regarding" in
+	// events.k8s.io/v1.
+	InvolvedObject apiv1.ObjectReference `json:"involvedObject"`
+	// Related is an optional secondary object.
+	Related *apiv1.ObjectReference `json:"related,omitempty"`
+	// Type is Normal or Warning.
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+	// Action is what was done, or failed, regarding the involved object.
+	Action string `json:"action,omitempty"`
+	// Message is the human readable description, "note" in
+	// events.k8s.io/v1.
+	Message string `json:"message"`
+	// Count is the number of times the event has occurred, series included.
+	Count          int32     `json:"count"`
+	FirstTimestamp time.Time `json:"firstTimestamp"`
+	LastTimestamp  time.Time `json:"lastTimestamp"`
+	// Series is set for events the reporting controller has been
+	// deduplicating into a series.
+	Series *EventSeries `json:"series,omitempty"`
+	// ReportingController and ReportingInstance identify the emitter, eg.
+	// kubelet and its node.
+	ReportingController string `json:"reportingController,omitempty"`
+	ReportingInstance   string `json:"reportingInstance,omitempty"`
+	// Workload is nil when the involved object isn't part of a known workload.
+	Workload *Workload `json:"workload,omitempty"`
+	// Change is only set on the events recording workload changes, see
+	// WorkloadChangeSource.
+	Change *WorkloadChange `json:"change,omitempty"`
+}
+
+// EventSeries describes an ongoing series of events.
+type EventSeries struct {
+	Count            int32     `json:"count"`
+	LastObservedTime time.Time `json:"lastObservedTime"`
+}
+
+func firstNonZero(times ...time.Time) time.Time {
+	for _, t := range times {
+		if !t.IsZero() {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// fromCoreEvent normalizes a core/v1 event.
+func fromCoreEvent(e *apiv1.Event) *Event {
+	event := &Event{
+		Namespace:           e.Namespace,
+		Name:                e.Name,
+		UID:                 e.UID,
+		ResourceVersion:     e.ResourceVersion,
+		InvolvedObject:      e.InvolvedObject,
+		Related:             e.Related,
+		Type:                e.Type,
+		Reason:              e.Reason,
+		Action:              e.Action,
+		Message:             e.Message,
+		Count:               e.Count,
+		FirstTimestamp:      firstNonZero(e.FirstTimestamp.Time, e.EventTime.Time, e.CreationTimestamp.Time),
+		ReportingController: firstNonEmpty(e.ReportingController, e.Source.Component),
+		ReportingInstance:   firstNonEmpty(e.ReportingInstance, e.Source.Host),
+	}
+	var lastObserved time.Time
+	if e.Series != nil {
+		event.Series = &EventSeries{Count: e.Series.Count, LastObservedTime: e.Series.LastObservedTime.Time}
+		lastObserved = e.Series.LastObservedTime.Time
+		if e.Series.Count > event.Count {
+			event.Count = e.Series.Count
+		}
+	}
+	event.LastTimestamp = firstNonZero(lastObserved, e.LastTimestamp.Time, event.FirstTimestamp)
+	if event.Count == 0 {
+		event.Count = 1
+	}
+	return event
+}
+
+// fromEventsV1 normalizes an events.k8s.io/v1 event.
+func fromEventsV1(e *eventsv1.Event) *Event {
+	event := &Event{
+		Namespace:           e.Namespace,
+		Name:                e.Name,
+		UID:                 e.UID,
+		ResourceVersion:     e.ResourceVersion,
+		InvolvedObject:      e.Regarding,
+		Related:             e.Related,
+		Type:                e.Type,
+		Reason:              e.Reason,
+		Action:              e.Action,
+		Message:             e.Note,
+		Count:               e.DeprecatedCount,
+		FirstTimestamp:      firstNonZero(e.EventTime.Time, e.DeprecatedFirstTimestamp.Time, e.CreationTimestamp.Time),
+		ReportingController: firstNonEmpty(e.ReportingController, e.DeprecatedSource.Component),
+		ReportingInstance:   firstNonEmpty(e.ReportingInstance, e.DeprecatedSource.Host),
+	}
+	var lastObserved time.Time
+	if e.Series != nil {
+		event.Series = &EventSeries{Count: e.Series.Count, LastObservedTime: e.Series.LastObservedTime.Time}
+		lastObserved = e.Series.LastObservedTime.Time
+		if e.Series.Count > event.Count {
+			event.Count = e.Series.Count
+		}
+	}
+	event.LastTimestamp = firstNonZero(lastObserved, e.DeprecatedLastTimestamp.Time, event.FirstTimestamp)
+	if event.Count == 0 {
+		event.Count = 1
+	}
+	return event
+}
+
+// eventAPI is the API events are read from.
+type eventAPI interface {
+	// list returns the current events and the resource version of the list.
+	list(ctx context.Context, opts metav1.ListOptions) ([]*Event, string, error)
+	watch(ctx context.Context, opts metav1.ListOptions) (kubewatch.Interface, error)
+	// convert normalizes an object received from the watch.
+	convert(obj runtime.Object) (*Event, bool)
+}
+
+type coreEventAPI struct {
+	client kubev1core.EventInterface
+}
+
+func (api coreEventAPI) list(ctx context.Context, opts metav1.ListOptions) ([]*Event, string, error) {
+	list, err := api.client.List(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	events := []*Event{}
+	for i := range list.Items {
+		events = append(events, fromCoreEvent(&list.Items[i]))
+	}
+	return events, list.ResourceVersion, nil
+}
+
+func (api coreEventAPI) watch(ctx context.Context, opts metav1.ListOptions) (kubewatch.Interface, error) {
+	return api.client.Watch(ctx, opts)
+}
+
+func (api coreEventAPI) convert(obj runtime.Object) (*Event, bool) {
+	event, ok := obj.(*apiv1.Event)
+	if !ok {
+		return nil, false
+	}
+	return fromCoreEvent(event), true
+}
+
+type eventsV1API struct {
+	client kubev1events.EventInterface
+}
+
+func (api eventsV1API) list(ctx context.Context, opts metav1.ListOptions) ([]*Event, string, error) {
+	list, err := api.client.List(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	events := []*Event{}
+	for i := range list.Items {
+		events = append(events, fromEventsV1(&list.Items[i]))
+	}
+	return events, list.ResourceVersion, nil
+}
+
+func (api eventsV1API) watch(ctx context.Context, opts metav1.ListOptions) (kubewatch.Interface, error) {
+	return api.client.Watch(ctx, opts)
+}
+
+func (api eventsV1API) convert(obj runtime.Object) (*Event, bool) {
+	event, ok := obj.(*eventsv1.Event)
+	if !ok {
+		return nil, false
+	}
+	return fromEventsV1(event), true
+}
+
+// newEventAPI reads events from events.k8s.io/v1 when the cluster serves it,
+// core/v1 otherwise. Discovery is abandoned when ctx is done.
+func newEventAPI(ctx context.Context, client kubeclient.Interface, namespace string) eventAPI {
+	groupVersion := eventsv1.SchemeGroupVersion.String()
+
+	type discovery struct {
+		resources *metav1.APIResourceList
+		err       error
+	}
+	done := make(chan discovery, 1)
+	go func() {
+		resources, err := client.Discovery().ServerResourcesForGroupVersion(groupVersion)
+		done <- discovery{resources, err}
+	}()
+	var result discovery
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		result.err = ctx.Err()
+	}
+
+	if result.err != nil && !apierrors.IsNotFound(result.err) {
+		log.Warnf("Could not discover %s, reading events from core/v1: %v", groupVersion, result.err)
+	}
+	if result.err == nil {
+		for _, resource := range result.resources.APIResources {
+			if resource.Name == "events" {
+				log.Infof("Reading events from %s", groupVersion)
+				return eventsV1API{client: client.EventsV1().Events(namespace)}
+			}
+		}
+	}
+	log.Info("Reading events from core/v1")
+	return coreEventAPI{client: client.CoreV1().Events(namespace)}
+}
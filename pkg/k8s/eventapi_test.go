@@ -0,0 +1,108 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	apiv1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var (
+	testEventStart = time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+	testEventLast  = testEventStart.Add(5 * time.Minute)
+)
+
+func TestFromCoreEvent(t *testing.T) {
+	event := fromCoreEvent(&apiv1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Namespace: "default", Name: "e"},
+		InvolvedObject: apiv1.ObjectReference{Kind: "Pod", Name: "nginx"},
+		Reason:         "BackOff",
+		Message:        "Back-off restarting failed container",
+		Count:          12,
+		FirstTimestamp: metav1.NewTime(testEventStart),
+		LastTimestamp:  metav1.NewTime(testEventLast),
+		Source:         apiv1.EventSource{Component: "kubelet", Host: "node-1"},
+	})
+
+	assert.Equal(t, "nginx", event.InvolvedObject.Name)
+	assert.Equal(t, "Back-off restarting failed container", event.Message)
+	assert.Equal(t, int32(12), event.Count)
+	assert.Equal(t, testEventStart, event.FirstTimestamp.UTC())
+	assert.Equal(t, testEventLast, event.LastTimestamp.UTC())
+	assert.Equal(t, "kubelet", event.ReportingController)
+	assert.Equal(t, "node-1", event.ReportingInstance)
+	assert.Nil(t, event.Series)
+}
+
+func TestFromEventsV1(t *testing.T) {
+	event := fromEventsV1(&eventsv1.Event{
+		ObjectMeta:          metav1.ObjectMeta{Namespace: "default", Name: "e"},
+		EventTime:           metav1.NewMicroTime(testEventStart),
+		Regarding:           apiv1.ObjectReference{Kind: "Pod", Name: "nginx"},
+		Related:             &apiv1.ObjectReference{Kind: "Node", Name: "node-1"},
+		Reason:              "FailedScheduling",
+		Action:              "Scheduling",
+		Note:                "0/3 nodes are available",
+		Type:                apiv1.EventTypeWarning,
+		ReportingController: "default-scheduler",
+		ReportingInstance:   "default-scheduler-master-1",
+		Series: &eventsv1.EventSeries{
+			Count:            7,
+			LastObservedTime: metav1.NewMicroTime(testEventLast),
+		},
+	})
+
+	assert.Equal(t, "nginx", event.InvolvedObject.Name)
+	assert.Equal(t, "node-1", event.Related.Name)
+	assert.Equal(t, "0/3 nodes are available", event.Message)
+	assert.Equal(t, "Scheduling", event.Action)
+	assert.Equal(t, int32(7), event.Count)
+	assert.Equal(t, testEventStart, event.FirstTimestamp.UTC())
+	assert.Equal(t, testEventLast, event.LastTimestamp.UTC())
+	assert.Equal(t, "default-scheduler", event.ReportingController)
+	assert.Equal(t, int32(7), event.Series.Count)
+}
+
+func TestFromEventsV1Singleton(t *testing.T) {
+	event := fromEventsV1(&eventsv1.Event{
+		EventTime: metav1.NewMicroTime(testEventStart),
+		Note:      "m",
+	})
+	assert.Equal(t, int32(1), event.Count)
+	assert.Equal(t, testEventStart, event.LastTimestamp.UTC())
+}
+
+func TestNewEventAPI(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	_, ok := newEventAPI(context.Background(), client, apiv1.NamespaceAll).(coreEventAPI)
+	assert.True(t, ok)
+
+	client.Resources = []*metav1.APIResourceList{{
+		GroupVersion: eventsv1.SchemeGroupVersion.String(),
+		APIResources: []metav1.APIResource{{Name: "events", Namespaced: true, Kind: "Event"}},
+	}}
+	_, ok = newEventAPI(context.Background(), client, apiv1.NamespaceAll).(eventsV1API)
+	assert.True(t, ok)
+}
+
+func TestEventsV1APIList(t *testing.T) {
+	client := fake.NewSimpleClientset(&eventsv1.Event{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "e"},
+		EventTime:  metav1.NewMicroTime(testEventStart),
+		Regarding:  apiv1.ObjectReference{Kind: "Pod", Name: "nginx"},
+		Note:       "m",
+	})
+	api := eventsV1API{client: client.EventsV1().Events(apiv1.NamespaceAll)}
+
+	events, _, err := api.list(context.Background(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "nginx", events[0].InvolvedObject.Name)
+	assert.Equal(t, "m", events[0].Message)
+}
@@ -2,16 +2,17 @@ package k8s
 
 import (
 	"context"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 
-	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kubewatch "k8s.io/apimachinery/pkg/watch"
 	kubeclient "k8s.io/client-go/kubernetes"
-	kubev1core "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
 const (
@@ -28,32 +29,94 @@ var (
 			Help:      "The total number of events.",
 		},
 		[]string{"type", "involved_object", "reason"})
+	watchReconnectsNum = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "watch_reconnects_total",
+			Help:      "The total number of times the event watch was re-established.",
+		})
+	watchGapsNum = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "watch_gaps_total",
+			Help:      "The total number of times the event watch could not resume from the last resource version and had to relist.",
+		})
+	replayedEventsNum = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "replayed_total",
+			Help:      "The total number of events recovered by relisting after a watch gap.",
+		})
 )
 
 func init() {
 	prometheus.MustRegister(totalEventsNum)
+	prometheus.MustRegister(watchReconnectsNum)
+	prometheus.MustRegister(watchGapsNum)
+	prometheus.MustRegister(replayedEventsNum)
 }
 
 // EventSource produces Kubernetes events.
 type EventSource struct {
-	// Large local buffer, periodically read.
-	localEventsBuffer chan *apiv1.Event
-	eventClient       kubev1core.EventInterface
+	// Filter, if set, selects the events to keep. It is applied before events
+	// are delivered to subscribers.
+	Filter *EventFilter
+	// Enricher, if set, attaches workload information to the events kept.
+	Enricher *EventEnricher
+	// Alerter, if set, evaluates its alert rules over the events kept, once
+	// enriched.
+	Alerter *Alerter
+
+	api eventAPI
+	// Subscription backing GetNewEvents, unless events are aggregated.
+	polling *Subscription
+	// When set, events are aggregated for GetNewEvents.
+	aggregator *eventAggregator
+
+	subscriptionsLock sync.Mutex
+	subscriptions     []*Subscription
+
+	// Resource version of the last update processed, the watch resumes from
+	// there. Empty before the first list, or once it has expired.
+	lastResourceVersion string
+	// Time of the most recent event processed, used to replay only the
+	// events we have missed when the resource version has expired.
+	lastEventTime time.Time
+	// Resource versions of the events processed that last happened at
+	// lastEventTime, by event. Event timestamps have a resolution of a
+	// second, more events may have happened in that same second.
+	lastEventVersions map[string]string
+}
+
+// EnableAggregation collapses repeated events, ie. events about the same
+// object with the same reason and message, seen within window of each other.
+// GetNewEvents then returns one aggregated event per group instead of every
+// event. Subscriptions still receive every event. Must be called before Start.
+func (source *EventSource) EnableAggregation(window time.Duration) {
+	source.StopPolling()
+	source.aggregator = newEventAggregator(window, localEventsBufferSize)
+}
+
+// StopPolling releases the buffer backing GetNewEvents, for users consuming
+// events through Subscribe only. GetNewEvents returns no events afterwards.
+func (source *EventSource) StopPolling() {
+	if source.polling != nil {
+		source.polling.Unsubscribe()
+		source.polling = nil
+	}
 }
 
 // GetNewEvents returns the Kubernetes events that have been fired since the
 // previous invocation of the function.
-func (source *EventSource) GetNewEvents() []*apiv1.Event {
-	// Get all data from the buffer.
-	events := []*apiv1.Event{}
-event_loop:
-	for {
-		select {
-		case event := <-source.localEventsBuffer:
-			events = append(events, event)
-		default:
-			break event_loop
-		}
+func (source *EventSource) GetNewEvents() []*Event {
+	events := []*Event{}
+	if source.aggregator != nil {
+		events = source.aggregator.flush(time.Now())
+	} else if source.polling != nil {
+		events = source.polling.drain()
 	}
 
 	for _, event := range events {
@@ -63,37 +126,139 @@ event_loop:
 	return events
 }
 
-func (source *EventSource) setupWatcher() (<-chan kubewatch.Event, error) {
-	// Do not write old events.
-	events, err := source.eventClient.List(context.Background(), metav1.ListOptions{})
+func (source *EventSource) buffer(ctx context.Context, event *Event) {
+	if source.aggregator != nil {
+		if !source.aggregator.add(event, time.Now()) {
+			log.Errorf("Too many event aggregation groups, dropping event")
+		}
+	}
+	source.publish(ctx, event)
+}
+
+// eventsAfter returns the events that last happened after t, or at t in a
+// version other than the one in seen.
+func eventsAfter(events []*Event, t time.Time, seen map[string]string) []*Event {
+	after := []*Event{}
+	for _, event := range events {
+		if event.LastTimestamp.Equal(t) {
+			if version, ok := seen[eventKey(event)]; ok && version == event.ResourceVersion {
+				continue
+			}
+		} else if !event.LastTimestamp.After(t) {
+			continue
+		}
+		after = append(after, event)
+	}
+	return after
+}
+
+// list lists the current events and returns the ones we haven't seen yet. The
+// first list doesn't return old events.
+func (source *EventSource) list(ctx context.Context) ([]*Event, error) {
+	events, resourceVersion, err := source.api.list(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
 
-	watcher, err := source.eventClient.Watch(
-		context.Background(),
+	var missed []*Event
+	if !source.lastEventTime.IsZero() {
+		missed = eventsAfter(events, source.lastEventTime, source.lastEventVersions)
+		replayedEventsNum.Add(float64(len(missed)))
+		log.Infof("Replaying %d events missed during the watch gap", len(missed))
+	}
+	source.lastResourceVersion = resourceVersion
+	return missed, nil
+}
+
+// setupWatcher resumes watching from the last resource version processed. If
+// there is none, or it has expired, events are relisted and the ones missed
+// in between are returned for replay.
+func (source *EventSource) setupWatcher(ctx context.Context) (<-chan kubewatch.Event, []*Event, error) {
+	var missed []*Event
+	resuming := source.lastResourceVersion != ""
+	if !resuming {
+		var err error
+		if missed, err = source.list(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	watcher, err := source.api.watch(
+		ctx,
 		metav1.ListOptions{
-			Watch:           true,
-			ResourceVersion: events.ResourceVersion,
+			Watch:               true,
+			ResourceVersion:     source.lastResourceVersion,
+			AllowWatchBookmarks: true,
 		},
 	)
+	if resuming && (apierrors.IsResourceExpired(err) || apierrors.IsGone(err)) {
+		log.Info("Event watch resource version expired, relisting")
+		watchGapsNum.Inc()
+		source.lastResourceVersion = ""
+		return source.setupWatcher(ctx)
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return watcher.ResultChan(), nil
+	return watcher.ResultChan(), missed, nil
 }
 
-func (source *EventSource) watch(cancel <-chan interface{}) {
+func (source *EventSource) process(ctx context.Context, event *Event) {
+	switch {
+	case event.LastTimestamp.After(source.lastEventTime):
+		source.lastEventTime = event.LastTimestamp
+		source.lastEventVersions = map[string]string{eventKey(event): event.ResourceVersion}
+	case event.LastTimestamp.Equal(source.lastEventTime):
+		if source.lastEventVersions == nil {
+			source.lastEventVersions = make(map[string]string)
+		}
+		source.lastEventVersions[eventKey(event)] = event.ResourceVersion
+	}
+	source.keep(ctx, event)
+}
+
+// Inject adds an event that doesn't come from the Kubernetes event API, eg. a
+// workload change, to the events of the source. It is filtered, enriched and
+// delivered like any other event.
+func (source *EventSource) Inject(ctx context.Context, event *Event) {
+	source.keep(ctx, event)
+}
+
+func (source *EventSource) keep(ctx context.Context, event *Event) {
+	if source.Filter != nil && !source.Filter.Keep(ctx, event) {
+		return
+	}
+	if source.Enricher != nil {
+		source.Enricher.Enrich(event)
+	}
+	if source.Alerter != nil {
+		source.Alerter.Observe(event)
+	}
+	source.buffer(ctx, event)
+}
+
+func (source *EventSource) watch(ctx context.Context) {
 	// Outer loop, for reconnections.
-	for {
+	for connected := false; ; connected = true {
+		if connected {
+			watchReconnectsNum.Inc()
+		}
 
 		// Setup watcher on events
-		watchChannel, err := source.setupWatcher()
+		watchChannel, missed, err := source.setupWatcher(ctx)
 		if err != nil {
 			log.Errorf("failed to setup watch for events: %v", err)
-			time.Sleep(time.Second)
-			continue
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-ctx.Done():
+				log.Infof("Event watching stopped")
+				return
+			}
+		}
+		for _, event := range missed {
+			source.process(ctx, event)
 		}
 
 		// Inner loop, for update processing.
@@ -108,6 +273,13 @@ func (source *EventSource) watch(cancel <-chan interface{}) {
 
 				if watchUpdate.Type == kubewatch.Error {
 					if status, ok := watchUpdate.Object.(*metav1.Status); ok {
+						if status.Code == http.StatusGone {
+							// Our resource version is too old, relist.
+							log.Info("Event watch resource version expired, relisting")
+							watchGapsNum.Inc()
+							source.lastResourceVersion = ""
+							break inner_loop
+						}
 						log.Errorf("Error during watch: %#v", status)
 						break inner_loop
 					}
@@ -115,18 +287,16 @@ func (source *EventSource) watch(cancel <-chan interface{}) {
 					break inner_loop
 				}
 
-				if event, ok := watchUpdate.Object.(*apiv1.Event); ok {
+				if event, ok := source.api.convert(watchUpdate.Object); ok {
+					source.lastResourceVersion = event.ResourceVersion
+
 					switch watchUpdate.Type {
 					case kubewatch.Added, kubewatch.Modified:
-						select {
-						case source.localEventsBuffer <- event:
-							// Ok, buffer not full.
-						default:
-							// Buffer full, need to drop the event.
-							log.Errorf("Event buffer full, dropping event")
-						}
+						source.process(ctx, event)
 					case kubewatch.Deleted:
 						// Deleted events are silently ignored.
+					case kubewatch.Bookmark:
+						// Bookmarks only move the resource version forward.
 					default:
 						log.Warningf("Unknown watchUpdate.Type: %#v", watchUpdate.Type)
 					}
@@ -134,7 +304,7 @@ func (source *EventSource) watch(cancel <-chan interface{}) {
 					log.Errorf("Wrong object received: %v", watchUpdate)
 				}
 
-			case <-cancel:
+			case <-ctx.Done():
 				log.Infof("Event watching stopped")
 				return
 			}
@@ -142,19 +312,24 @@ func (source *EventSource) watch(cancel <-chan interface{}) {
 	}
 }
 
-// NewEventSource listens to kubernetes events in namespace. Call GetNewEvents
-// periodically to retrieve batches of events.
-func NewEventSource(client *kubeclient.Clientset, namespace string) *EventSource {
-	eventClient := client.CoreV1().Events(namespace)
+// NewEventSource listens to kubernetes events in namespace. Events are read
+// from the events.k8s.io/v1 API when the cluster serves it, core/v1
+// otherwise, as discovered within ctx. Call GetNewEvents periodically to
+// retrieve batches of events, or Subscribe to have them delivered.
+func NewEventSource(ctx context.Context, client *kubeclient.Clientset, namespace string) *EventSource {
 	result := EventSource{
-		localEventsBuffer: make(chan *apiv1.Event, localEventsBufferSize),
-		eventClient:       eventClient,
+		api: newEventAPI(ctx, client, namespace),
 	}
+	result.polling = result.Subscribe(SubscriptionOptions{
+		Name:       "polling",
+		BufferSize: localEventsBufferSize,
+		Policy:     BufferDropNewest,
+	})
 	return &result
 }
 
-// Start starts watching for Kubernetes event. The cancel channel can be used to
-// terminate the operation.
-func (source *EventSource) Start(cancel <-chan interface{}) {
-	source.watch(cancel)
+// Start starts watching for Kubernetes event until ctx is done. Cancelling ctx
+// also interrupts any list or watch request in flight.
+func (source *EventSource) Start(ctx context.Context) {
+	source.watch(ctx)
 }
@@ -0,0 +1,112 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubewatch "k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	kubetesting "k8s.io/client-go/testing"
+)
+
+func timedEvent(name string, t time.Time) apiv1.Event {
+	return apiv1.Event{
+		ObjectMeta:    metav1.ObjectMeta{Namespace: "default", Name: name},
+		Message:       "m",
+		LastTimestamp: metav1.NewTime(t),
+	}
+}
+
+func TestSetupWatcherResumesFromExpiredResourceVersion(t *testing.T) {
+	now := time.Now()
+
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("list", "events", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		return true, &apiv1.EventList{
+			ListMeta: metav1.ListMeta{ResourceVersion: "10"},
+			Items: []apiv1.Event{
+				timedEvent("seen", now.Add(-time.Minute)),
+				timedEvent("missed", now.Add(time.Minute)),
+			},
+		}, nil
+	})
+	watchedVersions := []string{}
+	client.PrependWatchReactor("events", func(action kubetesting.Action) (bool, kubewatch.Interface, error) {
+		rv := action.(kubetesting.WatchActionImpl).WatchRestrictions.ResourceVersion
+		watchedVersions = append(watchedVersions, rv)
+		if rv == "5" {
+			return true, nil, apierrors.NewResourceExpired("too old resource version")
+		}
+		return true, kubewatch.NewFake(), nil
+	})
+
+	source := &EventSource{
+		api:                 coreEventAPI{client: client.CoreV1().Events(apiv1.NamespaceAll)},
+		lastResourceVersion: "5",
+		lastEventTime:       now,
+	}
+	_, missed, err := source.setupWatcher(context.Background())
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"5", "10"}, watchedVersions)
+	assert.Equal(t, "10", source.lastResourceVersion)
+	assert.Len(t, missed, 1)
+	assert.Equal(t, "missed", missed[0].Name)
+}
+
+func TestListReplaysEventsOfTheLastSecond(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	seen := timedEvent("seen", now)
+	seen.ResourceVersion = "3"
+	updated := timedEvent("updated", now)
+	updated.ResourceVersion = "7"
+	missed := timedEvent("missed", now)
+	missed.ResourceVersion = "8"
+
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("list", "events", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		return true, &apiv1.EventList{
+			ListMeta: metav1.ListMeta{ResourceVersion: "10"},
+			Items:    []apiv1.Event{seen, updated, missed},
+		}, nil
+	})
+
+	source := &EventSource{api: coreEventAPI{client: client.CoreV1().Events(apiv1.NamespaceAll)}}
+	source.process(context.Background(), &Event{Namespace: "default", Name: "seen", ResourceVersion: "3", LastTimestamp: now})
+	source.process(context.Background(), &Event{Namespace: "default", Name: "updated", ResourceVersion: "4", LastTimestamp: now})
+
+	// Events sharing the second of the last event processed are replayed
+	// unless they were processed in that version.
+	replayed, err := source.list(context.Background())
+	assert.NoError(t, err)
+	names := []string{}
+	for _, event := range replayed {
+		names = append(names, event.Name)
+	}
+	assert.Equal(t, []string{"updated", "missed"}, names)
+}
+
+func TestSetupWatcherFirstList(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("list", "events", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		return true, &apiv1.EventList{
+			ListMeta: metav1.ListMeta{ResourceVersion: "10"},
+			Items:    []apiv1.Event{timedEvent("old", time.Now())},
+		}, nil
+	})
+
+	source := &EventSource{api: coreEventAPI{client: client.CoreV1().Events(apiv1.NamespaceAll)}}
+	_, missed, err := source.setupWatcher(context.Background())
+	assert.NoError(t, err)
+
+	// Old events are not reported.
+	assert.Len(t, missed, 0)
+	assert.Equal(t, "10", source.lastResourceVersion)
+}
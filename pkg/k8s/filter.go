@@ -0,0 +1,363 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	kubeclient "k8s.io/client-go/kubernetes"
+)
+
+const (
+	labelCacheTTL     = time.Minute
+	labelFetchTimeout = 10 * time.Second
+)
+
+var (
+	filterMatchesNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "filter_matched_total",
+			Help:      "The total number of events matched by a filter rule.",
+		},
+		[]string{"rule", "action"})
+)
+
+func init() {
+	prometheus.MustRegister(filterMatchesNum)
+}
+
+// EventRule matches events. All the non-empty criteria of a rule must match
+// for the rule to match, list criteria match if any of their values match.
+type EventRule struct {
+	// Name identifies the rule in metrics.
+	Name       string   `json:"name"`
+	Namespaces []string `json:"namespaces"`
+	// Kinds of the involved object, eg. Pod.
+	Kinds   []string `json:"kinds"`
+	Reasons []string `json:"reasons"`
+	// Types are Normal or Warning.
+	Types []string `json:"types"`
+	// LabelSelector is matched against the labels of the involved object.
+	LabelSelector string `json:"labelSelector"`
+	// Message is a regular expression matched against the event message.
+	Message string `json:"message"`
+
+	selector labels.Selector
+	message  *regexp.Regexp
+}
+
+// EventFilterConfig is the declarative configuration of an EventFilter.
+//
+//	include:
+//	- name: warnings
+//	  types: [Warning]
+//	exclude:
+//	- name: kube-system
+//	  namespaces: [kube-system]
+type EventFilterConfig struct {
+	Include []EventRule `json:"include"`
+	Exclude []EventRule `json:"exclude"`
+}
+
+// LabelLookup returns the labels of the object an event is about.
+type LabelLookup func(ctx context.Context, ref *apiv1.ObjectReference) (map[string]string, error)
+
+// EventFilter decides which events are kept. An event is kept if it matches
+// at least one include rule, or there are no include rules, and doesn't match
+// any exclude rule.
+type EventFilter struct {
+	include []*EventRule
+	exclude []*EventRule
+	labels  LabelLookup
+}
+
+func (rule *EventRule) hasCriteria() bool {
+	return len(rule.Namespaces) > 0 || len(rule.Kinds) > 0 || len(rule.Reasons) > 0 ||
+		len(rule.Types) > 0 || rule.LabelSelector != "" || rule.Message != ""
+}
+
+// compile parses the label selector and message regexp of the rule.
+func (rule *EventRule) compile() error {
+	if rule.LabelSelector != "" {
+		selector, err := labels.Parse(rule.LabelSelector)
+		if err != nil {
+			return fmt.Errorf("rule '%s': invalid label selector: %v", rule.Name, err)
+		}
+		rule.selector = selector
+	}
+	if rule.Message != "" {
+		message, err := regexp.Compile(rule.Message)
+		if err != nil {
+			return fmt.Errorf("rule '%s': invalid message regexp: %v", rule.Name, err)
+		}
+		rule.message = message
+	}
+	return nil
+}
+
+func compileRules(rules []EventRule, action string) ([]*EventRule, error) {
+	compiled := []*EventRule{}
+	for i := range rules {
+		rule := rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("%s-%d", action, i)
+		}
+		// A filter rule without criteria matches every event, which is most
+		// likely a typo in the configuration.
+		if !rule.hasCriteria() {
+			return nil, fmt.Errorf("events filter: rule '%s' has no criteria", rule.Name)
+		}
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("events filter: %v", err)
+		}
+		compiled = append(compiled, &rule)
+	}
+	return compiled, nil
+}
+
+// NewEventFilter compiles config into an EventFilter. lookup is used to
+// resolve the labels of involved objects and can be nil if no rule has a
+// label selector.
+func NewEventFilter(config *EventFilterConfig, lookup LabelLookup) (*EventFilter, error) {
+	include, err := compileRules(config.Include, "include")
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compileRules(config.Exclude, "exclude")
+	if err != nil {
+		return nil, err
+	}
+
+	f := &EventFilter{
+		include: include,
+		exclude: exclude,
+		labels:  lookup,
+	}
+	if f.needsLabels() && lookup == nil {
+		return nil, fmt.Errorf("events filter: label selectors require a label lookup")
+	}
+	return f, nil
+}
+
+// ParseEventFilterConfig parses a YAML or JSON EventFilterConfig. Unknown
+// fields are rejected.
+func ParseEventFilterConfig(data []byte) (*EventFilterConfig, error) {
+	data, err := yaml.ToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	config := EventFilterConfig{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (f *EventFilter) needsLabels() bool {
+	for _, rules := range [][]*EventRule{f.include, f.exclude} {
+		for _, rule := range rules {
+			if rule.selector != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchString(values []string, s string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFields returns whether event matches all the criteria of the rule but
+// its label selector.
+func (rule *EventRule) matchFields(event *Event) bool {
+	if !matchString(rule.Namespaces, event.Namespace) ||
+		!matchString(rule.Kinds, event.InvolvedObject.Kind) ||
+		!matchString(rule.Reasons, event.Reason) ||
+		!matchString(rule.Types, event.Type) {
+		return false
+	}
+	return rule.message == nil || rule.message.MatchString(event.Message)
+}
+
+func (f *EventFilter) matchRule(ctx context.Context, rule *EventRule, event *Event) bool {
+	if !rule.matchFields(event) {
+		return false
+	}
+	if rule.selector != nil {
+		objectLabels, err := f.labels(ctx, &event.InvolvedObject)
+		if err != nil {
+			log.Debugf("events filter: could not get labels of %s %s/%s: %v",
+				event.InvolvedObject.Kind, event.InvolvedObject.Namespace, event.InvolvedObject.Name, err)
+		}
+		if !rule.selector.Matches(labels.Set(objectLabels)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *EventFilter) firstMatch(ctx context.Context, rules []*EventRule, event *Event) *EventRule {
+	for _, rule := range rules {
+		if f.matchRule(ctx, rule, event) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Keep returns whether event passes the filter.
+func (f *EventFilter) Keep(ctx context.Context, event *Event) bool {
+	if len(f.include) > 0 {
+		rule := f.firstMatch(ctx, f.include, event)
+		if rule == nil {
+			return false
+		}
+		filterMatchesNum.WithLabelValues(rule.Name, "include").Inc()
+	}
+
+	if rule := f.firstMatch(ctx, f.exclude, event); rule != nil {
+		filterMatchesNum.WithLabelValues(rule.Name, "exclude").Inc()
+		return false
+	}
+	return true
+}
+
+type cachedLabels struct {
+	labels  map[string]string
+	expires time.Time
+}
+
+// ObjectLabelLookup looks up the labels of the objects events are most
+// commonly about: the labels of workloads come from the workload caches, when
+// there are some, other objects are fetched, waiting at most Timeout, and
+// cached.
+type ObjectLabelLookup struct {
+	client    kubeclient.Interface
+	workloads *EventEnricher
+	// Timeout bounds the time spent fetching the labels of an object.
+	Timeout time.Duration
+
+	sync.Mutex
+	cache map[string]cachedLabels
+}
+
+// NewObjectLabelLookup creates an ObjectLabelLookup. workloads can be nil.
+func NewObjectLabelLookup(client kubeclient.Interface, workloads *EventEnricher) *ObjectLabelLookup {
+	return &ObjectLabelLookup{
+		client:    client,
+		workloads: workloads,
+		Timeout:   labelFetchTimeout,
+		cache:     make(map[string]cachedLabels),
+	}
+}
+
+func (l *ObjectLabelLookup) get(ctx context.Context, ref *apiv1.ObjectReference) (metav1.Object, error) {
+	opts := metav1.GetOptions{}
+	switch ref.Kind {
+	case "Pod":
+		return l.client.CoreV1().Pods(ref.Namespace).Get(ctx, ref.Name, opts)
+	case "Node":
+		return l.client.CoreV1().Nodes().Get(ctx, ref.Name, opts)
+	case "Service":
+		return l.client.CoreV1().Services(ref.Namespace).Get(ctx, ref.Name, opts)
+	case "PersistentVolumeClaim":
+		return l.client.CoreV1().PersistentVolumeClaims(ref.Namespace).Get(ctx, ref.Name, opts)
+	case "Deployment":
+		return l.client.AppsV1().Deployments(ref.Namespace).Get(ctx, ref.Name, opts)
+	case "ReplicaSet":
+		return l.client.AppsV1().ReplicaSets(ref.Namespace).Get(ctx, ref.Name, opts)
+	case "DaemonSet":
+		return l.client.AppsV1().DaemonSets(ref.Namespace).Get(ctx, ref.Name, opts)
+	case "StatefulSet":
+		return l.client.AppsV1().StatefulSets(ref.Namespace).Get(ctx, ref.Name, opts)
+	case "Job":
+		return l.client.BatchV1().Jobs(ref.Namespace).Get(ctx, ref.Name, opts)
+	case "CronJob":
+		return l.client.BatchV1().CronJobs(ref.Namespace).Get(ctx, ref.Name, opts)
+	}
+	return nil, fmt.Errorf("unsupported kind %s", ref.Kind)
+}
+
+func labelsKey(ref *apiv1.ObjectReference) string {
+	return fmt.Sprintf("%s/%s/%s", ref.Kind, ref.Namespace, ref.Name)
+}
+
+// Labels implements LabelLookup.
+func (l *ObjectLabelLookup) Labels(ctx context.Context, ref *apiv1.ObjectReference) (map[string]string, error) {
+	if l.workloads != nil {
+		if object := l.workloads.get(ref.Kind, ref.Namespace, ref.Name); object != nil {
+			return object.labels, nil
+		}
+	}
+
+	key := labelsKey(ref)
+	l.Lock()
+	cached, ok := l.cache[key]
+	l.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.labels, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, l.Timeout)
+	defer cancel()
+	var objectLabels map[string]string
+	object, err := l.get(ctx, ref)
+	if err == nil {
+		objectLabels = object.GetLabels()
+	}
+
+	// Cache negative answers as well, the object may well be gone.
+	l.Lock()
+	l.cache[key] = cachedLabels{labels: objectLabels, expires: time.Now().Add(labelCacheTTL)}
+	l.Unlock()
+
+	return objectLabels, err
+}
+
+// Run evicts the expired labels from the cache until ctx is done.
+func (l *ObjectLabelLookup) Run(ctx context.Context) {
+	ticker := time.NewTicker(labelCacheTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.evict(time.Now())
+		}
+	}
+}
+
+func (l *ObjectLabelLookup) evict(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	for k, v := range l.cache {
+		if now.After(v.expires) {
+			delete(l.cache, k)
+		}
+	}
+}
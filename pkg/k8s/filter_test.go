@@ -0,0 +1,150 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var testFilterConfig = `
+include:
+  - name: warnings
+    types: [Warning]
+  - name: deployments
+    kinds: [Deployment]
+exclude:
+  - name: kube-system
+    namespaces: [kube-system]
+  - name: probes
+    message: "^(Liveness|Readiness) probe failed"
+  - name: canaries
+    labelSelector: track=canary
+`
+
+func filterEvent(namespace, kind, eventType, message string) *Event {
+	event := testEvent("e", message)
+	event.Namespace = namespace
+	event.InvolvedObject.Namespace = namespace
+	event.InvolvedObject.Kind = kind
+	event.Type = eventType
+	return event
+}
+
+func TestEventFilter(t *testing.T) {
+	config, err := ParseEventFilterConfig([]byte(testFilterConfig))
+	assert.NoError(t, err)
+
+	lookup := func(ctx context.Context, ref *apiv1.ObjectReference) (map[string]string, error) {
+		if ref.Name == "canary" {
+			return map[string]string{"track": "canary"}, nil
+		}
+		return nil, nil
+	}
+	filter, err := NewEventFilter(config, lookup)
+	assert.NoError(t, err)
+
+	canary := filterEvent("default", "Pod", "Warning", "m")
+	canary.InvolvedObject.Name = "canary"
+
+	tests := []struct {
+		event *Event
+		keep  bool
+	}{
+		{filterEvent("default", "Pod", "Warning", "Back-off restarting failed container"), true},
+		{filterEvent("default", "Pod", "Normal", "Pulled image"), false},
+		{filterEvent("default", "Deployment", "Normal", "Scaled up replica set"), true},
+		{filterEvent("kube-system", "Pod", "Warning", "Back-off restarting failed container"), false},
+		{filterEvent("default", "Pod", "Warning", "Liveness probe failed: timeout"), false},
+		{canary, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.keep, filter.Keep(context.Background(), test.event), test.event.Message)
+	}
+}
+
+func TestEventFilterNoInclude(t *testing.T) {
+	filter, err := NewEventFilter(&EventFilterConfig{
+		Exclude: []EventRule{{Reasons: []string{"Pulled"}}},
+	}, nil)
+	assert.NoError(t, err)
+
+	pulled := testEvent("e", "m")
+	pulled.Reason = "Pulled"
+	assert.False(t, filter.Keep(context.Background(), pulled))
+	assert.True(t, filter.Keep(context.Background(), testEvent("e", "m")))
+}
+
+func TestEventFilterInvalid(t *testing.T) {
+	_, err := NewEventFilter(&EventFilterConfig{
+		Include: []EventRule{{Message: "("}},
+	}, nil)
+	assert.Error(t, err)
+
+	_, err = NewEventFilter(&EventFilterConfig{
+		Include: []EventRule{{LabelSelector: "a in (b"}},
+	}, nil)
+	assert.Error(t, err)
+
+	// Rules without criteria would match every event.
+	_, err = NewEventFilter(&EventFilterConfig{
+		Exclude: []EventRule{{Name: "everything"}},
+	}, nil)
+	assert.Error(t, err)
+
+	// Label selectors need a way to resolve labels.
+	_, err = NewEventFilter(&EventFilterConfig{
+		Include: []EventRule{{LabelSelector: "app=foo"}},
+	}, nil)
+	assert.Error(t, err)
+}
+
+func TestParseEventFilterConfigStrict(t *testing.T) {
+	_, err := ParseEventFilterConfig([]byte(`
+exclude:
+  - name: kube-system
+    namespace: [kube-system]
+`))
+	assert.Error(t, err)
+}
+
+func TestObjectLabelLookup(t *testing.T) {
+	client := fake.NewSimpleClientset(&apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"pool": "spot"}},
+	})
+	enricher := NewEventEnricher(client, 1024*1024)
+	enricher.stores["Pod"].Add(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx", Labels: map[string]string{"app": "nginx"}},
+	})
+	lookup := NewObjectLabelLookup(client, enricher)
+	ctx := context.Background()
+
+	// Workload labels come from the workload caches.
+	labels, err := lookup.Labels(ctx, &apiv1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "nginx"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"app": "nginx"}, labels)
+
+	// Other objects are fetched, the first time they are looked up.
+	node := &apiv1.ObjectReference{Kind: "Node", Name: "node-1"}
+	labels, err = lookup.Labels(ctx, node)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"pool": "spot"}, labels)
+
+	// Then cached.
+	assert.NoError(t, client.CoreV1().Nodes().Delete(ctx, "node-1", metav1.DeleteOptions{}))
+	labels, err = lookup.Labels(ctx, node)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"pool": "spot"}, labels)
+
+	// Until they expire.
+	lookup.evict(time.Now().Add(labelCacheTTL + time.Second))
+	assert.Empty(t, lookup.cache)
+	_, err = lookup.Labels(ctx, node)
+	assert.Error(t, err)
+}
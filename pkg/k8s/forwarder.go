@@ -0,0 +1,380 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// The EventForwarder POSTs batches of events as a JSON document of the form:
+//
+//   {
+//     "dropped": 0,
+//     "events": [
+//       {
+//         "namespace": "default",
+//         "name": "nginx-7db9fccd9b-2f8zj.15a8d2f7c2c8e9b1",
+//         "uid": "4f4a0c6e-1d9a-11e8-9a5b-42010a840044",
+//         "type": "Warning",
+//         "reason": "BackOff",
+//         "message": "Back-off restarting failed container",
+//         "count": 12,
+//         "firstTimestamp": "2018-03-01T10:00:00Z",
+//         "lastTimestamp": "2018-03-01T10:05:00Z",
+//         "source": {"component": "kubelet", "host": "node-1"},
+//         "involvedObject": {
+//           "kind": "Pod",
+//           "namespace": "default",
+//           "name": "nginx-7db9fccd9b-2f8zj",
+//           "uid": "4e8f7a3c-1d9a-11e8-9a5b-42010a840044",
+//           "fieldPath": "spec.containers{nginx}"
+//         },
+//         "workload": {
+//           "owners": [
+//             {"kind": "ReplicaSet", "name": "nginx-7db9fccd9b"},
+//             {"kind": "Deployment", "name": "nginx"}
+//           ],
+//           "kind": "Deployment",
+//           "name": "nginx",
+//           "labels": {"team": "web"},
+//           "nodeName": "node-1",
+//           "images": ["nginx:1.13"]
+//         }
+//       }
+//     ]
+//   }
+//
+// action and series are only present for events that carry them, mostly
+// those emitted through the events.k8s.io/v1 API. series is of the form:
+//
+//   {"count": 42, "lastObservedTime": "2018-03-01T10:05:00Z"}
+//
+// workload is only present when the agent knows which workload the involved
+// object belongs to.
+//
+// change is only present on the events, of reason TemplateChanged, recording
+// a change of the pod template of a Deployment, DaemonSet or StatefulSet:
+//
+//   {
+//     "oldImages": {"nginx": "nginx:1.13"},
+//     "newImages": {"nginx": "nginx:1.14"},
+//     "revision": 4,
+//     "changedBy": "kubectl-set"
+//   }
+//
+// dropped is the number of events the forwarder had to discard since the last
+// successful request, because they were too large or rejected by the endpoint,
+// so the receiving end can account for gaps.
+
+const (
+	defaultMaxPayloadBytes = 1024 * 1024
+	defaultMaxRetries      = 3
+	defaultRetryInterval   = time.Second
+	defaultRequestTimeout  = 30 * time.Second
+)
+
+var (
+	forwardedEventsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "forwarded_total",
+			Help:      "The total number of events forwarded to a sink.",
+		},
+		[]string{"sink"})
+	droppedEventsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "dropped_total",
+			Help:      "The total number of events that could not be forwarded to a sink.",
+		},
+		[]string{"sink", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(forwardedEventsNum)
+	prometheus.MustRegister(droppedEventsNum)
+}
+
+type forwardedEventSource struct {
+	Component string `json:"component,omitempty"`
+	Host      string `json:"host,omitempty"`
+}
+
+type forwardedObject struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	UID       string `json:"uid,omitempty"`
+	FieldPath string `json:"fieldPath,omitempty"`
+}
+
+type forwardedEvent struct {
+	Namespace      string               `json:"namespace"`
+	Name           string               `json:"name"`
+	UID            string               `json:"uid"`
+	Type           string               `json:"type"`
+	Reason         string               `json:"reason"`
+	Message        string               `json:"message"`
+	Count          int32                `json:"count"`
+	FirstTimestamp time.Time            `json:"firstTimestamp"`
+	LastTimestamp  time.Time            `json:"lastTimestamp"`
+	Source         forwardedEventSource `json:"source"`
+	Action         string               `json:"action,omitempty"`
+	Series         *EventSeries         `json:"series,omitempty"`
+	InvolvedObject forwardedObject      `json:"involvedObject"`
+	Workload       *Workload            `json:"workload,omitempty"`
+	Change         *WorkloadChange      `json:"change,omitempty"`
+}
+
+type eventsPayload struct {
+	Dropped int               `json:"dropped"`
+	Events  []json.RawMessage `json:"events"`
+}
+
+func toForwardedEvent(event *Event) forwardedEvent {
+	return forwardedEvent{
+		Namespace:      event.Namespace,
+		Name:           event.Name,
+		UID:            string(event.UID),
+		Type:           event.Type,
+		Reason:         event.Reason,
+		Message:        event.Message,
+		Count:          event.Count,
+		FirstTimestamp: event.FirstTimestamp.UTC(),
+		LastTimestamp:  event.LastTimestamp.UTC(),
+		Source: forwardedEventSource{
+			Component: event.ReportingController,
+			Host:      event.ReportingInstance,
+		},
+		Action: event.Action,
+		Series: event.Series,
+		InvolvedObject: forwardedObject{
+			Kind:      event.InvolvedObject.Kind,
+			Namespace: event.InvolvedObject.Namespace,
+			Name:      event.InvolvedObject.Name,
+			UID:       string(event.InvolvedObject.UID),
+			FieldPath: event.InvolvedObject.FieldPath,
+		},
+		Workload: event.Workload,
+		Change:   event.Change,
+	}
+}
+
+// EventForwarder sends Kubernetes events to an HTTP endpoint, Weave Cloud or a
+// generic webhook. It implements EventSink and is not safe for concurrent use.
+type EventForwarder struct {
+	// URL of the endpoint receiving events.
+	URL string
+	// Token is the Weave Cloud instance token. No Authorization header is
+	// sent when empty.
+	Token string
+	// Client is the HTTP client used to send requests.
+	Client *http.Client
+	// MaxPayloadBytes is the maximum size of a single request body. Larger
+	// batches are split across several requests.
+	MaxPayloadBytes int
+	// MaxRetries is the number of times a failed request is retried before
+	// giving up with a TemporaryError.
+	MaxRetries int
+	// RetryInterval is the wait before the first retry, doubled on each
+	// subsequent retry.
+	RetryInterval time.Duration
+	// RequestTimeout is the maximum duration of a single request, a request
+	// timing out is retried. No limit when 0.
+	RequestTimeout time.Duration
+
+	name string
+	// Number of events dropped since the last successful request.
+	dropped int
+}
+
+// NewEventForwarder creates an EventForwarder sending events to Weave Cloud,
+// with default limits.
+func NewEventForwarder(url, token string) *EventForwarder {
+	return &EventForwarder{
+		name:            "weave-cloud",
+		URL:             url,
+		Token:           token,
+		Client:          &http.Client{},
+		MaxPayloadBytes: defaultMaxPayloadBytes,
+		MaxRetries:      defaultMaxRetries,
+		RetryInterval:   defaultRetryInterval,
+		RequestTimeout:  defaultRequestTimeout,
+	}
+}
+
+// NewWebhookSink creates an EventForwarder POSTing events to a generic
+// webhook.
+func NewWebhookSink(url string) *EventForwarder {
+	f := NewEventForwarder(url, "")
+	f.name = "webhook"
+	return f
+}
+
+// Name implements EventSink.
+func (f *EventForwarder) Name() string {
+	return f.name
+}
+
+// Send implements EventSink.
+func (f *EventForwarder) Send(ctx context.Context, events []*Event) error {
+	return f.Forward(ctx, events)
+}
+
+// Close implements EventSink.
+func (f *EventForwarder) Close() error {
+	return nil
+}
+
+// Drop implements dropper, the events are reported as dropped with the next
+// request.
+func (f *EventForwarder) Drop(reason string, n int) {
+	f.drop(reason, n)
+}
+
+func (f *EventForwarder) drop(reason string, n int) {
+	f.dropped += n
+	droppedEventsNum.WithLabelValues(f.name, reason).Add(float64(n))
+}
+
+// Forward sends events to the endpoint. Events are split into batches no
+// larger than MaxPayloadBytes. An error is returned if any of the events
+// could not be delivered. Events that can never be delivered are dropped, a
+// TemporaryError is returned if some events are worth sending again later.
+func (f *EventForwarder) Forward(ctx context.Context, events []*Event) error {
+	// Leave room for the payload envelope, accounting for the events which
+	// may be dropped before the last batch is sent.
+	maxBatchBytes := f.MaxPayloadBytes - f.envelopeBytes(len(events))
+
+	var lastErr, tempErr error
+	batch := []json.RawMessage{}
+	batchBytes := 0
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := f.send(ctx, batch); IsTemporary(err) {
+			tempErr = err
+		} else if err != nil {
+			lastErr = err
+		}
+		batch = []json.RawMessage{}
+		batchBytes = 0
+	}
+
+	for _, event := range events {
+		data, err := json.Marshal(toForwardedEvent(event))
+		if err != nil {
+			f.drop("encoding", 1)
+			lastErr = err
+			continue
+		}
+		if len(data) > maxBatchBytes {
+			f.drop("too_large", 1)
+			lastErr = fmt.Errorf("event %s/%s is larger than the maximum payload size", event.Namespace, event.Name)
+			continue
+		}
+		// Events are separated by a comma.
+		if len(batch) > 0 && batchBytes+1+len(data) > maxBatchBytes {
+			flush()
+		}
+		if len(batch) > 0 {
+			batchBytes++
+		}
+		batch = append(batch, data)
+		batchBytes += len(data)
+	}
+	flush()
+
+	if tempErr != nil {
+		return tempErr
+	}
+	return lastErr
+}
+
+// envelopeBytes returns the size of a payload without events, once n more
+// events are dropped.
+func (f *EventForwarder) envelopeBytes(n int) int {
+	data, _ := json.Marshal(eventsPayload{Dropped: f.dropped + n, Events: []json.RawMessage{}})
+	return len(data)
+}
+
+func (f *EventForwarder) send(ctx context.Context, events []json.RawMessage) error {
+	body, err := json.Marshal(eventsPayload{
+		Dropped: f.dropped,
+		Events:  events,
+	})
+	if err != nil {
+		f.drop("encoding", len(events))
+		return err
+	}
+
+	wait := f.RetryInterval
+	for attempt := 0; ; attempt++ {
+		retry, err := f.post(ctx, body)
+		if err == nil {
+			f.dropped = 0
+			forwardedEventsNum.WithLabelValues(f.name).Add(float64(len(events)))
+			return nil
+		}
+		if !retry {
+			f.drop("rejected", len(events))
+			return err
+		}
+		if attempt >= f.MaxRetries {
+			return &TemporaryError{Err: err}
+		}
+
+		log.Debugf("Failed to forward events, retrying in %s: %v", wait, err)
+		select {
+		case <-time.After(wait):
+			wait *= 2
+		case <-ctx.Done():
+			return &TemporaryError{Err: ctx.Err()}
+		}
+	}
+}
+
+// post sends a single request and returns whether a failed request is worth
+// retrying.
+func (f *EventForwarder) post(ctx context.Context, body []byte) (bool, error) {
+	reqCtx := ctx
+	if f.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, f.RequestTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, f.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", f.Token))
+	}
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused.
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("forwarding events: %s", resp.Status)
+}
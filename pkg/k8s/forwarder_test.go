@@ -0,0 +1,280 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const testToken = "WEAVE_CLOUD_TOKEN_123"
+
+func testEvent(name, message string) *Event {
+	return &Event{
+		Namespace: "default",
+		Name:      name,
+		InvolvedObject: apiv1.ObjectReference{
+			Kind:      "Pod",
+			Namespace: "default",
+			Name:      "nginx",
+		},
+		Type:    apiv1.EventTypeWarning,
+		Reason:  "BackOff",
+		Message: message,
+		Count:   1,
+	}
+}
+
+type receivedPayload struct {
+	Dropped int              `json:"dropped"`
+	Events  []forwardedEvent `json:"events"`
+}
+
+type testReceiver struct {
+	sync.Mutex
+	payloads []receivedPayload
+	// Status codes to answer with, in order. Once exhausted, answers 200.
+	statuses []int
+}
+
+func (r *testReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+
+	if req.Header.Get("Authorization") != fmt.Sprintf("Bearer %s", testToken) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	payload := receivedPayload{}
+	if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.payloads = append(r.payloads, payload)
+}
+
+func newTestForwarder(url string) *EventForwarder {
+	f := NewEventForwarder(url, testToken)
+	f.RetryInterval = time.Millisecond
+	return f
+}
+
+func TestForwardEvents(t *testing.T) {
+	receiver := &testReceiver{}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	f := newTestForwarder(ts.URL)
+	err := f.Forward(context.Background(), []*Event{
+		testEvent("e1", "Back-off restarting failed container"),
+		testEvent("e2", "Back-off restarting failed container"),
+	})
+	assert.NoError(t, err)
+
+	assert.Len(t, receiver.payloads, 1)
+	payload := receiver.payloads[0]
+	assert.Equal(t, 0, payload.Dropped)
+	assert.Len(t, payload.Events, 2)
+	assert.Equal(t, "e1", payload.Events[0].Name)
+	assert.Equal(t, "BackOff", payload.Events[0].Reason)
+	assert.Equal(t, "Pod", payload.Events[0].InvolvedObject.Kind)
+}
+
+func TestForwardEventsSplitsBatches(t *testing.T) {
+	receiver := &testReceiver{}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	f := newTestForwarder(ts.URL)
+	f.MaxPayloadBytes = 1024
+	events := []*Event{}
+	for i := 0; i < 10; i++ {
+		events = append(events, testEvent(fmt.Sprintf("e%d", i), strings.Repeat("x", 200)))
+	}
+	err := f.Forward(context.Background(), events)
+	assert.NoError(t, err)
+
+	assert.True(t, len(receiver.payloads) > 1)
+	n := 0
+	for _, payload := range receiver.payloads {
+		n += len(payload.Events)
+	}
+	assert.Equal(t, 10, n)
+}
+
+func TestForwardEventsTooLarge(t *testing.T) {
+	receiver := &testReceiver{}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	f := newTestForwarder(ts.URL)
+	f.MaxPayloadBytes = 1024
+	err := f.Forward(context.Background(), []*Event{
+		testEvent("big", strings.Repeat("x", 2048)),
+		testEvent("small", "small"),
+	})
+	assert.Error(t, err)
+
+	// The small event goes through and accounts for the dropped one.
+	assert.Len(t, receiver.payloads, 1)
+	assert.Equal(t, 1, receiver.payloads[0].Dropped)
+	assert.Equal(t, "small", receiver.payloads[0].Events[0].Name)
+}
+
+func TestForwardEventsRetries(t *testing.T) {
+	receiver := &testReceiver{
+		statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+	}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	f := newTestForwarder(ts.URL)
+	err := f.Forward(context.Background(), []*Event{testEvent("e1", "m")})
+	assert.NoError(t, err)
+	assert.Len(t, receiver.payloads, 1)
+}
+
+func TestForwardEventsTemporaryError(t *testing.T) {
+	receiver := &testReceiver{
+		statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+	}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	f := newTestForwarder(ts.URL)
+	f.MaxRetries = 1
+	err := f.Forward(context.Background(), []*Event{testEvent("e1", "m")})
+	assert.True(t, IsTemporary(err))
+
+	// Temporary failures aren't reported as dropped, the events may be sent
+	// again.
+	err = f.Forward(context.Background(), []*Event{testEvent("e2", "m")})
+	assert.NoError(t, err)
+	assert.Len(t, receiver.payloads, 1)
+	assert.Equal(t, 0, receiver.payloads[0].Dropped)
+}
+
+func TestForwardEventsGivesUp(t *testing.T) {
+	receiver := &testReceiver{
+		statuses: []int{http.StatusBadRequest},
+	}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	f := newTestForwarder(ts.URL)
+	err := f.Forward(context.Background(), []*Event{testEvent("e1", "m")})
+	assert.Error(t, err)
+	assert.False(t, IsTemporary(err))
+	assert.Len(t, receiver.payloads, 0)
+
+	// The next successful request reports the dropped event.
+	err = f.Forward(context.Background(), []*Event{testEvent("e2", "m")})
+	assert.NoError(t, err)
+	assert.Len(t, receiver.payloads, 1)
+	assert.Equal(t, 1, receiver.payloads[0].Dropped)
+}
+
+func TestForwardEventsPayloadBoundary(t *testing.T) {
+	sizes := []int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		sizes = append(sizes, len(body))
+	}))
+	defer ts.Close()
+
+	events := []*Event{testEvent("e1", "m"), testEvent("e2", "m")}
+	e1, err := json.Marshal(toForwardedEvent(events[0]))
+	assert.NoError(t, err)
+	e2, err := json.Marshal(toForwardedEvent(events[1]))
+	assert.NoError(t, err)
+	payloadBytes := len(`{"dropped":0,"events":[]}`) + len(e1) + 1 + len(e2)
+
+	// Both events fit in a payload of exactly the maximum size.
+	f := newTestForwarder(ts.URL)
+	f.MaxPayloadBytes = payloadBytes
+	assert.NoError(t, f.Forward(context.Background(), events))
+	assert.Equal(t, []int{payloadBytes}, sizes)
+
+	// But not in one byte less.
+	sizes = nil
+	f.MaxPayloadBytes = payloadBytes - 1
+	assert.NoError(t, f.Forward(context.Background(), events))
+	assert.Len(t, sizes, 2)
+	for _, size := range sizes {
+		assert.True(t, size <= f.MaxPayloadBytes)
+	}
+}
+
+func TestForwardEventsRequestTimeout(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	// A hung request times out and is retried.
+	f := newTestForwarder(ts.URL)
+	f.RequestTimeout = 10 * time.Millisecond
+	assert.NoError(t, f.Forward(context.Background(), []*Event{testEvent("e1", "m")}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestForwardEventsFanoutDropped(t *testing.T) {
+	receiver := &testReceiver{
+		statuses: []int{http.StatusServiceUnavailable},
+	}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	f := newTestForwarder(ts.URL)
+	f.MaxRetries = 0
+	fanout := NewEventFanout(10, f)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		fanout.Run(ctx)
+		close(done)
+	}()
+
+	// Without a spool, events the forwarder gave up on are reported as
+	// dropped.
+	fanout.Send([]*Event{testEvent("e1", "m")})
+	fanout.Send([]*Event{testEvent("e2", "m")})
+	received := func() int {
+		receiver.Lock()
+		defer receiver.Unlock()
+		return len(receiver.payloads)
+	}
+	for i := 0; i < 1000 && received() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if assert.Len(t, receiver.payloads, 1) {
+		assert.Equal(t, 1, receiver.payloads[0].Dropped)
+	}
+}
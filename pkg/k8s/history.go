@@ -0,0 +1,184 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var historyEventsNum = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "launcher",
+		Subsystem: "events",
+		Name:      "history_events",
+		Help:      "The number of events kept in the event history.",
+	})
+
+func init() {
+	prometheus.MustRegister(historyEventsNum)
+}
+
+// EventQuery selects events from an EventHistory. Empty fields match any
+// event.
+type EventQuery struct {
+	Namespace string
+	// Kind and Name of the involved object.
+	Kind   string
+	Name   string
+	Reason string
+	// Since only selects the events that last happened after that time.
+	Since time.Time
+}
+
+// ParseEventQuery parses an EventQuery from the namespace, kind, name, reason
+// and since URL query parameters. since is either a RFC 3339 time or a
+// duration, eg. 15m, relative to now.
+func ParseEventQuery(values url.Values, now time.Time) (EventQuery, error) {
+	query := EventQuery{
+		Namespace: values.Get("namespace"),
+		Kind:      values.Get("kind"),
+		Name:      values.Get("name"),
+		Reason:    values.Get("reason"),
+	}
+	if since := values.Get("since"); since != "" {
+		if d, err := time.ParseDuration(since); err == nil {
+			query.Since = now.Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+			query.Since = t
+		} else {
+			return query, fmt.Errorf("invalid since '%s', must be a RFC 3339 time or a duration", since)
+		}
+	}
+	return query, nil
+}
+
+func (query *EventQuery) matches(event *Event) bool {
+	return (query.Namespace == "" || query.Namespace == event.Namespace) &&
+		(query.Kind == "" || query.Kind == event.InvolvedObject.Kind) &&
+		(query.Name == "" || query.Name == event.InvolvedObject.Name) &&
+		(query.Reason == "" || query.Reason == event.Reason) &&
+		(query.Since.IsZero() || event.LastTimestamp.After(query.Since))
+}
+
+// EventHistory keeps the most recent events in memory, beyond the TTL of
+// events in the API server, and serves them over HTTP.
+type EventHistory struct {
+	sync.Mutex
+	// Ring buffer, next is the position of the oldest event once full.
+	events []*Event
+	next   int
+	full   bool
+}
+
+// NewEventHistory creates an EventHistory keeping up to size events.
+func NewEventHistory(size int) *EventHistory {
+	return &EventHistory{
+		events: make([]*Event, size),
+	}
+}
+
+// Add records event, replacing the oldest event when the history is full.
+func (h *EventHistory) Add(event *Event) {
+	h.Lock()
+	defer h.Unlock()
+
+	if len(h.events) == 0 {
+		return
+	}
+	h.events[h.next] = event
+	h.next = (h.next + 1) % len(h.events)
+	if h.next == 0 {
+		h.full = true
+	}
+	historyEventsNum.Set(float64(h.len()))
+}
+
+func (h *EventHistory) len() int {
+	if h.full {
+		return len(h.events)
+	}
+	return h.next
+}
+
+// Query returns the events selected by query, oldest first.
+func (h *EventHistory) Query(query EventQuery) []*Event {
+	h.Lock()
+	defer h.Unlock()
+
+	events := []*Event{}
+	start := 0
+	if h.full {
+		start = h.next
+	}
+	for i := 0; i < h.len(); i++ {
+		event := h.events[(start+i)%len(h.events)]
+		if query.matches(event) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Run records the events delivered to subscription until ctx is done or the
+// subscription is closed.
+func (h *EventHistory) Run(ctx context.Context, subscription *Subscription) {
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				return
+			}
+			h.Add(event)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func wantsNDJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "ndjson"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// ServeHTTP serves the events selected by the query parameters, see
+// ParseEventQuery, as a JSON array or, with format=ndjson or an
+// application/x-ndjson Accept header, as newline-delimited JSON.
+func (h *EventHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query, err := ParseEventQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events := h.Query(query)
+
+	if wantsNDJSON(r) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				log.Debugf("Writing event history: %v", err)
+				return
+			}
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		log.Debugf("Writing event history: %v", err)
+	}
+}
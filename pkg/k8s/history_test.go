@@ -0,0 +1,106 @@
+package k8s
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func historyMessages(events []*Event) []string {
+	messages := []string{}
+	for _, event := range events {
+		messages = append(messages, event.Message)
+	}
+	return messages
+}
+
+func TestEventHistoryRing(t *testing.T) {
+	h := NewEventHistory(3)
+	assert.Len(t, h.Query(EventQuery{}), 0)
+
+	for _, message := range []string{"1", "2"} {
+		h.Add(testEvent("e", message))
+	}
+	assert.Equal(t, []string{"1", "2"}, historyMessages(h.Query(EventQuery{})))
+
+	for _, message := range []string{"3", "4", "5"} {
+		h.Add(testEvent("e", message))
+	}
+	assert.Equal(t, []string{"3", "4", "5"}, historyMessages(h.Query(EventQuery{})))
+}
+
+func TestEventHistoryQuery(t *testing.T) {
+	now := time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC)
+	h := NewEventHistory(10)
+
+	old := testEvent("e", "old")
+	old.LastTimestamp = now.Add(-time.Hour)
+	h.Add(old)
+	recent := testEvent("e", "recent")
+	recent.LastTimestamp = now.Add(-time.Minute)
+	h.Add(recent)
+	other := testEvent("e", "other")
+	other.Namespace = "prod"
+	other.Reason = "FailedScheduling"
+	other.LastTimestamp = now
+	h.Add(other)
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"old", "recent", "other"}},
+		{"namespace=prod", []string{"other"}},
+		{"kind=Pod&name=nginx&reason=BackOff", []string{"old", "recent"}},
+		{"kind=Deployment", []string{}},
+		{"since=10m", []string{"recent", "other"}},
+		{"since=2018-03-01T09:30:00Z&namespace=default", []string{"recent"}},
+	}
+	for _, test := range tests {
+		values, err := url.ParseQuery(test.query)
+		assert.NoError(t, err)
+		query, err := ParseEventQuery(values, now)
+		assert.NoError(t, err, test.query)
+		assert.Equal(t, test.expected, historyMessages(h.Query(query)), test.query)
+	}
+
+	_, err := ParseEventQuery(url.Values{"since": {"yesterday"}}, now)
+	assert.Error(t, err)
+}
+
+func TestEventHistoryServeHTTP(t *testing.T) {
+	h := NewEventHistory(10)
+	h.Add(testEvent("a", "1"))
+	h.Add(testEvent("b", "2"))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/events?name=nginx", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	events := []*Event{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &events))
+	assert.Equal(t, []string{"1", "2"}, historyMessages(events))
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.Header.Set("Accept", "application/x-ndjson")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	lines := 0
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		event := Event{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		lines++
+	}
+	assert.Equal(t, 2, lines)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/events?since=soon", nil))
+	assert.Equal(t, 400, w.Code)
+}
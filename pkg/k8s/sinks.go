@@ -0,0 +1,323 @@
+package k8s
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFileSinkMaxBytes   = 100 * 1024 * 1024
+	defaultFileSinkMaxBackups = 3
+	// How often sinks holding on to undelivered events get to retry.
+	sinkFlushInterval = 10 * time.Second
+)
+
+var (
+	sinkBufferDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "sink_buffer_batches",
+			Help:      "The number of event batches waiting to be sent to a sink.",
+		},
+		[]string{"sink"})
+)
+
+func init() {
+	prometheus.MustRegister(sinkBufferDepth)
+}
+
+// EventSink consumes batches of Kubernetes events.
+type EventSink interface {
+	// Name identifies the sink in logs and metrics.
+	Name() string
+	// Send delivers a batch of events.
+	Send(ctx context.Context, events []*Event) error
+	// Close releases the resources held by the sink.
+	Close() error
+}
+
+// TemporaryError is returned by a sink when a batch couldn't be delivered but
+// may be on a later attempt. The sink hasn't accounted for those events as
+// dropped, it is up to the caller to either retry or drop them.
+type TemporaryError struct {
+	Err error
+}
+
+func (e *TemporaryError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *TemporaryError) Unwrap() error {
+	return e.Err
+}
+
+// IsTemporary returns whether err is, or wraps, a TemporaryError.
+func IsTemporary(err error) bool {
+	var temporary *TemporaryError
+	return errors.As(err, &temporary)
+}
+
+// JSONLinesSink writes events as JSON lines, one event per line, using the
+// format documented on EventForwarder.
+type JSONLinesSink struct {
+	name string
+	w    io.Writer
+}
+
+// NewStdoutSink creates a sink writing events to stdout.
+func NewStdoutSink() *JSONLinesSink {
+	return &JSONLinesSink{name: "stdout", w: os.Stdout}
+}
+
+// Name implements EventSink.
+func (s *JSONLinesSink) Name() string {
+	return s.name
+}
+
+// Send implements EventSink.
+func (s *JSONLinesSink) Send(ctx context.Context, events []*Event) error {
+	if err := writeJSONLines(s.w, events); err != nil {
+		droppedEventsNum.WithLabelValues(s.name, "write_failed").Add(float64(len(events)))
+		return err
+	}
+	forwardedEventsNum.WithLabelValues(s.name).Add(float64(len(events)))
+	return nil
+}
+
+// Close implements EventSink.
+func (s *JSONLinesSink) Close() error {
+	return nil
+}
+
+func writeJSONLines(w io.Writer, events []*Event) error {
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	for _, event := range events {
+		if err := enc.Encode(toForwardedEvent(event)); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+// FileSink appends events as JSON lines to a file. The file is rotated once it
+// grows over MaxBytes, keeping MaxBackups old files named path.1, path.2, ...
+type FileSink struct {
+	Path       string
+	MaxBytes   int64
+	MaxBackups int
+
+	f    *os.File
+	size int64
+}
+
+// NewFileSink creates a sink appending events to path.
+func NewFileSink(path string) *FileSink {
+	return &FileSink{
+		Path:       path,
+		MaxBytes:   defaultFileSinkMaxBytes,
+		MaxBackups: defaultFileSinkMaxBackups,
+	}
+}
+
+// Name implements EventSink.
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+
+	if s.MaxBackups <= 0 {
+		return os.Remove(s.Path)
+	}
+	for i := s.MaxBackups - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", s.Path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", s.Path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(s.Path, s.Path+".1")
+}
+
+// Send implements EventSink.
+func (s *FileSink) Send(ctx context.Context, events []*Event) error {
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			droppedEventsNum.WithLabelValues(s.Name(), "write_failed").Add(float64(len(events)))
+			return err
+		}
+	}
+
+	w := &countingWriter{w: s.f}
+	err := writeJSONLines(w, events)
+	s.size += w.n
+	if err != nil {
+		droppedEventsNum.WithLabelValues(s.Name(), "write_failed").Add(float64(len(events)))
+		return err
+	}
+	forwardedEventsNum.WithLabelValues(s.Name()).Add(float64(len(events)))
+
+	if s.MaxBytes > 0 && s.size >= s.MaxBytes {
+		return s.rotate()
+	}
+	return nil
+}
+
+// Close implements EventSink.
+func (s *FileSink) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// flusher is implemented by sinks holding on to events they couldn't deliver
+// yet.
+type flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// dropper is implemented by sinks accounting for the events they drop, eg.
+// to report them to their endpoint.
+type dropper interface {
+	Drop(reason string, n int)
+}
+
+type sinkOutput struct {
+	sink    EventSink
+	batches chan []*Event
+}
+
+// EventFanout dispatches batches of events to several sinks. Each sink has its
+// own buffer and goroutine so a slow sink doesn't stall the others. When the
+// buffer of a sink is full, batches for that sink are dropped.
+type EventFanout struct {
+	outputs []sinkOutput
+}
+
+// NewEventFanout creates an EventFanout buffering up to bufferSize batches per
+// sink.
+func NewEventFanout(bufferSize int, sinks ...EventSink) *EventFanout {
+	f := &EventFanout{}
+	for _, sink := range sinks {
+		f.outputs = append(f.outputs, sinkOutput{
+			sink:    sink,
+			batches: make(chan []*Event, bufferSize),
+		})
+	}
+	return f
+}
+
+// Send queues events for every sink. It never blocks.
+func (f *EventFanout) Send(events []*Event) {
+	if len(events) == 0 {
+		return
+	}
+	for _, output := range f.outputs {
+		select {
+		case output.batches <- events:
+			sinkBufferDepth.WithLabelValues(output.sink.Name()).Set(float64(len(output.batches)))
+		default:
+			log.Errorf("Event sink %s buffer full, dropping %d events", output.sink.Name(), len(events))
+			droppedEventsNum.WithLabelValues(output.sink.Name(), "buffer_full").Add(float64(len(events)))
+		}
+	}
+}
+
+// Run sends the queued batches to the sinks until ctx is done, then closes the
+// sinks.
+func (f *EventFanout) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, output := range f.outputs {
+		wg.Add(1)
+		go func(output sinkOutput) {
+			defer wg.Done()
+			f.runSink(ctx, output)
+		}(output)
+	}
+	wg.Wait()
+}
+
+func (f *EventFanout) runSink(ctx context.Context, output sinkOutput) {
+	name := output.sink.Name()
+	defer func() {
+		if err := output.sink.Close(); err != nil {
+			log.Errorf("Failed to close event sink %s: %v", name, err)
+		}
+	}()
+
+	var flushes <-chan time.Time
+	if _, ok := output.sink.(flusher); ok {
+		ticker := time.NewTicker(sinkFlushInterval)
+		defer ticker.Stop()
+		flushes = ticker.C
+	}
+
+	for {
+		select {
+		case <-flushes:
+			if err := output.sink.(flusher).Flush(ctx); err != nil {
+				log.Errorf("Failed to flush event sink %s: %v", name, err)
+			}
+		case events := <-output.batches:
+			sinkBufferDepth.WithLabelValues(name).Set(float64(len(output.batches)))
+			if err := output.sink.Send(ctx, events); err != nil {
+				log.Errorf("Failed to send %d events to sink %s: %v", len(events), name, err)
+				// Nothing retries these events, the sink gave up on them.
+				if d, ok := output.sink.(dropper); ok && IsTemporary(err) {
+					d.Drop("send_failed", len(events))
+				} else if IsTemporary(err) {
+					droppedEventsNum.WithLabelValues(name, "send_failed").Add(float64(len(events)))
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
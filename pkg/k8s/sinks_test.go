@@ -0,0 +1,117 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONLinesSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := &JSONLinesSink{name: "test", w: buf}
+
+	err := sink.Send(context.Background(), []*Event{
+		testEvent("e1", "m1"),
+		testEvent("e2", "m2"),
+	})
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	event := forwardedEvent{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &event))
+	assert.Equal(t, "e2", event.Name)
+	assert.Equal(t, "m2", event.Message)
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-sink")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.log")
+	sink := NewFileSink(path)
+	sink.MaxBytes = 100
+	sink.MaxBackups = 2
+	defer sink.Close()
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, sink.Send(context.Background(), []*Event{testEvent("e", "m")}))
+	}
+
+	// Every event is larger than MaxBytes, so each one ends up rotated.
+	_, err = os.Stat(path + ".1")
+	assert.NoError(t, err)
+	_, err = os.Stat(path + ".2")
+	assert.NoError(t, err)
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+type blockingSink struct {
+	unblock chan struct{}
+}
+
+func (s *blockingSink) Name() string { return "blocking" }
+func (s *blockingSink) Send(ctx context.Context, events []*Event) error {
+	select {
+	case <-s.unblock:
+	case <-ctx.Done():
+	}
+	return nil
+}
+func (s *blockingSink) Close() error { return nil }
+
+type recordingSink struct {
+	sync.Mutex
+	events []*Event
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+func (s *recordingSink) Send(ctx context.Context, events []*Event) error {
+	s.Lock()
+	defer s.Unlock()
+	s.events = append(s.events, events...)
+	return nil
+}
+func (s *recordingSink) Close() error { return nil }
+
+func (s *recordingSink) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.events)
+}
+
+func TestEventFanoutSlowSink(t *testing.T) {
+	slow := &blockingSink{unblock: make(chan struct{})}
+	fast := &recordingSink{}
+	fanout := NewEventFanout(1, slow, fast)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		fanout.Run(ctx)
+		close(done)
+	}()
+
+	for i := 0; i < 10; i++ {
+		fanout.Send([]*Event{testEvent("e", "m")})
+		// Let the fast sink drain its buffer.
+		for j := 0; j < 100 && fast.len() <= i; j++ {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	assert.Equal(t, 10, fast.len())
+
+	cancel()
+	<-done
+}
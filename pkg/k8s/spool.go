@@ -0,0 +1,448 @@
+package k8s
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSpoolMaxBytes     = 100 * 1024 * 1024
+	defaultSpoolMaxAge       = 24 * time.Hour
+	defaultSpoolSegmentBytes = 4 * 1024 * 1024
+	defaultSpoolBatchSize    = 500
+
+	spoolCursorFile    = "cursor"
+	spoolSegmentSuffix = ".seg"
+)
+
+var (
+	spoolDepthBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "spool_bytes",
+			Help:      "The number of bytes of spooled events not yet delivered.",
+		},
+		[]string{"spool"})
+	spoolDroppedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "spool_dropped_bytes_total",
+			Help:      "The total number of bytes of spooled events dropped before delivery.",
+		},
+		[]string{"spool", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(spoolDepthBytes)
+	prometheus.MustRegister(spoolDroppedBytes)
+}
+
+// SpoolPosition is a position in an EventSpool.
+type SpoolPosition struct {
+	Segment uint64
+	Offset  int64
+}
+
+func (p SpoolPosition) before(other SpoolPosition) bool {
+	return p.Segment < other.Segment || (p.Segment == other.Segment && p.Offset < other.Offset)
+}
+
+type spooledEvent struct {
+	SpooledAt time.Time `json:"spooledAt"`
+	Event     *Event    `json:"event"`
+}
+
+// EventSpool is a bounded on-disk log of events. Events are appended to
+// segment files, one JSON record per line, and read back from a cursor that
+// only moves forward when the reader acknowledges what it has read. The
+// cursor is persisted so unacknowledged events survive restarts.
+//
+// When the spool grows over MaxBytes, or its oldest segment hasn't been
+// written to for longer than MaxAge, the oldest segment is dropped.
+type EventSpool struct {
+	// MaxBytes is the maximum size of the spool on disk.
+	MaxBytes int64
+	// MaxAge is the maximum age of a segment.
+	MaxAge time.Duration
+	// SegmentBytes is the size after which a new segment is started.
+	SegmentBytes int64
+
+	name string
+	dir  string
+
+	sync.Mutex
+	// Segment ids, oldest first. The first segment is always the one the
+	// cursor is in and the last one is head, the segment being written to.
+	segments []uint64
+	sizes    map[uint64]int64
+	head     *os.File
+	cursor   SpoolPosition
+}
+
+// OpenEventSpool opens, or creates, the spool stored in dir. name identifies
+// the spool in metrics.
+func OpenEventSpool(name, dir string) (*EventSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &EventSpool{
+		MaxBytes:     defaultSpoolMaxBytes,
+		MaxAge:       defaultSpoolMaxAge,
+		SegmentBytes: defaultSpoolSegmentBytes,
+		name:         name,
+		dir:          dir,
+		sizes:        make(map[uint64]int64),
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), spoolSegmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, id)
+		s.sizes[id] = entry.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, spoolCursorFile)); err == nil {
+		if _, err := fmt.Sscanf(string(data), "%d %d", &s.cursor.Segment, &s.cursor.Offset); err != nil {
+			log.Warnf("Invalid cursor in event spool %s, reading from the start: %v", dir, err)
+			s.cursor = SpoolPosition{}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Forget about the segments the cursor is past.
+	for len(s.segments) > 0 && s.segments[0] < s.cursor.Segment {
+		s.removeSegment(s.segments[0])
+	}
+	if len(s.segments) > 0 && s.cursor.Segment < s.segments[0] {
+		s.cursor = SpoolPosition{Segment: s.segments[0]}
+	}
+
+	// Always write to a fresh segment, the previous head may end with a
+	// partial record.
+	if err := s.roll(); err != nil {
+		return nil, err
+	}
+	if len(s.segments) == 1 {
+		s.cursor = SpoolPosition{Segment: s.segments[0]}
+	}
+	s.updateDepth()
+	return s, nil
+}
+
+func (s *EventSpool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, spoolSegmentSuffix))
+}
+
+// roll starts a new head segment.
+func (s *EventSpool) roll() error {
+	id := uint64(1)
+	if len(s.segments) > 0 {
+		id = s.segments[len(s.segments)-1] + 1
+	}
+	head, err := os.OpenFile(s.segmentPath(id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if s.head != nil {
+		s.head.Close()
+	}
+	s.head = head
+	s.segments = append(s.segments, id)
+	s.sizes[id] = 0
+	return nil
+}
+
+func (s *EventSpool) removeSegment(id uint64) {
+	if err := os.Remove(s.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to remove event spool segment: %v", err)
+	}
+	delete(s.sizes, id)
+	s.segments = s.segments[1:]
+}
+
+func (s *EventSpool) writeCursor() error {
+	path := filepath.Join(s.dir, spoolCursorFile)
+	data := fmt.Sprintf("%d %d\n", s.cursor.Segment, s.cursor.Offset)
+	if err := ioutil.WriteFile(path+".tmp", []byte(data), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *EventSpool) diskBytes() int64 {
+	var total int64
+	for _, size := range s.sizes {
+		total += size
+	}
+	return total
+}
+
+func (s *EventSpool) updateDepth() {
+	spoolDepthBytes.WithLabelValues(s.name).Set(float64(s.diskBytes() - s.cursor.Offset))
+}
+
+// dropOldest drops the oldest segment, along with the events in it that
+// haven't been acknowledged.
+func (s *EventSpool) dropOldest(reason string) error {
+	if len(s.segments) == 1 {
+		if err := s.roll(); err != nil {
+			return err
+		}
+	}
+	id := s.segments[0]
+	lost := s.sizes[id] - s.cursor.Offset
+	s.removeSegment(id)
+	s.cursor = SpoolPosition{Segment: s.segments[0]}
+
+	if lost > 0 {
+		log.Warnf("Event spool %s: dropped %d bytes of undelivered events (%s)", s.name, lost, reason)
+		spoolDroppedBytes.WithLabelValues(s.name, reason).Add(float64(lost))
+	}
+	return s.writeCursor()
+}
+
+// expire drops the segments older than MaxAge.
+func (s *EventSpool) expire(now time.Time) error {
+	for {
+		id := s.segments[0]
+		if id == s.segments[len(s.segments)-1] && s.sizes[id] == s.cursor.Offset {
+			// Nothing left to read.
+			return nil
+		}
+		info, err := os.Stat(s.segmentPath(id))
+		if err != nil {
+			return err
+		}
+		if now.Sub(info.ModTime()) <= s.MaxAge {
+			return nil
+		}
+		if err := s.dropOldest("age"); err != nil {
+			return err
+		}
+	}
+}
+
+// Append writes events at the end of the spool.
+func (s *EventSpool) Append(events []*Event) error {
+	s.Lock()
+	defer s.Unlock()
+	defer s.updateDepth()
+
+	now := time.Now()
+	if err := s.expire(now); err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		data, err := json.Marshal(spooledEvent{SpooledAt: now, Event: event})
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+
+		id := s.segments[len(s.segments)-1]
+		if s.sizes[id] > 0 && s.sizes[id]+int64(len(data)) > s.SegmentBytes {
+			if err := s.roll(); err != nil {
+				return err
+			}
+			id = s.segments[len(s.segments)-1]
+		}
+		n, err := s.head.Write(data)
+		s.sizes[id] += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	for s.diskBytes() > s.MaxBytes && s.diskBytes() > s.sizes[s.segments[len(s.segments)-1]] {
+		if err := s.dropOldest("size"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Peek reads up to max events from the cursor. It returns the position
+// following the last event read, to be given to Ack once the events have been
+// delivered.
+func (s *EventSpool) Peek(max int) ([]*Event, SpoolPosition, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.expire(time.Now()); err != nil {
+		return nil, s.cursor, err
+	}
+
+	events := []*Event{}
+	pos := s.cursor
+	for i := 0; i < len(s.segments) && len(events) < max; i++ {
+		if i > 0 {
+			pos = SpoolPosition{Segment: s.segments[i]}
+		}
+		var err error
+		events, pos, err = s.read(pos, events, max)
+		if err != nil {
+			return nil, s.cursor, err
+		}
+	}
+	return events, pos, nil
+}
+
+// read appends the events of the segment starting at pos to events.
+func (s *EventSpool) read(pos SpoolPosition, events []*Event, max int) ([]*Event, SpoolPosition, error) {
+	f, err := os.Open(s.segmentPath(pos.Segment))
+	if err != nil {
+		return events, pos, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(pos.Offset, io.SeekStart); err != nil {
+		return events, pos, err
+	}
+
+	r := bufio.NewReader(f)
+	for len(events) < max {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Ignore partially written records.
+			break
+		}
+		if err != nil {
+			return events, pos, err
+		}
+		pos.Offset += int64(len(line))
+
+		record := spooledEvent{}
+		if err := json.Unmarshal(line, &record); err != nil || record.Event == nil {
+			spoolDroppedBytes.WithLabelValues(s.name, "corrupt").Add(float64(len(line)))
+			continue
+		}
+		events = append(events, record.Event)
+	}
+	return events, pos, nil
+}
+
+// Ack moves the cursor to pos, as returned by Peek, and removes the segments
+// that have been fully read.
+func (s *EventSpool) Ack(pos SpoolPosition) error {
+	s.Lock()
+	defer s.Unlock()
+	defer s.updateDepth()
+
+	// The events may have been dropped in the meantime.
+	if pos.before(s.cursor) {
+		return nil
+	}
+	for len(s.segments) > 1 && s.segments[0] < pos.Segment {
+		s.removeSegment(s.segments[0])
+	}
+	s.cursor = pos
+	return s.writeCursor()
+}
+
+// Close closes the spool.
+func (s *EventSpool) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.head.Close()
+}
+
+// SpoolingSink spools events to disk before sending them to another sink so
+// they survive the sink being unavailable and agent restarts. Events are
+// delivered at least once: they are only removed from the spool once the sink
+// has accepted them or dropped them for good.
+type SpoolingSink struct {
+	// BatchSize is the maximum number of events sent to the sink at once.
+	BatchSize int
+
+	sink  EventSink
+	spool *EventSpool
+}
+
+// NewSpoolingSink creates a SpoolingSink sending the events spooled in spool
+// to sink.
+func NewSpoolingSink(sink EventSink, spool *EventSpool) *SpoolingSink {
+	return &SpoolingSink{
+		BatchSize: defaultSpoolBatchSize,
+		sink:      sink,
+		spool:     spool,
+	}
+}
+
+// Name implements EventSink.
+func (s *SpoolingSink) Name() string {
+	return s.sink.Name()
+}
+
+// Send implements EventSink. It spools events and sends as many spooled
+// events as the sink accepts.
+func (s *SpoolingSink) Send(ctx context.Context, events []*Event) error {
+	if err := s.spool.Append(events); err != nil {
+		droppedEventsNum.WithLabelValues(s.Name(), "spool_failed").Add(float64(len(events)))
+		return err
+	}
+	return s.Flush(ctx)
+}
+
+// Flush sends the spooled events to the sink until the spool is empty or the
+// sink fails.
+func (s *SpoolingSink) Flush(ctx context.Context) error {
+	for {
+		events, pos, err := s.spool.Peek(s.BatchSize)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		err = s.sink.Send(ctx, events)
+		if IsTemporary(err) {
+			// Keep the events around for the next attempt.
+			log.Debugf("Event sink %s unavailable, %d events left in spool: %v", s.Name(), len(events), err)
+			return nil
+		}
+		if err != nil {
+			// The sink has given up on those events, don't try again.
+			log.Errorf("Failed to send %d spooled events to sink %s: %v", len(events), s.Name(), err)
+		}
+		if err := s.spool.Ack(pos); err != nil {
+			return err
+		}
+	}
+}
+
+// Close implements EventSink.
+func (s *SpoolingSink) Close() error {
+	if err := s.sink.Close(); err != nil {
+		return err
+	}
+	return s.spool.Close()
+}
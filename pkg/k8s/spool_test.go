@@ -0,0 +1,155 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSpool(t *testing.T) (*EventSpool, string) {
+	dir, err := ioutil.TempDir("", "event-spool")
+	assert.NoError(t, err)
+	spool, err := OpenEventSpool("test", dir)
+	assert.NoError(t, err)
+	return spool, dir
+}
+
+func eventNames(events []*Event) []string {
+	names := []string{}
+	for _, event := range events {
+		names = append(names, event.Name)
+	}
+	return names
+}
+
+func TestEventSpool(t *testing.T) {
+	spool, dir := newTestSpool(t)
+	defer os.RemoveAll(dir)
+	spool.SegmentBytes = 200
+
+	assert.NoError(t, spool.Append([]*Event{testEvent("e1", "m"), testEvent("e2", "m")}))
+	assert.NoError(t, spool.Append([]*Event{testEvent("e3", "m")}))
+	assert.True(t, len(spool.segments) > 1)
+
+	events, pos, err := spool.Peek(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"e1", "e2"}, eventNames(events))
+
+	// Not acknowledged, the same events are read again.
+	events, _, err = spool.Peek(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"e1", "e2"}, eventNames(events))
+
+	assert.NoError(t, spool.Ack(pos))
+	events, pos, err = spool.Peek(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"e3"}, eventNames(events))
+	assert.NoError(t, spool.Ack(pos))
+
+	events, _, err = spool.Peek(10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 0)
+	// Fully read segments are removed.
+	assert.Len(t, spool.segments, 1)
+}
+
+func TestEventSpoolReopen(t *testing.T) {
+	spool, dir := newTestSpool(t)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, spool.Append([]*Event{testEvent("e1", "m"), testEvent("e2", "m")}))
+	_, pos, err := spool.Peek(1)
+	assert.NoError(t, err)
+	assert.NoError(t, spool.Ack(pos))
+	assert.NoError(t, spool.Close())
+
+	spool, err = OpenEventSpool("test", dir)
+	assert.NoError(t, err)
+	defer spool.Close()
+	assert.NoError(t, spool.Append([]*Event{testEvent("e3", "m")}))
+
+	events, _, err := spool.Peek(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"e2", "e3"}, eventNames(events))
+}
+
+func TestEventSpoolMaxBytes(t *testing.T) {
+	spool, dir := newTestSpool(t)
+	defer os.RemoveAll(dir)
+	spool.SegmentBytes = 1
+	spool.MaxBytes = 1000
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, spool.Append([]*Event{testEvent("e", "m")}))
+	}
+	assert.True(t, spool.diskBytes() <= spool.MaxBytes)
+
+	events, _, err := spool.Peek(100)
+	assert.NoError(t, err)
+	assert.True(t, len(events) > 0)
+	assert.True(t, len(events) < 20)
+}
+
+func TestEventSpoolMaxAge(t *testing.T) {
+	spool, dir := newTestSpool(t)
+	defer os.RemoveAll(dir)
+	spool.MaxAge = time.Hour
+
+	assert.NoError(t, spool.Append([]*Event{testEvent("e1", "m")}))
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(spool.segmentPath(spool.segments[0]), old, old))
+
+	events, _, err := spool.Peek(10)
+	assert.NoError(t, err)
+	assert.Len(t, events, 0)
+
+	assert.NoError(t, spool.Append([]*Event{testEvent("e2", "m")}))
+	events, _, err = spool.Peek(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"e2"}, eventNames(events))
+}
+
+type flakySink struct {
+	recordingSink
+	err error
+}
+
+func (s *flakySink) Send(ctx context.Context, events []*Event) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.recordingSink.Send(ctx, events)
+}
+
+func TestSpoolingSink(t *testing.T) {
+	spool, dir := newTestSpool(t)
+	defer os.RemoveAll(dir)
+
+	sink := &flakySink{err: &TemporaryError{Err: errors.New("unavailable")}}
+	spooling := NewSpoolingSink(sink, spool)
+	defer spooling.Close()
+
+	assert.NoError(t, spooling.Send(context.Background(), []*Event{testEvent("e1", "m")}))
+	assert.NoError(t, spooling.Send(context.Background(), []*Event{testEvent("e2", "m")}))
+	assert.Equal(t, 0, sink.len())
+
+	sink.err = nil
+	assert.NoError(t, spooling.Flush(context.Background()))
+	assert.Equal(t, []string{"e1", "e2"}, eventNames(sink.events))
+
+	// Delivered events aren't sent again.
+	assert.NoError(t, spooling.Flush(context.Background()))
+	assert.Equal(t, 2, sink.len())
+
+	// Events the sink gives up on aren't retried either.
+	sink.err = errors.New("rejected")
+	assert.NoError(t, spooling.Send(context.Background(), []*Event{testEvent("e3", "m")}))
+	sink.err = nil
+	assert.NoError(t, spooling.Flush(context.Background()))
+	assert.Equal(t, 2, sink.len())
+}
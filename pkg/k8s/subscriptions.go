@@ -0,0 +1,194 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// BufferPolicy decides what happens when the buffer of a subscription is
+// full.
+type BufferPolicy string
+
+// Buffer policies.
+const (
+	// BufferBlock makes the event source wait for the subscriber, holding
+	// up every other subscriber.
+	BufferBlock BufferPolicy = "block"
+	// BufferDropOldest makes room for the new event by dropping the oldest
+	// buffered event.
+	BufferDropOldest BufferPolicy = "drop-oldest"
+	// BufferDropNewest drops the new event.
+	BufferDropNewest BufferPolicy = "drop-newest"
+)
+
+// ParseBufferPolicy parses the name of a BufferPolicy.
+func ParseBufferPolicy(s string) (BufferPolicy, error) {
+	switch policy := BufferPolicy(s); policy {
+	case BufferBlock, BufferDropOldest, BufferDropNewest:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown buffer policy '%s', must be one of %s, %s, %s", s, BufferBlock, BufferDropOldest, BufferDropNewest)
+}
+
+var (
+	subscriptionBufferDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "subscription_buffer_events",
+			Help:      "The number of events buffered for a subscriber.",
+		},
+		[]string{"subscriber"})
+	subscriptionDroppedNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "subscription_dropped_total",
+			Help:      "The total number of events dropped because the buffer of a subscriber was full.",
+		},
+		[]string{"subscriber"})
+)
+
+func init() {
+	prometheus.MustRegister(subscriptionBufferDepth)
+	prometheus.MustRegister(subscriptionDroppedNum)
+}
+
+// SubscriptionOptions configures a Subscription.
+type SubscriptionOptions struct {
+	// Name identifies the subscriber in metrics.
+	Name       string
+	BufferSize int
+	Policy     BufferPolicy
+}
+
+// Subscription delivers the events of an EventSource to one subscriber.
+type Subscription struct {
+	name   string
+	policy BufferPolicy
+	events chan *Event
+	// Closed on Unsubscribe, to release a blocked publisher.
+	done   chan struct{}
+	source *EventSource
+	once   sync.Once
+}
+
+// Events returns the channel events are delivered on. It is closed by
+// Unsubscribe.
+func (s *Subscription) Events() <-chan *Event {
+	return s.events
+}
+
+// Unsubscribe stops the delivery of events.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		close(s.done)
+		s.source.removeSubscription(s)
+		close(s.events)
+		subscriptionBufferDepth.DeleteLabelValues(s.name)
+	})
+}
+
+func (s *Subscription) drop() {
+	subscriptionDroppedNum.WithLabelValues(s.name).Inc()
+}
+
+// deliver buffers event according to the buffer policy of the subscription.
+// It returns false if ctx is done before a blocked event could be delivered.
+func (s *Subscription) deliver(ctx context.Context, event *Event) bool {
+	defer func() {
+		subscriptionBufferDepth.WithLabelValues(s.name).Set(float64(len(s.events)))
+	}()
+
+	switch s.policy {
+	case BufferBlock:
+		select {
+		case s.events <- event:
+		case <-s.done:
+		case <-ctx.Done():
+			return false
+		}
+	case BufferDropOldest:
+		for {
+			select {
+			case s.events <- event:
+				return true
+			default:
+			}
+			// Make room, the subscriber may have done so meanwhile.
+			select {
+			case <-s.events:
+				s.drop()
+			default:
+			}
+		}
+	default:
+		select {
+		case s.events <- event:
+		default:
+			s.drop()
+		}
+	}
+	return true
+}
+
+// drain returns the events currently buffered.
+func (s *Subscription) drain() []*Event {
+	events := []*Event{}
+	for {
+		select {
+		case event := <-s.events:
+			events = append(events, event)
+		default:
+			subscriptionBufferDepth.WithLabelValues(s.name).Set(0)
+			return events
+		}
+	}
+}
+
+// Subscribe delivers the events kept by the source to a new subscriber. Each
+// subscriber has its own buffer, sized and managed as per opts.
+func (source *EventSource) Subscribe(opts SubscriptionOptions) *Subscription {
+	s := &Subscription{
+		name:   opts.Name,
+		policy: opts.Policy,
+		events: make(chan *Event, opts.BufferSize),
+		done:   make(chan struct{}),
+		source: source,
+	}
+
+	source.subscriptionsLock.Lock()
+	defer source.subscriptionsLock.Unlock()
+	source.subscriptions = append(source.subscriptions, s)
+	return s
+}
+
+func (source *EventSource) removeSubscription(s *Subscription) {
+	source.subscriptionsLock.Lock()
+	defer source.subscriptionsLock.Unlock()
+	for i, subscription := range source.subscriptions {
+		if subscription == s {
+			source.subscriptions = append(source.subscriptions[:i], source.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// publish delivers event to every subscriber. Holding the lock keeps
+// Unsubscribe from closing a channel we are sending on, Unsubscribe releases
+// a blocked publisher before taking it.
+func (source *EventSource) publish(ctx context.Context, event *Event) {
+	source.subscriptionsLock.Lock()
+	defer source.subscriptionsLock.Unlock()
+
+	for _, s := range source.subscriptions {
+		if !s.deliver(ctx, event) {
+			log.Debugf("Event source stopped while blocked on subscriber %s", s.name)
+			return
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func receiveMessages(s *Subscription) []string {
+	messages := []string{}
+	for {
+		select {
+		case event := <-s.Events():
+			messages = append(messages, event.Message)
+		default:
+			return messages
+		}
+	}
+}
+
+func TestParseBufferPolicy(t *testing.T) {
+	policy, err := ParseBufferPolicy("drop-oldest")
+	assert.NoError(t, err)
+	assert.Equal(t, BufferDropOldest, policy)
+
+	_, err = ParseBufferPolicy("drop-all")
+	assert.Error(t, err)
+}
+
+func TestSubscriptionPolicies(t *testing.T) {
+	source := &EventSource{}
+	oldest := source.Subscribe(SubscriptionOptions{Name: "oldest", BufferSize: 2, Policy: BufferDropOldest})
+	newest := source.Subscribe(SubscriptionOptions{Name: "newest", BufferSize: 2, Policy: BufferDropNewest})
+
+	ctx := context.Background()
+	for _, message := range []string{"1", "2", "3"} {
+		source.publish(ctx, testEvent("e", message))
+	}
+
+	assert.Equal(t, []string{"2", "3"}, receiveMessages(oldest))
+	assert.Equal(t, []string{"1", "2"}, receiveMessages(newest))
+}
+
+func TestSubscriptionBlock(t *testing.T) {
+	source := &EventSource{}
+	s := source.Subscribe(SubscriptionOptions{Name: "block", BufferSize: 1, Policy: BufferBlock})
+
+	ctx := context.Background()
+	source.publish(ctx, testEvent("e", "1"))
+
+	done := make(chan struct{})
+	go func() {
+		source.publish(ctx, testEvent("e", "2"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("publish didn't block on a full buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, "1", (<-s.Events()).Message)
+	<-done
+	assert.Equal(t, "2", (<-s.Events()).Message)
+
+	// A cancelled context releases a blocked publisher.
+	source.publish(ctx, testEvent("e", "3"))
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	source.publish(cancelled, testEvent("e", "4"))
+}
+
+func TestUnsubscribe(t *testing.T) {
+	source := &EventSource{}
+	s := source.Subscribe(SubscriptionOptions{Name: "block", BufferSize: 1, Policy: BufferBlock})
+	other := source.Subscribe(SubscriptionOptions{Name: "other", BufferSize: 10, Policy: BufferDropNewest})
+
+	ctx := context.Background()
+	source.publish(ctx, testEvent("e", "1"))
+
+	done := make(chan struct{})
+	go func() {
+		source.publish(ctx, testEvent("e", "2"))
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Unsubscribing releases the publisher and closes the channel.
+	s.Unsubscribe()
+	<-done
+	for range s.Events() {
+	}
+	assert.Len(t, source.subscriptions, 1)
+
+	source.publish(ctx, testEvent("e", "3"))
+	assert.Equal(t, []string{"1", "2", "3"}, receiveMessages(other))
+}
+
+func TestGetNewEventsCompatibility(t *testing.T) {
+	source := &EventSource{}
+	source.polling = source.Subscribe(SubscriptionOptions{Name: "polling", BufferSize: 10, Policy: BufferDropNewest})
+	s := source.Subscribe(SubscriptionOptions{Name: "s", BufferSize: 10, Policy: BufferDropNewest})
+
+	source.buffer(context.Background(), testEvent("e", "1"))
+	events := source.GetNewEvents()
+	assert.Len(t, events, 1)
+	assert.Len(t, source.GetNewEvents(), 0)
+	assert.Equal(t, []string{"1"}, receiveMessages(s))
+
+	source.StopPolling()
+	source.buffer(context.Background(), testEvent("e", "2"))
+	assert.Len(t, source.GetNewEvents(), 0)
+	assert.Equal(t, []string{"2"}, receiveMessages(s))
+}
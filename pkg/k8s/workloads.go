@@ -0,0 +1,553 @@
+package k8s
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubewatch "k8s.io/apimachinery/pkg/watch"
+	kubeclient "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// Owner chains are short in practice, eg. Pod -> ReplicaSet -> Deployment.
+	maxOwnerDepth = 5
+)
+
+var (
+	workloadCacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "workload_cache_bytes",
+			Help:      "The estimated memory used by the workload caches.",
+		})
+	workloadCacheObjects = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "workload_cache_objects",
+			Help:      "The number of objects in the workload caches.",
+		},
+		[]string{"kind"})
+	workloadCacheOverflowNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "workload_cache_overflow_total",
+			Help:      "The total number of objects not cached because the workload cache memory budget was exhausted.",
+		},
+		[]string{"kind"})
+	enrichedEventsNum = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "launcher",
+			Subsystem: "events",
+			Name:      "enriched_total",
+			Help:      "The total number of events looked up in the workload caches, by result.",
+		},
+		[]string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(workloadCacheBytes)
+	prometheus.MustRegister(workloadCacheObjects)
+	prometheus.MustRegister(workloadCacheOverflowNum)
+	prometheus.MustRegister(enrichedEventsNum)
+}
+
+// ObjectOwner is a link of an owner chain.
+type ObjectOwner struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// Workload describes the workload the involved object of an event belongs
+// to.
+type Workload struct {
+	// Owners is the chain of controllers of the involved object, closest
+	// first, eg. a Pod's ReplicaSet then Deployment.
+	Owners []ObjectOwner `json:"owners,omitempty"`
+	// Kind and Name of the top-level workload. That's the involved object
+	// itself when it has no owner.
+	Kind   string            `json:"kind"`
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// NodeName is only set for events about pods.
+	NodeName string   `json:"nodeName,omitempty"`
+	Images   []string `json:"images,omitempty"`
+}
+
+// cachedObject is the part of an object kept in the workload caches.
+type cachedObject struct {
+	namespace string
+	name      string
+	labels    map[string]string
+	owner     *ObjectOwner
+	nodeName  string
+	images    []string
+	// template is only set for Deployments, DaemonSets and StatefulSets.
+	template *templateDigest
+	// Estimated memory footprint.
+	size int64
+}
+
+// templateDigest is what the workload caches keep of a pod template, enough
+// to tell it changed and how its images did.
+type templateDigest struct {
+	hash [sha256.Size]byte
+	// Images by container name, init containers included.
+	images map[string]string
+}
+
+func digestTemplate(template *apiv1.PodTemplateSpec) *templateDigest {
+	data, _ := json.Marshal(template)
+	return &templateDigest{hash: sha256.Sum256(data), images: containerImages(template)}
+}
+
+func podSpecImages(spec *apiv1.PodSpec) []string {
+	images := []string{}
+	for _, container := range spec.Containers {
+		images = append(images, container.Image)
+	}
+	return images
+}
+
+// trimObject extracts what the workload caches need from a full object.
+func trimObject(obj interface{}) (*cachedObject, bool) {
+	var spec *apiv1.PodSpec
+	var template *apiv1.PodTemplateSpec
+	nodeName := ""
+	switch o := obj.(type) {
+	case *apiv1.Pod:
+		spec = &o.Spec
+		nodeName = o.Spec.NodeName
+	case *appsv1.ReplicaSet:
+		spec = &o.Spec.Template.Spec
+	case *appsv1.Deployment:
+		template = &o.Spec.Template
+	case *appsv1.DaemonSet:
+		template = &o.Spec.Template
+	case *appsv1.StatefulSet:
+		template = &o.Spec.Template
+	case *batchv1.Job:
+		spec = &o.Spec.Template.Spec
+	default:
+		return nil, false
+	}
+	if template != nil {
+		spec = &template.Spec
+	}
+
+	meta := obj.(metav1.Object)
+	cached := &cachedObject{
+		namespace: meta.GetNamespace(),
+		name:      meta.GetName(),
+		labels:    meta.GetLabels(),
+		nodeName:  nodeName,
+		images:    podSpecImages(spec),
+	}
+	if ref := metav1.GetControllerOfNoCopy(meta); ref != nil {
+		cached.owner = &ObjectOwner{Kind: ref.Kind, Name: ref.Name}
+	}
+	if template != nil {
+		cached.template = digestTemplate(template)
+	}
+
+	// Rough estimate of the memory held: strings plus some overhead for
+	// the struct, slice and map headers.
+	size := 128 + len(cached.namespace) + len(cached.name) + len(cached.nodeName)
+	for k, v := range cached.labels {
+		size += 32 + len(k) + len(v)
+	}
+	for _, image := range cached.images {
+		size += 16 + len(image)
+	}
+	if cached.owner != nil {
+		size += 48 + len(cached.owner.Kind) + len(cached.owner.Name)
+	}
+	if cached.template != nil {
+		size += 80 + sha256.Size
+		for name, image := range cached.template.images {
+			size += 32 + len(name) + len(image)
+		}
+	}
+	cached.size = int64(size)
+
+	return cached, true
+}
+
+// cacheBudget is the memory budget shared by the workload caches.
+type cacheBudget struct {
+	max int64
+
+	sync.Mutex
+	used int64
+}
+
+func (b *cacheBudget) reserve(n int64) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.used+n > b.max {
+		return false
+	}
+	b.used += n
+	workloadCacheBytes.Set(float64(b.used))
+	return true
+}
+
+func (b *cacheBudget) release(n int64) {
+	b.Lock()
+	defer b.Unlock()
+	b.used -= n
+	workloadCacheBytes.Set(float64(b.used))
+}
+
+// workloadObserver is told about the updates of the objects of a
+// trimmedStore, along with what was cached of them before. Objects that
+// weren't cached are left out.
+type workloadObserver interface {
+	workloadUpdated(kind string, old, cur *cachedObject, obj interface{})
+	workloadDeleted(kind, key string)
+}
+
+// trimmedStore is a cache.Store only keeping the trimmed down version of the
+// objects it is given, within a memory budget. Objects that don't fit are
+// left out.
+type trimmedStore struct {
+	kind   string
+	budget *cacheBudget
+	// observer, if set, is told about updates once the store is unlocked.
+	observer workloadObserver
+
+	sync.RWMutex
+	objects map[string]*cachedObject
+}
+
+var _ cache.Store = &trimmedStore{}
+
+func newTrimmedStore(kind string, budget *cacheBudget) *trimmedStore {
+	return &trimmedStore{
+		kind:    kind,
+		budget:  budget,
+		objects: make(map[string]*cachedObject),
+	}
+}
+
+func (s *trimmedStore) deleteKey(key string) {
+	if old, ok := s.objects[key]; ok {
+		s.budget.release(old.size)
+		delete(s.objects, key)
+	}
+}
+
+// add caches obj, and returns what was cached of it before, if anything,
+// along with what it's trimmed down to.
+func (s *trimmedStore) add(obj interface{}) (old, cached *cachedObject, err error) {
+	cached, ok := trimObject(obj)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected object %T in %s cache", obj, s.kind)
+	}
+	key := cached.namespace + "/" + cached.name
+
+	old = s.objects[key]
+	s.deleteKey(key)
+	if !s.budget.reserve(cached.size) {
+		workloadCacheOverflowNum.WithLabelValues(s.kind).Inc()
+		return old, cached, nil
+	}
+	s.objects[key] = cached
+	return old, cached, nil
+}
+
+func (s *trimmedStore) updateCount() {
+	workloadCacheObjects.WithLabelValues(s.kind).Set(float64(len(s.objects)))
+}
+
+// Add implements cache.Store.
+func (s *trimmedStore) Add(obj interface{}) error {
+	s.Lock()
+	old, cached, err := s.add(obj)
+	s.updateCount()
+	s.Unlock()
+	if old != nil && s.observer != nil {
+		s.observer.workloadUpdated(s.kind, old, cached, obj)
+	}
+	return err
+}
+
+// Update implements cache.Store.
+func (s *trimmedStore) Update(obj interface{}) error {
+	return s.Add(obj)
+}
+
+// Delete implements cache.Store.
+func (s *trimmedStore) Delete(obj interface{}) error {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.deleteKey(key)
+	s.updateCount()
+	s.Unlock()
+	if s.observer != nil {
+		s.observer.workloadDeleted(s.kind, key)
+	}
+	return nil
+}
+
+// List implements cache.Store.
+func (s *trimmedStore) List() []interface{} {
+	s.RLock()
+	defer s.RUnlock()
+	list := make([]interface{}, 0, len(s.objects))
+	for _, object := range s.objects {
+		list = append(list, object)
+	}
+	return list
+}
+
+// ListKeys implements cache.Store.
+func (s *trimmedStore) ListKeys() []string {
+	s.RLock()
+	defer s.RUnlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Get implements cache.Store.
+func (s *trimmedStore) Get(obj interface{}) (interface{}, bool, error) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return nil, false, err
+	}
+	return s.GetByKey(key)
+}
+
+// GetByKey implements cache.Store.
+func (s *trimmedStore) GetByKey(key string) (interface{}, bool, error) {
+	object := s.get(key)
+	return object, object != nil, nil
+}
+
+func (s *trimmedStore) get(key string) *cachedObject {
+	s.RLock()
+	defer s.RUnlock()
+	return s.objects[key]
+}
+
+// Replace implements cache.Store. The observer is told about the objects
+// updated and deleted since they were last listed.
+func (s *trimmedStore) Replace(list []interface{}, resourceVersion string) error {
+	type update struct {
+		old, cached *cachedObject
+		obj         interface{}
+	}
+	updates := []update{}
+
+	s.Lock()
+	previous := make(map[string]*cachedObject, len(s.objects))
+	for key, object := range s.objects {
+		previous[key] = object
+		s.deleteKey(key)
+	}
+	var err error
+	for _, obj := range list {
+		var cached *cachedObject
+		if _, cached, err = s.add(obj); err != nil {
+			break
+		}
+		key := cached.namespace + "/" + cached.name
+		if old, ok := previous[key]; ok {
+			updates = append(updates, update{old, cached, obj})
+			delete(previous, key)
+		}
+	}
+	s.updateCount()
+	s.Unlock()
+
+	if err != nil || s.observer == nil {
+		return err
+	}
+	for _, u := range updates {
+		s.observer.workloadUpdated(s.kind, u.old, u.cached, u.obj)
+	}
+	for key := range previous {
+		s.observer.workloadDeleted(s.kind, key)
+	}
+	return nil
+}
+
+// Resync implements cache.Store.
+func (s *trimmedStore) Resync() error {
+	return nil
+}
+
+// EventEnricher attaches the owner chain, workload labels, node name and
+// container images of the involved object to events. It keeps its own caches
+// of pods, ReplicaSets and top-level workloads, trimmed down to the fields it
+// needs and bounded by a memory budget.
+type EventEnricher struct {
+	client kubeclient.Interface
+	budget *cacheBudget
+	stores map[string]*trimmedStore
+}
+
+// NewEventEnricher creates an EventEnricher whose caches use up to maxBytes
+// of memory.
+func NewEventEnricher(client kubeclient.Interface, maxBytes int64) *EventEnricher {
+	e := &EventEnricher{
+		client: client,
+		budget: &cacheBudget{max: maxBytes},
+		stores: make(map[string]*trimmedStore),
+	}
+	for _, kind := range []string{"Pod", "ReplicaSet", "Deployment", "DaemonSet", "StatefulSet", "Job"} {
+		e.stores[kind] = newTrimmedStore(kind, e.budget)
+	}
+	return e
+}
+
+func (e *EventEnricher) listWatch(ctx context.Context, kind string) (*cache.ListWatch, runtime.Object) {
+	all := metav1.NamespaceAll
+	switch kind {
+	case "Pod":
+		pods := e.client.CoreV1().Pods(all)
+		return &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return pods.List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (kubewatch.Interface, error) {
+				return pods.Watch(ctx, options)
+			},
+		}, &apiv1.Pod{}
+	case "ReplicaSet":
+		replicaSets := e.client.AppsV1().ReplicaSets(all)
+		return &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return replicaSets.List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (kubewatch.Interface, error) {
+				return replicaSets.Watch(ctx, options)
+			},
+		}, &appsv1.ReplicaSet{}
+	case "Deployment":
+		deployments := e.client.AppsV1().Deployments(all)
+		return &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return deployments.List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (kubewatch.Interface, error) {
+				return deployments.Watch(ctx, options)
+			},
+		}, &appsv1.Deployment{}
+	case "DaemonSet":
+		daemonSets := e.client.AppsV1().DaemonSets(all)
+		return &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return daemonSets.List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (kubewatch.Interface, error) {
+				return daemonSets.Watch(ctx, options)
+			},
+		}, &appsv1.DaemonSet{}
+	case "StatefulSet":
+		statefulSets := e.client.AppsV1().StatefulSets(all)
+		return &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return statefulSets.List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (kubewatch.Interface, error) {
+				return statefulSets.Watch(ctx, options)
+			},
+		}, &appsv1.StatefulSet{}
+	case "Job":
+		jobs := e.client.BatchV1().Jobs(all)
+		return &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return jobs.List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (kubewatch.Interface, error) {
+				return jobs.Watch(ctx, options)
+			},
+		}, &batchv1.Job{}
+	}
+	panic("unknown workload kind " + kind)
+}
+
+// observe has o told about the updates of the Deployments, DaemonSets and
+// StatefulSets cached. It must be called before Start.
+func (e *EventEnricher) observe(o workloadObserver) {
+	for _, kind := range []string{"Deployment", "DaemonSet", "StatefulSet"} {
+		e.stores[kind].observer = o
+	}
+}
+
+// Start fills and maintains the caches until ctx is done.
+func (e *EventEnricher) Start(ctx context.Context) {
+	var wg sync.WaitGroup
+	for kind, store := range e.stores {
+		lw, expectedType := e.listWatch(ctx, kind)
+		reflector := cache.NewReflector(lw, expectedType, store, 0)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reflector.Run(ctx.Done())
+		}()
+	}
+	log.Info("Started workload caches for event enrichment")
+	wg.Wait()
+}
+
+func (e *EventEnricher) get(kind, namespace, name string) *cachedObject {
+	store, ok := e.stores[kind]
+	if !ok {
+		return nil
+	}
+	return store.get(namespace + "/" + name)
+}
+
+// Enrich sets the Workload of event, if its involved object is known.
+func (e *EventEnricher) Enrich(event *Event) {
+	ref := event.InvolvedObject
+	object := e.get(ref.Kind, ref.Namespace, ref.Name)
+	if object == nil {
+		enrichedEventsNum.WithLabelValues("miss").Inc()
+		return
+	}
+	enrichedEventsNum.WithLabelValues("hit").Inc()
+
+	workload := &Workload{
+		Kind:     ref.Kind,
+		Name:     ref.Name,
+		Labels:   object.labels,
+		NodeName: object.nodeName,
+		Images:   object.images,
+	}
+	for owner := object.owner; owner != nil && len(workload.Owners) < maxOwnerDepth; owner = object.owner {
+		workload.Owners = append(workload.Owners, *owner)
+		workload.Kind = owner.Kind
+		workload.Name = owner.Name
+		// We may not know about the owner, eg. a CronJob, in which case its
+		// labels are unknown too.
+		workload.Labels = nil
+		if object = e.get(owner.Kind, ref.Namespace, owner.Name); object == nil {
+			break
+		}
+		workload.Labels = object.labels
+	}
+	event.Workload = workload
+}
@@ -0,0 +1,163 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func controlledBy(kind, name string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+}
+
+func podTemplate(image string) apiv1.PodTemplateSpec {
+	return apiv1.PodTemplateSpec{
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{{Name: "main", Image: image}},
+		},
+	}
+}
+
+func TestEventEnricher(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "nginx",
+				Labels:    map[string]string{"team": "web"},
+			},
+			Spec: appsv1.DeploymentSpec{Template: podTemplate("nginx:1.13")},
+		},
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       "default",
+				Name:            "nginx-7db9fccd9b",
+				OwnerReferences: controlledBy("Deployment", "nginx"),
+			},
+			Spec: appsv1.ReplicaSetSpec{Template: podTemplate("nginx:1.13")},
+		},
+		&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       "default",
+				Name:            "nginx-7db9fccd9b-2f8zj",
+				OwnerReferences: controlledBy("ReplicaSet", "nginx-7db9fccd9b"),
+			},
+			Spec: podTemplate("nginx:1.13").Spec,
+		},
+	)
+
+	enricher := NewEventEnricher(client, 1024*1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go enricher.Start(ctx)
+
+	synced := func() bool {
+		for _, kind := range []string{"Pod", "ReplicaSet", "Deployment"} {
+			if len(enricher.stores[kind].ListKeys()) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 100 && !synced(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	event := testEvent("e", "m")
+	event.InvolvedObject.Name = "nginx-7db9fccd9b-2f8zj"
+	enricher.Enrich(event)
+
+	assert.NotNil(t, event.Workload)
+	assert.Equal(t, []ObjectOwner{
+		{Kind: "ReplicaSet", Name: "nginx-7db9fccd9b"},
+		{Kind: "Deployment", Name: "nginx"},
+	}, event.Workload.Owners)
+	assert.Equal(t, "Deployment", event.Workload.Kind)
+	assert.Equal(t, "nginx", event.Workload.Name)
+	assert.Equal(t, map[string]string{"team": "web"}, event.Workload.Labels)
+	assert.Equal(t, []string{"nginx:1.13"}, event.Workload.Images)
+
+	unknown := testEvent("e", "m")
+	unknown.InvolvedObject.Name = "unknown"
+	enricher.Enrich(unknown)
+	assert.Nil(t, unknown.Workload)
+}
+
+func TestTrimmedStoreBudget(t *testing.T) {
+	budget := &cacheBudget{max: 300}
+	store := newTrimmedStore("Pod", budget)
+
+	pod := func(name string) *apiv1.Pod {
+		return &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec:       apiv1.PodSpec{NodeName: "node-1"},
+		}
+	}
+
+	assert.NoError(t, store.Add(pod("a")))
+	assert.NoError(t, store.Add(pod("b")))
+	assert.NoError(t, store.Add(pod("c")))
+	// Only what fits in the budget is kept.
+	assert.Len(t, store.ListKeys(), 2)
+	assert.True(t, budget.used <= budget.max)
+
+	// Deleting makes room again.
+	assert.NoError(t, store.Delete(pod("a")))
+	assert.NoError(t, store.Add(pod("c")))
+	assert.ElementsMatch(t, []string{"default/b", "default/c"}, store.ListKeys())
+
+	cached := store.get("default/c")
+	assert.Equal(t, "node-1", cached.nodeName)
+}
+
+// recordingObserver records the workload updates and deletions it's told
+// about.
+type recordingObserver struct {
+	updates []string
+	deleted []string
+}
+
+func (o *recordingObserver) workloadUpdated(kind string, old, cur *cachedObject, obj interface{}) {
+	o.updates = append(o.updates, old.template.images["main"]+" -> "+cur.template.images["main"])
+}
+
+func (o *recordingObserver) workloadDeleted(kind, key string) {
+	o.deleted = append(o.deleted, key)
+}
+
+func TestTrimmedStoreObserver(t *testing.T) {
+	observer := &recordingObserver{}
+	store := newTrimmedStore("Deployment", &cacheBudget{max: 1024 * 1024})
+	store.observer = observer
+
+	deployment := func(name, image string) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec:       appsv1.DeploymentSpec{Template: podTemplate(image)},
+		}
+	}
+
+	// Objects listed for the first time aren't updates.
+	assert.NoError(t, store.Replace([]interface{}{deployment("nginx", "nginx:1.13"), deployment("redis", "redis:4.0")}, ""))
+	assert.NoError(t, store.Add(deployment("envoy", "envoy:1.5")))
+	assert.Empty(t, observer.updates)
+
+	assert.NoError(t, store.Update(deployment("nginx", "nginx:1.14")))
+	assert.Equal(t, []string{"nginx:1.13 -> nginx:1.14"}, observer.updates)
+
+	// Relists report what changed in between.
+	assert.NoError(t, store.Replace([]interface{}{deployment("nginx", "nginx:1.15"), deployment("envoy", "envoy:1.5")}, ""))
+	assert.Equal(t, []string{"nginx:1.13 -> nginx:1.14", "nginx:1.14 -> nginx:1.15", "envoy:1.5 -> envoy:1.5"}, observer.updates)
+	assert.Equal(t, []string{"default/redis"}, observer.deleted)
+
+	assert.NoError(t, store.Delete(deployment("envoy", "envoy:1.5")))
+	assert.Equal(t, []string{"default/redis", "default/envoy"}, observer.deleted)
+}
@@ -1,11 +1,13 @@
 package kubectl
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 )
@@ -25,19 +27,19 @@ type status struct {
 
 // Client implements a kubectl client to execute commands
 type Client interface {
-	Execute(args ...string) (string, error)
-	ExecuteOutputMatrix(args ...string) (stdout, stderr string, err error)
+	Execute(ctx context.Context, args ...string) (string, error)
+	ExecuteOutputMatrix(ctx context.Context, args ...string) (stdout, stderr string, err error)
 }
 
 // Execute executes kubectl <args> and returns the combined stdout/err output.
-func Execute(c Client, args ...string) (string, error) {
-	return c.Execute(args...)
+func Execute(ctx context.Context, c Client, args ...string) (string, error) {
+	return c.Execute(ctx, args...)
 }
 
 // ExecuteJSON execute kubectl <args> and returns the combined json stdout and err output.
-func ExecuteJSON(c Client, o interface{}, args ...string) error {
+func ExecuteJSON(ctx context.Context, c Client, o interface{}, args ...string) error {
 	a := append(args, "-ojson")
-	oJSON, err := c.Execute(a...)
+	oJSON, err := c.Execute(ctx, a...)
 	if err != nil {
 		return err
 	}
@@ -122,9 +124,9 @@ func parseVersionOutput(stdout string) (clientVersion, serverVersion string, err
 
 // GetVersionInfo returns the version metadata from kubectl
 // May return a value for the kubectl client version, despite also returning an error
-func GetVersionInfo(c Client) (string, string, error) {
+func GetVersionInfo(ctx context.Context, c Client) (string, string, error) {
 	// Capture stdout only (to ignore server reachability errors)
-	stdout, stderr, err := c.ExecuteOutputMatrix("version")
+	stdout, stderr, err := c.ExecuteOutputMatrix(ctx, "version")
 	clientVersion, serverVersion, parseErr := parseVersionOutput(stdout)
 	// If the server is unreachable, we might have an error but parsable output
 	if parseErr != nil {
@@ -145,20 +147,20 @@ func GetVersionInfo(c Client) (string, string, error) {
 }
 
 // GetClusterInfo gets the current Kubernetes cluster information
-func GetClusterInfo(c Client) (ClusterInfo, error) {
-	currentContext, err := Execute(c, "config", "current-context")
+func GetClusterInfo(ctx context.Context, c Client) (ClusterInfo, error) {
+	currentContext, err := Execute(ctx, c, "config", "current-context")
 	if err != nil {
 		return ClusterInfo{}, err
 	}
 
-	name, err := Execute(c, "config", "view",
+	name, err := Execute(ctx, c, "config", "view",
 		fmt.Sprintf("-o=jsonpath='{.contexts[?(@.name == \"%s\")].context.cluster}'", currentContext),
 	)
 	if err != nil {
 		return ClusterInfo{}, err
 	}
 
-	serverAddress, err := Execute(c,
+	serverAddress, err := Execute(ctx, c,
 		"config",
 		"view",
 		fmt.Sprintf("-o=jsonpath='{.clusters[?(@.name == \"%s\")].cluster.server}'", name),
@@ -174,15 +176,77 @@ func GetClusterInfo(c Client) (ClusterInfo, error) {
 }
 
 // Apply applies via kubectl
-func Apply(c Client, f string) error {
+func Apply(ctx context.Context, c Client, f string) error {
 	// Escape ',' to prevent a url being interpreted as an array, and split
-	_, err := Execute(c, "apply", "-f", strings.Replace(f, ",", "%2C", -1))
+	_, err := Execute(ctx, c, "apply", "-f", strings.Replace(f, ",", "%2C", -1))
+	return err
+}
+
+// ApplyNames applies f, like Apply, and returns the objects applied, of the
+// form kind.group/name.
+func ApplyNames(ctx context.Context, c Client, f string) ([]string, error) {
+	return applyNames(ctx, c, "apply", "-f", strings.Replace(f, ",", "%2C", -1), "-o", "name")
+}
+
+// DryRunNames returns the objects applying f would create or update, of the
+// form kind.group/name, without applying it.
+func DryRunNames(ctx context.Context, c Client, f string) ([]string, error) {
+	return applyNames(ctx, c, "apply", "--dry-run=client", "-f", strings.Replace(f, ",", "%2C", -1), "-o", "name")
+}
+
+func applyNames(ctx context.Context, c Client, args ...string) ([]string, error) {
+	out, err := Execute(ctx, c, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+	return names, nil
+}
+
+// Diff returns whether applying f would change the objects in the cluster.
+func Diff(ctx context.Context, c Client, f string) (bool, error) {
+	_, stderr, err := c.ExecuteOutputMatrix(ctx, "diff", "-f", strings.Replace(f, ",", "%2C", -1))
+	if err == nil {
+		return false, nil
+	}
+	// kubectl diff exits with 1 when there are differences, above on errors.
+	if exitErr, ok := err.(interface{ ExitCode() int }); ok && exitErr.ExitCode() == 1 {
+		return true, nil
+	}
+	return false, fmt.Errorf("%v: %s", err, trimOutput(stderr))
+}
+
+// LabelResources sets labels on objects, of the form kind/name, overwriting
+// existing values.
+func LabelResources(ctx context.Context, c Client, namespace string, objects []string, labels map[string]string) error {
+	if len(objects) == 0 {
+		return nil
+	}
+
+	keys := []string{}
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := []string{"label", "--overwrite", fmt.Sprintf("--namespace=%s", namespace)}
+	args = append(args, objects...)
+	for _, key := range keys {
+		args = append(args, fmt.Sprintf("%s=%s", key, labels[key]))
+	}
+	_, err := Execute(ctx, c, args...)
 	return err
 }
 
 // ResourceExists return true if the resource exists
-func ResourceExists(c Client, resourceType, namespace, resourceName string) (bool, error) {
-	_, err := Execute(c, "get", resourceType, resourceName, fmt.Sprintf("--namespace=%s", namespace))
+func ResourceExists(ctx context.Context, c Client, resourceType, namespace, resourceName string) (bool, error) {
+	_, err := Execute(ctx, c, "get", resourceType, resourceName, fmt.Sprintf("--namespace=%s", namespace))
 	if err != nil {
 		// k8s 1.4 answers with "Error from server: secrets "weave-cloud" not found"
 		// More recent versions with "Error from server (NotFound): secrets "weave-cloud" not found
@@ -197,12 +261,166 @@ func ResourceExists(c Client, resourceType, namespace, resourceName string) (boo
 }
 
 // DeleteResource deletes a resource
-func DeleteResource(c Client, resourceType, namespace, resourceName string) error {
-	_, err := Execute(c, "delete", resourceType, resourceName, fmt.Sprintf("--namespace=%s", namespace))
+func DeleteResource(ctx context.Context, c Client, resourceType, namespace, resourceName string) error {
+	_, err := Execute(ctx, c, "delete", resourceType, resourceName, fmt.Sprintf("--namespace=%s", namespace))
 	return err
 }
 
-func isPodReady(c Client, podName, ns string) error {
+// Resource identifies a Kubernetes object. Namespace is empty for
+// cluster-scoped objects.
+type Resource struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (r Resource) String() string {
+	if r.Namespace == "" {
+		return fmt.Sprintf("%s/%s", strings.ToLower(r.Kind), r.Name)
+	}
+	return fmt.Sprintf("%s/%s (namespace %s)", strings.ToLower(r.Kind), r.Name, r.Namespace)
+}
+
+type objectList struct {
+	Items []object `json:"items"`
+}
+
+type object struct {
+	Kind     string         `json:"kind"`
+	Metadata objectMetadata `json:"metadata"`
+	RoleRef  roleRef        `json:"roleRef"`
+	Subjects []subject      `json:"subjects"`
+}
+
+type objectMetadata struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels"`
+}
+
+type roleRef struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+type subject struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+func listObjects(ctx context.Context, c Client, resourceType, namespace, selector string) ([]object, error) {
+	args := []string{"get", resourceType}
+	if namespace != "" {
+		args = append(args, fmt.Sprintf("--namespace=%s", namespace))
+	}
+	if selector != "" {
+		args = append(args, fmt.Sprintf("--selector=%s", selector))
+	}
+
+	list := objectList{}
+	if err := ExecuteJSON(ctx, c, &list, args...); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func toResource(o object) Resource {
+	return Resource{
+		Kind:      o.Kind,
+		Namespace: o.Metadata.Namespace,
+		Name:      o.Metadata.Name,
+	}
+}
+
+// ListResources returns the objects of resourceType matching the label
+// selector. An empty namespace lists cluster-scoped objects.
+func ListResources(ctx context.Context, c Client, resourceType, namespace, selector string) ([]Resource, error) {
+	objects, err := listObjects(ctx, c, resourceType, namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := []Resource{}
+	for _, o := range objects {
+		resources = append(resources, toResource(o))
+	}
+	return resources, nil
+}
+
+// LabelledResource is a Resource along with its labels.
+type LabelledResource struct {
+	Resource
+	Labels map[string]string
+}
+
+// GetLabelledResources returns objects, of the form kind/name, along with
+// their labels. Objects which don't exist are left out.
+func GetLabelledResources(ctx context.Context, c Client, namespace string, objects []string) ([]LabelledResource, error) {
+	if len(objects) == 0 {
+		return nil, nil
+	}
+
+	args := []string{"get", fmt.Sprintf("--namespace=%s", namespace), "--ignore-not-found"}
+	args = append(args, objects...)
+	out, err := Execute(ctx, c, append(args, "-ojson")...)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(out) == "" {
+		return nil, nil
+	}
+
+	// A single object is returned as is, several in a List.
+	var list struct {
+		object
+		Items []object `json:"items"`
+	}
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		return nil, err
+	}
+	items := list.Items
+	if list.Kind != "List" {
+		items = []object{list.object}
+	}
+
+	resources := []LabelledResource{}
+	for _, o := range items {
+		resources = append(resources, LabelledResource{Resource: toResource(o), Labels: o.Metadata.Labels})
+	}
+	return resources, nil
+}
+
+// RoleBinding is a ClusterRoleBinding along with the ClusterRole it grants.
+type RoleBinding struct {
+	Resource
+	Role string
+}
+
+// ListClusterRoleBindingsForNamespace returns the ClusterRoleBindings granting
+// a role to a ServiceAccount of namespace.
+func ListClusterRoleBindingsForNamespace(ctx context.Context, c Client, namespace string) ([]RoleBinding, error) {
+	objects, err := listObjects(ctx, c, "clusterrolebindings", "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := []RoleBinding{}
+	for _, o := range objects {
+		for _, s := range o.Subjects {
+			if s.Kind == "ServiceAccount" && s.Namespace == namespace {
+				bindings = append(bindings, RoleBinding{
+					Resource: toResource(o),
+					Role:     o.RoleRef.Name,
+				})
+				break
+			}
+		}
+	}
+	return bindings, nil
+}
+
+func isPodReady(ctx context.Context, c Client, podName, ns string) error {
 	// Timeout is set for 30 seconds, as Kubernetes requires some time to create a pod.
 	timeout := time.After(1 * time.Minute)
 	tick := time.Tick(1 * time.Second)
@@ -211,8 +429,10 @@ func isPodReady(c Client, podName, ns string) error {
 		select {
 		case <-timeout:
 			return fmt.Errorf("timed out during DNS check")
+		case <-ctx.Done():
+			return ctx.Err()
 		case <-tick:
-			ok, err := checkPod(c, podName, ns)
+			ok, err := checkPod(ctx, c, podName, ns)
 			if err != nil {
 				return err
 			} else if ok {
@@ -222,10 +442,10 @@ func isPodReady(c Client, podName, ns string) error {
 	}
 }
 
-func checkPod(c Client, podName, ns string) (bool, error) {
+func checkPod(ctx context.Context, c Client, podName, ns string) (bool, error) {
 	// Retrieve current pod data.
 	p := pod{}
-	err := ExecuteJSON(c, &p, "get", "pod", podName, "-n", ns)
+	err := ExecuteJSON(ctx, c, &p, "get", "pod", podName, "-n", ns)
 	if err != nil {
 		return false, err
 	}
@@ -250,26 +470,26 @@ func randomizeName(name string) string {
 }
 
 //TestDNS creates a pod where a nslookup is called on a provided domain. It returns true only if the pod was successful.
-func TestDNS(c Client, domain string) (bool, error) {
+func TestDNS(ctx context.Context, c Client, domain string) (bool, error) {
 	// Generate a "random" pod name, to prevent "already exists" errors.
 	podName := randomizeName("launcher-pre-flight")
 	ns := "weave"
 
 	// Create weave namespace, as this happens before any resources are created.
-	_, err := CreateNamespace(c, ns)
+	_, err := CreateNamespace(ctx, c, ns)
 	if err != nil {
 		return false, err
 	}
 
 	// Create pod to perform nslookup on a passed domain to check DNS is working.
-	_, err = Execute(c, "run", "-n", "weave", "--image", "docker.io/alpine", "--labels=launcher=dns", "--restart=Never", "--command", podName, "nslookup", domain)
+	_, err = Execute(ctx, c, "run", "-n", "weave", "--image", "docker.io/alpine", "--labels=launcher=dns", "--restart=Never", "--command", podName, "nslookup", domain)
 	if err != nil {
 		return false, err
 	}
 
 	// Initially fetch the pod, which was created above.
 	p := pod{}
-	err = ExecuteJSON(c, &p, "get", "pod", podName, "-n", ns)
+	err = ExecuteJSON(ctx, c, &p, "get", "pod", podName, "-n", ns)
 	if err != nil {
 		return false, err
 	}
@@ -277,24 +497,24 @@ func TestDNS(c Client, domain string) (bool, error) {
 	if p.Status.Phase != podSuccess && p.Status.Phase != podFailure {
 		// If the state has not been reached yet, we enter a retry phase.
 		// In isPodReady function we retry to get pod status phase for a minute and then timeout.
-		err := isPodReady(c, podName, ns)
+		err := isPodReady(ctx, c, podName, ns)
 		// Either an error occurred or timeout was reached.
 		if err != nil {
 			// Attempt to cleanup pod.
-			_ = DeleteResource(c, "pod", ns, podName)
+			_ = DeleteResource(ctx, c, "pod", ns, podName)
 			return false, err
 		}
 	}
 
 	// Get fresh pod data.
-	err = ExecuteJSON(c, &p, "get", "pod", podName, "-n", ns)
+	err = ExecuteJSON(ctx, c, &p, "get", "pod", podName, "-n", ns)
 	if err != nil {
 		return false, err
 	}
 
 	// If the final status of the pod was failed, we should return an error as DNS is not working.
 	if p.Status.Phase == podFailure {
-		err = DeleteResource(c, "pod", ns, podName)
+		err = DeleteResource(ctx, c, "pod", ns, podName)
 		if err != nil {
 			return false, err
 		}
@@ -307,7 +527,7 @@ func TestDNS(c Client, domain string) (bool, error) {
 	}
 
 	// Cleanup the pod.
-	err = DeleteResource(c, "pod", ns, podName)
+	err = DeleteResource(ctx, c, "pod", ns, podName)
 	if err != nil {
 		// We should still return that DNS works, there was only a problem with deleting the resource.
 		return true, err
@@ -318,8 +538,8 @@ func TestDNS(c Client, domain string) (bool, error) {
 }
 
 // CreateNamespace creates a new namespace and returns whether it was created or not
-func CreateNamespace(c Client, namespace string) (bool, error) {
-	_, err := Execute(c, "create", "namespace", namespace)
+func CreateNamespace(ctx context.Context, c Client, namespace string) (bool, error) {
+	_, err := Execute(ctx, c, "create", "namespace", namespace)
 	if err != nil {
 		if strings.Contains(err.Error(), "AlreadyExists") {
 			return false, nil
@@ -330,8 +550,9 @@ func CreateNamespace(c Client, namespace string) (bool, error) {
 }
 
 // CreateClusterRoleBinding creates a new cluster role binding
-func CreateClusterRoleBinding(c Client, name, role, user string) error {
+func CreateClusterRoleBinding(ctx context.Context, c Client, name, role, user string) error {
 	_, err := Execute(
+		ctx,
 		c,
 		"create",
 		"clusterrolebinding",
@@ -348,8 +569,8 @@ func CreateClusterRoleBinding(c Client, name, role, user string) error {
 }
 
 // CreateSecretFromLiteral creates a new secret with a single (key,value) pair.
-func CreateSecretFromLiteral(c Client, namespace, name, key, value string, override bool) (bool, error) {
-	secretExists, err := ResourceExists(c, "secret", namespace, name)
+func CreateSecretFromLiteral(ctx context.Context, c Client, namespace, name, key, value string, override bool) (bool, error) {
+	secretExists, err := ResourceExists(ctx, c, "secret", namespace, name)
 	if err != nil {
 		return false, err
 	}
@@ -358,20 +579,20 @@ func CreateSecretFromLiteral(c Client, namespace, name, key, value string, overr
 		if !override {
 			return false, nil
 		}
-		err := DeleteResource(c, "secret", namespace, name)
+		err := DeleteResource(ctx, c, "secret", namespace, name)
 		if err != nil {
 			return false, err
 		}
 	}
 
 	// Create the weave namespace and the weave-cloud secret
-	_, err = CreateNamespace(c, namespace)
+	_, err = CreateNamespace(ctx, c, namespace)
 	if err != nil {
 		return false, err
 	}
 
 	// Create the secret
-	_, err = Execute(c,
+	_, err = Execute(ctx, c,
 		fmt.Sprintf("--namespace=%s", namespace),
 		"create",
 		"secret",
@@ -391,9 +612,9 @@ type secretManifest struct {
 }
 
 // GetSecretValue returns the value of a secret
-func GetSecretValue(c Client, namespace, name, key string) (string, error) {
+func GetSecretValue(ctx context.Context, c Client, namespace, name, key string) (string, error) {
 	var secretDefn secretManifest
-	err := ExecuteJSON(c, &secretDefn, "get", "secret", name, fmt.Sprintf("--namespace=%s", namespace))
+	err := ExecuteJSON(ctx, c, &secretDefn, "get", "secret", name, fmt.Sprintf("--namespace=%s", namespace))
 	if err != nil {
 		return "", err
 	}
@@ -421,9 +642,9 @@ type nodeStatus struct {
 }
 
 // GetContainerRuntimeName returns the container runtime name the node uses.
-func GetContainerRuntimeName(c Client) (string, error) {
+func GetContainerRuntimeName(ctx context.Context, c Client) (string, error) {
 	var n nodes
-	err := ExecuteJSON(c, &n, "get", "nodes", "-owide")
+	err := ExecuteJSON(ctx, c, &n, "get", "nodes", "-owide")
 	if err != nil {
 		return "", err
 	}
@@ -1,6 +1,7 @@
 package kubectl
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
@@ -18,7 +19,7 @@ func NewTestClient() *TestClient {
 	return tc
 }
 
-func (t *TestClient) Execute(args ...string) (string, error) {
+func (t *TestClient) Execute(ctx context.Context, args ...string) (string, error) {
 	cmd := strings.Join(args, " ")
 	response, ok := t.responses[cmd]
 	if ok {
@@ -27,8 +28,8 @@ func (t *TestClient) Execute(args ...string) (string, error) {
 	return "", fmt.Errorf("Missing response for %q", cmd)
 }
 
-func (t *TestClient) ExecuteOutputMatrix(args ...string) (stdout, stderr string, err error) {
-	stdout, err = Execute(t, args...)
+func (t *TestClient) ExecuteOutputMatrix(ctx context.Context, args ...string) (stdout, stderr string, err error) {
+	stdout, err = Execute(ctx, t, args...)
 	return stdout, "", err
 }
 
@@ -37,7 +38,7 @@ func TestGetSecretValue(t *testing.T) {
 
 	json := `{"data":{"token": "c2VjcmV0IQ=="}}`
 	tc.responses["get secret weave-cloud --namespace=weave -ojson"] = json
-	res, err := GetSecretValue(tc, "weave", "weave-cloud", "token")
+	res, err := GetSecretValue(context.Background(), tc, "weave", "weave-cloud", "token")
 	assert.Equal(t, res, "secret!")
 	assert.NoError(t, err)
 }
@@ -75,3 +76,128 @@ func TestParseVersionOutput(t *testing.T) {
 		assert.Equal(t, test.serverVersion, serverVersion)
 	}
 }
+
+func TestListClusterRoleBindingsForNamespace(t *testing.T) {
+	tc := NewTestClient()
+
+	json := `{"items": [
+	  {"kind": "ClusterRoleBinding", "metadata": {"name": "weave-agent"},
+	   "roleRef": {"kind": "ClusterRole", "name": "weave-agent"},
+	   "subjects": [{"kind": "ServiceAccount", "name": "weave-agent", "namespace": "weave"}]},
+	  {"kind": "ClusterRoleBinding", "metadata": {"name": "cluster-admin"},
+	   "roleRef": {"kind": "ClusterRole", "name": "cluster-admin"},
+	   "subjects": [{"kind": "Group", "name": "system:masters"}]}
+	]}`
+	tc.responses["get clusterrolebindings -ojson"] = json
+	bindings, err := ListClusterRoleBindingsForNamespace(context.Background(), tc, "weave")
+	assert.NoError(t, err)
+	assert.Equal(t, []RoleBinding{
+		{
+			Resource: Resource{Kind: "ClusterRoleBinding", Name: "weave-agent"},
+			Role:     "weave-agent",
+		},
+	}, bindings)
+}
+
+func TestListResources(t *testing.T) {
+	tc := NewTestClient()
+
+	json := `{"items": [{"kind": "Deployment", "metadata": {"name": "weave-flux-agent", "namespace": "kube-system"}}]}`
+	tc.responses["get deployments --namespace=kube-system --selector=name=weave-flux-agent -ojson"] = json
+	resources, err := ListResources(context.Background(), tc, "deployments", "kube-system", "name=weave-flux-agent")
+	assert.NoError(t, err)
+	assert.Equal(t, []Resource{{Kind: "Deployment", Namespace: "kube-system", Name: "weave-flux-agent"}}, resources)
+	assert.Equal(t, "deployment/weave-flux-agent (namespace kube-system)", resources[0].String())
+}
+
+func TestApplyNames(t *testing.T) {
+	tc := NewTestClient()
+	tc.responses["apply -f https://example.com/cloudwatch.yaml?resources=rds%2Cclassic-elb -o name"] = "deployment.apps/cloudwatch-exporter\nservice/cloudwatch-exporter\n"
+
+	names, err := ApplyNames(context.Background(), tc, "https://example.com/cloudwatch.yaml?resources=rds,classic-elb")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deployment.apps/cloudwatch-exporter", "service/cloudwatch-exporter"}, names)
+}
+
+func TestDryRunNames(t *testing.T) {
+	tc := NewTestClient()
+	tc.responses["apply --dry-run=client -f https://example.com/cloudwatch.yaml?resources=rds%2Cclassic-elb -o name"] = "deployment.apps/cloudwatch-exporter\n"
+
+	names, err := DryRunNames(context.Background(), tc, "https://example.com/cloudwatch.yaml?resources=rds,classic-elb")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deployment.apps/cloudwatch-exporter"}, names)
+}
+
+func TestGetLabelledResources(t *testing.T) {
+	tc := NewTestClient()
+	tc.responses["get --namespace=weave --ignore-not-found deployment.apps/d service/s -ojson"] = `{"kind": "List", "items": [
+	  {"kind": "Deployment", "metadata": {"name": "d", "namespace": "weave", "labels": {"a": "1"}}},
+	  {"kind": "Service", "metadata": {"name": "s", "namespace": "weave"}}
+	]}`
+	tc.responses["get --namespace=weave --ignore-not-found deployment.apps/d -ojson"] = `{"kind": "Deployment", "metadata": {"name": "d", "namespace": "weave", "labels": {"a": "1"}}}`
+	tc.responses["get --namespace=weave --ignore-not-found service/gone -ojson"] = ""
+	ctx := context.Background()
+
+	deployment := LabelledResource{
+		Resource: Resource{Kind: "Deployment", Namespace: "weave", Name: "d"},
+		Labels:   map[string]string{"a": "1"},
+	}
+	resources, err := GetLabelledResources(ctx, tc, "weave", []string{"deployment.apps/d", "service/s"})
+	assert.NoError(t, err)
+	assert.Equal(t, []LabelledResource{deployment, {Resource: Resource{Kind: "Service", Namespace: "weave", Name: "s"}}}, resources)
+
+	resources, err = GetLabelledResources(ctx, tc, "weave", []string{"deployment.apps/d"})
+	assert.NoError(t, err)
+	assert.Equal(t, []LabelledResource{deployment}, resources)
+
+	resources, err = GetLabelledResources(ctx, tc, "weave", []string{"service/gone"})
+	assert.NoError(t, err)
+	assert.Empty(t, resources)
+}
+
+func TestLabelResources(t *testing.T) {
+	tc := NewTestClient()
+	tc.responses["label --overwrite --namespace=weave deployment.apps/d service/s a=1 b=2"] = ""
+
+	err := LabelResources(context.Background(), tc, "weave", []string{"deployment.apps/d", "service/s"}, map[string]string{"b": "2", "a": "1"})
+	assert.NoError(t, err)
+	assert.NoError(t, LabelResources(context.Background(), tc, "weave", nil, map[string]string{"a": "1"}))
+}
+
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e exitError) ExitCode() int { return int(e) }
+
+// diffClient answers kubectl diff with the exit code code.
+type diffClient struct {
+	TestClient
+	code int
+}
+
+func (c *diffClient) ExecuteOutputMatrix(ctx context.Context, args ...string) (stdout, stderr string, err error) {
+	if c.code == 0 {
+		return "", "", nil
+	}
+	return "", "error: the server could not find the requested resource", exitError(c.code)
+}
+
+func TestDiff(t *testing.T) {
+	for _, test := range []struct {
+		code    int
+		changed bool
+		err     string
+	}{
+		{0, false, ""},
+		{1, true, ""},
+		{2, false, "exit status 2: error: the server could not find the requested resource"},
+	} {
+		changed, err := Diff(context.Background(), &diffClient{code: test.code}, "https://example.com/cloudwatch.yaml")
+		assert.Equal(t, test.changed, changed)
+		if test.err == "" {
+			assert.NoError(t, err)
+		} else if assert.Error(t, err) {
+			assert.Equal(t, test.err, err.Error())
+		}
+	}
+}
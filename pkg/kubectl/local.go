@@ -2,6 +2,7 @@ package kubectl
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -29,8 +30,9 @@ func (k LocalClient) IsPresent() bool {
 }
 
 // Execute executes kubectl <args> and returns the combined stdout/err output.
-func (k LocalClient) Execute(args ...string) (string, error) {
-	cmd := exec.Command(Command, append(k.GlobalArgs, args...)...)
+// The kubectl process is killed if ctx is done before it exits.
+func (k LocalClient) Execute(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, Command, append(k.GlobalArgs, args...)...)
 	cmd.Env = append(os.Environ(), k.Env...)
 	stdout, stderr, err := outputMatrix(cmd)
 	if err != nil {
@@ -42,8 +44,8 @@ func (k LocalClient) Execute(args ...string) (string, error) {
 }
 
 // ExecuteOutputMatrix executes kubectl <args> and returns stdout and stderr
-func (k LocalClient) ExecuteOutputMatrix(args ...string) (stdout, stderr string, err error) {
-	cmd := exec.Command(Command, append(k.GlobalArgs, args...)...)
+func (k LocalClient) ExecuteOutputMatrix(ctx context.Context, args ...string) (stdout, stderr string, err error) {
+	cmd := exec.CommandContext(ctx, Command, append(k.GlobalArgs, args...)...)
 	cmd.Env = append(os.Environ(), k.Env...)
 	return outputMatrix(cmd)
 }
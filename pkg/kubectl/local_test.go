@@ -1,6 +1,7 @@
 package kubectl
 
 import (
+	"context"
 	"os/exec"
 	"testing"
 
@@ -26,7 +27,7 @@ func TestTrimOutput(t *testing.T) {
 
 func ExampleLocalClient() {
 	local := LocalClient{}
-	local.Execute("apply", "-f", "service.yaml")
+	local.Execute(context.Background(), "apply", "-f", "service.yaml")
 }
 
 func TestOutputMatrix(t *testing.T) {
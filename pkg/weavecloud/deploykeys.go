@@ -0,0 +1,61 @@
+package weavecloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultDeployKeysURLTemplate is the default URL template for UpdateDeployKeys
+const DefaultDeployKeysURLTemplate = "https://{{.WCHostname}}/api/flux/deploy-keys"
+
+// States of a deploy key.
+const (
+	// DeployKeyActive is the key Flux uses.
+	DeployKeyActive = "active"
+	// DeployKeyPending is the key Flux switches to once it's authorised on
+	// the git host, and users confirmed it is.
+	DeployKeyPending = "pending"
+)
+
+// DeployKey is a public SSH key Flux uses to access its git repository
+type DeployKey struct {
+	PublicKey   string    `json:"publicKey"`
+	Fingerprint string    `json:"fingerprint"`
+	State       string    `json:"state"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type deployKeysView struct {
+	Keys []DeployKey `json:"keys"`
+}
+
+// UpdateDeployKeys reports the deploy keys of Flux given an instance token
+func UpdateDeployKeys(ctx context.Context, apiURL, token string, keys []DeployKey) error {
+	body, err := json.Marshal(deployKeysView{Keys: keys})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, apiURL, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf(resp.Status)
+	}
+	return nil
+}
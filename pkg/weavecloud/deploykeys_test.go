@@ -0,0 +1,44 @@
+package weavecloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateDeployKeys(t *testing.T) {
+	created := time.Date(2018, 1, 11, 0, 0, 0, 0, time.UTC)
+	keys := []DeployKey{
+		{PublicKey: "ssh-rsa AAAA1", Fingerprint: "SHA256:1", State: DeployKeyActive, CreatedAt: created},
+		{PublicKey: "ssh-rsa AAAA2", Fingerprint: "SHA256:2", State: DeployKeyPending, CreatedAt: created},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, fmt.Sprintf("Bearer %s", instanceToken), r.Header.Get("Authorization"))
+
+		view := deployKeysView{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&view))
+		assert.Equal(t, keys, view.Keys)
+	}))
+	defer ts.Close()
+
+	err := UpdateDeployKeys(context.Background(), ts.URL, instanceToken, keys)
+	assert.NoError(t, err)
+}
+
+func TestUpdateDeployKeysError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	err := UpdateDeployKeys(context.Background(), ts.URL, instanceToken, nil)
+	assert.Error(t, err)
+}
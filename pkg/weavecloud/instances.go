@@ -2,6 +2,7 @@ package weavecloud
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -16,8 +17,8 @@ type lookupInstanceByTokenView struct {
 const DefaultWCOrgLookupURLTemplate = "https://{{.WCHostname}}/api/users/org/lookup"
 
 // LookupInstanceByToken returns the instance ID given an instance token
-func LookupInstanceByToken(apiURL, token string) (string, string, error) {
-	req, err := http.NewRequest(http.MethodGet, apiURL, nil)
+func LookupInstanceByToken(ctx context.Context, apiURL, token string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
 	if err != nil {
 		return "", "", err
 	}
@@ -53,14 +54,14 @@ type platformVersionUpdate struct {
 const DefaultWCOrgPlatformVersionURLTemplate = "https://{{.WCHostname}}/api/users/org/platform_version"
 
 // UpdateInstancePlatformVersionByToken updates the instance platform version given an instance token
-func UpdateInstancePlatformVersionByToken(apiURL, token, platformVersion string) error {
+func UpdateInstancePlatformVersionByToken(ctx context.Context, apiURL, token, platformVersion string) error {
 	buf := &bytes.Buffer{}
 	platformInfo := platformVersionUpdate{PlatformVersion: platformVersion}
 	if err := json.NewEncoder(buf).Encode(platformInfo); err != nil {
 		return err
 	}
 
-	req, err := http.NewRequest(http.MethodPut, apiURL, buf)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, apiURL, buf)
 	if err != nil {
 		return err
 	}
@@ -1,11 +1,13 @@
 package weavecloud
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -30,8 +32,22 @@ func TestLookupInstanceByToken(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	id, name, err := LookupInstanceByToken(ts.URL, instanceToken)
+	id, name, err := LookupInstanceByToken(context.Background(), ts.URL, instanceToken)
 	assert.NoError(t, err)
 	assert.Equal(t, instanceID, id)
 	assert.Equal(t, instanceName, name)
 }
+
+func TestLookupInstanceByTokenCancelled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, _, err := LookupInstanceByToken(ctx, ts.URL, instanceToken)
+	assert.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+}
@@ -0,0 +1,63 @@
+package weavecloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// DefaultNotificationURLTemplate is the default URL template for SendNotification
+const DefaultNotificationURLTemplate = "https://{{.WCHostname}}/api/notification/external/events"
+
+type notificationView struct {
+	Type     string               `json:"type"`
+	Messages notificationMessages `json:"messages"`
+}
+
+type notificationMessages struct {
+	Browser notificationBrowser `json:"browser"`
+}
+
+type notificationBrowser struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// SendNotification sends an event of the given type to the Weave Cloud UI
+func SendNotification(ctx context.Context, apiURL, token, eventType, text string) error {
+	notification := notificationView{
+		Type: eventType,
+		Messages: notificationMessages{
+			Browser: notificationBrowser{
+				Type: eventType,
+				Text: text,
+			},
+		},
+	}
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf(resp.Status)
+	}
+	return nil
+}
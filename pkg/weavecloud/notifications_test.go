@@ -0,0 +1,28 @@
+package weavecloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendNotification(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, fmt.Sprintf("Bearer %s", instanceToken), r.Header.Get("Authorization"))
+
+		notification := notificationView{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&notification))
+		assert.Equal(t, "cluster_disconnected", notification.Type)
+		assert.Equal(t, "cluster_disconnected", notification.Messages.Browser.Type)
+		assert.Equal(t, "bye", notification.Messages.Browser.Text)
+	}))
+	defer ts.Close()
+
+	err := SendNotification(context.Background(), ts.URL, instanceToken, "cluster_disconnected", "bye")
+	assert.NoError(t, err)
+}